@@ -0,0 +1,504 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package evhttp parses HTTP/1.1 requests from the evio Data event and
+// writes the responses of a handler back to the connection.
+//
+//	var events evio.Events
+//	events.Data = evhttp.Data(evhttp.Config{}, func(c evio.Conn, req *evhttp.Request, res *evhttp.Response) {
+//		res.Body = []byte("Hello World!\r\n")
+//	})
+//
+// Requests may be split across reads and pipelined, and their sizes are
+// limited by the Config. Connections are kept alive unless the client asks
+// otherwise. The state of a connection is
+// stored in its context, so the context must not be used for anything else.
+//
+// A handler may take the connection over with Response.Hijack, such as for
+// a CONNECT or an Upgrade, after which the input goes to a Data event of its
+// own instead of being parsed:
+//
+//	res.Status = http.StatusSwitchingProtocols
+//	res.Header.Set("Upgrade", "echo")
+//	res.Hijack(func(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+//		return in, evio.None
+//	})
+//
+// A handler may also stream the body with Response.Stream, writing it in
+// chunks from any goroutine. The requests that follow on the connection are
+// handled once the stream is closed:
+//
+//	w := res.Stream()
+//	go func() {
+//		for _, part := range parts {
+//			w.Write(part)
+//			w.Flush()
+//		}
+//		w.Close()
+//	}()
+package evhttp
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jursonmo/evio"
+)
+
+// DefaultMaxHeaderBytes and DefaultMaxBodyBytes are the limits of a Config
+// that doesn't set them.
+const (
+	DefaultMaxHeaderBytes = 1 << 20
+	DefaultMaxBodyBytes   = 10 << 20
+)
+
+// Config is the configuration of a Data event.
+type Config struct {
+	// MaxHeaderBytes is the most that a request line and its headers, or a
+	// line of a chunked body, may be. Zero means DefaultMaxHeaderBytes.
+	MaxHeaderBytes int
+	// MaxBodyBytes is the most that the body of a request may be. A larger
+	// Content-Length, or chunks that add up to more, are refused with a 413
+	// status before the body is read. Zero means DefaultMaxBodyBytes.
+	MaxBodyBytes int64
+}
+
+// Request is a parsed HTTP request.
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+	Proto  string // "HTTP/1.1"
+	Header http.Header
+	Body   []byte
+}
+
+// Response is the response to a request. It's sent with a 200 status and an
+// empty body unless the handler sets them.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+
+	hijack func(c evio.Conn, in []byte) (out []byte, action evio.Action)
+	stream *ChunkedWriter
+}
+
+// Hijack takes the connection out of HTTP once the response is written.
+// The response is written without a Content-Length, and its body, if any,
+// follows the header as the first output of the new protocol. The input
+// that came after the request, and all of the input and wakes from then on,
+// are passed to data unparsed. The context of the connection still belongs
+// to evhttp.
+func (res *Response) Hijack(data func(c evio.Conn, in []byte) (out []byte, action evio.Action)) {
+	res.hijack = data
+}
+
+// Stream returns a writer for the body of the response, which is sent with
+// chunked transfer encoding instead of a Content-Length. The body, if any,
+// is sent as the first chunk. The writer may be used after the handler
+// returns and from any goroutine, and the connection waits for it to be
+// closed before it handles the next request. The client must speak
+// HTTP/1.1 to read it.
+func (res *Response) Stream() *ChunkedWriter {
+	if res.stream == nil {
+		res.stream = &ChunkedWriter{}
+	}
+	return res.stream
+}
+
+// ChunkedWriter writes the body of a streamed response. Writes are
+// buffered until Flush, which wakes the connection to send them, and Close
+// sends the last chunk.
+type ChunkedWriter struct {
+	c       evio.Conn
+	mu      sync.Mutex
+	buf     []byte // written chunks that weren't flushed
+	out     []byte // flushed chunks that weren't sent
+	started bool   // the handler returned, so flushes wake the connection
+	woken   bool   // a wake is pending
+	closed  bool
+}
+
+var errStreamClosed = errors.New("stream closed")
+
+// Write writes p as a chunk. It's sent by the next Flush or Close.
+func (w *ChunkedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, errStreamClosed
+	}
+	w.buf = appendChunk(w.buf, p)
+	return len(p), nil
+}
+
+// Flush sends the chunks that were written. The error is the one of the
+// wake, such as when the connection closed.
+func (w *ChunkedWriter) Flush() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return errStreamClosed
+	}
+	return w.flushLocked()
+}
+
+// Close sends the chunks that were written and the last chunk, which ends
+// the response.
+func (w *ChunkedWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return errStreamClosed
+	}
+	w.closed = true
+	w.buf = append(w.buf, "0\r\n\r\n"...)
+	return w.flushLocked()
+}
+
+// flushLocked moves the written chunks to the output and wakes the
+// connection, unlocking the writer. The connection isn't woken before the
+// handler returns, since the Data event takes the output then.
+func (w *ChunkedWriter) flushLocked() error {
+	w.out = append(w.out, w.buf...)
+	w.buf = w.buf[:0]
+	if !w.started || w.woken || len(w.out) == 0 {
+		w.mu.Unlock()
+		return nil
+	}
+	w.woken = true
+	c := w.c
+	w.mu.Unlock()
+	if err := c.Wake(); err != nil {
+		w.mu.Lock()
+		w.woken = false
+		w.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// take returns the output for the Data event to send, and whether the
+// stream is finished.
+func (w *ChunkedWriter) take(out []byte) ([]byte, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	out = append(out, w.out...)
+	w.out, w.woken = w.out[:0], false
+	return out, w.closed
+}
+
+// Handler handles a request by filling in the response.
+type Handler func(c evio.Conn, req *Request, res *Response)
+
+// conn is the state of a connection.
+type conn struct {
+	is      evio.InputStream
+	req     *Request                                                      // the request whose body is being read
+	length  int64                                                         // the Content-Length of req, -1 when it's chunked
+	trailer bool                                                          // the last chunk of req was read
+	scanned int                                                           // the input that was searched for the end of the header
+	data    func(c evio.Conn, in []byte) (out []byte, action evio.Action) // hijacked
+	stream  *ChunkedWriter                                                // the response that's being streamed
+	close   bool                                                          // close once the stream is finished
+}
+
+var (
+	errMalformed    = errors.New("malformed request")
+	errTooLarge     = errors.New("request header too large")
+	errBodyTooLarge = errors.New("request body too large")
+	errUnsupported  = errors.New("unsupported transfer encoding")
+)
+
+// Data returns a Data event that parses the requests of a connection and
+// calls the handler for each of them.
+func Data(config Config, handler Handler) func(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+	if config.MaxHeaderBytes == 0 {
+		config.MaxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	if config.MaxBodyBytes == 0 {
+		config.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	return func(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+		hc, ok := c.Context().(*conn)
+		if ok && hc.data != nil {
+			return hc.data(c, in)
+		}
+		if !ok {
+			if in == nil {
+				return
+			}
+			hc = &conn{}
+			c.SetContext(hc)
+		}
+		if hc.stream != nil {
+			// the input waits for the stream to finish
+			hc.is.End(hc.is.Begin(in))
+			var done bool
+			if out, done = hc.stream.take(out); !done {
+				return out, evio.None
+			}
+			hc.stream, in = nil, nil
+			if hc.close {
+				hc.is.End(nil)
+				return out, evio.Close
+			}
+		} else if in == nil {
+			return
+		}
+		data := hc.is.Begin(in)
+		for len(data) > 0 {
+			req, leftover, err := hc.read(data, &config)
+			if err != nil {
+				status := http.StatusBadRequest
+				switch err {
+				case errTooLarge:
+					status = http.StatusRequestHeaderFieldsTooLarge
+				case errBodyTooLarge:
+					status = http.StatusRequestEntityTooLarge
+				case errUnsupported:
+					status = http.StatusNotImplemented
+				}
+				res := Response{Status: status, Body: []byte(err.Error() + "\n")}
+				out = appendResponse(out, &res, true)
+				action = evio.Close
+				data = nil
+				break
+			}
+			data = leftover
+			if req == nil {
+				break // incomplete request
+			}
+			res := Response{Header: make(http.Header)}
+			handler(c, req, &res)
+			if res.hijack != nil {
+				out = appendResponse(out, &res, false)
+				hc.is.End(nil)
+				hc.data = res.hijack
+				if len(data) == 0 {
+					return out, evio.None
+				}
+				rest, act := hc.data(c, data)
+				return append(out, rest...), act
+			}
+			close := !keepAlive(req)
+			out = appendResponse(out, &res, close)
+			if w := res.stream; w != nil {
+				w.mu.Lock()
+				w.c, w.started = c, true
+				w.mu.Unlock()
+				var done bool
+				if out, done = w.take(out); !done {
+					hc.stream, hc.close = w, close
+					break
+				}
+			}
+			if close {
+				action = evio.Close
+				data = nil
+				break
+			}
+		}
+		hc.is.End(data)
+		return
+	}
+}
+
+// keepAlive reports whether the connection persists after the request.
+func keepAlive(req *Request) bool {
+	connection := strings.ToLower(req.Header.Get("Connection"))
+	if req.Proto == "HTTP/1.0" {
+		return connection == "keep-alive"
+	}
+	return connection != "close"
+}
+
+// read reads a request from the data, and returns it once it's complete
+// along with the data that follows. The header of a request whose body
+// isn't complete yet is kept, so that it's only parsed once, and the body is
+// taken from the data as it comes.
+func (hc *conn) read(data []byte, config *Config) (*Request, []byte, error) {
+	if hc.req == nil {
+		req, leftover, err := hc.parseHeader(data, config)
+		if req == nil || err != nil {
+			return nil, leftover, err
+		}
+		hc.req, data = req, leftover
+	}
+	data, complete, err := hc.readBody(data, config)
+	if !complete || err != nil {
+		return nil, data, err
+	}
+	req := hc.req
+	hc.req, hc.trailer = nil, false
+	return req, data, nil
+}
+
+// parseHeader parses the request line and the headers, and returns a nil
+// request when they aren't complete yet. The search for the end of the
+// header resumes where the last one stopped.
+func (hc *conn) parseHeader(data []byte, config *Config) (*Request, []byte, error) {
+	from := hc.scanned - 3
+	if from < 0 {
+		from = 0
+	}
+	end := bytes.Index(data[from:], []byte("\r\n\r\n"))
+	if end == -1 {
+		if len(data) > config.MaxHeaderBytes {
+			return nil, data, errTooLarge
+		}
+		hc.scanned = len(data)
+		return nil, data, nil
+	}
+	end += from
+	hc.scanned = 0
+	if end > config.MaxHeaderBytes {
+		return nil, data, errTooLarge
+	}
+	lines := strings.Split(string(data[:end]), "\r\n")
+	parts := strings.Split(lines[0], " ")
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return nil, data, errMalformed
+	}
+	req := &Request{Method: parts[0], Path: parts[1], Proto: parts[2]}
+	if i := strings.IndexByte(req.Path, '?'); i != -1 {
+		req.Path, req.Query = req.Path[:i], req.Path[i+1:]
+	}
+	req.Header = make(http.Header)
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, data, errMalformed
+		}
+		key := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:i]))
+		req.Header.Add(key, strings.TrimSpace(line[i+1:]))
+	}
+	hc.length = 0
+	if te := req.Header.Get("Transfer-Encoding"); te != "" {
+		if !strings.EqualFold(te, "chunked") {
+			return nil, data, errUnsupported
+		}
+		hc.length = -1
+	} else if cl := req.Header.Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			return nil, data, errMalformed
+		}
+		if n > config.MaxBodyBytes {
+			return nil, data, errBodyTooLarge
+		}
+		hc.length = n
+	}
+	return req, data[end+4:], nil
+}
+
+// readBody reads the body of the request. The chunks of a chunked body
+// are decoded, and taken from the data, as soon as they're complete; the
+// body is complete once the last chunk and the trailers have been read.
+func (hc *conn) readBody(data []byte, config *Config) (leftover []byte, complete bool, err error) {
+	req := hc.req
+	if hc.length >= 0 {
+		if int64(len(data)) < hc.length {
+			return data, false, nil
+		}
+		if hc.length > 0 {
+			req.Body = append([]byte{}, data[:hc.length]...)
+		}
+		return data[hc.length:], true, nil
+	}
+	for {
+		i := bytes.Index(data, []byte("\r\n"))
+		if i == -1 {
+			if len(data) > config.MaxHeaderBytes {
+				return data, false, errTooLarge
+			}
+			return data, false, nil
+		}
+		if hc.trailer {
+			// skip the trailers
+			data = data[i+2:]
+			if i == 0 {
+				if req.Body == nil {
+					req.Body = []byte{}
+				}
+				return data, true, nil
+			}
+			continue
+		}
+		line := string(data[:i])
+		if j := strings.IndexByte(line, ';'); j != -1 {
+			line = line[:j] // chunk extensions
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil || size < 0 {
+			return data, false, errMalformed
+		}
+		if size > config.MaxBodyBytes-int64(len(req.Body)) {
+			return data, false, errBodyTooLarge
+		}
+		if size == 0 {
+			hc.trailer = true
+			data = data[i+2:]
+			continue
+		}
+		chunk := data[i+2:]
+		if int64(len(chunk)) < size+2 {
+			return data, false, nil
+		}
+		if chunk[size] != '\r' || chunk[size+1] != '\n' {
+			return data, false, errMalformed
+		}
+		req.Body = append(req.Body, chunk[:size]...)
+		data = chunk[size+2:]
+	}
+}
+
+// appendResponse appends a response to the provided bytes.
+func appendResponse(b []byte, res *Response, close bool) []byte {
+	status := res.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	b = append(b, "HTTP/1.1 "...)
+	b = strconv.AppendInt(b, int64(status), 10)
+	b = append(b, ' ')
+	b = append(b, http.StatusText(status)...)
+	b = append(b, "\r\n"...)
+	var head bytes.Buffer
+	res.Header.Write(&head)
+	b = append(b, head.Bytes()...)
+	if res.stream != nil {
+		b = append(b, "Transfer-Encoding: chunked\r\n"...)
+	} else if res.hijack == nil {
+		b = append(b, "Content-Length: "...)
+		b = strconv.AppendInt(b, int64(len(res.Body)), 10)
+		b = append(b, "\r\n"...)
+	}
+	if close {
+		b = append(b, "Connection: close\r\n"...)
+	}
+	b = append(b, "\r\n"...)
+	if res.stream != nil {
+		return appendChunk(b, res.Body)
+	}
+	return append(b, res.Body...)
+}
+
+// appendChunk appends a chunk of a chunked body. An empty chunk is left
+// out, since it would end the body.
+func appendChunk(b, p []byte) []byte {
+	if len(p) == 0 {
+		return b
+	}
+	b = strconv.AppendInt(b, int64(len(p)), 16)
+	b = append(b, "\r\n"...)
+	b = append(b, p...)
+	return append(b, "\r\n"...)
+}
@@ -0,0 +1,295 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evhttp
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jursonmo/evio"
+)
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// testServe serves the handler and calls the client once it's serving.
+func testServe(t *testing.T, addr string, config Config, handler Handler, client func(c net.Conn)) {
+	var events evio.Events
+	events.Serving = func(_ evio.Server) (action evio.Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			client(c)
+			c.Close()
+			c, err = net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("SHUTDOWN / HTTP/1.1\r\n\r\n"))
+		}()
+		return
+	}
+	data := Data(config, handler)
+	events.Data = func(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+		if string(in) == "SHUTDOWN / HTTP/1.1\r\n\r\n" {
+			return nil, evio.Shutdown
+		}
+		return data(c, in)
+	}
+	must(evio.Serve(events, "tcp://"+addr))
+}
+
+// readResponses reads n responses and returns their bodies.
+func readResponses(c net.Conn, n int) []string {
+	rd := bufio.NewReader(c)
+	var bodies []string
+	for i := 0; i < n; i++ {
+		res, err := http.ReadResponse(rd, nil)
+		must(err)
+		body, err := ioutil.ReadAll(res.Body)
+		must(err)
+		bodies = append(bodies, res.Status+" "+string(body))
+	}
+	return bodies
+}
+
+func echo(c evio.Conn, req *Request, res *Response) {
+	res.Header.Set("Content-Type", "text/plain")
+	res.Body = append([]byte(req.Method+" "+req.Path+" "), req.Body...)
+}
+
+func TestPipelining(t *testing.T) {
+	var bodies []string
+	testServe(t, ":9957", Config{}, echo, func(c net.Conn) {
+		c.Write([]byte("GET /a HTTP/1.1\r\nHost: x\r\n\r\n" +
+			"POST /b HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET /c?q=1 HTTP/1.1\r\nHost: x\r\n\r\n"))
+		bodies = readResponses(c, 3)
+	})
+	expected := []string{"200 OK GET /a ", "200 OK POST /b hello", "200 OK GET /c "}
+	for i := range expected {
+		if bodies[i] != expected[i] {
+			t.Fatalf("response %d: expected %q, got %q", i, expected[i], bodies[i])
+		}
+	}
+}
+
+func TestSplitChunked(t *testing.T) {
+	var bodies []string
+	testServe(t, ":9956", Config{}, echo, func(c net.Conn) {
+		req := "POST /chunked HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"5\r\nhello\r\n7;ext=1\r\n, world\r\n0\r\nTrailer: 1\r\n\r\n" +
+			"GET /after HTTP/1.1\r\nHost: x\r\n\r\n"
+		// send the requests a few bytes at a time
+		for i := 0; i < len(req); i += 7 {
+			end := i + 7
+			if end > len(req) {
+				end = len(req)
+			}
+			c.Write([]byte(req[i:end]))
+			time.Sleep(time.Millisecond)
+		}
+		bodies = readResponses(c, 2)
+	})
+	expected := []string{"200 OK POST /chunked hello, world", "200 OK GET /after "}
+	for i := range expected {
+		if bodies[i] != expected[i] {
+			t.Fatalf("response %d: expected %q, got %q", i, expected[i], bodies[i])
+		}
+	}
+}
+
+func TestConnectionClose(t *testing.T) {
+	var bodies []string
+	var rest []byte
+	testServe(t, ":9955", Config{}, echo, func(c net.Conn) {
+		c.Write([]byte("GET /a HTTP/1.1\r\nConnection: close\r\n\r\nGET /b HTTP/1.1\r\n\r\n"))
+		rd := bufio.NewReader(c)
+		res, err := http.ReadResponse(rd, nil)
+		must(err)
+		body, _ := ioutil.ReadAll(res.Body)
+		bodies = append(bodies, string(body))
+		rest, _ = ioutil.ReadAll(rd)
+	})
+	if len(bodies) != 1 || bodies[0] != "GET /a " || len(rest) != 0 {
+		t.Fatalf("expected a single response before close, got %q and %q", bodies, rest)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	var bodies []string
+	testServe(t, ":9954", Config{}, echo, func(c net.Conn) {
+		c.Write([]byte("NONSENSE\r\n\r\n"))
+		bodies = readResponses(c, 1)
+	})
+	if bodies[0] != "400 Bad Request malformed request\n" {
+		t.Fatalf("unexpected response %q", bodies[0])
+	}
+}
+
+func TestHijack(t *testing.T) {
+	upgrade := func(c evio.Conn, req *Request, res *Response) {
+		res.Status = http.StatusSwitchingProtocols
+		res.Header.Set("Upgrade", "echo")
+		res.Header.Set("Connection", "Upgrade")
+		res.Hijack(func(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+			return in, evio.None
+		})
+	}
+	var status, first, second string
+	testServe(t, ":9953", Config{}, upgrade, func(c net.Conn) {
+		// the bytes after the request belong to the new protocol
+		c.Write([]byte("GET /echo HTTP/1.1\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nhello "))
+		rd := bufio.NewReader(c)
+		res, err := http.ReadResponse(rd, nil)
+		must(err)
+		status = res.Status
+		b := make([]byte, 6)
+		_, err = io.ReadFull(rd, b)
+		must(err)
+		first = string(b)
+		req := "GET /a HTTP/1.1\r\n\r\n"
+		c.Write([]byte(req))
+		b = make([]byte, len(req))
+		_, err = io.ReadFull(rd, b)
+		must(err)
+		second = string(b)
+	})
+	if status != "101 Switching Protocols" {
+		t.Fatalf("expected 101 Switching Protocols, got %q", status)
+	}
+	if first != "hello " || second != "GET /a HTTP/1.1\r\n\r\n" {
+		t.Fatalf("expected the input echoed unparsed, got %q and %q", first, second)
+	}
+}
+
+func TestStream(t *testing.T) {
+	next := make(chan bool)
+	stream := func(c evio.Conn, req *Request, res *Response) {
+		if req.Path != "/stream" {
+			echo(c, req, res)
+			return
+		}
+		res.Body = []byte("hello ")
+		w := res.Stream()
+		go func() {
+			<-next
+			w.Write([]byte("chunked "))
+			w.Write([]byte("world"))
+			w.Flush()
+			<-next
+			w.Write([]byte("!"))
+			w.Close()
+		}()
+	}
+	var first, second, body, te, after string
+	testServe(t, ":9952", Config{}, stream, func(c net.Conn) {
+		// the second request waits for the stream to finish
+		c.Write([]byte("GET /stream HTTP/1.1\r\n\r\nGET /after HTTP/1.1\r\n\r\n"))
+		rd := bufio.NewReader(c)
+		res, err := http.ReadResponse(rd, nil)
+		must(err)
+		if len(res.TransferEncoding) > 0 {
+			te = res.TransferEncoding[0]
+		}
+		b := make([]byte, 6)
+		_, err = io.ReadFull(res.Body, b)
+		must(err)
+		first = string(b)
+		next <- true
+		b = make([]byte, 13)
+		_, err = io.ReadFull(res.Body, b)
+		must(err)
+		second = string(b)
+		next <- true
+		rest, err := ioutil.ReadAll(res.Body)
+		must(err)
+		body = first + second + string(rest)
+		res, err = http.ReadResponse(rd, nil)
+		must(err)
+		rest, err = ioutil.ReadAll(res.Body)
+		must(err)
+		after = res.Status + " " + string(rest)
+	})
+	if te != "chunked" {
+		t.Fatalf("expected chunked transfer encoding, got %q", te)
+	}
+	if first != "hello " || second != "chunked world" {
+		t.Fatalf("expected the flushed chunks, got %q and %q", first, second)
+	}
+	if body != "hello chunked world!" {
+		t.Fatalf("expected %q, got %q", "hello chunked world!", body)
+	}
+	if after != "200 OK GET /after " {
+		t.Fatalf("expected the next response after the stream, got %q", after)
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	var large, chunked, small []string
+	config := Config{MaxBodyBytes: 10}
+	testServe(t, ":9796", config, echo, func(c net.Conn) {
+		// refused before the body is sent
+		c.Write([]byte("POST /large HTTP/1.1\r\nContent-Length: 1000000000000\r\n\r\n"))
+		large = readResponses(c, 1)
+		c, err := net.Dial("tcp", ":9796")
+		must(err)
+		defer c.Close()
+		c.Write([]byte("POST /chunked HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+			"6\r\nhello \r\n6\r\n"))
+		chunked = readResponses(c, 1)
+		c, err = net.Dial("tcp", ":9796")
+		must(err)
+		defer c.Close()
+		c.Write([]byte("POST /small HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello"))
+		time.Sleep(time.Millisecond * 10)
+		c.Write([]byte(" you!"))
+		small = readResponses(c, 1)
+	})
+	if large[0] != "413 Request Entity Too Large request body too large\n" {
+		t.Fatalf("expected a large Content-Length to be refused, got %q", large[0])
+	}
+	if chunked[0] != "413 Request Entity Too Large request body too large\n" {
+		t.Fatalf("expected large chunks to be refused, got %q", chunked[0])
+	}
+	if small[0] != "200 OK POST /small hello you!" {
+		t.Fatalf("expected a body within the limit, got %q", small[0])
+	}
+}
+
+func TestPendingBody(t *testing.T) {
+	config := Config{MaxHeaderBytes: DefaultMaxHeaderBytes, MaxBodyBytes: DefaultMaxBodyBytes}
+	for _, test := range []struct{ header, body, expected string }{
+		{"Content-Length: 6\r\n", "upload", "upload"},
+		{"Transfer-Encoding: chunked\r\n", "3\r\nupl\r\n3\r\noad\r\n0\r\n\r\n", "upload"},
+	} {
+		var hc conn
+		req, data, err := hc.read([]byte("POST /slow HTTP/1.1\r\n"+test.header+"\r\n"), &config)
+		if req != nil || err != nil || len(data) != 0 || hc.req == nil {
+			t.Fatalf("%q: expected the header to be kept, got %v and %v", test.header, req, err)
+		}
+		// the body comes a byte at a time, and the header isn't parsed again
+		pending := hc.req
+		for i := 0; i < len(test.body) && req == nil; i++ {
+			data = append(data, test.body[i])
+			if req, data, err = hc.read(data, &config); err != nil {
+				t.Fatal(err)
+			}
+			if req == nil && hc.req != pending {
+				t.Fatalf("%q: expected the pending request to be kept", test.header)
+			}
+		}
+		if req != pending || string(req.Body) != test.expected || len(data) != 0 || hc.req != nil {
+			t.Fatalf("%q: expected the request with its body, got %q", test.header, req.Body)
+		}
+	}
+}
@@ -5,13 +5,44 @@
 package evio
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/jursonmo/evio/internal"
 )
 
+// ErrUnsupported is returned by operations that are not available on the
+// platform or for the type of server or connection.
+var ErrUnsupported = errors.New("operation not supported")
+
+// ErrQueueFull is returned by Conn.Wake when the loop has too many pending
+// wakes.
+var ErrQueueFull = internal.ErrQueueFull
+
+// ErrWouldBlock is returned by Conn.TryWrite when the buffered output of the
+// connection is at its high watermark.
+var ErrWouldBlock = errors.New("write would block")
+
+// ErrFDHeadroom is passed to Events.OnAcceptError when accepting pauses to
+// keep Events.FDHeadroom file descriptors free.
+var ErrFDHeadroom = errors.New("file descriptor headroom reached")
+
 // Action is an action that occurs after the completion of an event.
 type Action int
 
@@ -24,28 +55,663 @@ const (
 	Close
 	// Shutdown shutdowns the server.
 	Shutdown
+	// More calls the Data event again with no input once the output of the
+	// event has been written, so that a large response can be streamed in
+	// bounded steps without waking the connection. It's returned by the
+	// Opened and Data events, and it's ignored for UDP connections.
+	More
 )
 
+// UserAction is the first of the actions that are left to the application,
+// which are carried out by the handlers in Events.Actions. The actions
+// below it are reserved.
+const UserAction Action = 1 << 16
+
+// errReservedAction is returned by Serve for a handler in Events.Actions
+// that's registered for a reserved action.
+var errReservedAction = errors.New("evio: Events.Actions has a reserved action")
+
+// checkActions returns an error when a handler is registered for a
+// reserved action.
+func checkActions(actions map[Action]func(c Conn) Action) error {
+	for action := range actions {
+		if action < UserAction {
+			return errReservedAction
+		}
+	}
+	return nil
+}
+
+// userAction calls the handler of an application's action and returns the
+// built-in action that follows it. An action without a handler and one
+// that the handler maps to another application action become None.
+func userAction(actions map[Action]func(c Conn) Action, c Conn, action Action) Action {
+	fn := actions[action]
+	if fn == nil {
+		return None
+	}
+	if action = fn(c); action >= UserAction {
+		return None
+	}
+	return action
+}
+
 // Options are set when the client opens.
 type Options struct {
 	// TCPKeepAlive (SO_KEEPALIVE) socket option.
 	TCPKeepAlive time.Duration
+	// TCPUserTimeout (TCP_USER_TIMEOUT) is the maximum amount of time that
+	// transmitted data may remain unacknowledged before the kernel forcibly
+	// closes the connection. Unlike TCPKeepAlive it also detects dead peers
+	// while there is pending outbound data. Only supported on Linux.
+	TCPUserTimeout time.Duration
 	// ReuseInputBuffer will forces the connection to share and reuse the
 	// same input packet buffer with all other connections that also use
 	// this option.
 	// Default value is false, which means that all input data which is
 	// passed to the Data event will be a uniquely copied []byte slice.
+	// When it's true the input passed to the Data event is only valid
+	// until Data returns, and it must be copied to be kept any longer.
+	// Events.InputBuffer can set this for all connections.
 	ReuseInputBuffer bool
+	// Timestamping (SO_TIMESTAMPING) requests kernel receive timestamps for
+	// the connection. The timestamp of the data passed to the most recent
+	// Data event is available from Conn.Timestamp.
+	// Only supported on Linux and not for stdlib ("-net") servers.
+	Timestamping bool
+	// Mark (SO_MARK) sets the firewall mark of the connection's socket,
+	// which can be used for policy routing and traffic classification.
+	// Only supported on Linux and requires CAP_NET_ADMIN. A listener can be
+	// marked with the "mark" address option, e.g. `tcp://:8080?mark=7`.
+	Mark int
+	// OpenTimeout closes the connection when Conn.Ready isn't called within
+	// this duration after the connection opens. It's meant for protocols
+	// that start with a handshake, to drop clients that connect but never
+	// send the expected prologue.
+	OpenTimeout time.Duration
+	// MaxDataChunk limits the size of the input passed to a Data event.
+	// The input of a larger read is passed to Data in order, in chunks of
+	// at most this size, which bounds the work done per event. When an
+	// event returns an action the remaining chunks aren't passed to Data,
+	// although they're still readable from the rwc of a Detached event.
+	// Zero means no limit.
+	MaxDataChunk int
+	// ReadBatchBytes holds back the input of the connection until this
+	// many bytes have arrived, and then passes all of it to a single Data
+	// event, which saves events for peers that send many small messages.
+	// Input that stays below it is passed on once it has waited for
+	// ReadBatchDelay, which defaults to 10ms, so that an idle peer isn't
+	// kept waiting. Zero means no batching. It's ignored by stdlib ("-net")
+	// servers and for UDP.
+	ReadBatchBytes int
+	ReadBatchDelay time.Duration
+	// MaxInFlight limits the requests of the connection that are in flight
+	// between Conn.BeginRequest and Conn.EndRequest, so that a client
+	// can't pipeline an unbounded amount of work. Reads pause once the
+	// limit is reached and resume when a request ends below it. Input that
+	// was already read is still passed to Data, and stdlib ("-net")
+	// servers may read one more packet before they pause. Zero means no
+	// limit.
+	MaxInFlight int
+	// Label groups the connection with the others that have the same
+	// label, such as the connections of a tenant, for Events.RateLimits.
+	Label string
+	// Priority orders the reads of the connections that are ready at the
+	// same time, so that the Data events of latency sensitive connections
+	// fire first in a wake up of the loop. Higher runs first, and the
+	// connections of the same priority keep the order of the kernel. It's
+	// ignored by stdlib ("-net") servers, which read each connection on a
+	// goroutine of its own.
+	Priority int
 }
 
+// readBatchDelay is the default of Options.ReadBatchDelay.
+const readBatchDelay = 10 * time.Millisecond
+
 // Server represents a server context which provides information about the
 // running server and has control functions for managing state.
 type Server struct {
 	// The addrs parameter is an array of listening addresses that align
-	// with the addr strings passed to the Serve function.
+	// with the addr strings passed to the Serve function, less the ones
+	// that Events.PartialBind left out.
 	Addrs []net.Addr
 	// NumLoops is the number of loops that the server is using.
 	NumLoops int
+
+	lns        []*listener
+	attach     func(rwc io.ReadWriteCloser) error
+	stats      func() Stats
+	closeWhere func(pred func(c Conn) bool) int
+	drainLoop  func(idx int) error
+	tlsConfigs []*tls.Config
+	trace      *tracer
+	lameDuck   *int32
+	dump       func()
+	done       <-chan struct{} // closed once the server stops
+}
+
+// Attach hands a connection to the server's loops, such as one that was
+// passed to the Detached event and taken out of the loop for a blocking
+// operation. It's handled like a newly accepted connection, so the Opened
+// event fires again, and its AddrIndex is -1. The rwc may be a detached
+// connection, a net.Conn or an *os.File socket, and it must not be used once
+// Attach returns. Attach waits for the server to start, so it must not be
+// called from the Serving event itself.
+func (s Server) Attach(rwc io.ReadWriteCloser) error {
+	if s.attach == nil {
+		return ErrUnsupported
+	}
+	return s.attach(rwc)
+}
+
+// Stats is a snapshot of the state of a server.
+type Stats struct {
+	// Conns is the number of open connections.
+	Conns int
+	// Loops holds the state of each loop.
+	Loops []LoopStats
+	// Listeners holds the accept queue of each TCP listener. It's only
+	// reported on Linux.
+	Listeners []ListenerStats
+	// ListenOverflows is the number of connections that the kernel dropped
+	// because an accept queue was full, and ListenDrops is the number that
+	// listeners dropped for any reason. They're counted for all of the
+	// listeners of the host, not just the server's, so a growing count
+	// shows that connections are lost before evio sees them. They're only
+	// reported on Linux.
+	ListenOverflows, ListenDrops int64
+	// LameDuck reports whether the lame duck mode is on.
+	LameDuck bool
+}
+
+// ListenerStats is a snapshot of the accept queue of a listener.
+type ListenerStats struct {
+	// Addr is the address of the listener.
+	Addr net.Addr
+	// Queued is the number of connections that wait to be accepted, and
+	// Backlog is the most that may wait before the kernel drops new ones.
+	Queued, Backlog int
+}
+
+// listenStats adds the state of the accept queues to a snapshot.
+func listenStats(st *Stats, lns []*listener) {
+	for _, ln := range lns {
+		if _, ok := ln.ln.(*net.TCPListener); !ok {
+			continue
+		}
+		ls := ListenerStats{Addr: ln.lnaddr}
+		if ln.control(func(fd int) (err error) {
+			ls.Queued, ls.Backlog, err = internal.ListenQueue(fd)
+			return err
+		}) == nil {
+			st.Listeners = append(st.Listeners, ls)
+		}
+	}
+	st.ListenOverflows, st.ListenDrops, _ = internal.ListenOverflows()
+}
+
+// LoopStats is a snapshot of the state of a loop. The timings and the poll
+// calls are only recorded when Events.LoopStats is set, the counters always.
+type LoopStats struct {
+	// Conns is the number of open connections on the loop.
+	Conns int
+	// Iterations is the number of times the loop waited for events.
+	Iterations int64
+	// PollCalls is the number of system calls that the loop made to wait
+	// for events, to change the events it waits for, and to read, write
+	// and accept the connections, such as calls to epoll_wait, epoll_ctl,
+	// read and write. It shows what a Backend saves.
+	PollCalls int64
+	// WaitAvg and WaitMax are the moving average and the maximum of the
+	// time that the loop blocked waiting for events, such as in
+	// epoll_wait.
+	WaitAvg, WaitMax time.Duration
+	// DispatchAvg and DispatchMax are the moving average and the maximum of
+	// the time that the loop spent handling the events of a wait, which is
+	// mostly time spent in the event handlers.
+	DispatchAvg, DispatchMax time.Duration
+	// Accepts is the number of connections that the loop took on, whether
+	// they were accepted or attached, and Closes is the number that it
+	// closed. A migrated connection is closed by its new loop.
+	Accepts, Closes int64
+	// BytesIn and BytesOut are the number of bytes that the loop read from
+	// and wrote to its connections. UDP datagrams aren't counted.
+	BytesIn, BytesOut int64
+	// Timeouts is the number of Options.OpenTimeout and Conn.SetDeadline
+	// timers that fired on the loop.
+	Timeouts int64
+}
+
+// loopCounters counts the connections and bytes of a loop for LoopStats. The
+// loop updates them and Stats reads them from any goroutine.
+type loopCounters struct {
+	accepts, closes   int64
+	bytesIn, bytesOut int64
+	timeouts          int64
+}
+
+// fill copies the counters to the stats of the loop.
+func (lc *loopCounters) fill(ls *LoopStats) {
+	ls.Accepts = atomic.LoadInt64(&lc.accepts)
+	ls.Closes = atomic.LoadInt64(&lc.closes)
+	ls.BytesIn = atomic.LoadInt64(&lc.bytesIn)
+	ls.BytesOut = atomic.LoadInt64(&lc.bytesOut)
+	ls.Timeouts = atomic.LoadInt64(&lc.timeouts)
+}
+
+// Stats returns a snapshot of the state of the server. It's empty until the
+// server has started, and it may be called from any goroutine.
+func (s Server) Stats() Stats {
+	if s.stats == nil {
+		return Stats{}
+	}
+	st := s.stats()
+	st.LameDuck = s.LameDuck()
+	return st
+}
+
+// CloseWhere closes the connections for which pred returns true and returns
+// how many it closed, such as for evicting the connections of a tenant that
+// are told apart by their context, or dropping idle ones. The predicate is
+// called on the loop of each connection, like an event, so it may use the
+// context. The connections close as with a Close action and their Closed
+// events fire. It waits for all of the loops, so it must not be called from
+// an event.
+func (s Server) CloseWhere(pred func(c Conn) bool) int {
+	if s.closeWhere == nil {
+		return 0
+	}
+	return s.closeWhere(pred)
+}
+
+// DrainLoop stops the loop at idx, which is its index in Stats().Loops, after
+// moving its connections to the other loops, which keep serving them without
+// firing any events for the move. It's meant for taking a loop out of
+// service, and autoscaling may add a loop back. It may be called from any
+// goroutine but an event's, and it returns an error when idx is out of
+// range or it's the last loop. It returns ErrUnsupported for stdlib ("-net")
+// servers and servers on a Pool.
+func (s Server) DrainLoop(idx int) error {
+	if s.drainLoop == nil {
+		return ErrUnsupported
+	}
+	return s.drainLoop(idx)
+}
+
+// SetTrace turns tracing on or off without restarting the server. While
+// it's on, the accepts, reads, writes and state changes of the connections
+// are written to Events.Logger, which helps debugging a server in
+// production. It may be called from any goroutine, and it returns an error
+// when Events.Logger isn't set.
+func (s Server) SetTrace(on bool) error {
+	if s.trace == nil {
+		return ErrUnsupported
+	}
+	if s.trace.log == nil {
+		return errNoLogger
+	}
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&s.trace.on, v)
+	return nil
+}
+
+// Tracing reports whether tracing is on.
+func (s Server) Tracing() bool {
+	return s.trace.enabled()
+}
+
+// SetLameDuck turns the lame duck mode on or off. It's meant for taking a
+// server out of rotation gracefully: the server keeps accepting and serving
+// connections as usual, but a health check that's served by it reports it
+// unhealthy by checking LameDuck, so that the load balancers stop sending
+// it new traffic. It may be called from any goroutine.
+func (s Server) SetLameDuck(on bool) error {
+	if s.lameDuck == nil {
+		return ErrUnsupported
+	}
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(s.lameDuck, v)
+	return nil
+}
+
+// LameDuck reports whether the lame duck mode is on. It may be called from
+// any goroutine, including the events.
+func (s Server) LameDuck() bool {
+	return s.lameDuck != nil && atomic.LoadInt32(s.lameDuck) == 1
+}
+
+// dumpBusiest is the number of connections with the most pending output
+// that a dump lists for each loop.
+const dumpBusiest = 5
+
+// loopDump is the state of a loop that's written by a dump.
+type loopDump struct {
+	idx   int        // loop index
+	conns int        // open connections
+	notes int        // queued notes, such as wakes
+	busy  []connDump // connections with pending output
+}
+
+// connDump is the state of a connection that's written by a dump.
+type connDump struct {
+	id     uint64
+	remote net.Addr
+	out    int // pending output
+}
+
+// writeDump writes the state of the loops to the logger, with the
+// connections that have the most pending output.
+func writeDump(log Logger, dumps []loopDump) {
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].idx < dumps[j].idx })
+	for _, d := range dumps {
+		log.Printf("evio: loop %d: %d conns, %d queued notes", d.idx, d.conns, d.notes)
+		busy := d.busy
+		sort.Slice(busy, func(i, j int) bool { return busy[i].out > busy[j].out })
+		if len(busy) > dumpBusiest {
+			busy = busy[:dumpBusiest]
+		}
+		for _, c := range busy {
+			log.Printf("evio: loop %d: conn %d %v: %d bytes pending", d.idx, c.id, c.remote, c.out)
+		}
+	}
+}
+
+// watchDumpSignal calls dump each time the signal is received, until done
+// is closed.
+func watchDumpSignal(sig os.Signal, dump func(), done chan struct{}) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ch:
+				dump()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// watchStats passes a snapshot of the server to fn each time the interval
+// elapses on the clock, until done is closed.
+func watchStats(clock Clock, interval time.Duration, stats func() Stats,
+	fn func(st Stats), done chan struct{}) {
+	go func() {
+		for {
+			ch := make(chan struct{})
+			t := clock.AfterFunc(interval, func() { close(ch) })
+			select {
+			case <-ch:
+				fn(stats())
+			case <-done:
+				t.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Clock tells the time and runs the timers of a server.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// AfterFunc calls fn in its own goroutine once d has elapsed.
+	AfterFunc(d time.Duration, fn func()) ClockTimer
+}
+
+// ClockTimer is a timer that was started by a Clock.
+type ClockTimer interface {
+	// Stop prevents the timer from firing. It returns false if the timer
+	// has already fired or been stopped.
+	Stop() bool
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+func (systemClock) AfterFunc(d time.Duration, fn func()) ClockTimer {
+	return time.AfterFunc(d, fn)
+}
+
+// eventsClock returns the clock of the events, which defaults to the
+// system clock.
+func eventsClock(events Events) Clock {
+	if events.Clock == nil {
+		return systemClock{}
+	}
+	return events.Clock
+}
+
+// goLabeled runs fn on a new goroutine. When on is set, for
+// Events.ProfileLabels, the goroutine is labeled with its role and index
+// from the start.
+func goLabeled(on bool, role string, idx int, fn func()) {
+	if !on {
+		go fn()
+		return
+	}
+	labels := pprof.Labels("evio.role", role, "evio."+role, strconv.Itoa(idx))
+	pprof.Do(context.Background(), labels, func(context.Context) {
+		go fn()
+	})
+}
+
+// clockSleep pauses the current goroutine for d on the clock.
+func clockSleep(clock Clock, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	ch := make(chan struct{})
+	clock.AfterFunc(d, func() { close(ch) })
+	<-ch
+}
+
+// Logger receives the log messages of a server. A *log.Logger is a Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+var errNoLogger = errors.New("tracing needs Events.Logger")
+
+// tracer writes the traces of a server to its logger while tracing is on.
+type tracer struct {
+	log Logger
+	on  int32
+}
+
+// enabled reports whether traces are written. It's checked before a trace
+// is formatted, so tracing costs next to nothing while it's off.
+func (t *tracer) enabled() bool {
+	return t != nil && atomic.LoadInt32(&t.on) == 1
+}
+
+func (t *tracer) printf(format string, v ...interface{}) {
+	t.log.Printf("evio: "+format, v...)
+}
+
+// ListenerFiles returns duplicates of the server's listening sockets, in the
+// same order as Addrs. They are meant to be handed to a new process, such as
+// with exec.Cmd.ExtraFiles, which continues accepting on them by calling
+// ServeFiles. The server keeps serving on its own copies until it's shut
+// down. The caller is responsible for closing the returned files.
+func (s Server) ListenerFiles() ([]*os.File, error) {
+	files := make([]*os.File, 0, len(s.lns))
+	for _, ln := range s.lns {
+		f, err := ln.file()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// ServeHandoff receives sockets that another process hands off over the unix
+// listener with SCM_RIGHTS, such as a front-end that accepts connections and
+// passes them on with HandoffConn. Each socket is added to the server's loops
+// like with Attach. It returns once the listener is closed or fails to
+// accept, and it must not be called from the Serving event itself.
+func (s Server) ServeHandoff(ln *net.UnixListener) error {
+	if s.attach == nil || rightsSpace == 0 {
+		return ErrUnsupported
+	}
+	for {
+		uc, err := ln.AcceptUnix()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handoffRun(uc)
+	}
+}
+
+// handoffRun attaches the sockets that are received on a handoff connection
+// until the connection is closed.
+func (s Server) handoffRun(uc *net.UnixConn) {
+	defer uc.Close()
+	buf := make([]byte, 1)
+	oob := make([]byte, rightsSpace)
+	for {
+		n, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+		var in, state []byte
+		if err == nil && n == 1 && buf[0] == handoffMigrate {
+			// the state of a migrated connection follows its socket
+			if in, err = readHandoffBlock(uc); err == nil {
+				state, err = readHandoffBlock(uc)
+			}
+		}
+		if oobn > 0 {
+			fds, perr := parseUnixRights(oob[:oobn])
+			for _, fd := range fds {
+				f := os.NewFile(uintptr(fd), "handoff")
+				var rwc io.ReadWriteCloser = f
+				if buf[0] == handoffMigrate {
+					rwc = &handoffConn{File: f, in: in, state: state}
+				}
+				if perr != nil || err != nil || s.Attach(rwc) != nil {
+					f.Close()
+				}
+			}
+		}
+		if err != nil || (n == 0 && oobn == 0) {
+			return
+		}
+	}
+}
+
+// The first byte of a handoff message, which carries the socket.
+const (
+	handoffPlain   = 0 // sent by HandoffConn
+	handoffMigrate = 1 // sent by MigrateConn, followed by the state
+)
+
+// maxHandoffBlock limits the input and the state of a migrated connection.
+const maxHandoffBlock = 16 << 20
+
+// readHandoffBlock reads a block of a migrated connection's state, which is
+// its size as 4 bytes in big endian and the bytes.
+func readHandoffBlock(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := int(size[0])<<24 | int(size[1])<<16 | int(size[2])<<8 | int(size[3])
+	if n > maxHandoffBlock {
+		return nil, errors.New("handoff state too large")
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// appendHandoffBlock appends a block that readHandoffBlock reads.
+func appendHandoffBlock(b, block []byte) []byte {
+	n := len(block)
+	b = append(b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	return append(b, block...)
+}
+
+// handoffConn is a socket that was received by ServeHandoff along with the
+// state that MigrateConn sent with it.
+type handoffConn struct {
+	*os.File
+	in    []byte // input that the sender read but didn't pass to Data
+	state []byte // context of the connection
+}
+
+// HandoffConn sends the socket of a connection over a unix connection to a
+// server that's receiving with ServeHandoff. The caller still owns conn and
+// should close it once the socket has been sent.
+func HandoffConn(uc *net.UnixConn, conn syscall.Conn) error {
+	return sysControl(conn, func(fd int) error {
+		rights, err := unixRights(fd)
+		if err != nil {
+			return err
+		}
+		_, _, err = uc.WriteMsgUnix([]byte{handoffPlain}, rights, nil)
+		return err
+	})
+}
+
+// MigrateConn moves a connection that the Detached event took out of the
+// loop to a server in another process that's receiving with ServeHandoff,
+// such as to spread the load of a busy process. The socket is sent with
+// the input that the loop read but didn't pass to Data, and with the state,
+// which is opaque to evio, such as the session of the connection. The
+// receiving server adds the connection like with Attach, with the state as
+// its context, of type []byte, when it's not empty, and it passes the input
+// to Data once the connection is opened. The caller still owns rwc and
+// should close it once it's sent.
+func MigrateConn(uc *net.UnixConn, rwc io.ReadWriteCloser, state []byte) error {
+	if rightsSpace == 0 {
+		return ErrUnsupported
+	}
+	var in []byte
+	var sock interface{} = rwc
+	switch v := rwc.(type) {
+	case *stddetachedConn:
+		sock, in = v.conn, v.in
+	case interface{ unread() []byte }:
+		in = v.unread()
+	}
+	msg := []byte{handoffMigrate}
+	msg = appendHandoffBlock(msg, in)
+	msg = appendHandoffBlock(msg, state)
+	send := func(fd int) error {
+		rights, err := unixRights(fd)
+		if err != nil {
+			return err
+		}
+		// the socket goes with the first byte, and the state after it
+		if _, _, err = uc.WriteMsgUnix(msg[:1], rights, nil); err != nil {
+			return err
+		}
+		_, err = uc.Write(msg[1:])
+		return err
+	}
+	if f, ok := sock.(interface{ Fd() uintptr }); ok {
+		return send(int(f.Fd()))
+	}
+	return sysControl(sock, send)
 }
 
 // Conn is an evio connection.
@@ -54,16 +720,188 @@ type Conn interface {
 	Context() interface{}
 	// SetContext sets a user-defined context.
 	SetContext(interface{})
+	// ID is a number that identifies the connection in the process, such
+	// as for correlating the logs of its events. It's assigned when the
+	// connection is accepted, or added with Server.Attach, by
+	// Events.ConnIDGen when it's set, and stays the same for all of its
+	// events. Request IDs can be kept in the context.
+	// It's zero for UDP packets.
+	ID() uint64
 	// AddrIndex is the index of server address that was passed to the Serve call.
+	// It's -1 for connections that were added with Server.Attach.
 	AddrIndex() int
 	// LocalAddr is the connection's local socket address.
 	LocalAddr() net.Addr
 	// RemoteAddr is the connection's remote peer address.
 	RemoteAddr() net.Addr
-	// Wake triggers a Data event for this connection.
-	Wake()
+	// Wake triggers a Data event for this connection. The output of the
+	// event is appended to the output that's waiting to be written. It
+	// returns ErrQueueFull when Events.WakeQueueSize wakes are already
+	// pending on the connection's loop, so callers can back off and retry.
+	Wake() error
+	// Timestamp is the kernel receive time of the data passed to the most
+	// recent Data event. It's the zero time unless Options.Timestamping was
+	// set and the platform supports it.
+	Timestamp() time.Time
+	// ReadableBytes returns the number of bytes that are waiting in the
+	// socket's receive buffer (FIONREAD) and will be read by the next Data
+	// event. It returns ErrUnsupported for stdlib ("-net") servers and
+	// UDP connections.
+	ReadableBytes() (int, error)
+	// Peek returns up to n bytes of the input that's waiting in the
+	// socket's receive buffer without consuming it, so the bytes are still
+	// passed to the next Data event. It returns fewer bytes when less input
+	// is available, and io.EOF when the peer closed the connection. It
+	// returns an error for a negative n, and ErrUnsupported for stdlib
+	// ("-net") servers and UDP connections.
+	Peek(n int) ([]byte, error)
+	// SetNoDelay sets TCP_NODELAY on the connection, which disables
+	// Nagle's algorithm when true. Protocols may flip it between phases,
+	// such as off for a bulk transfer and on for interactive traffic.
+	// It must be called from an event, and it returns ErrUnsupported for
+	// connections that aren't TCP.
+	SetNoDelay(noDelay bool) error
+	// SetKeepAlive enables TCP keepalive with the provided period, or
+	// disables it when the period is zero. It must be called from an event,
+	// and it returns ErrUnsupported for connections that aren't TCP.
+	SetKeepAlive(period time.Duration) error
+	// PeerCred returns the credentials of the process that connected over
+	// a unix socket (SO_PEERCRED, or LOCAL_PEERCRED on BSD), as they were
+	// when it connected, so local clients can be authenticated. The pid is
+	// -1 where the platform doesn't report it. It returns ErrUnsupported
+	// for connections that aren't unix sockets.
+	PeerCred() (pid, uid, gid int, err error)
+	// OriginalDst returns the address that a TCP connection was headed to
+	// before an iptables REDIRECT or TPROXY rule redirected it to the
+	// server (SO_ORIGINAL_DST), so a transparent proxy can connect to the
+	// intended destination. It's only supported on Linux, it fails when
+	// the connection has no conntrack entry, and it returns ErrUnsupported
+	// for connections that aren't TCP.
+	OriginalDst() (net.Addr, error)
+	// WriteFrom streams the reader to the connection after the output
+	// that's already queued, including the output of the event that calls
+	// it. It's read in chunks as the socket drains, so a large source isn't
+	// buffered in memory, and the reader isn't closed at the end. A Close
+	// or Detach action takes effect once the reader is drained, and the
+	// connection is closed if the reader fails. It must be called from an
+	// event, and it returns ErrUnsupported for UDP and TLS connections.
+	WriteFrom(r io.Reader) error
+	// SendUrgent queues b ahead of the output that's waiting to be
+	// written, for control messages such as a ping or an abort that
+	// shouldn't wait behind bulk data. The output of an event or of
+	// WriteFrom that the socket already started to take is finished
+	// first, so it isn't interleaved with b, and urgent output goes out in
+	// the order it was sent. It must be called from an event, and it
+	// returns ErrUnsupported for UDP and TLS connections.
+	SendUrgent(b []byte) error
+	// WriteString queues s to be written, ahead of the output of the event
+	// that calls it. It saves converting text to a byte slice, since s is
+	// copied straight into the write buffer. Stdlib ("-net") servers write
+	// it right away, with one copy. It must be called from an event, and
+	// it returns ErrUnsupported for UDP and TLS connections.
+	WriteString(s string) error
+	// WriteBuffers queues the buffers to be written in order, ahead of the
+	// output of the event that calls it, like WriteString. They're copied
+	// into the write buffer back to back, so a header and a body that were
+	// built apart go out together, with a single write when the socket has
+	// room. Stdlib ("-net") servers write them right away, with writev
+	// where it's supported. On a UDP connection they're sent right away
+	// as a single datagram to the peer, ahead of the output of the event,
+	// with sendmsg on Linux so that a header and a payload aren't copied
+	// together. It must be called from an event, and it returns
+	// ErrUnsupported for TLS connections.
+	WriteBuffers(bufs net.Buffers) error
+	// TryWrite queues b to be written like WriteString, unless the
+	// buffered output of the connection is at or above the high watermark
+	// set with SetWriteWatermarks, in which case it queues nothing and
+	// returns ErrWouldBlock. A write that crosses the mark is queued whole,
+	// so the output may exceed the mark by one write. A producer stops at
+	// ErrWouldBlock and resumes from the OnWriteLow event, for instance
+	// by calling Wake, which gives it backpressure instead of output that
+	// grows without bound. It never blocks without a high watermark.
+	// Stdlib ("-net") servers write right away, so it never returns
+	// ErrWouldBlock there. It must be called from an event, and it returns
+	// ErrUnsupported for UDP and TLS connections.
+	TryWrite(b []byte) error
+	// SetWriteWatermarks sets the amounts of buffered output at which the
+	// OnWriteHigh and OnWriteLow events fire for the connection, which
+	// lets a producer stop once the peer falls behind and resume once it
+	// catches up. OnWriteHigh fires when the output grows to high bytes or
+	// more, and OnWriteLow when it then drains to low bytes or less. A high
+	// of zero turns them off, and low must be below high. It must be
+	// called from an event, and it returns ErrUnsupported for UDP and TLS
+	// connections.
+	SetWriteWatermarks(low, high int) error
+	// Drain stops passing input to the Data event and closes the
+	// connection once its pending output has been written. It's meant for
+	// sending an error response and ignoring whatever the peer says next.
+	// The write side is shut down after the output, and the input is
+	// discarded until the peer closes, for up to a few seconds, so that the
+	// peer can read the output without the connection being reset. It
+	// must be called from an event, and it does nothing for UDP
+	// connections.
+	Drain()
+	// CloseWithReason closes the connection like Drain, after sending the
+	// close message of the application protocol with the code and the
+	// reason, such as a WebSocket close frame. The message is framed by
+	// Events.CloseFrame, which is websocket.CloseFrame for WebSockets, and
+	// written after all of the other output,
+	// including the output of the event that calls it. It must be called
+	// from an event, and it returns ErrUnsupported when CloseFrame isn't
+	// set, and for UDP and TLS connections.
+	CloseWithReason(code int, reason string) error
+	// Ready marks the connection's handshake as complete, which cancels the
+	// Options.OpenTimeout deadline. It must be called from an event.
+	Ready()
+	// BeginRequest marks the start of a request, which counts toward
+	// Options.MaxInFlight until EndRequest is called for it. It must be
+	// called from an event, and it does nothing for UDP connections.
+	BeginRequest()
+	// EndRequest marks the end of a request that BeginRequest started,
+	// once its response has been written, and resumes the reads that the
+	// limit paused. It must be called from an event, such as the one that
+	// Wake fires, and it does nothing for UDP connections.
+	EndRequest()
+	// SuspendUntil pauses the reads of the connection until done is
+	// closed, such as while an asynchronous operation that the input
+	// started is in flight, so that no more input is passed to Data until
+	// it completes. Wakes still fire Data. Reads resume once all of the
+	// channels passed to SuspendUntil are closed and Options.MaxInFlight
+	// allows. The input that stdlib ("-net") servers read before the reads
+	// paused is held until they resume. It must be called from an event,
+	// and it returns ErrUnsupported for UDP connections.
+	SuspendUntil(done <-chan struct{}) error
+	// SetDeadline calls fn on the loop of the connection once the time t
+	// is reached, in place of a built-in timeout, which makes it the
+	// primitive of keepalives and protocol timers. Like an event, fn
+	// returns output to write and an action, and it may set the deadline
+	// again. A connection has one deadline: setting it replaces the last
+	// one, and a zero t or a nil fn cancels it. The deadline moves along
+	// with the connection to another loop, and it's canceled when the
+	// connection closes or detaches. It must be called from an event, and
+	// it returns ErrUnsupported for UDP and TLS connections.
+	SetDeadline(t time.Time, fn func(c Conn) (out []byte, action Action)) error
 }
 
+// drainLinger is how long a drained connection waits for the peer to close
+// before it's closed anyway.
+var drainLinger = 5 * time.Second
+
+// connID is the last connection ID that was assigned.
+var connID uint64
+
+// nextConnID returns a new connection ID from gen, or from the counter of
+// the process when gen is nil.
+func nextConnID(gen func() uint64) uint64 {
+	if gen != nil {
+		return gen()
+	}
+	return atomic.AddUint64(&connID, 1)
+}
+
+// writeFromChunk is the size of the chunks that WriteFrom reads.
+const writeFromChunk = 0x10000
+
 // LoadBalance sets the load balancing method.
 type LoadBalance int
 
@@ -78,6 +916,125 @@ const (
 	LeastConnections
 )
 
+// AcceptDecision tells which loop took an accepted connection and why. It's
+// passed to Events.OnAcceptDecision.
+type AcceptDecision struct {
+	// ID is the ID of the connection, and AddrIndex is the index of the
+	// listener that accepted it.
+	ID        uint64
+	AddrIndex int
+	// RemoteAddr is the address of the peer.
+	RemoteAddr net.Addr
+	// Balance is the method that picked the loop. Stdlib ("-net") servers
+	// only balance with RoundRobin, or with Random when Events.Seed is set.
+	Balance LoadBalance
+	// Loop is the index of the loop in Stats().Loops, and Conns holds the
+	// number of connections of each loop when the loop was picked.
+	Loop  int
+	Conns []int
+}
+
+// loopRand picks the loops of the accepted connections for a seeded Random
+// balance.
+type loopRand struct {
+	mu   sync.Mutex
+	rng  *rand.Rand
+	next int // loop of the next connection
+}
+
+// newLoopRand returns nil when the seed is zero.
+func newLoopRand(seed int64) *loopRand {
+	if seed == 0 {
+		return nil
+	}
+	return &loopRand{rng: rand.New(rand.NewSource(seed))}
+}
+
+// pick returns the loop, out of n, of the next connection.
+func (r *loopRand) pick(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	idx := r.next % n
+	r.next = r.rng.Intn(n)
+	return idx
+}
+
+// turn reports whether the loop idx, out of n, gets the next connection.
+func (r *loopRand) turn(idx, n int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.next%n == idx
+}
+
+// advance picks the loop, out of n, of the connection after the one that
+// was just accepted.
+func (r *loopRand) advance(n int) {
+	r.mu.Lock()
+	r.next = r.rng.Intn(n)
+	r.mu.Unlock()
+}
+
+// Backend selects the mechanism that the event loops use to wait for socket
+// events.
+type Backend int
+
+const (
+	// DefaultBackend uses epoll on Linux and kqueue on BSD and Darwin.
+	DefaultBackend Backend = iota
+	// IOUring uses io_uring on Linux 5.1 and later. The reads, writes and
+	// accepts of the connections are submitted to the ring, along with the
+	// changes to the interest set, so they don't take system calls of their
+	// own. A connection that's read is received into buffers of the ring
+	// from then on, and its input arrives with the wait. The writes and
+	// accepts fail instead of blocking, like they do on a non-blocking
+	// socket. The receives need Linux 5.7, and the accepts Linux 6.10,
+	// otherwise they're system calls as with epoll. It falls back to the
+	// default backend when io_uring isn't available.
+	IOUring
+)
+
+// InputBuffer sets whether the input that's passed to the Data event is
+// copied out of the loop's read buffer.
+type InputBuffer int
+
+const (
+	// DefaultInputBuffer copies the input unless the connection's
+	// Options.ReuseInputBuffer is set.
+	DefaultInputBuffer InputBuffer = iota
+	// ReuseInput passes the loop's read buffer to the Data event of all
+	// connections, as if they all set Options.ReuseInputBuffer. The input
+	// is only valid until Data returns. This avoids a copy per read.
+	ReuseInput
+	// CopyInput always copies the input, ignoring
+	// Options.ReuseInputBuffer, so the input may be kept after Data
+	// returns. It's a safe mode for handlers that aren't known to follow
+	// the reuse contract.
+	CopyInput
+)
+
+// poisonInput overwrites the reused input buffer after the Data event
+// returns, so that handlers that keep the input past the event see garbage
+// instead of data that happens to still be right. It's enabled by building
+// with the evio_poison tag, which is meant for tests.
+var poisonInput bool
+
+// debugInput checks that helpers like InPlace are used by their rules,
+// and panics when they're not. It's enabled by building with the
+// evio_debug tag, which also enables poisonInput.
+var debugInput bool
+
+// poisonByte is what the input buffer is overwritten with.
+const poisonByte = 0xDE
+
+// poison overwrites a reused input buffer when poisoning is enabled.
+func poison(b []byte) {
+	if poisonInput {
+		for i := range b {
+			b[i] = poisonByte
+		}
+	}
+}
+
 // Events represents the server events for the Serve call.
 // Each event has an Action return value that is used manage the state
 // of the connection and server.
@@ -89,10 +1046,177 @@ type Events struct {
 	// will run the server single-threaded. Setting to -1 will automatically
 	// assign this value equal to runtime.NumProcs().
 	NumLoops int
+	// MinLoops and MaxLoops enable autoscaling of the number of loops,
+	// which takes the place of NumLoops when MaxLoops is greater than
+	// MinLoops. The server starts with MinLoops loops, at least one, and
+	// adds loops up to MaxLoops while the number of connections per loop
+	// stays above ConnsPerLoop. Once the load subsides loops are retired
+	// again, and their connections are moved to the remaining loops.
+	// Autoscaling is ignored by stdlib ("-net") servers and servers on a
+	// Pool.
+	MinLoops, MaxLoops int
+	// ConnsPerLoop is the number of connections per loop above which
+	// autoscaling adds a loop. It defaults to 1024.
+	ConnsPerLoop int
 	// LoadBalance sets the load balancing method. Load balancing is always a
 	// best effort to attempt to distribute the incoming connections between
 	// multiple loops. This option is only works when NumLoops is set.
 	LoadBalance LoadBalance
+	// Seed, when non-zero, makes Random pick the loop of each accepted
+	// connection with a pseudo-random generator seeded with it, so that the
+	// distribution is the same across runs. It's meant for reproducible load
+	// tests, and it serializes the accepts across the loops.
+	Seed int64
+	// Backend selects the event notification mechanism of the loops. It's
+	// ignored by stdlib ("-net") servers.
+	Backend Backend
+	// Pool runs the server on the loops of a shared pool instead of
+	// starting its own, in which case NumLoops and Backend are ignored. It's
+	// ignored by stdlib ("-net") servers.
+	Pool *Pool
+	// InputBuffer sets whether the input passed to the Data event is copied
+	// or reused for all connections. It's ignored by stdlib ("-net")
+	// servers, which always copy.
+	InputBuffer InputBuffer
+	// Listeners holds the settings of individual listeners, keyed by the
+	// index of their address in the Serve call.
+	Listeners map[int]ListenerConfig
+	// PartialBind keeps serving on the addresses that were bound when
+	// others fail, instead of failing Serve, which then fails only when
+	// none of them could be bound. The failed addresses are left out, so
+	// Server.Addrs and Conn.AddrIndex only count the listeners that were
+	// bound, while Listeners still applies to the addresses by the order
+	// they were passed in.
+	PartialBind bool
+	// MaxConnsPerIP limits the number of open connections from a single
+	// source IP address. Connections over the limit are closed as soon as
+	// they're accepted, before the Opened event. Zero means no limit.
+	MaxConnsPerIP int
+	// Trusted holds the networks of trusted peers, such as the internal
+	// services behind the same load balancer. Connections from them aren't
+	// counted against MaxConnsPerIP and aren't throttled by RateLimits.
+	Trusted []*net.IPNet
+	// FDHeadroom is the number of file descriptors that are kept free below
+	// the process's limit (RLIMIT_NOFILE). Accepting pauses while more
+	// connections would leave fewer than that, so that the handlers can
+	// still open files and dial out instead of the server running into
+	// EMFILE, and OnAcceptError is passed ErrFDHeadroom. The descriptors
+	// that are open when the server starts are counted, but not the ones
+	// that are opened later outside of the server. Zero disables it, and
+	// it's ignored where the limit can't be read.
+	FDHeadroom int
+	// WakeQueueSize limits the number of pending Conn.Wake calls per loop.
+	// Wake returns ErrQueueFull when the limit is reached. Zero means no
+	// limit. It's ignored by servers on a Pool.
+	WakeQueueSize int
+	// LoopStats enables timing of the loops, which is reported by
+	// Server.Stats. It's ignored by stdlib ("-net") servers and servers on
+	// a Pool.
+	LoopStats bool
+	// StatsInterval, when set along with OnStats, makes the server pass a
+	// snapshot of Server.Stats to OnStats each time the interval elapses
+	// on the Clock, as a ready-made feed for metrics. OnStats is called
+	// from a goroutine of its own, not from a loop, one snapshot at a time.
+	StatsInterval time.Duration
+	OnStats       func(st Stats)
+	// MaxReadsPerWait and MaxBytesPerWait bound the input that's read from
+	// a connection each time the loop wakes up. A connection keeps being
+	// read while its socket fills the read buffer, until it has been read
+	// MaxReadsPerWait times or MaxBytesPerWait bytes, and then the loop
+	// moves on to the other ready connections and picks it up again on
+	// the next wake up. This keeps a connection that's flooding the loop
+	// from starving the others. The default is a single read, and zero
+	// bytes means no byte limit. They're ignored by stdlib ("-net")
+	// servers.
+	MaxReadsPerWait, MaxBytesPerWait int
+	// MaxReadPerCycle caps the total number of bytes that a loop reads
+	// from all of its connections each time it wakes up, which bounds the
+	// memory that a flood across many connections takes before the Data
+	// events consume it. Once the cap is reached the remaining readable
+	// connections are read on the next wake up. Zero means no cap. It
+	// doesn't apply to UDP, and it's ignored by stdlib ("-net") servers.
+	MaxReadPerCycle int
+	// WriteSpin is the number of times a write that fills the socket is
+	// retried right away, yielding the processor in between, before the
+	// loop waits for the socket to become writable again. A fast reader
+	// may drain the socket in the meantime, which saves a trip through the
+	// poll at the cost of CPU. Zero means no retries. It's ignored by
+	// stdlib ("-net") servers.
+	WriteSpin int
+	// BusyPoll, when non-zero, makes a loop poll its sockets without
+	// blocking for this long after each wake up that had events, which
+	// trims the latency of waking up at the cost of CPU. A loop only busy
+	// polls while it has connections, so an idle loop still blocks in the
+	// kernel and costs nothing. It's ignored by stdlib ("-net") servers and
+	// servers on a Pool.
+	BusyPoll time.Duration
+	// ListenOptions are applied to the listening sockets once they're bound,
+	// and to each connection that's accepted on them. They allow setting
+	// socket options that have no setting of their own. Serve fails when
+	// an option fails on a listener. A connection on which an option fails
+	// is closed and the error is passed to OnAcceptError. The options
+	// aren't applied again to the listeners that are passed to ServeFiles.
+	ListenOptions []ListenOption
+	// UDPGRO enables UDP generic receive offload on the UDP listeners, so
+	// that the kernel may hand over several datagrams from the same peer
+	// with a single read. They are split again and each datagram still
+	// gets its own Data event. It needs Linux 5.0 or later and it's ignored
+	// elsewhere and by stdlib ("-net") servers.
+	UDPGRO bool
+	// UDPSegment, when non-zero, sends the output of the Data events of UDP
+	// listeners as datagrams of this many bytes, with the last one holding
+	// the rest. On Linux 4.18 or later the kernel splits the output with
+	// generic segmentation offload (UDP_SEGMENT), which takes one send for
+	// many datagrams. Elsewhere it's split before sending.
+	UDPSegment int
+	// Logger receives the traces of the server while Server.SetTrace has
+	// turned tracing on.
+	Logger Logger
+	// DumpSignal, when set along with Logger, makes the server write the
+	// state of its loops to Logger each time the process receives the
+	// signal, such as syscall.SIGUSR1, for debugging a stuck loop. That's
+	// the connections and queued notes of each loop, and the connections
+	// with the most pending output. A SIGQUIT no longer exits the process
+	// while the server runs.
+	DumpSignal os.Signal
+	// ParallelClose closes the connections that are left when the server
+	// shuts down on all of the loops at once, one goroutine per loop, so a
+	// server with many connections returns from Serve sooner. The Closed
+	// events of a loop still fire one at a time, and Serve returns once
+	// all of them have returned, but the events of different loops run in
+	// parallel, as they do while the server runs. Stdlib ("-net") servers
+	// and servers on a Pool always close the loops in parallel.
+	ParallelClose bool
+	// ProfileLabels sets pprof labels on the goroutines of the server's
+	// loops, so that profiles attribute the work to a loop: "evio.role" is
+	// "loop" and "evio.loop" is the index of the loop. The listeners of
+	// stdlib ("-net") servers are labeled with the role "listener" and
+	// "evio.listener". The loops of a Pool aren't labeled.
+	ProfileLabels bool
+	// Clock is the source of time of the server's timers, such as the open
+	// timeouts, the read batches and the delays of the Tick event. It
+	// defaults to the system clock, and tests can set a fake clock to
+	// advance time without sleeping. The timers of servers on a Pool, and
+	// of the loops on BSD, which are kqueue timers, keep the system clock.
+	Clock Clock
+	// ConnIDGen, when set, generates the IDs of the connections in place
+	// of the counter of the process, such as to take them from the ID
+	// scheme of a tracing system. It's called as each connection is
+	// accepted or attached, from the goroutines of different loops and
+	// listeners at once, so it must be safe for concurrent use. IDs should
+	// be unique and non-zero, since a zero ID stands for a UDP packet.
+	ConnIDGen func() uint64
+	// RateLimits limits the rate at which the connections are read by
+	// their Options.Label. It's ignored for UDP.
+	RateLimits *RateLimits
+	// InboundLimit caps the input that the InBuffers of the connections
+	// hold in total, and sheds the largest when the input goes over it.
+	// The buffers of the connections that close or detach stop counting.
+	InboundLimit *InboundLimit
+	// OnBind fires for each of the addresses passed to Serve once it has
+	// been bound, with the error when binding it failed, before the
+	// Serving event.
+	OnBind func(addr string, err error)
 	// Serving fires when the server can accept connections. The server
 	// parameter has information and various utilities.
 	//准备开始服务时调用，一般用来打印一些服务运行的参数
@@ -104,7 +1228,14 @@ type Events struct {
 	// The opts return value is used to set connection options.
 	Opened func(c Conn) (out []byte, opts Options, action Action)
 	// Closed fires when a connection has closed.
-	// The err parameter is the last known connection error.
+	// The err parameter is the last known connection error. It's nil when
+	// the peer closed the connection, whether that was found by a read or
+	// by a write that failed with EPIPE. A reset of a connection that the
+	// peer hadn't closed is passed on as ECONNRESET as soon as the poll
+	// reports it, without waiting for a read or a write to fail.
+	// Neither Opened nor Closed fires for UDP, since the server keeps no
+	// UDP sessions: each packet is passed to Data on its own, so there are
+	// no sessions to close when the server shuts down.
 	Closed func(c Conn, err error) (action Action)
 	// Detached fires when a connection has been previously detached.
 	// Once detached it's up to the receiver of this event to manage the
@@ -112,20 +1243,102 @@ type Events struct {
 	// this connection.
 	// The conn parameter is a ReadWriteCloser that represents the
 	// underlying socket connection. It can be freely used in goroutines
-	// and should be closed when it's no longer needed.
+	// and should be closed when it's no longer needed. It also implements
+	// net.Conn, including the deadline methods, with the addresses of the
+	// connection. For poll servers a deadline only applies to the Reads and
+	// Writes that start after it's set, unlike with net.Conn, where it
+	// unblocks them. It has a Context method that returns the context
+	// that the connection had when it was detached:
+	//	ctx := rwc.(interface{ Context() interface{} }).Context()
 	Detached func(c Conn, rwc io.ReadWriteCloser) (action Action)
+	// OnAcceptError fires when accepting a connection fails with a transient
+	// error, such as EMFILE or ENFILE when the process or system runs out of
+	// file descriptors, or ECONNABORTED. The server keeps running unless
+	// Shutdown is returned, and accepting pauses briefly when out of file
+	// descriptors.
+	OnAcceptError func(err error) (action Action)
+	// OnAcceptDecision fires for each accepted stream connection with the
+	// load balancing decision that placed it on a loop, before the Opened
+	// event, so that tests can assert the balancing and production can
+	// analyze it. It's called from the goroutines of different loops and
+	// listeners at once.
+	OnAcceptDecision func(d AcceptDecision)
+	// DrainBacklog, when set, makes a server that shuts down accept the
+	// connections that still wait in the accept queues of its listeners,
+	// which would otherwise be reset as the listeners close. Each one is
+	// passed to DrainBacklog, whose output, such as a short "server
+	// shutting down" response, is written before the connection is closed
+	// cleanly. The connections aren't on a loop, so the Opened and Closed
+	// events don't fire for them, and only the addresses, the ID and the
+	// context of the Conn are of use. It's ignored by servers on a Pool.
+	DrainBacklog func(c Conn) (out []byte)
+	// CloseFrame frames the close message of the application protocol that
+	// Conn.CloseWithReason sends to the peer. The websocket package
+	// provides CloseFrame, which frames a WebSocket close frame holding the
+	// code and the reason.
+	CloseFrame func(c Conn, code int, reason string) []byte
 	// PreWrite fires just before any data is written to any client socket.
 	PreWrite func()
+	// OnBufferFull fires when the connection's write buffer goes from empty
+	// to holding data that's waiting to be written.
+	OnBufferFull func(c Conn)
+	// OnBufferEmpty fires when all of the connection's buffered data has
+	// been written to the socket.
+	OnBufferEmpty func(c Conn)
+	// OnWriteHigh fires when the connection's buffered output reaches the
+	// high watermark set with Conn.SetWriteWatermarks.
+	OnWriteHigh func(c Conn)
+	// OnWriteLow fires when the buffered output of a connection that
+	// reached its high watermark drains to the low watermark.
+	OnWriteLow func(c Conn)
 	// Data fires when a connection sends the server data.
 	// The in parameter is the incoming data.
-	// Use the out return value to write data to the connection.
+	// Use the out return value to write data to the connection. It's
+	// appended to the output of earlier events that's still waiting to be
+	// written, such as when the socket was full. Earlier versions replaced
+	// that output with it, which dropped the part that wasn't written.
 	//events.Data 是数据处理回调函数，读到数据时会调用它，(c *conn) Wake()也会调用它,利用out返回值来注册写事件
 	Data func(c Conn, in []byte) (out []byte, action Action)
+	// Actions holds the handlers of the application's own actions, which
+	// are UserAction and above, such as a protocol's "upgrade". When the
+	// Opened or Data event of a stream connection returns one of them, its
+	// handler is called on the loop once the output of the event was
+	// written, and the connection then follows the built-in action that
+	// the handler returns. An action without a handler is ignored like
+	// None. Serve returns an error for a handler of a reserved action.
+	Actions map[Action]func(c Conn) Action
 	// Tick fires immediately after the server starts and will fire again
 	// following the duration specified by the delay return value.
 	Tick func() (delay time.Duration, action Action)
 }
 
+// Pool is a set of event loops that are shared by multiple servers. It lets
+// a process that hosts many small services run them on a fixed number of
+// goroutines rather than giving each server loops of its own. Servers are
+// added to a pool by setting Events.Pool.
+type Pool struct {
+	p *pool
+}
+
+// NewPool starts a pool with the provided number of loops. When numLoops is
+// less than zero it uses runtime.NumCPU loops.
+func NewPool(numLoops int) *Pool {
+	if numLoops <= 0 {
+		if numLoops == 0 {
+			numLoops = 1
+		} else {
+			numLoops = runtime.NumCPU()
+		}
+	}
+	return &Pool{p: newPool(numLoops)}
+}
+
+// Close stops the loops of the pool. Servers that are still running on the
+// pool are shut down.
+func (p *Pool) Close() {
+	p.p.close()
+}
+
 // Serve starts handling events for the specified addresses.
 //
 // Addresses should use a scheme prefix and be formatted
@@ -138,9 +1351,31 @@ type Events struct {
 //  udp4  - IPv4
 //  udp6  - IPv6
 //  unix  - Unix Domain Socket
+//  vsock - VM socket (AF_VSOCK) like `vsock://3:9851`, Linux only
 //
 // The "tcp" network scheme is assumed when one is not specified.
+//
+// An address that's passed more than once is an error, unless all of its
+// copies have the reuseport option, which binds a socket for each of them.
+// A UDP address with the reuseport option also binds a socket for each loop,
+// which only that loop reads, so the kernel keeps the datagrams of a flow
+// on one loop. Servers on a Pool and stdlib ("-net") servers share one
+// socket between the loops.
+//
+// The udpbuf option sets the size of the buffer that the datagrams of a UDP
+// listener are received into, like `udp://:9851?udpbuf=1500`. It defaults
+// to 65535 bytes, and the part of a datagram that doesn't fit is dropped.
+//
+// The backlog option sets the size of the accept queue of a stream
+// listener, like `tcp://:9851?backlog=128`. It defaults to the system's
+// limit, and it's ignored on platforms that can't change it.
 func Serve(events Events, addr ...string) error {
+	if err := checkDuplicateAddrs(addr); err != nil {
+		return err
+	}
+	if err := checkActions(events.Actions); err != nil {
+		return err
+	}
 	var lns []*listener
 	defer func() {
 		for _, ln := range lns {
@@ -148,51 +1383,214 @@ func Serve(events Events, addr ...string) error {
 		}
 	}()
 	var stdlib bool
-	for _, addr := range addr {
-		var ln listener
-		var stdlibt bool
-		ln.network, ln.addr, ln.opts, stdlibt = parseAddr(addr)
+	var failed error
+	listeners := make(map[int]ListenerConfig)
+	for i, addr := range addr {
+		ln, stdlibt, err := bindAddr(events, i, addr)
+		if events.OnBind != nil {
+			events.OnBind(addr, err)
+		}
+		if err != nil {
+			if !events.PartialBind {
+				return err
+			}
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		// the settings follow their listener when others are left out
+		if lc, ok := events.Listeners[i]; ok {
+			listeners[len(lns)] = lc
+		}
+		lns = append(lns, ln)
 		if stdlibt {
 			stdlib = true
 		}
-		if ln.network == "unix" {
-			os.RemoveAll(ln.addr)
-		}
-		var err error
-		if ln.network == "udp" {
-			if ln.opts.reusePort {
-				ln.pconn, err = reuseportListenPacket(ln.network, ln.addr)
-			} else {
-				ln.pconn, err = net.ListenPacket(ln.network, ln.addr)
+	}
+	if len(lns) == 0 && failed != nil {
+		return failed
+	}
+	events.Listeners = listeners
+	events = tlsEvents(events)
+	if stdlib {
+		for _, ln := range lns {
+			if ln.network == "vsock" {
+				return ErrUnsupported
 			}
-		} else {
-			if ln.opts.reusePort {
-				ln.ln, err = reuseportListen(ln.network, ln.addr)
-			} else {
-				ln.ln, err = net.Listen(ln.network, ln.addr)
+		}
+		return stdserve(events, lns)
+	}
+	for _, ln := range lns {
+		if ln.network != "vsock" {
+			if err := ln.system(); err != nil {
+				return err
 			}
 		}
-		if err != nil {
-			return err
+	}
+	return serve(events, lns)
+}
+
+// bindAddr creates the listener of the address that was passed to Serve at
+// idx, and reports whether it asked for a stdlib server.
+func bindAddr(events Events, idx int, addr string) (*listener, bool, error) {
+	ln := new(listener)
+	var stdlib bool
+	ln.network, ln.addr, ln.opts, stdlib = parseAddr(addr)
+	if ln.network == "unix" {
+		os.RemoveAll(ln.addr)
+	}
+	if ln.network == "vsock" {
+		if err := ln.listenVsock(); err != nil {
+			return nil, stdlib, err
 		}
-		if ln.pconn != nil {
-			ln.lnaddr = ln.pconn.LocalAddr()
+		if err := applyListenOptions(events.ListenOptions, ln.fd); err != nil {
+			ln.close()
+			return nil, stdlib, err
+		}
+		return ln, stdlib, nil
+	}
+	var err error
+	if ln.network == "udp" {
+		if ln.opts.reusePort {
+			ln.pconn, err = reuseportListenPacket(ln.network, ln.addr)
+		} else {
+			ln.pconn, err = net.ListenPacket(ln.network, ln.addr)
+		}
+	} else {
+		if ln.opts.reusePort {
+			ln.ln, err = reuseportListen(ln.network, ln.addr)
 		} else {
+			ln.ln, err = net.Listen(ln.network, ln.addr)
+		}
+	}
+	if err != nil {
+		return nil, stdlib, err
+	}
+	if ln.pconn != nil {
+		ln.lnaddr = ln.pconn.LocalAddr()
+	} else {
+		ln.lnaddr = ln.ln.Addr()
+	}
+	if err := ln.setOpts(events, idx); err != nil {
+		ln.close()
+		return nil, stdlib, err
+	}
+	return ln, stdlib, nil
+}
+
+// checkDuplicateAddrs returns an error for an address that's passed to Serve
+// more than once without the reuseport option.
+func checkDuplicateAddrs(addrs []string) error {
+	type key struct{ network, address string }
+	reusePort := make(map[key]bool)
+	for _, addr := range addrs {
+		network, address, opts, _ := parseAddr(addr)
+		k := key{network, address}
+		reuse, ok := reusePort[k]
+		if ok && !(reuse && opts.reusePort) {
+			return fmt.Errorf("duplicate listener address %s://%s", network, address)
+		}
+		reusePort[k] = opts.reusePort
+	}
+	return nil
+}
+
+// ServeFiles starts handling events for listening sockets that were inherited
+// as open files, such as the ones returned by Server.ListenerFiles and passed
+// to a re-executed process with exec.Cmd.ExtraFiles, where they're available
+// as os.NewFile(3+i). The files are closed once the listeners are created.
+//
+// Together with ListenerFiles this allows restarting a server without
+// dropping its listening sockets. The new process accepts on the same
+// sockets while the old one finishes its work and shuts down.
+func ServeFiles(events Events, files ...*os.File) error {
+	if err := checkActions(events.Actions); err != nil {
+		return err
+	}
+	events = tlsEvents(events)
+	var lns []*listener
+	defer func() {
+		for _, ln := range lns {
+			ln.close()
+		}
+	}()
+	for _, f := range files {
+		var ln listener
+		var err error
+		if ln.ln, err = net.FileListener(f); err == nil {
 			ln.lnaddr = ln.ln.Addr()
+		} else if ln.pconn, err = net.FilePacketConn(f); err == nil {
+			ln.lnaddr = ln.pconn.LocalAddr()
 		}
-		if !stdlib {
-			if err := ln.system(); err != nil {
-				return err
-			}
+		f.Close()
+		if err != nil {
+			return err
+		}
+		ln.network = ln.lnaddr.Network()
+		ln.addr = ln.lnaddr.String()
+		if err := ln.system(); err != nil {
+			return err
 		}
 		lns = append(lns, &ln)
 	}
-	if stdlib {
-		return stdserve(events, lns)
-	}
 	return serve(events, lns)
 }
 
+// errWatermarks is returned by Conn.SetWriteWatermarks for marks that are
+// out of order.
+var errWatermarks = errors.New("low watermark must be below the high watermark")
+
+// errPeekSize is returned by Conn.Peek for a negative size.
+var errPeekSize = errors.New("peek size must not be negative")
+
+// checkWatermarks validates the marks of Conn.SetWriteWatermarks.
+func checkWatermarks(low, high int) error {
+	if high != 0 && (low < 0 || low >= high) {
+		return errWatermarks
+	}
+	return nil
+}
+
+// ListenOption sets an option on the file descriptor of a socket, usually
+// with syscall.SetsockoptInt.
+type ListenOption func(fd int) error
+
+// applyListenOptions calls the options with the file descriptor and returns
+// the first error.
+func applyListenOptions(opts []ListenOption, fd int) error {
+	for _, opt := range opts {
+		if err := opt(fd); err != nil {
+			return fmt.Errorf("listen option: %w", err)
+		}
+	}
+	return nil
+}
+
+// EchoEvents returns events that write the input of each connection back to
+// it. They're meant for profiling the loops without writing a handler.
+func EchoEvents() Events {
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	return events
+}
+
+// BenchEvents returns events that discard the input and reply to each Data
+// event with out, which may be nil to only read. They're meant for
+// profiling the loops without writing a handler.
+func BenchEvents(out []byte) Events {
+	var events Events
+	events.Data = func(c Conn, in []byte) ([]byte, Action) {
+		if in == nil {
+			return nil, None
+		}
+		return out, None
+	}
+	return events
+}
+
 // InputStream is a helper type for managing input streams from inside
 // the Data event.
 type InputStream struct{ b []byte }
@@ -219,6 +1617,406 @@ func (is *InputStream) End(data []byte) {
 	}
 }
 
+// ErrBufferFull is returned by InBuffer.Append when the input would grow
+// past the buffer's limit.
+var ErrBufferFull = errors.New("input buffer full")
+
+// inBufferKeep is the capacity up to which an InBuffer keeps its memory once
+// all of its input was consumed.
+const inBufferKeep = 64 << 10
+
+// InBuffer is a helper type for assembling the frames of a connection
+// across Data events, and it's meant to be kept in the connection's
+// context. The input is appended at the end and consumed from the front,
+// and the space of the consumed input is reused. The limit protects the
+// server from a peer that sends a frame that never completes.
+type InBuffer struct {
+	buf []byte
+	off int // start of the input that wasn't consumed
+	max int
+
+	limit   *InboundLimit // counts the input of the server, set by Track
+	c       Conn          // woken when the buffer is shed
+	counted int           // input counted by the limit, guarded by its mutex
+	pos     int           // position in the heap of the limit plus one, guarded by its mutex
+	shed    int32         // 1: reset by the limit
+}
+
+// NewInBuffer returns a buffer that holds up to max bytes of input. Zero
+// means no limit.
+func NewInBuffer(max int) *InBuffer {
+	return &InBuffer{max: max}
+}
+
+// Track counts the input of the buffer, which belongs to the connection,
+// against the server-wide limit. It must be called from an event. A
+// connection has one tracked buffer, and tracking another one stops
+// counting the first.
+func (b *InBuffer) Track(limit *InboundLimit, c Conn) {
+	b.limit, b.c = limit, c
+	if ic, ok := c.(inboundConn); ok {
+		if old := ic.trackInBuffer(b); old != nil && old != b {
+			old.limit.release(old)
+		}
+	}
+	b.limit.set(b, b.Len())
+}
+
+// Append adds the input to the end of the buffer. It returns ErrBufferFull
+// and adds nothing when the buffer would hold more than its limit, after
+// which the connection is usually closed. It also returns ErrBufferFull
+// once, with the buffer reset, when the buffer was shed by the limit that
+// tracks it.
+func (b *InBuffer) Append(in []byte) error {
+	if b.limit != nil && atomic.CompareAndSwapInt32(&b.shed, 1, 0) {
+		b.Reset()
+		return ErrBufferFull
+	}
+	if b.max > 0 && b.Len()+len(in) > b.max {
+		return ErrBufferFull
+	}
+	if b.limit != nil && len(in) > 0 {
+		b.limit.set(b, b.Len()+len(in))
+		if atomic.CompareAndSwapInt32(&b.shed, 1, 0) {
+			b.Reset()
+			return ErrBufferFull
+		}
+	}
+	if b.off > 0 && len(b.buf)+len(in) > cap(b.buf) {
+		// move the input to the front rather than growing
+		n := copy(b.buf, b.buf[b.off:])
+		b.buf, b.off = b.buf[:n], 0
+	}
+	b.buf = append(b.buf, in...)
+	return nil
+}
+
+// Bytes returns the input that wasn't consumed. It's valid until the next
+// call to Append, Consume or Reset.
+func (b *InBuffer) Bytes() []byte {
+	return b.buf[b.off:]
+}
+
+// Len returns the number of bytes that weren't consumed.
+func (b *InBuffer) Len() int {
+	return len(b.buf) - b.off
+}
+
+// Consume drops the first n bytes of the input, such as a frame that was
+// handled. It panics if n is more than Len.
+func (b *InBuffer) Consume(n int) {
+	if n < 0 || n > b.Len() {
+		panic("evio: InBuffer.Consume out of range")
+	}
+	b.off += n
+	if b.off == len(b.buf) {
+		b.Reset()
+	} else if b.limit != nil {
+		b.limit.set(b, b.Len())
+	}
+}
+
+// Reset drops all of the input. Large buffers are released.
+func (b *InBuffer) Reset() {
+	if cap(b.buf) > inBufferKeep {
+		b.buf = nil
+	} else {
+		b.buf = b.buf[:0]
+	}
+	b.off = 0
+	if b.limit != nil {
+		b.limit.set(b, 0)
+	}
+}
+
+// InPlace is a helper type for parsing the input of a connection in place,
+// and it's meant to be kept in the connection's context. It's like
+// InputStream, but the ownership of the input is explicit. The slice that
+// Begin returns is borrowed from the loop when nothing was left over, so
+// with ReuseInputBuffer it's only valid until End. The tail that End is
+// given is the only part that's kept for the next read, and it's copied
+// out of the loop's buffer only when it was borrowed.
+//
+// The rules are that Begin and End are called in pairs, that End is given
+// the tail of the slice that Begin returned, and that no slice of the input
+// is kept past End. Builds with the evio_debug tag panic when the first two
+// are broken, and overwrite the released input so the third shows up.
+type InPlace struct {
+	buf    []byte // input left over from earlier reads, owned by the helper
+	data   []byte // input returned by Begin, tracked in debug builds
+	active bool   // Begin was called without End
+}
+
+// Begin accepts the input of a Data event and returns the bytes to parse,
+// which is the input itself when nothing was left over.
+func (p *InPlace) Begin(in []byte) []byte {
+	if debugInput && p.active {
+		panic("evio: InPlace.Begin called twice without End")
+	}
+	p.active = true
+	data := in
+	if len(p.buf) > 0 {
+		p.buf = append(p.buf, in...)
+		data = p.buf
+	}
+	if debugInput {
+		p.data = data
+	}
+	return data
+}
+
+// Borrowed reports whether the bytes returned by Begin are the loop's own
+// input rather than the helper's buffer.
+func (p *InPlace) Borrowed() bool {
+	return p.active && len(p.buf) == 0
+}
+
+// End keeps rest, which is the unparsed tail of the bytes returned by
+// Begin, for the next read. Any other slice of the input must not be used
+// after End.
+func (p *InPlace) End(rest []byte) {
+	if debugInput {
+		if !p.active {
+			panic("evio: InPlace.End called without Begin")
+		}
+		if !isTail(p.data, rest) {
+			panic("evio: InPlace.End was passed a slice that isn't the tail of the input")
+		}
+		p.data = nil
+	}
+	p.active = false
+	switch {
+	case len(p.buf) == 0:
+		// the input was borrowed
+		if len(rest) > 0 {
+			p.buf = append(p.buf, rest...)
+		}
+	case len(rest) < len(p.buf):
+		n := copy(p.buf, rest)
+		poison(p.buf[n:])
+		if n == 0 && cap(p.buf) > inBufferKeep {
+			p.buf = nil
+		} else {
+			p.buf = p.buf[:n]
+		}
+	}
+}
+
+// Len returns the number of bytes kept for the next read.
+func (p *InPlace) Len() int {
+	return len(p.buf)
+}
+
+// isTail reports whether rest is a tail of data, sharing its memory.
+func isTail(data, rest []byte) bool {
+	if len(rest) == 0 {
+		return true
+	}
+	if len(rest) > len(data) {
+		return false
+	}
+	return &data[len(data)-len(rest)] == &rest[0]
+}
+
+// Stream is a helper type that bridges a connection to io.Reader and
+// io.Writer for a worker goroutine, so that stdlib codecs such as
+// json.Decoder and bufio can be used on it, and it's meant to be kept in
+// the connection's context. The loop passes the input of the Data event to
+// Feed and returns what Flush returns from the event. The worker reads
+// with Read, which blocks until there's input, and writes with Write,
+// which queues the output and wakes the connection so that the loop
+// writes it. The reads of the connection are paused while the worker is
+// behind by the read watermark. The methods are safe for concurrent use,
+// but Read and Write must not be called from an event, since they may
+// block the loop.
+type Stream struct {
+	c      Conn
+	mu     sync.Mutex
+	cond   sync.Cond
+	in     []byte
+	out    []byte
+	high   int           // read watermark
+	resume chan struct{} // closed to resume the reads, nil unless paused
+	woken  bool          // a wake is pending for the output
+	done   bool          // the worker is finished
+	closed bool          // the connection closed
+}
+
+// defaultStreamWatermark is the read watermark of a new Stream.
+const defaultStreamWatermark = 1 << 20
+
+// NewStream returns a stream for the connection.
+func NewStream(c Conn) *Stream {
+	s := &Stream{c: c, high: defaultStreamWatermark}
+	s.cond.L = &s.mu
+	return s
+}
+
+// SetReadWatermark sets the input that the worker may leave unread before
+// Feed pauses the reads of the connection with SuspendUntil, which resume
+// once Read takes the input below it. It's 1MB by default, and zero means
+// no limit.
+func (s *Stream) SetReadWatermark(high int) {
+	s.mu.Lock()
+	s.high = high
+	s.resumeLocked()
+	s.mu.Unlock()
+}
+
+// Feed adds the input of a Data event for the worker to read. The input is
+// copied, so it may be the loop's reused buffer. It must be called from the
+// Data event, since it may pause the reads.
+func (s *Stream) Feed(in []byte) {
+	if len(in) == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.in = append(s.in, in...)
+	s.cond.Broadcast()
+	var resume chan struct{}
+	if s.high > 0 && len(s.in) >= s.high && s.resume == nil && !s.closed {
+		s.resume = make(chan struct{})
+		resume = s.resume
+	}
+	s.mu.Unlock()
+	if resume != nil {
+		s.c.SuspendUntil(resume)
+	}
+}
+
+// resumeLocked resumes the reads once the unread input is below the
+// watermark.
+func (s *Stream) resumeLocked() {
+	if s.resume != nil && (s.high <= 0 || len(s.in) < s.high || s.closed) {
+		close(s.resume)
+		s.resume = nil
+	}
+}
+
+// Flush returns the output that the worker wrote, for the Data event to
+// return. The action is Close once the worker called Done and all of its
+// output was flushed.
+func (s *Stream) Flush() (out []byte, action Action) {
+	s.mu.Lock()
+	out, s.out, s.woken = s.out, nil, false
+	if s.done {
+		action = Close
+	}
+	s.mu.Unlock()
+	return out, action
+}
+
+// Close ends the stream when the connection closed, such as from the
+// Closed event. Read returns io.EOF once the input was read, and Write
+// returns io.ErrClosedPipe.
+func (s *Stream) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.resumeLocked()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Done tells the loop that the worker is finished, and the connection is
+// closed once the output was written.
+func (s *Stream) Done() {
+	s.mu.Lock()
+	s.done = true
+	s.mu.Unlock()
+	s.wake()
+}
+
+// Read reads the input that was fed to the stream, and blocks until there
+// is some or the stream is closed.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.in) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if len(s.in) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, s.in)
+	s.in = s.in[:copy(s.in, s.in[n:])]
+	s.resumeLocked()
+	return n, nil
+}
+
+// Write queues the output and wakes the connection to write it. Once the
+// output is queued it's written, so a wake that fails, such as with
+// ErrQueueFull, isn't an error: the output is written by the next Data
+// event, or by the wake of the next Write.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	s.out = append(s.out, p...)
+	s.mu.Unlock()
+	s.wake()
+	return len(p), nil
+}
+
+// wake wakes the connection unless a wake is already pending.
+func (s *Stream) wake() error {
+	s.mu.Lock()
+	if s.woken || s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.woken = true
+	s.mu.Unlock()
+	if err := s.c.Wake(); err != nil {
+		s.mu.Lock()
+		s.woken = false
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Pending is a helper type for correlating the requests that are pushed
+// to a connection, such as from a Wake, with the responses that come back,
+// and it's meant to be kept in the connection's context. A handler that
+// sends a request registers what to do with the response, and the Data
+// event passes the next input to it.
+type Pending struct {
+	fns []func(c Conn, in []byte) (out []byte, action Action)
+}
+
+// Expect registers fn to handle the input of a response. The handlers are
+// called in the order they were registered, one for each input that's
+// passed to Next.
+func (p *Pending) Expect(fn func(c Conn, in []byte) (out []byte, action Action)) {
+	p.fns = append(p.fns, fn)
+}
+
+// Len returns the number of handlers that are waiting for a response.
+func (p *Pending) Len() int {
+	return len(p.fns)
+}
+
+// Next passes the input to the oldest waiting handler, which is removed,
+// and returns what it returned. It returns false when no handler is
+// waiting, so the input is handled as usual.
+func (p *Pending) Next(c Conn, in []byte) (out []byte, action Action, ok bool) {
+	if len(p.fns) == 0 {
+		return nil, None, false
+	}
+	fn := p.fns[0]
+	p.fns[0] = nil
+	p.fns = p.fns[1:]
+	out, action = fn(c, in)
+	return out, action, true
+}
+
+// Reset drops the waiting handlers, such as when the connection closes.
+func (p *Pending) Reset() {
+	p.fns = nil
+}
+
 type listener struct {
 	ln      net.Listener
 	lnaddr  net.Addr
@@ -228,10 +2026,315 @@ type listener struct {
 	fd      int
 	network string
 	addr    string
+	handoff bool // listener was handed to another server
+	gro     bool // UDP_GRO is enabled
+	perLoop bool // UDP reuseport listener with a socket for each loop
+}
+
+// udpBufSize returns the size of the buffer that the datagrams of the
+// listener are received into.
+func (ln *listener) udpBufSize() int {
+	if ln.opts.udpBuf > 0 {
+		return ln.opts.udpBuf
+	}
+	return udpBufSize
+}
+
+// udpBufSize is the default size of the UDP receive buffer.
+const udpBufSize = 0xFFFF
+
+// file returns a duplicate of the listening socket. The listener no longer
+// removes its unix socket file when closed, because it may be in use by the
+// receiver of the file.
+func (ln *listener) file() (*os.File, error) {
+	var f *os.File
+	var err error
+	switch netln := ln.ln.(type) {
+	case nil:
+		switch pconn := ln.pconn.(type) {
+		case *net.UDPConn:
+			f, err = pconn.File()
+		default:
+			err = errors.New("listener does not support files")
+		}
+	case *net.TCPListener:
+		f, err = netln.File()
+	case *net.UnixListener:
+		netln.SetUnlinkOnClose(false)
+		f, err = netln.File()
+	default:
+		err = errors.New("listener does not support files")
+	}
+	if err != nil {
+		return nil, err
+	}
+	ln.handoff = true
+	return f, nil
+}
+
+// VsockAddr is the address of a VM socket (AF_VSOCK) endpoint.
+type VsockAddr struct {
+	CID  uint32 // context id of the VM, 2 is the host
+	Port uint32
+}
+
+func (a *VsockAddr) Network() string { return "vsock" }
+func (a *VsockAddr) String() string {
+	return strconv.FormatUint(uint64(a.CID), 10) + ":" + strconv.FormatUint(uint64(a.Port), 10)
+}
+
+// parseVsockAddr parses a "cid:port" address. The cid may be "any".
+func parseVsockAddr(addr string) (*VsockAddr, error) {
+	i := strings.LastIndexByte(addr, ':')
+	if i == -1 {
+		return nil, errors.New("missing port in vsock address " + addr)
+	}
+	var a VsockAddr
+	if addr[:i] == "any" {
+		a.CID = 0xFFFFFFFF // VMADDR_CID_ANY
+	} else {
+		cid, err := strconv.ParseUint(addr[:i], 10, 32)
+		if err != nil {
+			return nil, errors.New("invalid cid in vsock address " + addr)
+		}
+		a.CID = uint32(cid)
+	}
+	port, err := strconv.ParseUint(addr[i+1:], 10, 32)
+	if err != nil {
+		return nil, errors.New("invalid port in vsock address " + addr)
+	}
+	a.Port = uint32(port)
+	return &a, nil
+}
+
+// listenVsock creates the listener of a vsock address, which the net
+// package doesn't support.
+func (ln *listener) listenVsock() error {
+	addr, err := parseVsockAddr(ln.addr)
+	if err != nil {
+		return err
+	}
+	ln.fd, err = internal.VsockListen(addr.CID, addr.Port)
+	if err != nil {
+		return err
+	}
+	if addr.CID, addr.Port, err = internal.VsockName(ln.fd); err != nil {
+		ln.close()
+		return err
+	}
+	ln.lnaddr = addr
+	return nil
+}
+
+// errNoReusePort is returned for reuseport steering on a listener without
+// the reuseport address option.
+var errNoReusePort = errors.New("reuseport steering needs the reuseport option")
+
+// setOpts applies the socket options from the address and from the config
+// of the listener at idx, and then the listen options, to the listener.
+func (ln *listener) setOpts(events Events, idx int) error {
+	if ln.opts.backlog > 0 && ln.ln != nil {
+		if err := ln.control(func(fd int) error {
+			return internal.SetBacklog(fd, ln.opts.backlog)
+		}); err != nil && err != syscall.ENOPROTOOPT {
+			return err
+		}
+	}
+	if ln.opts.mark != 0 {
+		if err := ln.control(func(fd int) error {
+			return internal.SetMark(fd, ln.opts.mark)
+		}); err != nil {
+			return err
+		}
+	}
+	lc := events.Listeners[idx]
+	if lc.ReusePortCPU || lc.ReusePortProgram != 0 {
+		if !ln.opts.reusePort {
+			return errNoReusePort
+		}
+		if err := ln.control(func(fd int) error {
+			if lc.ReusePortProgram != 0 {
+				return internal.AttachReuseportEBPF(fd, lc.ReusePortProgram)
+			}
+			return internal.AttachReuseportCPU(fd)
+		}); err != nil {
+			return err
+		}
+	}
+	if len(events.ListenOptions) > 0 {
+		return ln.control(func(fd int) error {
+			return applyListenOptions(events.ListenOptions, fd)
+		})
+	}
+	return nil
+}
+
+// control calls fn with the file descriptor of the listening socket.
+func (ln *listener) control(fn func(fd int) error) error {
+	if ln.pconn != nil {
+		return sysControl(ln.pconn, fn)
+	}
+	return sysControl(ln.ln, fn)
+}
+
+// acceptPause is how long accepting pauses when out of file descriptors.
+const acceptPause = time.Millisecond * 100
+
+// transientAcceptError reports whether the accept error shouldn't stop the
+// server, and whether accepting should pause for a while.
+func transientAcceptError(err error) (transient, pause bool) {
+	switch {
+	case errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE),
+		err == ErrFDHeadroom:
+		return true, true
+	case errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.ENOBUFS),
+		errors.Is(err, syscall.ENOMEM):
+		return true, false
+	}
+	return false, false
+}
+
+// fdCounts returns the process's limit of open file descriptors and the
+// number that are open. It's a variable so that tests can lower the limit.
+var fdCounts = func() (limit, open int, err error) {
+	if limit, err = internal.FDLimit(); err != nil {
+		return 0, 0, err
+	}
+	open, err = internal.OpenFDs()
+	return limit, open, err
+}
+
+// fdGuard counts the open connections of a server for Events.FDHeadroom.
+// A nil guard allows everything.
+type fdGuard struct {
+	max  int32 // connections that fit above the headroom
+	open int32 // connections that were accepted and not closed
+}
+
+func newFDGuard(headroom int) *fdGuard {
+	if headroom <= 0 {
+		return nil
+	}
+	limit, open, err := fdCounts()
+	if err != nil {
+		return nil
+	}
+	max := limit - open - headroom
+	if max < 0 {
+		max = 0
+	}
+	return &fdGuard{max: int32(max)}
+}
+
+// full reports whether accepting must pause.
+func (g *fdGuard) full() bool {
+	return g != nil && atomic.LoadInt32(&g.open) >= g.max
+}
+
+// acquire counts an accepted connection.
+func (g *fdGuard) acquire() {
+	if g != nil {
+		atomic.AddInt32(&g.open, 1)
+	}
+}
+
+// release uncounts a connection that was closed or detached.
+func (g *fdGuard) release() {
+	if g != nil {
+		atomic.AddInt32(&g.open, -1)
+	}
+}
+
+// ipLimit counts the open connections per source IP for
+// Events.MaxConnsPerIP. A nil limit allows everything.
+type ipLimit struct {
+	mu     sync.Mutex
+	max    int
+	counts map[string]int
+}
+
+func newIPLimit(max int) *ipLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &ipLimit{max: max, counts: make(map[string]int)}
+}
+
+// acquire counts a connection from the ip, unless the ip is at the limit.
+// Connections without an ip, such as unix sockets, aren't limited.
+func (lim *ipLimit) acquire(ip string) bool {
+	if lim == nil || ip == "" {
+		return true
+	}
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	if lim.counts[ip] >= lim.max {
+		return false
+	}
+	lim.counts[ip]++
+	return true
+}
+
+// release uncounts a connection that was acquired.
+func (lim *ipLimit) release(ip string) {
+	if lim == nil || ip == "" {
+		return
+	}
+	lim.mu.Lock()
+	if lim.counts[ip]--; lim.counts[ip] <= 0 {
+		delete(lim.counts, ip)
+	}
+	lim.mu.Unlock()
+}
+
+// trustedIP reports whether the ip is in one of the trusted networks.
+func trustedIP(nets []*net.IPNet, ip string) bool {
+	if len(nets) == 0 || ip == "" {
+		return false
+	}
+	addr := net.ParseIP(ip)
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of a tcp address. IPv4-mapped IPv6 addresses are
+// returned in their IPv4 form so that both map to the same count.
+func addrIP(addr net.Addr) string {
+	if addr, ok := addr.(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// sysControl calls fn with the file descriptor of a net package connection
+// or listener.
+func sysControl(v interface{}, fn func(fd int) error) error {
+	sc, ok := v.(syscall.Conn)
+	if !ok {
+		return errors.New("socket has no file descriptor")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) {
+		ferr = fn(int(fd))
+	}); err != nil {
+		return err
+	}
+	return ferr
 }
 
 type addrOpts struct {
 	reusePort bool
+	mark      int // SO_MARK
+	udpBuf    int // size of the UDP receive buffer
+	backlog   int // size of the accept queue
 }
 
 func parseAddr(addr string) (network, address string, opts addrOpts, stdlib bool) {
@@ -261,6 +2364,12 @@ func parseAddr(addr string) (network, address string, opts addrOpts, stdlib bool
 							opts.reusePort = true
 						}
 					}
+				case "mark":
+					opts.mark, _ = strconv.Atoi(kv[1])
+				case "udpbuf":
+					opts.udpBuf, _ = strconv.Atoi(kv[1])
+				case "backlog":
+					opts.backlog, _ = strconv.Atoi(kv[1])
 				}
 			}
 		}
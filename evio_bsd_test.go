@@ -0,0 +1,111 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package evio
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jursonmo/evio/internal"
+)
+
+func TestKqueueTimer(t *testing.T) {
+	p := internal.OpenPoll()
+	defer p.Close()
+	errDone := errors.New("done")
+	var fired []int
+	start := time.Now()
+	var elapsed time.Duration
+	p.Trigger("start")
+	err := p.Wait(func(fd int, note interface{}) error {
+		switch note {
+		case "start":
+			p.AfterFunc(20*time.Millisecond, func() { fired = append(fired, 1) })
+			p.AfterFunc(30*time.Millisecond, func() { fired = append(fired, 2) }).Stop()
+			p.AfterFunc(60*time.Millisecond, func() {
+				fired = append(fired, 3)
+				elapsed = time.Since(start)
+				p.Trigger("done")
+			})
+		case "done":
+			return errDone
+		}
+		return nil
+	})
+	if err != errDone {
+		t.Fatal(err)
+	}
+	if len(fired) != 2 || fired[0] != 1 || fired[1] != 3 {
+		t.Fatalf("expected timers 1 and 3 to fire, got %v", fired)
+	}
+	if elapsed < 60*time.Millisecond {
+		t.Fatalf("expected the last timer to fire after 60ms, fired after %v", elapsed)
+	}
+}
+
+// BenchmarkWake compares the wake throughput of the kqueue EVFILT_USER
+// trigger with a self-pipe.
+func BenchmarkWake(b *testing.B) {
+	b.Run("user", func(b *testing.B) {
+		p := internal.OpenPoll()
+		defer p.Close()
+		errDone := errors.New("done")
+		done := make(chan struct{})
+		go func() {
+			var n int
+			p.Wait(func(fd int, note interface{}) error {
+				if n++; n == b.N {
+					return errDone
+				}
+				return nil
+			})
+			close(done)
+		}()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			p.Trigger(nil)
+		}
+		<-done
+	})
+	b.Run("pipe", func(b *testing.B) {
+		var fds [2]int
+		if err := syscall.Pipe(fds[:]); err != nil {
+			b.Fatal(err)
+		}
+		defer syscall.Close(fds[0])
+		defer syscall.Close(fds[1])
+		kq, err := syscall.Kqueue()
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer syscall.Close(kq)
+		changes := []syscall.Kevent_t{{
+			Ident: uint64(fds[0]), Flags: syscall.EV_ADD, Filter: syscall.EVFILT_READ,
+		}}
+		done := make(chan struct{})
+		go func() {
+			events := make([]syscall.Kevent_t, 1)
+			buf := make([]byte, 4096)
+			for n := 0; n < b.N; {
+				if _, err := syscall.Kevent(kq, changes, events, nil); err != nil {
+					continue
+				}
+				changes = nil
+				m, _ := syscall.Read(fds[0], buf)
+				n += m
+			}
+			close(done)
+		}()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			syscall.Write(fds[1], []byte{0})
+		}
+		<-done
+	})
+}
@@ -0,0 +1,334 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// errPoolNotServing is returned by ConnPool.Get when the server of the
+// pool's events isn't serving.
+var errPoolNotServing = errors.New("connection pool has no server")
+
+// defaultPoolDialTimeout limits dialing when ConnPool.DialTimeout is zero.
+const defaultPoolDialTimeout = 30 * time.Second
+
+// ConnPool keeps outbound connections for reuse by their destination, for
+// proxies and clients. The connections are dialed and attached to a server
+// with Server.Attach, so they're handled by the loops like any other
+// connection and the events see the input that the peer sends while they
+// sit in the pool, such as keepalives. The pool wraps the events of the
+// server with Events. A pooled connection is taken with Get and given back
+// with Put once the exchange on it is done. The timers of the pool run on
+// the Clock of the events.
+type ConnPool struct {
+	// Dial dials a destination. A net.Dialer with DialTimeout is used when
+	// it's nil.
+	Dial func(network, addr string) (net.Conn, error)
+	// DialTimeout limits dialing and attaching a connection. Zero means 30
+	// seconds.
+	DialTimeout time.Duration
+	// MaxIdle is the number of idle connections that are kept for each
+	// destination. Zero means 2.
+	MaxIdle int
+	// IdleTimeout closes connections that were idle for longer. Zero
+	// means no limit.
+	IdleTimeout time.Duration
+	// MaxLifetime closes connections that were dialed longer ago, once
+	// they're put back. Zero means no limit.
+	MaxLifetime time.Duration
+	// Check is called before an idle connection is handed out by Get, and
+	// the connection is closed and another one is taken when it returns
+	// false. It's called from the goroutine that calls Get, so it must
+	// only use the Conn methods that are safe outside of the events.
+	Check func(c Conn) bool
+
+	mu      sync.Mutex
+	srv     Server
+	serving bool
+	clock   Clock
+	idle    map[string][]*pooledConn // destination -> idle connections
+	conns   map[Conn]*pooledConn     // all of the open connections
+	pending map[string]*pooledConn   // local address -> dialed connection
+}
+
+// pooledConn is a connection of a ConnPool.
+type pooledConn struct {
+	c       Conn
+	key     string        // destination
+	created time.Time     // when it was dialed
+	ready   chan struct{} // closed by the Opened event
+	idle    bool          // it's in the idle list
+	closing bool          // the next Data event closes it
+	dropped bool          // Get gave up on it, so the Opened event closes it
+	timer   ClockTimer    // idle timeout
+}
+
+// Events returns the events with the pool's handling of its connections
+// added. The Serving event hands the server to the pool, which stops
+// dialing once the server stops.
+func (p *ConnPool) Events(events Events) Events {
+	p.mu.Lock()
+	p.clock = eventsClock(events)
+	p.mu.Unlock()
+	serving, opened, data, closed := events.Serving, events.Opened, events.Data, events.Closed
+	events.Serving = func(s Server) (action Action) {
+		p.mu.Lock()
+		p.srv, p.serving = s, true
+		p.mu.Unlock()
+		if s.done != nil {
+			go p.stop(s.done)
+		}
+		if serving != nil {
+			action = serving(s)
+		}
+		return action
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		var dropped bool
+		if c.AddrIndex() == -1 && c.LocalAddr() != nil {
+			p.mu.Lock()
+			key := c.LocalAddr().String()
+			if pc := p.pending[key]; pc != nil {
+				delete(p.pending, key)
+				if dropped = pc.dropped; !dropped {
+					pc.c = c
+					p.conns[c] = pc
+					close(pc.ready)
+				}
+			}
+			p.mu.Unlock()
+		}
+		if opened != nil {
+			out, opts, action = opened(c)
+		}
+		if dropped {
+			// nobody owns the connection
+			return nil, opts, Close
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if c.AddrIndex() == -1 {
+			p.mu.Lock()
+			pc := p.conns[c]
+			closing := pc != nil && pc.closing
+			p.mu.Unlock()
+			if closing {
+				return nil, Close
+			}
+		}
+		if data != nil {
+			return data(c, in)
+		}
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if c.AddrIndex() == -1 {
+			p.mu.Lock()
+			if pc := p.conns[c]; pc != nil {
+				delete(p.conns, c)
+				p.removeIdle(pc)
+			}
+			p.mu.Unlock()
+		}
+		if closed != nil {
+			return closed(c, err)
+		}
+		return
+	}
+	return events
+}
+
+// Get returns an idle connection to the destination, or dials a new one
+// and waits for its Opened event.
+func (p *ConnPool) Get(network, addr string) (Conn, error) {
+	key := network + "://" + addr
+	for {
+		p.mu.Lock()
+		if !p.serving {
+			p.mu.Unlock()
+			return nil, errPoolNotServing
+		}
+		idle := p.idle[key]
+		if len(idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		pc := idle[len(idle)-1]
+		p.removeIdle(pc)
+		if p.MaxLifetime > 0 && p.clock.Now().Sub(pc.created) >= p.MaxLifetime {
+			p.closeLocked(pc)
+			p.mu.Unlock()
+			continue
+		}
+		p.mu.Unlock()
+		if p.Check == nil || p.Check(pc.c) {
+			return pc.c, nil
+		}
+		p.mu.Lock()
+		p.closeLocked(pc)
+		p.mu.Unlock()
+	}
+	return p.dial(network, addr, key)
+}
+
+// dial dials a new connection and attaches it to the server.
+func (p *ConnPool) dial(network, addr, key string) (Conn, error) {
+	timeout := p.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultPoolDialTimeout
+	}
+	dial := p.Dial
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: timeout}).Dial
+	}
+	nc, err := dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	local := nc.LocalAddr().String()
+	p.mu.Lock()
+	if !p.serving {
+		p.mu.Unlock()
+		nc.Close()
+		return nil, errPoolNotServing
+	}
+	pc := &pooledConn{key: key, created: p.clock.Now(), ready: make(chan struct{})}
+	p.init()
+	p.pending[local] = pc
+	srv, clock := p.srv, p.clock
+	p.mu.Unlock()
+	if err = srv.Attach(nc); err != nil {
+		p.mu.Lock()
+		if p.pending[local] == pc {
+			delete(p.pending, local)
+		}
+		p.mu.Unlock()
+		return nil, err
+	}
+	expired := make(chan struct{})
+	timer := clock.AfterFunc(timeout, func() { close(expired) })
+	defer timer.Stop()
+	select {
+	case <-pc.ready:
+		return pc.c, nil
+	case <-expired:
+		err = errors.New("timed out attaching the connection")
+	case <-srv.done:
+		err = errPoolNotServing
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc.c != nil {
+		// opened as it timed out
+		return pc.c, nil
+	}
+	// the connection is attached, so it's left for the Opened event to
+	// close rather than dropped
+	pc.dropped = true
+	return nil, err
+}
+
+// Put gives a connection that was taken with Get back to the pool. It's
+// closed instead when its destination has MaxIdle idle connections or
+// it's past MaxLifetime.
+func (p *ConnPool) Put(c Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc := p.conns[c]
+	if pc == nil || pc.idle || pc.closing {
+		return
+	}
+	max := p.MaxIdle
+	if max <= 0 {
+		max = 2
+	}
+	if len(p.idle[pc.key]) >= max ||
+		(p.MaxLifetime > 0 && p.clock.Now().Sub(pc.created) >= p.MaxLifetime) {
+		p.closeLocked(pc)
+		return
+	}
+	pc.idle = true
+	p.idle[pc.key] = append(p.idle[pc.key], pc)
+	if p.IdleTimeout > 0 {
+		pc.timer = p.clock.AfterFunc(p.IdleTimeout, func() {
+			p.mu.Lock()
+			if pc.idle {
+				p.removeIdle(pc)
+				p.closeLocked(pc)
+			}
+			p.mu.Unlock()
+		})
+	}
+}
+
+// Idle returns the number of idle connections to the destination.
+func (p *ConnPool) Idle(network, addr string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle[network+"://"+addr])
+}
+
+// stop stops the pool once the server stops. The connections were closed
+// by the server, so they're forgotten.
+func (p *ConnPool) stop(done <-chan struct{}) {
+	<-done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.srv, p.serving = Server{}, false
+	for _, idle := range p.idle {
+		for _, pc := range idle {
+			if pc.timer != nil {
+				pc.timer.Stop()
+			}
+		}
+	}
+	p.idle, p.conns, p.pending = nil, nil, nil
+}
+
+// init creates the maps of the pool.
+func (p *ConnPool) init() {
+	if p.conns == nil {
+		p.idle = make(map[string][]*pooledConn)
+		p.conns = make(map[Conn]*pooledConn)
+		p.pending = make(map[string]*pooledConn)
+	}
+}
+
+// removeIdle takes a connection out of the idle list.
+func (p *ConnPool) removeIdle(pc *pooledConn) {
+	if !pc.idle {
+		return
+	}
+	pc.idle = false
+	if pc.timer != nil {
+		pc.timer.Stop()
+		pc.timer = nil
+	}
+	idle := p.idle[pc.key]
+	for i := range idle {
+		if idle[i] == pc {
+			idle = append(idle[:i], idle[i+1:]...)
+			break
+		}
+	}
+	if len(idle) == 0 {
+		delete(p.idle, pc.key)
+	} else {
+		p.idle[pc.key] = idle
+	}
+}
+
+// closeLocked closes a connection from its loop by waking it. The wake is
+// sent apart, since Put may be called from an event and stdlib loops
+// receive their wakes on a channel.
+func (p *ConnPool) closeLocked(pc *pooledConn) {
+	pc.closing = true
+	go pc.c.Wake()
+}
@@ -0,0 +1,12 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build evio_debug
+
+package evio
+
+func init() {
+	debugInput = true
+	poisonInput = true
+}
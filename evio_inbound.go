@@ -0,0 +1,108 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+)
+
+// InboundLimit caps the input that the InBuffers of a server's connections
+// hold in total, so that many peers that each send part of a frame and then
+// stall can't run the server out of memory. A buffer is counted once it's
+// tracked with InBuffer.Track, and the limit is passed to the server with
+// Events.InboundLimit, which stops counting the buffer of a connection when
+// it closes. When the input would go over the limit, the load is shed from
+// the largest buffers: they're reset and their next Append returns
+// ErrBufferFull, after which the connection is usually closed. The other
+// connections that are shed are woken, so that a peer that stalls is shed
+// too, which means that the Data event should Append the nil input of a
+// wake like any other.
+type InboundLimit struct {
+	mu   sync.Mutex
+	max  int
+	used int
+	bufs inboundHeap // buffers that hold input, the largest first
+}
+
+// NewInboundLimit returns a limit of max bytes.
+func NewInboundLimit(max int) *InboundLimit {
+	return &InboundLimit{max: max}
+}
+
+// Used returns the number of bytes that the tracked buffers hold.
+func (l *InboundLimit) Used() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used
+}
+
+// set records that the buffer holds n bytes, and sheds the largest buffers
+// while the total is over the limit.
+func (l *InboundLimit) set(b *InBuffer, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used += n - b.counted
+	b.counted = n
+	switch {
+	case n > 0 && b.pos == 0:
+		heap.Push(&l.bufs, b)
+	case n > 0:
+		heap.Fix(&l.bufs, b.pos-1)
+	case b.pos > 0:
+		heap.Remove(&l.bufs, b.pos-1)
+	}
+	for l.used > l.max && len(l.bufs) > 0 {
+		shed := heap.Pop(&l.bufs).(*InBuffer)
+		l.used -= shed.counted
+		shed.counted = 0
+		atomic.StoreInt32(&shed.shed, 1)
+		if shed != b {
+			// Wake blocks on the loops of stdlib servers
+			go shed.c.Wake()
+		}
+	}
+}
+
+// release stops counting the tracked buffer of a connection that was closed
+// or detached, if it's tracked by this limit.
+func (l *InboundLimit) release(b *InBuffer) {
+	if l == nil || b == nil || b.limit != l {
+		return
+	}
+	l.set(b, 0)
+}
+
+// inboundHeap is a heap of the tracked buffers by the input that they hold,
+// so that the largest is shed without scanning them all. The position of a
+// buffer in the heap is kept in the buffer, plus one.
+type inboundHeap []*InBuffer
+
+func (h inboundHeap) Len() int           { return len(h) }
+func (h inboundHeap) Less(i, j int) bool { return h[i].counted > h[j].counted }
+func (h inboundHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i+1, j+1
+}
+func (h *inboundHeap) Push(x interface{}) {
+	b := x.(*InBuffer)
+	b.pos = len(*h) + 1
+	*h = append(*h, b)
+}
+func (h *inboundHeap) Pop() interface{} {
+	old := *h
+	b := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	b.pos = 0
+	return b
+}
+
+// inboundConn is a connection that keeps its tracked buffer, so that the
+// buffer stops counting when the connection closes.
+type inboundConn interface {
+	trackInBuffer(b *InBuffer) (old *InBuffer)
+}
@@ -0,0 +1,28 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package evio
+
+import (
+	"time"
+
+	"github.com/jursonmo/evio/internal"
+)
+
+// timers holds the connection timers of a loop. They're EVFILT_TIMER
+// filters on the loop's kqueue, which fire from the poll itself.
+type timers struct{}
+
+// timer is a connection timer.
+type timer = internal.PollTimer
+
+// loopAfter calls fn on the loop once d has elapsed.
+func loopAfter(l *loop, d time.Duration, fn func()) *timer {
+	return l.poll.AfterFunc(d, fn)
+}
+
+// loopAdvanceWheel does nothing, as there's no timing wheel.
+func loopAdvanceWheel(l *loop) {}
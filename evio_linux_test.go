@@ -0,0 +1,1874 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jursonmo/evio/internal"
+)
+
+func TestMark(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("SO_MARK requires CAP_NET_ADMIN")
+	}
+	var lnmark, cmark int
+	var events Events
+	events.Serving = func(srv Server) (action Action) {
+		lnmark, _ = syscall.GetsockoptInt(srv.lns[0].fd, syscall.SOL_SOCKET, syscall.SO_MARK)
+		go func() {
+			c, err := net.Dial("tcp", ":9962")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("hello"))
+			c.Read([]byte{0})
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.Mark = 9
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		cmark, _ = syscall.GetsockoptInt(c.(*conn).fd, syscall.SOL_SOCKET, syscall.SO_MARK)
+		return nil, Shutdown
+	}
+	must(Serve(events, "tcp://:9962?mark=7"))
+	if lnmark != 7 {
+		t.Fatalf("expected listener mark 7, got %d", lnmark)
+	}
+	if cmark != 9 {
+		t.Fatalf("expected connection mark 9, got %d", cmark)
+	}
+}
+
+func TestTCPUserTimeout(t *testing.T) {
+	for _, stdlib := range []bool{false, true} {
+		network := "tcp"
+		if stdlib {
+			network = "tcp-net"
+		}
+		var timeout int
+		var events Events
+		events.Serving = func(srv Server) (action Action) {
+			go func() {
+				c, err := net.Dial("tcp", ":9964")
+				must(err)
+				defer c.Close()
+				c.Write([]byte("hello"))
+				c.Read([]byte{0})
+			}()
+			return
+		}
+		events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+			opts.TCPUserTimeout = time.Second * 3
+			return
+		}
+		events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+			var fd int
+			switch c := c.(type) {
+			case *conn:
+				fd = c.fd
+			case *stdconn:
+				sysControl(c.conn, func(sfd int) error {
+					fd = sfd
+					return nil
+				})
+			}
+			timeout, _ = syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, 0x12)
+			return nil, Shutdown
+		}
+		must(Serve(events, network+"://:9964"))
+		if timeout != 3000 {
+			t.Fatalf("%s: expected user timeout 3000, got %d", network, timeout)
+		}
+	}
+}
+
+func TestIOUring(t *testing.T) {
+	p, err := internal.OpenURingPoll()
+	if err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	p.Close()
+	t.Run("tcp", func(t *testing.T) {
+		t.Run("1-loop", func(t *testing.T) {
+			testServeBackend("tcp", ":9967", false, 10, 1, Random, IOUring)
+		})
+		t.Run("N-loop", func(t *testing.T) {
+			testServeBackend("tcp", ":9968", false, 10, -1, RoundRobin, IOUring)
+		})
+	})
+	t.Run("unix", func(t *testing.T) {
+		testServeBackend("tcp", ":9969", true, 10, 5, LeastConnections, IOUring)
+	})
+	t.Run("detach", testIOUringDetach)
+}
+
+// testIOUringDetach detaches a connection while the ring holds input that it
+// received for it, which the detached connection reads first.
+func testIOUringDetach(t *testing.T) {
+	sent := make(chan bool)
+	var rest string
+	var events Events
+	events.Backend = IOUring
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9875")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("detach"))
+			<-sent
+			c.Write([]byte("rest"))
+			// the loop receives it before it detaches the connection
+			time.Sleep(time.Second / 20)
+			sent <- true
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		sent <- true
+		<-sent
+		return nil, Detach
+	}
+	events.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+		defer rwc.Close()
+		rwc.(net.Conn).SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 4)
+		n, _ := io.ReadFull(rwc, buf)
+		rest = string(buf[:n])
+		return Shutdown
+	}
+	must(Serve(events, "tcp://:9875"))
+	if rest != "rest" {
+		t.Fatalf("expected the input that the ring held, got %q", rest)
+	}
+}
+
+// BenchmarkBackend compares the backends on an echo, and reports the system
+// calls that the loop makes per echo to wait, to change the interest set,
+// and to read and write.
+func BenchmarkBackend(b *testing.B) {
+	b.Run("epoll", func(b *testing.B) { benchmarkBackend(b, DefaultBackend, ":9970") })
+	b.Run("io_uring", func(b *testing.B) { benchmarkBackend(b, IOUring, ":9971") })
+}
+
+func benchmarkBackend(b *testing.B, backend Backend, addr string) {
+	var events Events
+	events.Backend = backend
+	events.LoopStats = true
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			calls := func() (n int64) {
+				for _, ls := range s.Stats().Loops {
+					n += ls.PollCalls
+				}
+				return n
+			}
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			ping := []byte("ping")
+			pong := make([]byte, len(ping))
+			// the first echo opens the connection
+			c.Write(ping)
+			_, err = io.ReadFull(c, pong)
+			must(err)
+			start := calls()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Write(ping)
+				_, err := io.ReadFull(c, pong)
+				must(err)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(calls()-start)/float64(b.N), "pollcalls/op")
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	must(Serve(events, "tcp://"+addr))
+}
+
+func TestAcceptError(t *testing.T) {
+	defer func() { acceptFunc = (*internal.Poll).Accept }()
+	var failures int
+	acceptFunc = func(p *internal.Poll, fd int) (int, syscall.Sockaddr, error) {
+		if failures < 3 {
+			failures++
+			return 0, nil, syscall.EMFILE
+		}
+		return p.Accept(fd)
+	}
+	var reported []error
+	var reply string
+	var events Events
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9980")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(c, buf)
+			must(err)
+			reply = string(buf)
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	events.OnAcceptError = func(err error) (action Action) {
+		reported = append(reported, err)
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	start := time.Now()
+	must(Serve(events, "tcp://:9980"))
+	if len(reported) != 3 || reported[0] != syscall.EMFILE {
+		t.Fatalf("expected 3 EMFILE errors, got %v", reported)
+	}
+	if reply != "ping" {
+		t.Fatalf("expected the server to recover, got %q", reply)
+	}
+	if elapsed := time.Since(start); elapsed < acceptPause*3 {
+		t.Fatalf("expected accepting to pause, took %v", elapsed)
+	}
+}
+
+func TestConnErrors(t *testing.T) {
+	defer func() {
+		acceptFunc = (*internal.Poll).Accept
+		readFunc = (*internal.Poll).Read
+	}()
+	var aborted bool
+	acceptFunc = func(p *internal.Poll, fd int) (int, syscall.Sockaddr, error) {
+		if !aborted {
+			aborted = true
+			return 0, nil, syscall.ECONNABORTED
+		}
+		return p.Accept(fd)
+	}
+	readFunc = func(p *internal.Poll, fd int, b []byte) (int, error) {
+		n, err := p.Read(fd, b)
+		if err == nil && string(b[:n]) == "reset" {
+			return 0, syscall.ECONNRESET
+		}
+		return n, err
+	}
+	var closeErr error
+	var reply string
+	var events Events
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9981")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("reset"))
+			c.Read(make([]byte, 1))
+
+			c2, err := net.Dial("tcp", ":9981")
+			must(err)
+			defer c2.Close()
+			c2.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(c2, buf)
+			must(err)
+			reply = string(buf)
+			c2.Write([]byte("quit"))
+		}()
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if closeErr == nil {
+			closeErr = err
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	must(Serve(events, "tcp://:9981"))
+	if !aborted {
+		t.Fatal("expected an aborted accept")
+	}
+	if closeErr != syscall.ECONNRESET {
+		t.Fatalf("expected the connection to be closed with ECONNRESET, got %v", closeErr)
+	}
+	if reply != "ping" {
+		t.Fatalf("expected the loop to keep running, got %q", reply)
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	testMaxConnsPerIP(t, "tcp", "127.0.0.1:9952")
+	testMaxConnsPerIP(t, "tcp-net", "127.0.0.1:9951")
+}
+
+func testMaxConnsPerIP(t *testing.T, network, addr string) {
+	// echo returns whether the server echoes over the connection
+	echo := func(c net.Conn) bool {
+		c.SetDeadline(time.Now().Add(time.Second))
+		if _, err := c.Write([]byte("x")); err != nil {
+			return false
+		}
+		_, err := c.Read([]byte{0})
+		return err == nil
+	}
+	dial := func(ip string) net.Conn {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		c, err := d.Dial("tcp", addr)
+		must(err)
+		return c
+	}
+	var served []bool
+	var reopened bool
+	var events Events
+	events.MaxConnsPerIP = 2
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			var conns []net.Conn
+			for i := 0; i < 4; i++ {
+				conns = append(conns, dial("127.0.0.1"))
+			}
+			for i := 0; i < 2; i++ {
+				conns = append(conns, dial("127.0.0.2"))
+			}
+			for _, c := range conns {
+				served = append(served, echo(c))
+			}
+			// closing a connection makes room for another
+			conns[0].Close()
+			for i := 0; i < 100 && !reopened; i++ {
+				c := dial("127.0.0.1")
+				if reopened = echo(c); !reopened {
+					time.Sleep(time.Millisecond * 10)
+				}
+				conns = append(conns, c)
+			}
+			for _, c := range conns {
+				c.Close()
+			}
+			c := dial("127.0.0.3")
+			defer c.Close()
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	must(Serve(events, network+"://"+addr))
+	expected := []bool{true, true, false, false, true, true}
+	for i := range expected {
+		if served[i] != expected[i] {
+			t.Fatalf("%s: connection %d: expected served %v, got %v", network, i, expected[i], served[i])
+		}
+	}
+	if !reopened {
+		t.Fatalf("%s: expected a connection after closing one", network)
+	}
+}
+
+func TestTrusted(t *testing.T) {
+	testTrusted(t, "tcp", "127.0.0.1:9817")
+	testTrusted(t, "tcp-net", "127.0.0.1:9816")
+}
+
+func testTrusted(t *testing.T, network, addr string) {
+	echo := func(c net.Conn) bool {
+		c.SetDeadline(time.Now().Add(time.Second))
+		if _, err := c.Write([]byte("x")); err != nil {
+			return false
+		}
+		_, err := c.Read([]byte{0})
+		return err == nil
+	}
+	dial := func(ip string) net.Conn {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+		c, err := d.Dial("tcp", addr)
+		must(err)
+		return c
+	}
+	_, trusted, err := net.ParseCIDR("127.0.0.2/32")
+	must(err)
+	served := make(chan []bool, 1)
+	var events Events
+	events.MaxConnsPerIP = 1
+	events.Trusted = []*net.IPNet{trusted}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			var conns []net.Conn
+			for i := 0; i < 3; i++ {
+				conns = append(conns, dial("127.0.0.2"))
+			}
+			for i := 0; i < 2; i++ {
+				conns = append(conns, dial("127.0.0.1"))
+			}
+			var res []bool
+			for _, c := range conns {
+				res = append(res, echo(c))
+				c.Close()
+			}
+			served <- res
+			c := dial("127.0.0.3")
+			defer c.Close()
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	must(Serve(events, network+"://"+addr))
+	res := <-served
+	expected := []bool{true, true, true, true, false}
+	for i := range expected {
+		if res[i] != expected[i] {
+			t.Fatalf("%s: connection %d: expected served %v, got %v", network, i, expected[i], res[i])
+		}
+	}
+}
+
+func TestVsock(t *testing.T) {
+	addr, err := parseVsockAddr("any:9946")
+	if err != nil || addr.CID != 0xFFFFFFFF || addr.Port != 9946 || addr.String() != "4294967295:9946" {
+		t.Fatalf("unexpected vsock address %v, %v", addr, err)
+	}
+	if _, err := parseVsockAddr("3"); err == nil {
+		t.Fatal("expected an error for a vsock address without a port")
+	}
+	const cidLocal = 1 // VMADDR_CID_LOCAL
+	fd, err := internal.VsockListen(cidLocal, 9946)
+	if err != nil {
+		t.Skipf("vsock loopback is not available: %v", err)
+	}
+	syscall.Close(fd)
+	var raddr net.Addr
+	var echo string
+	var events Events
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			fd, err := internal.VsockConnect(cidLocal, 9946)
+			must(err)
+			defer syscall.Close(fd)
+			_, err = syscall.Write(fd, []byte("hello"))
+			must(err)
+			buf := make([]byte, 5)
+			n, err := syscall.Read(fd, buf)
+			must(err)
+			echo = string(buf[:n])
+			syscall.Write(fd, []byte("shutdown"))
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		raddr = c.RemoteAddr()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	must(Serve(events, "vsock://1:9946"))
+	if echo != "hello" {
+		t.Fatalf("expected echo %q, got %q", "hello", echo)
+	}
+	if a, ok := raddr.(*VsockAddr); !ok || a.CID != cidLocal {
+		t.Fatalf("expected a vsock remote address, got %v", raddr)
+	}
+}
+
+func BenchmarkInputBuffer(b *testing.B) {
+	b.Run("reuse", func(b *testing.B) { benchmarkInputBuffer(b, ReuseInput, ":9942") })
+	b.Run("copy", func(b *testing.B) { benchmarkInputBuffer(b, CopyInput, ":9941") })
+}
+
+func benchmarkInputBuffer(b *testing.B, mode InputBuffer, addr string) {
+	const size = 16 * 1024
+	var events Events
+	events.InputBuffer = mode
+	var received int
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		// acknowledge each message
+		for received += len(in); received >= size; received -= size {
+			out = append(out, '!')
+		}
+		return
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			msg := make([]byte, size)
+			ack := make([]byte, 1)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Write(msg)
+				_, err := io.ReadFull(c, ack)
+				must(err)
+			}
+			b.StopTimer()
+			c.Close()
+			c, err = net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	must(Serve(events, "tcp://"+addr))
+}
+
+func BenchmarkWriteSpin(b *testing.B) {
+	b.Run("0", func(b *testing.B) { benchmarkWriteSpin(b, 0, ":9905") })
+	b.Run("64", func(b *testing.B) { benchmarkWriteSpin(b, 64, ":9904") })
+}
+
+func benchmarkWriteSpin(b *testing.B, spin int, addr string) {
+	const size = 1024 * 1024
+	var events Events
+	events.WriteSpin = spin
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			msg := make([]byte, size)
+			echo := make([]byte, size)
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				go c.Write(msg)
+				_, err := io.ReadFull(c, echo)
+				must(err)
+			}
+			b.StopTimer()
+			c.Close()
+			c, err = net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	must(Serve(events, "tcp://"+addr))
+}
+
+func TestAutoscale(t *testing.T) {
+	defer func(d time.Duration) { scaleInterval = d }(scaleInterval)
+	scaleInterval = time.Millisecond * 10
+	const addr = ":9938"
+	// waitLoops waits for the server to run n loops that hold all of the
+	// connections, since migrated ones are briefly on neither loop.
+	waitLoops := func(srv Server, n, conns int) Stats {
+		start := time.Now()
+		for {
+			st := srv.Stats()
+			var sum int
+			for _, ls := range st.Loops {
+				sum += ls.Conns
+			}
+			if len(st.Loops) == n && sum == conns {
+				return st
+			}
+			if time.Since(start) > time.Second*5 {
+				panic("timeout waiting for loops")
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	echo := func(c net.Conn) {
+		c.Write([]byte("ping"))
+		_, err := io.ReadFull(c, make([]byte, 4))
+		must(err)
+	}
+	var grown, shrunk Stats
+	var events Events
+	events.MinLoops, events.MaxLoops, events.ConnsPerLoop = 1, 3, 2
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			var conns []net.Conn
+			for i := 0; i < 8; i++ {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				conns = append(conns, c)
+				echo(c)
+			}
+			grown = waitLoops(srv, 3, 8)
+			// the connections keep working after they're migrated
+			for _, c := range conns {
+				echo(c)
+			}
+			for _, c := range conns[1:] {
+				c.Close()
+			}
+			shrunk = waitLoops(srv, 1, 1)
+			echo(conns[0])
+			c := conns[0]
+			c.Write([]byte("shutdown"))
+			c.Read(make([]byte, 1))
+			c.Close()
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	must(Serve(events, "tcp://"+addr))
+	for i, ls := range grown.Loops {
+		if ls.Conns == 0 {
+			t.Fatalf("expected connections to be migrated to loop %d, got %+v", i, grown)
+		}
+	}
+	if shrunk.Conns != 1 {
+		t.Fatalf("expected a connection on the remaining loop, got %+v", shrunk)
+	}
+}
+
+func TestSetNoDelay(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testSetNoDelay(t, "tcp", ":9933") })
+	t.Run("stdlib", func(t *testing.T) { testSetNoDelay(t, "tcp-net", ":9932") })
+}
+
+func testSetNoDelay(t *testing.T, network, addr string) {
+	// nodelay reads TCP_NODELAY from the connection's socket
+	nodelay := func(c Conn) (v int) {
+		var err error
+		if sc, ok := c.(*stdconn); ok {
+			must(sysControl(sc.conn, func(fd int) error {
+				v, err = syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+				return err
+			}))
+			return v
+		}
+		v, err = syscall.GetsockoptInt(c.(*conn).fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		must(err)
+		return v
+	}
+	var states []int
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			buf := make([]byte, 2)
+			for _, req := range []string{"off", "on", "off"} {
+				c.Write([]byte(req))
+				_, err = io.ReadFull(c, buf)
+				must(err)
+			}
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "on", "off":
+			must(c.SetNoDelay(string(in) == "on"))
+			must(c.SetKeepAlive(time.Minute))
+			states = append(states, nodelay(c))
+			return []byte("ok"), None
+		case "quit":
+			return nil, Shutdown
+		}
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	if len(states) != 3 || states[0] != 0 || states[1] == 0 || states[2] != 0 {
+		t.Fatalf("expected TCP_NODELAY to be toggled off, on and off, got %v", states)
+	}
+}
+
+func TestMaxReadPerCycle(t *testing.T) {
+	addr := ":9928"
+	const max = 100000
+	const conns, size = 8, 1 << 20
+	cycles := make(map[uint64]int)
+	var total int
+	var events Events
+	events.NumLoops = 1
+	events.MaxReadPerCycle = max
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			var wg sync.WaitGroup
+			for i := 0; i < conns; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c, err := net.Dial("tcp", addr)
+					must(err)
+					defer c.Close()
+					_, err = c.Write(make([]byte, size))
+					must(err)
+					c.Read(make([]byte, 1))
+				}()
+			}
+			wg.Wait()
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		cycles[c.(*conn).loop.poll.Cycle()] += len(in)
+		if total += len(in); total == conns*size {
+			action = Shutdown
+		}
+		return
+	}
+	must(Serve(events, "tcp://"+addr))
+	for cycle, n := range cycles {
+		if n > max {
+			t.Fatalf("expected at most %d bytes per cycle, read %d in cycle %d", max, n, cycle)
+		}
+	}
+}
+
+func TestTriggerNotes(t *testing.T) {
+	t.Run("epoll", func(t *testing.T) { testTriggerNotes(t, internal.OpenPoll()) })
+	t.Run("uring", func(t *testing.T) {
+		p, err := internal.OpenURingPoll()
+		if err != nil {
+			t.Skip(err)
+		}
+		testTriggerNotes(t, p)
+	})
+}
+
+func testTriggerNotes(t *testing.T, p *internal.Poll) {
+	defer p.Close()
+	const senders, notes = 4, 10000
+	errDone := errors.New("done")
+	for i := 0; i < senders; i++ {
+		go func() {
+			for j := 0; j < notes; j++ {
+				must(p.Trigger(1))
+			}
+		}()
+	}
+	var received int
+	var idle uint64
+	err := p.Wait(func(fd int, note interface{}) error {
+		switch note {
+		case 1:
+			if received++; received == senders*notes {
+				// the poll blocks while there are no notes
+				idle = p.Cycle()
+				time.AfterFunc(50*time.Millisecond, func() { p.Trigger(2) })
+			}
+		case 2:
+			idle = p.Cycle() - idle
+			return errDone
+		}
+		return nil
+	})
+	if err != errDone {
+		t.Fatal(err)
+	}
+	if received != senders*notes {
+		t.Fatalf("expected %d notes, got %d", senders*notes, received)
+	}
+	if idle > 2 {
+		t.Fatalf("expected the poll to block while idle, it woke up %d times", idle)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testSeed(t, "tcp", ":9921") })
+	t.Run("stdlib", func(t *testing.T) { testSeed(t, "tcp-net", ":9920") })
+}
+
+func testSeed(t *testing.T, network, addr string) {
+	run := func(seed int64) []int {
+		var mu sync.Mutex
+		var idxs []int
+		var events Events
+		events.NumLoops = 4
+		events.Seed = seed
+		events.Serving = func(s Server) (action Action) {
+			go func() {
+				for i := 0; i < 16; i++ {
+					c, err := net.Dial("tcp", addr)
+					must(err)
+					c.Write([]byte("ping"))
+					_, err = io.ReadFull(c, make([]byte, 4))
+					must(err)
+					c.Close()
+				}
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				defer c.Close()
+				c.Write([]byte("quit"))
+				c.Read(make([]byte, 1))
+			}()
+			return
+		}
+		events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+			mu.Lock()
+			if sc, ok := c.(*stdconn); ok {
+				idxs = append(idxs, sc.loop.idx)
+			} else {
+				idxs = append(idxs, c.(*conn).loop.idx)
+			}
+			mu.Unlock()
+			return
+		}
+		events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+			if string(in) == "quit" {
+				return nil, Shutdown
+			}
+			return in, None
+		}
+		must(Serve(events, network+"://"+addr))
+		return idxs
+	}
+	first, second := run(7), run(7)
+	if len(first) != 17 || len(second) != 17 {
+		t.Fatalf("expected 17 connections per run, got %d and %d", len(first), len(second))
+	}
+	loops := make(map[int]bool)
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("expected the same distribution, got %v and %v", first, second)
+		}
+		loops[first[i]] = true
+	}
+	if len(loops) < 2 {
+		t.Fatalf("expected the connections to be spread across loops, got %v", first)
+	}
+}
+
+func TestUDPGRO(t *testing.T) {
+	const seg = 100
+	var caps []int
+	var data []byte
+	var events Events
+	events.UDPGRO = true
+	events.InputBuffer = ReuseInput
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("udp", "127.0.0.1:9915")
+			must(err)
+			defer c.Close()
+			rc, err := c.(*net.UDPConn).SyscallConn()
+			must(err)
+			// send the datagrams as a single segmented write (UDP_SEGMENT)
+			rc.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, 103, seg)
+			})
+			if err == nil {
+				b := make([]byte, seg*4)
+				for i := range b {
+					b[i] = byte(i / seg)
+				}
+				c.Write(b)
+			}
+			time.Sleep(time.Second / 10)
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		caps = append(caps, cap(in))
+		data = append(data, in...)
+		if len(in) != seg {
+			t.Errorf("expected a datagram of %d bytes, got %d", seg, len(in))
+		}
+		return
+	}
+	must(Serve(events, "udp://127.0.0.1:9915"))
+	if len(caps) == 0 {
+		t.Skip("segmented sends are not supported")
+	}
+	if len(caps) != 4 {
+		t.Fatalf("expected 4 datagrams, got %d", len(caps))
+	}
+	for i, b := range data {
+		if b != byte(i/seg) {
+			t.Fatalf("unexpected byte %d at %d", b, i)
+		}
+	}
+	// coalesced datagrams are passed from successive offsets of the buffer
+	if caps[0] == caps[3] {
+		t.Skip("the kernel didn't coalesce the datagrams")
+	}
+	for i := 1; i < len(caps); i++ {
+		if caps[i] != caps[0]-i*seg {
+			t.Fatalf("expected the datagrams to be split from one read, got capacities %v", caps)
+		}
+	}
+}
+
+func TestUDPBuf(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testUDPBuf(t, "udp", "9866", "9865") })
+	t.Run("stdlib", func(t *testing.T) { testUDPBuf(t, "udp-net", "9864", "9863") })
+}
+
+func testUDPBuf(t *testing.T, network, large, small string) {
+	const max = 65507 // largest IPv4 UDP payload
+	big := make([]byte, max)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	got := make(map[int][]byte)
+	var caps []int
+	var events Events
+	events.InputBuffer = ReuseInput
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			for _, port := range []string{large, small} {
+				c, err := net.Dial("udp", "127.0.0.1:"+port)
+				must(err)
+				_, err = c.Write(big)
+				must(err)
+				c.Close()
+				time.Sleep(time.Second / 20)
+			}
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		got[c.AddrIndex()] = append([]byte{}, in...)
+		caps = append(caps, cap(in))
+		if len(got) == 2 {
+			action = Shutdown
+		}
+		return
+	}
+	must(Serve(events, network+"://127.0.0.1:"+large+"?udpbuf=65507",
+		network+"://127.0.0.1:"+small+"?udpbuf=512"))
+	if !bytes.Equal(got[0], big) {
+		t.Fatalf("expected the datagram of %d bytes whole, got %d bytes", max, len(got[0]))
+	}
+	if !bytes.Equal(got[1], big[:512]) {
+		t.Fatalf("expected the first 512 bytes of the datagram, got %d bytes", len(got[1]))
+	}
+	if network == "udp" && (caps[0] != max || caps[1] != 512) {
+		t.Fatalf("expected buffers of %d and 512 bytes, got %v", max, caps)
+	}
+}
+
+func TestUDPSegment(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testUDPSegment(t, "udp", "127.0.0.1:9914") })
+	t.Run("stdlib", func(t *testing.T) { testUDPSegment(t, "udp-net", "127.0.0.1:9913") })
+}
+
+func testUDPSegment(t *testing.T, network, addr string) {
+	const seg = 300
+	// the client passes what it received back over the channels
+	received := make(chan []int, 1)
+	mismatched := make(chan bool, 1)
+	var events Events
+	events.UDPSegment = seg
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			var sizes []int
+			var mismatch bool
+			defer func() {
+				received <- sizes
+				mismatched <- mismatch
+			}()
+			c, err := net.Dial("udp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("send"))
+			buf := make([]byte, 0x10000)
+			for i := 0; i < 11; i++ {
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := c.Read(buf)
+				if err != nil {
+					break
+				}
+				sizes = append(sizes, n)
+				for _, b := range buf[:n] {
+					if b != byte(i) {
+						mismatch = true
+					}
+				}
+			}
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "send":
+			for i := 0; i < 10; i++ {
+				out = append(out, bytes.Repeat([]byte{byte(i)}, seg)...)
+			}
+			out = append(out, bytes.Repeat([]byte{10}, 50)...)
+		case "quit":
+			action = Shutdown
+		}
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	sizes, mismatch := <-received, <-mismatched
+	if len(sizes) != 11 || mismatch {
+		t.Fatalf("expected 11 ordered datagrams, got sizes %v (mismatch %v)", sizes, mismatch)
+	}
+	for i, n := range sizes {
+		if (i < 10 && n != seg) || (i == 10 && n != 50) {
+			t.Fatalf("unexpected datagram sizes %v", sizes)
+		}
+	}
+}
+
+func TestListenOptions(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testListenOptions(t, "tcp://:9903") })
+	t.Run("stdlib", func(t *testing.T) { testListenOptions(t, "tcp-net://:9902") })
+	t.Run("error", func(t *testing.T) {
+		errFailed := errors.New("failed")
+		var events Events
+		events.ListenOptions = []ListenOption{func(fd int) error { return errFailed }}
+		if err := Serve(events, "tcp://:9901"); !errors.Is(err, errFailed) {
+			t.Fatalf("expected %v, got %v", errFailed, err)
+		}
+	})
+}
+
+// soReusePort is SO_REUSEPORT, which the syscall package lacks on Linux.
+const soReusePort = 0xf
+
+func testListenOptions(t *testing.T, addr string) {
+	getReusePort := func(fd int) int {
+		v, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort)
+		must(err)
+		return v
+	}
+	var fds []int
+	var lnopt, connopt int
+	var events Events
+	events.ListenOptions = []ListenOption{func(fd int) error {
+		fds = append(fds, fd)
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1)
+	}}
+	events.Serving = func(s Server) (action Action) {
+		lnopt = getReusePort(fds[0])
+		go func() {
+			c, err := net.Dial("tcp", s.Addrs[0].String())
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		switch c := c.(type) {
+		case *conn:
+			connopt = getReusePort(c.fd)
+		case *stdconn:
+			must(sysControl(c.conn, func(fd int) error {
+				connopt = getReusePort(fd)
+				return nil
+			}))
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return nil, Shutdown
+	}
+	must(Serve(events, addr))
+	if len(fds) != 2 {
+		t.Fatalf("expected the option to be applied twice, got %d", len(fds))
+	}
+	if lnopt != 1 || connopt != 1 {
+		t.Fatalf("expected SO_REUSEPORT on the listener and the connection, got %d and %d", lnopt, connopt)
+	}
+}
+
+func TestWriteWatermarks(t *testing.T) {
+	const piece, pieces = 64 << 10, 16
+	const low, high = 100 << 10, 300 << 10
+	var marks []string
+	var buffered []int
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		if err := c.SetWriteWatermarks(high, low); err == nil {
+			t.Error("expected an error for a low watermark above the high one")
+		}
+		must(c.SetWriteWatermarks(low, high))
+		return
+	}
+	events.OnWriteHigh = func(c Conn) {
+		marks = append(marks, "high")
+		buffered = append(buffered, c.(*conn).pending())
+	}
+	events.OnWriteLow = func(c Conn) {
+		marks = append(marks, "low")
+		buffered = append(buffered, c.(*conn).pending())
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		// nothing is written until the event returns
+		for i := 0; i < pieces; i++ {
+			must(c.SendUrgent(make([]byte, piece)))
+		}
+		return
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9900")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("go"))
+			_, err = io.ReadFull(c, make([]byte, piece*pieces))
+			must(err)
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	must(Serve(events, "tcp://:9900"))
+	if len(marks) != 2 || marks[0] != "high" || marks[1] != "low" {
+		t.Fatalf("expected the high and then the low watermark, got %v", marks)
+	}
+	// the piece that crosses the high mark fires it
+	if expected := (high/piece + 1) * piece; buffered[0] != expected {
+		t.Fatalf("expected the high watermark at %d bytes, got %d", expected, buffered[0])
+	}
+	if buffered[1] > low {
+		t.Fatalf("expected the low watermark at %d bytes or less, got %d", low, buffered[1])
+	}
+}
+
+func TestWritePeerClosed(t *testing.T) {
+	defer func() { readFunc = (*internal.Poll).Read }()
+	// the loop doesn't notice the close by reading, so that the write fails
+	var gone int32
+	readFunc = func(p *internal.Poll, fd int, b []byte) (int, error) {
+		if atomic.LoadInt32(&gone) == 1 {
+			return 0, syscall.EAGAIN
+		}
+		return p.Read(fd, b)
+	}
+	opened := make(chan Conn, 1)
+	var wakes int
+	var closeErr error
+	var closed int32
+	var events Events
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9899")
+			must(err)
+			c.Write([]byte("hello"))
+			sc := <-opened
+			atomic.StoreInt32(&gone, 1)
+			c.Close()
+			time.Sleep(time.Second / 20)
+			// the first write is reset by the peer, which the poll reports
+			// with EPIPE
+			for i := 0; i < 20 && atomic.LoadInt32(&closed) == 0; i++ {
+				sc.Wake()
+				time.Sleep(time.Second / 100)
+			}
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if in == nil {
+			wakes++
+			return []byte("ping"), None
+		}
+		opened <- c
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		closeErr = err
+		atomic.StoreInt32(&closed, 1)
+		return Shutdown
+	}
+	must(Serve(events, "tcp://:9899"))
+	if wakes < 1 {
+		t.Fatalf("expected the connection to be written after the peer closed, got %d writes", wakes)
+	}
+	if closeErr != nil {
+		t.Fatalf("expected the peer close to be reported as nil, got %v", closeErr)
+	}
+}
+
+func TestConnReset(t *testing.T) {
+	// the client sends the time of the reset before it resets, and the loop
+	// sends back the close error and how long it took to see it
+	resets := make(chan time.Time, 1)
+	closeErrs := make(chan error, 1)
+	elapsed := make(chan time.Duration, 1)
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.MaxInFlight = 1
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		// the request never ends, so the reads stay paused
+		c.BeginRequest()
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		elapsed <- time.Since(<-resets)
+		closeErrs <- err
+		return Shutdown
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9859")
+			must(err)
+			_, err = c.Write([]byte("request"))
+			must(err)
+			time.Sleep(time.Second / 20)
+			c.(*net.TCPConn).SetLinger(0)
+			resets <- time.Now()
+			c.Close()
+		}()
+		return
+	}
+	must(Serve(events, "tcp://:9859"))
+	if err := <-closeErrs; err != syscall.ECONNRESET {
+		t.Fatalf("expected the connection to be closed with ECONNRESET, got %v", err)
+	}
+	if d := <-elapsed; d > time.Second/10 {
+		t.Fatalf("expected the reset to be reported promptly, took %v", d)
+	}
+}
+
+func TestReusePortCPU(t *testing.T) {
+	const addr = "tcp://127.0.0.1:9896?reuseport=true"
+	var events Events
+	events.Listeners = map[int]ListenerConfig{0: {ReusePortCPU: true}}
+	if err := Serve(events, "tcp://127.0.0.1:9896"); err != errNoReusePort {
+		t.Fatalf("expected %v without reuseport, got %v", errNoReusePort, err)
+	}
+	// two servers share the reuseport group, and the first one to bind is
+	// at index 0
+	var counts [2]int32
+	serving := make(chan error)
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(done)
+	for i := range counts {
+		i := i
+		events.Serving = func(s Server) (action Action) {
+			serving <- nil
+			return
+		}
+		events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+			atomic.AddInt32(&counts[i], 1)
+			return []byte("x"), opts, action
+		}
+		events.Tick = func() (delay time.Duration, action Action) {
+			select {
+			case <-done:
+				return 0, Shutdown
+			default:
+				return time.Millisecond * 10, None
+			}
+		}
+		wg.Add(1)
+		go func(events Events) {
+			defer wg.Done()
+			if err := Serve(events, addr); err != nil {
+				serving <- err
+			}
+		}(events)
+		if err := <-serving; err != nil {
+			if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOPROTOOPT) {
+				t.Skipf("reuseport steering is not available: %v", err)
+			}
+			t.Fatal(err)
+		}
+	}
+	// connect from CPU 0, whose connections go to the socket at index 0
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	var set [16]uint64
+	set[0] = 1
+	if _, _, e0 := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0,
+		uintptr(len(set)*8), uintptr(unsafe.Pointer(&set[0]))); e0 != 0 {
+		t.Skipf("cannot pin to CPU 0: %v", e0)
+	}
+	for i := 0; i < 20; i++ {
+		c, err := net.Dial("tcp", "127.0.0.1:9896")
+		must(err)
+		_, err = io.ReadFull(c, make([]byte, 1))
+		must(err)
+		c.Close()
+	}
+	if n0, n1 := atomic.LoadInt32(&counts[0]), atomic.LoadInt32(&counts[1]); n0 != 20 || n1 != 0 {
+		t.Fatalf("expected all connections on the first server, got %d and %d", n0, n1)
+	}
+}
+
+func TestQueueChunks(t *testing.T) {
+	s := &server{}
+	c := &conn{fd: 1, srv: s}
+	check := func() {
+		var n int
+		for _, size := range c.chunks {
+			n += size
+		}
+		if n != len(c.out) {
+			t.Fatalf("expected the chunks to add up to %d bytes, got %d", len(c.out), n)
+		}
+	}
+	must(c.WriteString("abc"))
+	must(c.TryWrite([]byte("de")))
+	must(c.SendUrgent([]byte("URGENT")))
+	must(c.WriteBuffers(net.Buffers{[]byte("fg"), nil, []byte("h")}))
+	must(c.WriteString(""))
+	loopQueue(s, c, []byte("ij"))
+	check()
+	if len(c.chunks) != 4 || string(c.out) != "abcdefghij" || string(c.urgent) != "URGENT" {
+		t.Fatalf("expected 4 chunks and the urgent output apart, got %v %q %q", c.chunks, c.out, c.urgent)
+	}
+	c.out = c.out[4:]
+	c.sent(4)
+	check()
+	if !c.partial || c.chunks[0] != 1 {
+		t.Fatalf("expected the second chunk to be partly written, got %v", c.chunks)
+	}
+}
+
+func BenchmarkWriteString(b *testing.B) {
+	text := strings.Repeat("x", 1024)
+	s := &server{}
+	c := &conn{fd: 1, srv: s}
+	// the output goes through a Data event, like it does in a loop
+	bench := func(b *testing.B, data func(c Conn, in []byte) ([]byte, Action)) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			out, _ := data(c, nil)
+			loopQueue(s, c, out)
+			c.out, c.chunks = c.out[:0], c.chunks[:0]
+		}
+	}
+	b.Run("string", func(b *testing.B) {
+		bench(b, func(c Conn, in []byte) ([]byte, Action) {
+			c.WriteString(text)
+			return nil, None
+		})
+	})
+	b.Run("bytes", func(b *testing.B) {
+		bench(b, func(c Conn, in []byte) ([]byte, Action) {
+			return []byte(text), None
+		})
+	})
+}
+
+func TestReadBatch(t *testing.T) {
+	const frame, frames = 20, 50
+	var calls, total int
+	var latency time.Duration
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.ReadBatchBytes = frame * frames
+		opts.ReadBatchDelay = time.Second / 20
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "ping":
+			return []byte("pong"), None
+		case "quit":
+			return nil, Shutdown
+		}
+		calls++
+		total += len(in)
+		return
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9887")
+			must(err)
+			defer c.Close()
+			// small frames that are read one at a time are batched
+			for i := 0; i < frames; i++ {
+				c.Write(make([]byte, frame))
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(time.Second / 5)
+			// an idle connection gets its input after the delay
+			start := time.Now()
+			c.Write([]byte("ping"))
+			_, err = io.ReadFull(c, make([]byte, 4))
+			must(err)
+			latency = time.Since(start)
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	must(Serve(events, "tcp://:9887"))
+	if total != frame*frames {
+		t.Fatalf("expected %d bytes, got %d", frame*frames, total)
+	}
+	if calls > 3 {
+		t.Fatalf("expected the frames to be batched, got %d Data events", calls)
+	}
+	if latency < time.Second/20 || latency > time.Second/2 {
+		t.Fatalf("expected the idle input to wait for the delay, got %v", latency)
+	}
+}
+
+func TestOriginalDst(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testOriginalDst(t, "", "socket9870", ":9870") })
+	t.Run("stdlib", func(t *testing.T) { testOriginalDst(t, "-net", "socket9869", ":9869") })
+}
+
+func testOriginalDst(t *testing.T, std, sock, addr string) {
+	defer os.RemoveAll(sock)
+	type dst struct {
+		addr, local net.Addr
+		err         error
+	}
+	dsts := make(map[int]dst)
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		var r dst
+		r.addr, r.err = c.OriginalDst()
+		r.local = c.LocalAddr()
+		dsts[c.AddrIndex()] = r
+		if len(dsts) == 2 {
+			action = Shutdown
+		}
+		return
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			for _, dial := range [][2]string{{"unix", sock}, {"tcp", "127.0.0.1" + addr}} {
+				c, err := net.Dial(dial[0], dial[1])
+				must(err)
+				defer c.Close()
+				_, err = c.Write([]byte("hello"))
+				must(err)
+			}
+		}()
+		return
+	}
+	must(Serve(events, "unix"+std+"://"+sock, "tcp"+std+"://"+addr))
+	if err := dsts[0].err; err != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported for unix, got %v", err)
+	}
+	// without a redirect the original destination is the local address,
+	// when conntrack tracks the connection at all.
+	r := dsts[1]
+	switch r.err {
+	case nil:
+		a, ok := r.addr.(*net.TCPAddr)
+		if !ok || !a.IP.Equal(net.IPv4(127, 0, 0, 1)) || a.Port != r.local.(*net.TCPAddr).Port {
+			t.Fatalf("expected the local address %v, got %v", r.local, r.addr)
+		}
+	case syscall.ENOENT, syscall.ENOPROTOOPT:
+		t.Logf("no conntrack entry: %v", r.err)
+	default:
+		t.Fatal(r.err)
+	}
+}
+
+func TestPeerCred(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testPeerCred(t, "", "socket9884", ":9884") })
+	t.Run("stdlib", func(t *testing.T) { testPeerCred(t, "-net", "socket9883", ":9883") })
+}
+
+func testPeerCred(t *testing.T, std, sock, addr string) {
+	defer os.RemoveAll(sock)
+	type cred struct {
+		pid, uid, gid int
+		err           error
+	}
+	creds := make(map[int]cred)
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		var r cred
+		r.pid, r.uid, r.gid, r.err = c.PeerCred()
+		creds[c.AddrIndex()] = r
+		if len(creds) == 2 {
+			action = Shutdown
+		}
+		return
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			for _, dial := range [][2]string{{"unix", sock}, {"tcp", addr}} {
+				c, err := net.Dial(dial[0], dial[1])
+				must(err)
+				defer c.Close()
+				_, err = c.Write([]byte("hello"))
+				must(err)
+			}
+		}()
+		return
+	}
+	must(Serve(events, "unix"+std+"://"+sock, "tcp"+std+"://"+addr))
+	r := creds[0]
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.pid != os.Getpid() || r.uid != os.Getuid() || r.gid != os.Getgid() {
+		t.Fatalf("expected pid %d uid %d gid %d, got pid %d uid %d gid %d",
+			os.Getpid(), os.Getuid(), os.Getgid(), r.pid, r.uid, r.gid)
+	}
+	if err := creds[1].err; err != ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported for tcp, got %v", err)
+	}
+}
+
+func TestListenOverflow(t *testing.T) {
+	addr := "127.0.0.1:9852"
+	var opened int32
+	var done int32
+	release := make(chan struct{})
+	var st, before Stats
+	var events Events
+	events.NumLoops = 1
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return nil, opts, Shutdown
+		}
+		if atomic.AddInt32(&opened, 1) == 1 {
+			// block the loop so that nothing else is accepted
+			<-release
+		}
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			before = srv.Stats()
+			first, err := net.Dial("tcp", addr)
+			must(err)
+			defer first.Close()
+			for atomic.LoadInt32(&opened) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if c, err := net.DialTimeout("tcp", addr, time.Second/5); err == nil {
+						defer c.Close()
+						time.Sleep(time.Second / 5)
+					}
+				}()
+			}
+			time.Sleep(time.Second / 10)
+			st = srv.Stats()
+			wg.Wait()
+			atomic.StoreInt32(&done, 1)
+			close(release)
+			if c, err := net.Dial("tcp", addr); err == nil {
+				c.Close()
+			}
+		}()
+		return
+	}
+	must(Serve(events, "tcp://"+addr+"?backlog=1"))
+	if len(st.Listeners) != 1 {
+		t.Fatalf("expected the stats of one listener, got %+v", st.Listeners)
+	}
+	if ls := st.Listeners[0]; ls.Backlog != 1 || ls.Queued < 1 {
+		t.Fatalf("expected a full queue with a backlog of 1, got %+v", ls)
+	}
+	if st.ListenOverflows <= before.ListenOverflows {
+		t.Fatalf("expected the overflows to grow past %d, got %d",
+			before.ListenOverflows, st.ListenOverflows)
+	}
+}
+
+func TestUDPLoopSockets(t *testing.T) {
+	const flows, sends = 16, 5
+	addr := "127.0.0.1:9845"
+	// the loops are told apart by their goroutines
+	goroutine := func() string {
+		b := make([]byte, 64)
+		return string(bytes.Fields(b[:runtime.Stack(b, false)])[1])
+	}
+	var mu sync.Mutex
+	loops := make(map[string]map[string]bool) // flow -> goroutines
+	var events Events
+	events.NumLoops = 4
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		mu.Lock()
+		flow := c.RemoteAddr().String()
+		if loops[flow] == nil {
+			loops[flow] = make(map[string]bool)
+		}
+		loops[flow][goroutine()] = true
+		mu.Unlock()
+		return in, None
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			var conns []net.Conn
+			for i := 0; i < flows; i++ {
+				c, err := net.Dial("udp", addr)
+				must(err)
+				defer c.Close()
+				conns = append(conns, c)
+			}
+			buf := make([]byte, 16)
+			for i := 0; i < sends; i++ {
+				for _, c := range conns {
+					_, err := c.Write([]byte("ping"))
+					must(err)
+					c.SetReadDeadline(time.Now().Add(time.Second))
+					_, err = c.Read(buf)
+					must(err)
+				}
+			}
+			conns[0].Write([]byte("quit"))
+		}()
+		return
+	}
+	must(Serve(events, "udp://"+addr+"?reuseport=true"))
+	all := make(map[string]bool)
+	for flow, gs := range loops {
+		if len(gs) != 1 {
+			t.Fatalf("expected the flow %s to stay on one loop, got %d", flow, len(gs))
+		}
+		for g := range gs {
+			all[g] = true
+		}
+	}
+	if len(loops) != flows || len(all) < 2 {
+		t.Fatalf("expected %d flows over more than one loop, got %d flows over %d loops",
+			flows, len(loops), len(all))
+	}
+}
+
+// TestUDPShutdown shuts down a server while its loops read their own UDP
+// sockets. There are no UDP sessions, so no Closed events fire, and the
+// sockets of the loops are closed with the server.
+func TestUDPShutdown(t *testing.T) {
+	const flows = 16
+	addr := "127.0.0.1:9891"
+	openFDs := func() int {
+		f, err := os.Open("/proc/self/fd")
+		must(err)
+		defer f.Close()
+		names, err := f.Readdirnames(-1)
+		must(err)
+		return len(names) - 1 // the directory itself
+	}
+	run := func() {
+		var mu sync.Mutex
+		sockets := make(map[int]bool)
+		var opened, closed int32
+		var events Events
+		events.NumLoops = 4
+		events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+			atomic.AddInt32(&opened, 1)
+			return
+		}
+		events.Closed = func(c Conn, err error) (action Action) {
+			atomic.AddInt32(&closed, 1)
+			return
+		}
+		events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+			if string(in) == "quit" {
+				return nil, Shutdown
+			}
+			mu.Lock()
+			sockets[c.(*conn).udpfd] = true
+			mu.Unlock()
+			return in, None
+		}
+		done := make(chan bool)
+		events.Serving = func(_ Server) (action Action) {
+			go func() {
+				defer close(done)
+				var conns []net.Conn
+				for i := 0; i < flows; i++ {
+					c, err := net.Dial("udp", addr)
+					must(err)
+					defer c.Close()
+					conns = append(conns, c)
+				}
+				buf := make([]byte, 16)
+				for _, c := range conns {
+					_, err := c.Write([]byte("ping"))
+					must(err)
+					c.SetReadDeadline(time.Now().Add(time.Second))
+					_, err = c.Read(buf)
+					must(err)
+				}
+				// the flows are still open when the server shuts down
+				conns[0].Write([]byte("quit"))
+			}()
+			return
+		}
+		must(Serve(events, "udp://"+addr+"?reuseport=true"))
+		<-done
+		if opened != 0 || closed != 0 {
+			t.Fatalf("expected no Opened or Closed events for UDP, got %d and %d", opened, closed)
+		}
+		if len(sockets) < 2 {
+			t.Fatalf("expected the flows to be read by the sockets of the loops, got %d sockets", len(sockets))
+		}
+	}
+	// the first run opens the descriptors that the runtime keeps
+	run()
+	before := openFDs()
+	run()
+	if after := openFDs(); after != before {
+		t.Fatalf("expected the sockets to be closed with the server, %d descriptors before and %d after", before, after)
+	}
+}
+
+func TestBusyPollIdle(t *testing.T) {
+	addr := "127.0.0.1:9836"
+	cpu := func() time.Duration {
+		var ru syscall.Rusage
+		must(syscall.Getrusage(syscall.RUSAGE_SELF, &ru))
+		return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	}
+	measure := func() time.Duration {
+		start := cpu()
+		time.Sleep(300 * time.Millisecond)
+		return cpu() - start
+	}
+	closed := make(chan bool, 1)
+	var idle, busy, after time.Duration
+	var events Events
+	events.BusyPoll = time.Hour
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		closed <- true
+		return
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			idle = measure()
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			_, err = c.Write([]byte("ping"))
+			must(err)
+			_, err = io.ReadFull(c, make([]byte, 4))
+			must(err)
+			busy = measure()
+			c.Close()
+			<-closed
+			after = measure()
+			c, err = net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	must(Serve(events, "tcp://"+addr))
+	// the busy poll spins while there's a connection and stops after
+	if idle > 60*time.Millisecond || after > 60*time.Millisecond {
+		t.Fatalf("expected an idle loop to block, used %v before and %v after the connection", idle, after)
+	}
+	if busy < 100*time.Millisecond {
+		t.Fatalf("expected the loop to busy poll with a connection, used %v", busy)
+	}
+}
+
+func TestUDPWriteBuffers(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testUDPWriteBuffers(t, "udp", "127.0.0.1:9831") })
+	t.Run("stdlib", func(t *testing.T) { testUDPWriteBuffers(t, "udp-net", "127.0.0.1:9830") })
+}
+
+func testUDPWriteBuffers(t *testing.T, network, addr string) {
+	result := make(chan []string, 1)
+	var werr error
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("udp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("payload"))
+			var dgrams []string
+			buf := make([]byte, 64)
+			for i := 0; i < 2; i++ {
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := c.Read(buf)
+				if err != nil {
+					break
+				}
+				dgrams = append(dgrams, string(buf[:n]))
+			}
+			result <- dgrams
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		werr = c.WriteBuffers(net.Buffers{[]byte("header:"), in})
+		return []byte("output"), None
+	}
+	must(Serve(events, network+"://"+addr))
+	if werr != nil {
+		t.Fatal(werr)
+	}
+	dgrams := <-result
+	// the buffers go out as one datagram, ahead of the output
+	if len(dgrams) != 2 || dgrams[0] != "header:payload" || dgrams[1] != "output" {
+		t.Fatalf("expected %q and %q, got %q", "header:payload", "output", dgrams)
+	}
+}
@@ -19,11 +19,15 @@ func (ln *listener) close() {
 	if ln.pconn != nil {
 		ln.pconn.Close()
 	}
-	if ln.network == "unix" {
+	if ln.network == "unix" && !ln.handoff {
 		os.RemoveAll(ln.addr)
 	}
 }
 
+// stdDrainBacklog does nothing, as the listeners can't be accepted from
+// without blocking.
+func stdDrainBacklog(s *stdserver) {}
+
 func (ln *listener) system() error {
 	return nil
 }
@@ -32,6 +36,14 @@ func serve(events Events, listeners []*listener) error {
 	return stdserve(events, listeners)
 }
 
+type pool struct{}
+
+func newPool(numLoops int) *pool {
+	return &pool{}
+}
+
+func (p *pool) close() {}
+
 func reuseportListenPacket(proto, addr string) (l net.PacketConn, err error) {
 	return nil, errors.New("reuseport is not available")
 }
@@ -39,3 +51,14 @@ func reuseportListenPacket(proto, addr string) (l net.PacketConn, err error) {
 func reuseportListen(proto, addr string) (l net.Listener, err error) {
 	return nil, errors.New("reuseport is not available")
 }
+
+// rightsSpace is zero because sockets can't be passed with SCM_RIGHTS.
+const rightsSpace = 0
+
+func unixRights(fd int) ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+func parseUnixRights(oob []byte) ([]int, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,11 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build evio_poison
+
+package evio
+
+func init() {
+	poisonInput = true
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimits limits the rate at which the loops read the connections that
+// share a label, such as the connections of a tenant, so that one tenant
+// can't take the throughput of the others. A connection is given a label
+// with Options.Label, and the limits are passed to the server with
+// Events.RateLimits. Each label has a token bucket of bytes that's shared
+// by all of its connections, across the loops. The input of a read is
+// taken from the bucket of the connection, and once the bucket runs dry
+// the reads of the connection pause, like with Conn.SuspendUntil, until
+// it has refilled. The input that was read is passed to Data as usual, so
+// the throughput of a label may exceed its rate by a read per connection.
+// The limits may be changed while the server runs, and they don't apply
+// to the connections of Events.Trusted peers.
+type RateLimits struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+// rateBucket is the token bucket of a label.
+type rateBucket struct {
+	rate   float64   // bytes per second
+	burst  float64   // the most tokens that the bucket holds
+	tokens float64   // may go below zero after a large read
+	last   time.Time // when the tokens were last refilled
+}
+
+// Set limits the connections with the label to bytesPerSec, with bursts of
+// up to burst bytes. A burst of zero allows a second's worth of bytes. A
+// rate of zero or less removes the limit.
+func (r *RateLimits) Set(label string, bytesPerSec, burst int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if bytesPerSec <= 0 {
+		delete(r.buckets, label)
+		return
+	}
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	if r.buckets == nil {
+		r.buckets = make(map[string]*rateBucket)
+	}
+	b := r.buckets[label]
+	if b == nil {
+		b = &rateBucket{tokens: float64(burst)}
+		r.buckets[label] = b
+	}
+	b.rate, b.burst = float64(bytesPerSec), float64(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// take takes n bytes from the bucket of the label and returns how long the
+// reads have to wait for the bucket to refill, which is zero when it
+// didn't run dry or the label has no limit.
+func (r *RateLimits) take(label string, n int, now time.Time) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.buckets[label]
+	if b == nil {
+		return 0
+	}
+	if !b.last.IsZero() {
+		b.tokens += b.rate * now.Sub(b.last).Seconds()
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimit takes the input that was read from the bucket of the label, and
+// suspends the reads of the connection until the bucket has refilled when
+// it ran dry. It's called by the loop of the connection.
+func rateLimit(limits *RateLimits, clock Clock, c Conn, label string, n int) {
+	if limits == nil || label == "" {
+		return
+	}
+	if d := limits.take(label, n, clock.Now()); d > 0 {
+		done := make(chan struct{})
+		clock.AfterFunc(d, func() { close(done) })
+		c.SuspendUntil(done)
+	}
+}
@@ -5,13 +5,17 @@
 package evio
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"net"
+	"os"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/jursonmo/evio/internal"
 )
 
 var errClosing = errors.New("closing")
@@ -26,6 +30,14 @@ type stdserver struct {
 	cond     *sync.Cond     // shutdown signaler
 	serr     error          // signal error
 	accepted uintptr        // accept counter
+	rand     *loopRand      // seeded Random balance, nil without a seed
+	started  chan struct{}  // closed when the loops are running
+	done     chan struct{}  // closed when the server is shutting down
+	iplimit  *ipLimit       // connections per source ip
+	fds      *fdGuard       // connections allowed by the fd headroom
+	trace    *tracer        // traces while tracing is on
+	lameDuck int32          // set by Server.SetLameDuck
+	clock    Clock          // time of the timers
 }
 
 type stdudpconn struct {
@@ -33,43 +45,353 @@ type stdudpconn struct {
 	localAddr  net.Addr
 	remoteAddr net.Addr
 	in         []byte
+	pconn      net.PacketConn
 }
 
-func (c *stdudpconn) Context() interface{}       { return nil }
-func (c *stdudpconn) SetContext(ctx interface{}) {}
-func (c *stdudpconn) AddrIndex() int             { return c.addrIndex }
-func (c *stdudpconn) LocalAddr() net.Addr        { return c.localAddr }
-func (c *stdudpconn) RemoteAddr() net.Addr       { return c.remoteAddr }
-func (c *stdudpconn) Wake()                      {}
+func (c *stdudpconn) ID() uint64                  { return 0 }
+func (c *stdudpconn) Context() interface{}        { return nil }
+func (c *stdudpconn) SetContext(ctx interface{})  {}
+func (c *stdudpconn) AddrIndex() int              { return c.addrIndex }
+func (c *stdudpconn) LocalAddr() net.Addr         { return c.localAddr }
+func (c *stdudpconn) RemoteAddr() net.Addr        { return c.remoteAddr }
+func (c *stdudpconn) Wake() error                 { return nil }
+func (c *stdudpconn) Timestamp() time.Time        { return time.Time{} }
+func (c *stdudpconn) ReadableBytes() (int, error) { return 0, ErrUnsupported }
+func (c *stdudpconn) Peek(n int) ([]byte, error)  { return nil, ErrUnsupported }
+func (c *stdudpconn) Ready()                      {}
+func (c *stdudpconn) BeginRequest()               {}
+func (c *stdudpconn) EndRequest()                 {}
+func (c *stdudpconn) SetNoDelay(bool) error       { return ErrUnsupported }
+func (c *stdudpconn) SetKeepAlive(time.Duration) error {
+	return ErrUnsupported
+}
+func (c *stdudpconn) SuspendUntil(<-chan struct{}) error {
+	return ErrUnsupported
+}
+func (c *stdudpconn) CloseWithReason(int, string) error {
+	return ErrUnsupported
+}
+func (c *stdudpconn) SetDeadline(time.Time, func(c Conn) ([]byte, Action)) error {
+	return ErrUnsupported
+}
+func (c *stdudpconn) WriteFrom(io.Reader) error { return ErrUnsupported }
+func (c *stdudpconn) SendUrgent([]byte) error   { return ErrUnsupported }
+func (c *stdudpconn) WriteString(string) error  { return ErrUnsupported }
+func (c *stdudpconn) TryWrite([]byte) error     { return ErrUnsupported }
+func (c *stdudpconn) Drain()                    {}
+func (c *stdudpconn) SetWriteWatermarks(low, high int) error {
+	return ErrUnsupported
+}
+
+// WriteBuffers sends the buffers right away as a single datagram, copied
+// together.
+func (c *stdudpconn) WriteBuffers(bufs net.Buffers) error {
+	_, err := c.pconn.WriteTo(bytes.Join(bufs, nil), c.remoteAddr)
+	return err
+}
+func (c *stdudpconn) PeerCred() (pid, uid, gid int, err error) {
+	return 0, 0, 0, ErrUnsupported
+}
+func (c *stdudpconn) OriginalDst() (net.Addr, error) {
+	return nil, ErrUnsupported
+}
 
 type stdloop struct {
-	idx   int               // loop index
-	ch    chan interface{}  // command channel
-	conns map[*stdconn]bool // track all the conns bound to this loop
+	idx     int               // loop index
+	ch      chan interface{}  // command channel
+	conns   map[*stdconn]bool // track all the conns bound to this loop
+	wakes   int32             // pending wakes
+	wakemax int32             // pending wakes limit, zero is unbounded
+	count   int32             // connection count
+	ctr     loopCounters      // connection and byte counts
 }
 
 type stdconn struct {
 	addrIndex  int
 	localAddr  net.Addr
 	remoteAddr net.Addr
-	conn       net.Conn    // original connection
-	ctx        interface{} // user-defined context
-	loop       *stdloop    // owner loop
-	lnidx      int         // index of listener
-	donein     []byte      // extra data for done connection
-	done       int32       // 0: attached, 1: closed, 2: detached
+	id         uint64        // connection id
+	conn       net.Conn      // original connection
+	ctx        interface{}   // user-defined context
+	loop       *stdloop      // owner loop
+	srv        *stdserver    // owner server
+	lnidx      int           // index of listener
+	donein     []byte        // extra data for done connection
+	done       int32         // 0: attached, 1: closed, 2: detached
+	ready      bool          // handshake completed
+	openTimer  ClockTimer    // open timeout
+	ip         string        // source ip counted by the server's iplimit
+	inbuf      *InBuffer     // tracked by an InboundLimit
+	trusted    bool          // from a peer of Events.Trusted
+	chunk      int           // max size of the Data input
+	src        io.Reader     // streamed into the output by WriteFrom
+	draining   bool          // close once the output is written
+	closeFrame []byte        // written by the drain, for CloseWithReason
+	low, high  int           // write watermarks
+	inflight   int           // requests in flight
+	maxflight  int           // requests in flight at which reads pause
+	paused     int32         // 1: reads are paused
+	resume     chan struct{} // wakes the paused reader
+	suspends   int32         // SuspendUntil calls that wait for their channel
+	held       []byte        // input that was read while suspended
+	label      string        // Options.Label
+	deadlineTm ClockTimer    // calls deadlineFn at the deadline
+	deadlines  int           // counts SetDeadline calls to drop stale timers
+	deadlineFn func(c Conn) (out []byte, action Action)
 }
 
 type wakeReq struct {
+	c       *stdconn
+	counted bool // counted in the loop's pending wakes
+}
+
+type openTimeoutReq struct {
+	c *stdconn
+}
+
+// resumeReq tells the loop of a connection that a channel passed to
+// SuspendUntil was closed.
+type resumeReq struct {
+	c *stdconn
+}
+
+// deadlineReq tells the loop of a connection that the deadline that was set
+// by the numbered SetDeadline call is reached.
+type deadlineReq struct {
 	c *stdconn
+	n int
+}
+
+// closeWhereReq asks a loop to close the connections that match the
+// predicate, and to send the number it closed.
+type closeWhereReq struct {
+	pred func(c Conn) bool
+	done chan int
+}
+
+// moreReq calls the Data event of a connection that returned More.
+// dumpReq asks a loop to send its state for a dump.
+type dumpReq struct {
+	done chan loopDump
+}
+
+type moreReq struct {
+	c *stdconn
+}
+
+func (c *stdconn) ID() uint64                  { return c.id }
+func (c *stdconn) Context() interface{}        { return c.ctx }
+func (c *stdconn) SetContext(ctx interface{})  { c.ctx = ctx }
+func (c *stdconn) AddrIndex() int              { return c.addrIndex }
+func (c *stdconn) LocalAddr() net.Addr         { return c.localAddr }
+func (c *stdconn) RemoteAddr() net.Addr        { return c.remoteAddr }
+func (c *stdconn) Timestamp() time.Time        { return time.Time{} }
+func (c *stdconn) ReadableBytes() (int, error) { return 0, ErrUnsupported }
+func (c *stdconn) Peek(n int) ([]byte, error)  { return nil, ErrUnsupported }
+func (c *stdconn) Ready() {
+	c.ready = true
+	if c.openTimer != nil {
+		c.openTimer.Stop()
+		c.openTimer = nil
+	}
+}
+
+func (c *stdconn) BeginRequest() {
+	c.inflight++
+	if c.maxflight > 0 && c.inflight >= c.maxflight {
+		atomic.StoreInt32(&c.paused, 1)
+	}
+}
+
+func (c *stdconn) EndRequest() {
+	if c.inflight > 0 {
+		c.inflight--
+	}
+	if c.inflight < c.maxflight {
+		c.unpause()
+	}
+}
+
+// SuspendUntil stops passing the input to Data until done is closed. The
+// reader stops before its next read, and the input that it already read
+// is held until the reads resume.
+func (c *stdconn) SuspendUntil(done <-chan struct{}) error {
+	atomic.AddInt32(&c.suspends, 1)
+	l := c.loop
+	go func() {
+		<-done
+		l.ch <- resumeReq{c}
+	}()
+	return nil
+}
+
+// SetDeadline starts a clock timer, which tells the loop to call fn.
+func (c *stdconn) SetDeadline(t time.Time, fn func(c Conn) (out []byte, action Action)) error {
+	if c.deadlineTm != nil {
+		c.deadlineTm.Stop()
+		c.deadlineTm = nil
+	}
+	c.deadlines++
+	c.deadlineFn = nil
+	if t.IsZero() || fn == nil {
+		return nil
+	}
+	c.deadlineFn = fn
+	l, n := c.loop, c.deadlines
+	c.deadlineTm = c.srv.clock.AfterFunc(t.Sub(c.srv.clock.Now()), func() {
+		l.ch <- deadlineReq{c, n}
+	})
+	return nil
+}
+
+// unpause resumes the reads that BeginRequest paused.
+func (c *stdconn) unpause() {
+	if atomic.CompareAndSwapInt32(&c.paused, 1, 0) {
+		select {
+		case c.resume <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *stdconn) SetNoDelay(noDelay bool) error {
+	tc, ok := c.conn.(*net.TCPConn)
+	if !ok {
+		return ErrUnsupported
+	}
+	return tc.SetNoDelay(noDelay)
+}
+
+func (c *stdconn) SetKeepAlive(period time.Duration) error {
+	tc, ok := c.conn.(*net.TCPConn)
+	if !ok {
+		return ErrUnsupported
+	}
+	if period <= 0 {
+		return tc.SetKeepAlive(false)
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tc.SetKeepAlivePeriod(period)
+}
+
+func (c *stdconn) PeerCred() (pid, uid, gid int, err error) {
+	uc, ok := c.conn.(*net.UnixConn)
+	if !ok {
+		return 0, 0, 0, ErrUnsupported
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if cerr := rc.Control(func(fd uintptr) {
+		pid, uid, gid, err = internal.PeerCred(int(fd))
+	}); cerr != nil {
+		return 0, 0, 0, cerr
+	}
+	return pid, uid, gid, err
+}
+
+func (c *stdconn) OriginalDst() (addr net.Addr, err error) {
+	tc, ok := c.conn.(*net.TCPConn)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	if cerr := rc.Control(func(fd uintptr) {
+		addr, err = internal.OriginalDst(int(fd))
+	}); cerr != nil {
+		return nil, cerr
+	}
+	return addr, err
+}
+
+func (c *stdconn) Drain() {
+	c.draining = true
+}
+
+// CloseWithReason drains the connection, which writes the close message
+// once the output of the event was written.
+func (c *stdconn) CloseWithReason(code int, reason string) error {
+	if c.srv.events.CloseFrame == nil {
+		return ErrUnsupported
+	}
+	c.closeFrame = c.srv.events.CloseFrame(c, code, reason)
+	c.draining = true
+	return nil
+}
+
+// SendUrgent writes right away, since the output of the events isn't
+// queued.
+func (c *stdconn) SendUrgent(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	_, err := c.conn.Write(b)
+	return err
 }
 
-func (c *stdconn) Context() interface{}       { return c.ctx }
-func (c *stdconn) SetContext(ctx interface{}) { c.ctx = ctx }
-func (c *stdconn) AddrIndex() int             { return c.addrIndex }
-func (c *stdconn) LocalAddr() net.Addr        { return c.localAddr }
-func (c *stdconn) RemoteAddr() net.Addr       { return c.remoteAddr }
-func (c *stdconn) Wake()                      { c.loop.ch <- wakeReq{c} }
+// SetWriteWatermarks sets the marks, which fire around the writes that are
+// larger than the high mark, since the writes block.
+func (c *stdconn) SetWriteWatermarks(low, high int) error {
+	if err := checkWatermarks(low, high); err != nil {
+		return err
+	}
+	c.low, c.high = low, high
+	return nil
+}
+
+// WriteString writes right away, like SendUrgent.
+func (c *stdconn) WriteString(s string) error {
+	if len(s) > 0 {
+		io.WriteString(c.conn, s)
+	}
+	return nil
+}
+
+// TryWrite writes right away, like SendUrgent.
+func (c *stdconn) TryWrite(b []byte) error {
+	if len(b) > 0 {
+		c.conn.Write(b)
+	}
+	return nil
+}
+
+// WriteBuffers writes right away, like SendUrgent.
+func (c *stdconn) WriteBuffers(bufs net.Buffers) error {
+	bufs.WriteTo(c.conn)
+	return nil
+}
+
+func (c *stdconn) WriteFrom(r io.Reader) error {
+	if c.src != nil {
+		r = io.MultiReader(c.src, r)
+	}
+	c.src = r
+	return nil
+}
+
+func (c *stdconn) Wake() error {
+	l := c.loop
+	if l.wakemax > 0 && atomic.AddInt32(&l.wakes, 1) > l.wakemax {
+		atomic.AddInt32(&l.wakes, -1)
+		return ErrQueueFull
+	}
+	l.ch <- wakeReq{c, l.wakemax > 0}
+	return nil
+}
+
+// wake is like Wake but isn't limited by the wake queue size.
+func (c *stdconn) wake() { c.loop.ch <- wakeReq{c, false} }
+
+func (c *stdconn) trackInBuffer(b *InBuffer) (old *InBuffer) {
+	old, c.inbuf = c.inbuf, b
+	return old
+}
 
 type stdin struct {
 	c  *stdconn
@@ -90,6 +412,28 @@ func (s *stdserver) waitForShutdown() error {
 	return err
 }
 
+// nextLoop returns the loop of the next accepted connection.
+func (s *stdserver) nextLoop() *stdloop {
+	if s.rand != nil {
+		return s.loops[s.rand.pick(len(s.loops))]
+	}
+	return s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+}
+
+// acceptDecision passes the balance decision of a connection that was
+// accepted to the OnAcceptDecision event.
+func (s *stdserver) acceptDecision(c *stdconn) {
+	d := AcceptDecision{ID: c.id, AddrIndex: c.lnidx, RemoteAddr: c.conn.RemoteAddr(),
+		Balance: RoundRobin, Loop: c.loop.idx, Conns: make([]int, len(s.loops))}
+	if s.rand != nil {
+		d.Balance = Random
+	}
+	for i, l := range s.loops {
+		d.Conns[i] = int(atomic.LoadInt32(&l.count))
+	}
+	s.events.OnAcceptDecision(d)
+}
+
 // signalShutdown signals a shutdown an begins server closing
 func (s *stdserver) signalShutdown(err error) {
 	s.cond.L.Lock()
@@ -112,11 +456,29 @@ func stdserve(events Events, listeners []*listener) error {
 	s.events = events
 	s.lns = listeners
 	s.cond = sync.NewCond(&sync.Mutex{})
+	s.started = make(chan struct{})
+	s.done = make(chan struct{})
+	s.iplimit = newIPLimit(events.MaxConnsPerIP)
+	s.fds = newFDGuard(events.FDHeadroom)
+	s.trace = &tracer{log: events.Logger}
+	s.clock = eventsClock(events)
+	if events.LoadBalance == Random {
+		s.rand = newLoopRand(events.Seed)
+	}
 
 	//println("-- server starting")
 	if events.Serving != nil {
 		var svr Server
 		svr.NumLoops = numLoops
+		svr.lns = listeners
+		svr.attach = s.attach
+		svr.stats = s.stats
+		svr.closeWhere = s.closeWhere
+		svr.tlsConfigs = tlsConfigs(s.events)
+		svr.trace = s.trace
+		svr.lameDuck = &s.lameDuck
+		svr.dump = s.dump
+		svr.done = s.done
 		svr.Addrs = make([]net.Addr, len(listeners))
 		for i, ln := range listeners {
 			svr.Addrs[i] = ln.lnaddr
@@ -124,20 +486,23 @@ func stdserve(events Events, listeners []*listener) error {
 		action := events.Serving(svr)
 		switch action {
 		case Shutdown:
+			close(s.done)
 			return nil
 		}
 	}
 	for i := 0; i < numLoops; i++ {
 		s.loops = append(s.loops, &stdloop{
-			idx:   i,
-			ch:    make(chan interface{}),
-			conns: make(map[*stdconn]bool),
+			idx:     i,
+			ch:      make(chan interface{}),
+			conns:   make(map[*stdconn]bool),
+			wakemax: int32(events.WakeQueueSize),
 		})
 	}
 	var ferr error
 	defer func() {
 		// wait on a signal for shutdown
 		ferr = s.waitForShutdown()
+		close(s.done)
 
 		// notify all loops to close by closing all listeners
 		for _, l := range s.loops {
@@ -147,6 +512,11 @@ func stdserve(events Events, listeners []*listener) error {
 		// wait on all loops to main loop channel events
 		s.loopwg.Wait()
 
+		// answer the connections that the listeners didn't get to
+		if s.events.DrainBacklog != nil {
+			stdDrainBacklog(s)
+		}
+
 		// shutdown all listeners
 		for i := 0; i < len(s.lns); i++ {
 			s.lns[i].close()
@@ -165,12 +535,22 @@ func stdserve(events Events, listeners []*listener) error {
 	}()
 	s.loopwg.Add(numLoops)
 	for i := 0; i < numLoops; i++ {
-		go stdloopRun(s, s.loops[i])
+		l := s.loops[i]
+		goLabeled(events.ProfileLabels, "loop", i, func() { stdloopRun(s, l) })
 	}
 	s.lnwg.Add(len(listeners))
 	for i := 0; i < len(listeners); i++ {
-		go stdlistenerRun(s, listeners[i], i)
+		ln, i := listeners[i], i
+		goLabeled(events.ProfileLabels, "listener", i, func() { stdlistenerRun(s, ln, i) })
 	}
+	if events.DumpSignal != nil && events.Logger != nil {
+		watchDumpSignal(events.DumpSignal, s.dump, s.done)
+	}
+	if events.StatsInterval > 0 && events.OnStats != nil {
+		svr := Server{stats: s.stats, lameDuck: &s.lameDuck}
+		watchStats(s.clock, events.StatsInterval, svr.Stats, events.OnStats, s.done)
+	}
+	close(s.started)
 	return ferr
 }
 
@@ -180,46 +560,287 @@ func stdlistenerRun(s *stdserver, ln *listener, lnidx int) {
 		s.signalShutdown(ferr)
 		s.lnwg.Done()
 	}()
-	var packet [0xFFFF]byte
+	var packet []byte
+	if ln.pconn != nil {
+		packet = make([]byte, ln.udpBufSize())
+	} else {
+		packet = make([]byte, 0xFFFF)
+	}
 	for {
 		if ln.pconn != nil {
 			// udp
-			n, addr, err := ln.pconn.ReadFrom(packet[:])
+			n, addr, err := ln.pconn.ReadFrom(packet)
 			if err != nil {
 				ferr = err
 				return
 			}
-			l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
+			l := s.nextLoop()
 			l.ch <- &stdudpconn{
 				addrIndex:  lnidx,
 				localAddr:  ln.lnaddr,
 				remoteAddr: addr,
 				in:         append([]byte{}, packet[:n]...),
+				pconn:      ln.pconn,
 			}
 		} else {
 			// tcp
+			if ferr = stdwaitFDs(s); ferr != nil {
+				return
+			}
 			conn, err := ln.ln.Accept()
+			if err == nil {
+				// the accept may have been waiting since before the limit
+				// was reached, then the connection waits instead
+				if ferr = stdwaitFDs(s); ferr != nil {
+					conn.Close()
+					return
+				}
+			}
 			if err != nil {
-				ferr = err
-				return
+				transient, pause := transientAcceptError(err)
+				if !transient {
+					ferr = err
+					return
+				}
+				if s.events.OnAcceptError != nil {
+					switch s.events.OnAcceptError(err) {
+					case Shutdown:
+						ferr = errClosing
+						return
+					}
+				}
+				if pause {
+					clockSleep(s.clock, acceptPause)
+				}
+				continue
 			}
-			l := s.loops[int(atomic.AddUintptr(&s.accepted, 1))%len(s.loops)]
-			c := &stdconn{conn: conn, loop: l, lnidx: lnidx}
-			l.ch <- c
-			go func(c *stdconn) {
-				var packet [0xFFFF]byte
-				for {
-					n, err := c.conn.Read(packet[:])
-					if err != nil {
-						c.conn.SetReadDeadline(time.Time{})
-						l.ch <- &stderr{c, err}
+			if len(s.events.ListenOptions) > 0 {
+				if err := sysControl(conn, func(fd int) error {
+					return applyListenOptions(s.events.ListenOptions, fd)
+				}); err != nil {
+					conn.Close()
+					if s.events.OnAcceptError != nil && s.events.OnAcceptError(err) == Shutdown {
+						ferr = errClosing
 						return
 					}
-					l.ch <- &stdin{c, append([]byte{}, packet[:n]...)}
+					continue
 				}
-			}(c)
+			}
+			if accept := s.events.Listeners[lnidx].OnAccept; accept != nil && !accept(conn.RemoteAddr()) {
+				conn.Close()
+				continue
+			}
+			ip := addrIP(conn.RemoteAddr())
+			trusted := trustedIP(s.events.Trusted, ip)
+			if trusted {
+				// trusted peers aren't counted
+				ip = ""
+			}
+			if !s.iplimit.acquire(ip) {
+				conn.Close()
+				continue
+			}
+			l := s.nextLoop()
+			c := &stdconn{id: nextConnID(s.events.ConnIDGen), conn: conn, loop: l, srv: s, lnidx: lnidx, ip: ip,
+				trusted: trusted, resume: make(chan struct{}, 1)}
+			if s.events.OnAcceptDecision != nil {
+				s.acceptDecision(c)
+			}
+			s.fds.acquire()
+			select {
+			case l.ch <- c:
+				go stdconnRun(l, c)
+			case <-s.done:
+				// the loops are stopping
+				stdBacklogConn(s, c)
+				s.iplimit.release(c.ip)
+				s.fds.release()
+			}
+		}
+	}
+}
+
+// stdBacklogConn passes a connection that was accepted as the server shut
+// down to the DrainBacklog event, writes the output and closes it. Without
+// DrainBacklog, it's just closed.
+func stdBacklogConn(s *stdserver, c *stdconn) {
+	atomic.StoreInt32(&c.done, 1)
+	c.addrIndex = c.lnidx
+	if c.lnidx >= 0 {
+		c.localAddr = s.lns[c.lnidx].lnaddr
+	} else {
+		c.localAddr = c.conn.LocalAddr()
+	}
+	c.remoteAddr = c.conn.RemoteAddr()
+	if s.events.DrainBacklog != nil {
+		if out := s.events.DrainBacklog(c); len(out) > 0 {
+			c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			c.conn.Write(out)
+		}
+		if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
 		}
 	}
+	c.conn.Close()
+}
+
+// stdconnRun reads from the connection and sends the input to its loop.
+func stdconnRun(l *stdloop, c *stdconn) {
+	var packet [0xFFFF]byte
+	for {
+		for (atomic.LoadInt32(&c.paused) == 1 || atomic.LoadInt32(&c.suspends) > 0) &&
+			atomic.LoadInt32(&c.done) == 0 {
+			<-c.resume
+		}
+		n, err := c.conn.Read(packet[:])
+		if err != nil {
+			c.conn.SetReadDeadline(time.Time{})
+			l.ch <- &stderr{c, err}
+			return
+		}
+		l.ch <- &stdin{c, append([]byte{}, packet[:n]...)}
+	}
+}
+
+// stdwaitFDs pauses accepting while there's no room for connections under
+// Events.FDHeadroom.
+func stdwaitFDs(s *stdserver) error {
+	for s.fds.full() {
+		if s.events.OnAcceptError != nil && s.events.OnAcceptError(ErrFDHeadroom) == Shutdown {
+			return errClosing
+		}
+		clockSleep(s.clock, acceptPause)
+		select {
+		case <-s.done:
+			return errClosing
+		default:
+		}
+	}
+	return nil
+}
+
+// stats returns a snapshot of the server's loops.
+func (s *stdserver) stats() Stats {
+	var st Stats
+	select {
+	case <-s.started:
+	default:
+		return st
+	}
+	for _, l := range s.loops {
+		ls := LoopStats{Conns: int(atomic.LoadInt32(&l.count))}
+		l.ctr.fill(&ls)
+		st.Conns += ls.Conns
+		st.Loops = append(st.Loops, ls)
+	}
+	listenStats(&st, s.lns)
+	return st
+}
+
+// closeWhere closes the matching connections on all of the loops.
+func (s *stdserver) closeWhere(pred func(c Conn) bool) int {
+	<-s.started
+	done := make(chan int, len(s.loops))
+	var n int
+	for _, l := range s.loops {
+		select {
+		case l.ch <- closeWhereReq{pred, done}:
+		case <-s.done:
+			return n
+		}
+		select {
+		case closed := <-done:
+			n += closed
+		case <-s.done:
+			return n
+		}
+	}
+	return n
+}
+
+// stdloopCloseWhere closes the connections of the loop that match the
+// predicate.
+func stdloopCloseWhere(s *stdserver, l *stdloop, pred func(c Conn) bool, done chan int) error {
+	var n int
+	for c := range l.conns {
+		if atomic.LoadInt32(&c.done) == 0 && pred(userConn(c)) {
+			n++
+			stdloopClose(s, l, c)
+		}
+	}
+	done <- n
+	return nil
+}
+
+// dump writes the state of the loops to the logger. The writes block, so
+// no connection has pending output. It waits for the loops, so it must not
+// be called from an event.
+func (s *stdserver) dump() {
+	select {
+	case <-s.started:
+	default:
+		return
+	}
+	done := make(chan loopDump, 1)
+	var dumps []loopDump
+	for _, l := range s.loops {
+		select {
+		case l.ch <- dumpReq{done}:
+		case <-s.done:
+			return
+		}
+		select {
+		case d := <-done:
+			dumps = append(dumps, d)
+		case <-s.done:
+			return
+		}
+	}
+	writeDump(s.events.Logger, dumps)
+}
+
+// attach hands a connection to one of the loops.
+func (s *stdserver) attach(rwc io.ReadWriteCloser) error {
+	var conn net.Conn
+	var in []byte
+	var ctx interface{}
+	switch v := rwc.(type) {
+	case *stddetachedConn:
+		conn, in = v.conn, v.in
+	case *handoffConn:
+		var err error
+		conn, err = net.FileConn(v.File)
+		v.Close()
+		if err != nil {
+			return err
+		}
+		in = v.in
+		if len(v.state) > 0 {
+			ctx = v.state
+		}
+	case net.Conn:
+		conn = v
+	case *os.File:
+		var err error
+		conn, err = net.FileConn(v)
+		v.Close()
+		if err != nil {
+			return err
+		}
+	default:
+		return ErrUnsupported
+	}
+	<-s.started
+	l := s.nextLoop()
+	c := &stdconn{id: nextConnID(s.events.ConnIDGen), conn: conn, loop: l, srv: s, lnidx: -1,
+		resume: make(chan struct{}, 1), ctx: ctx}
+	s.fds.acquire()
+	l.ch <- c
+	if len(in) > 0 {
+		l.ch <- &stdin{c, in}
+	}
+	go stdconnRun(l, c)
+	return nil
 }
 
 func stdloopRun(s *stdserver, l *stdloop) {
@@ -248,7 +869,7 @@ func stdloopRun(s *stdserver, l *stdloop) {
 				if !ok {
 					break
 				}
-				time.Sleep(delay)
+				clockSleep(s.clock, delay)
 			}
 		}()
 	}
@@ -269,13 +890,41 @@ func stdloopRun(s *stdserver, l *stdloop) {
 			case *stdconn:
 				err = stdloopAccept(s, l, v)
 			case *stdin:
+				atomic.AddInt64(&l.ctr.bytesIn, int64(len(v.in)))
+				if l.conns[v.c] && !v.c.trusted {
+					rateLimit(s.events.RateLimits, s.clock, v.c, v.c.label, len(v.in))
+				}
 				err = stdloopRead(s, l, v.c, v.in)
 			case *stdudpconn:
 				err = stdloopReadUDP(s, l, v)
 			case *stderr:
 				err = stdloopError(s, l, v.c, v.err)
 			case wakeReq:
+				if v.counted {
+					atomic.AddInt32(&l.wakes, -1)
+				}
 				err = stdloopRead(s, l, v.c, nil)
+			case resumeReq:
+				if l.conns[v.c] {
+					err = stdloopResume(s, l, v.c)
+				}
+			case openTimeoutReq:
+				if l.conns[v.c] && !v.c.ready {
+					atomic.AddInt64(&l.ctr.timeouts, 1)
+					err = stdloopClose(s, l, v.c)
+				}
+			case deadlineReq:
+				if l.conns[v.c] && v.c.deadlines == v.n {
+					err = stdloopDeadline(s, l, v.c)
+				}
+			case closeWhereReq:
+				err = stdloopCloseWhere(s, l, v.pred, v.done)
+			case dumpReq:
+				v.done <- loopDump{idx: l.idx, conns: len(l.conns), notes: int(atomic.LoadInt32(&l.wakes))}
+			case moreReq:
+				if l.conns[v.c] && atomic.LoadInt32(&v.c.done) == 0 {
+					err = stdloopRead(s, l, v.c, nil)
+				}
 			}
 		}
 		if err != nil {
@@ -286,6 +935,7 @@ func stdloopRun(s *stdserver, l *stdloop) {
 
 func stdloopEgress(s *stdserver, l *stdloop) {
 	var closed bool
+	var backlog int // readers of the connections that were never opened
 loop:
 	for v := range l.ch {
 		switch v := v.(type) {
@@ -296,10 +946,21 @@ loop:
 					stdloopClose(s, l, c)
 				}
 			}
+		case *stdconn:
+			// accepted as the loop stopped, and its reader reports
+			// once it's closed
+			backlog++
+			stdBacklogConn(s, v)
+			s.iplimit.release(v.ip)
+			s.fds.release()
 		case *stderr:
+			if !l.conns[v.c] {
+				backlog--
+				break
+			}
 			stdloopError(s, l, v.c, v.err)
 		}
-		if len(l.conns) == 0 && closed {
+		if len(l.conns) == 0 && closed && backlog == 0 {
 			break loop
 		}
 	}
@@ -307,6 +968,17 @@ loop:
 
 func stdloopError(s *stdserver, l *stdloop, c *stdconn, err error) error {
 	delete(l.conns, c)
+	atomic.AddInt32(&l.count, -1)
+	atomic.AddInt64(&l.ctr.closes, 1)
+	s.iplimit.release(c.ip)
+	s.events.InboundLimit.release(c.inbuf)
+	s.fds.release()
+	if c.openTimer != nil {
+		c.openTimer.Stop()
+	}
+	if c.deadlineTm != nil {
+		c.deadlineTm.Stop()
+	}
 	closeEvent := true
 	switch atomic.LoadInt32(&c.done) {
 	case 0: // read error
@@ -323,13 +995,19 @@ func stdloopError(s *stdserver, l *stdloop, c *stdconn, err error) error {
 			c.conn.Close()
 		} else {
 			closeEvent = false
-			switch s.events.Detached(c, &stddetachedConn{c.conn, c.donein}) {
+			if s.trace.enabled() {
+				s.trace.printf("detached conn %d on loop %d", c.id, l.idx)
+			}
+			switch s.events.Detached(c, &stddetachedConn{c.conn, c.donein, c.ctx}) {
 			case Shutdown:
 				return errClosing
 			}
 		}
 	}
 	if closeEvent {
+		if s.trace.enabled() {
+			s.trace.printf("closed conn %d on loop %d: %v", c.id, l.idx, err)
+		}
 		if s.events.Closed != nil {
 			switch s.events.Closed(c, err) {
 			case Shutdown:
@@ -341,8 +1019,9 @@ func stdloopError(s *stdserver, l *stdloop, c *stdconn, err error) error {
 }
 
 type stddetachedConn struct {
-	conn net.Conn // original conn
-	in   []byte   // extra input data
+	conn net.Conn    // original conn
+	in   []byte      // extra input data
+	ctx  interface{} // context of the connection when it was detached
 }
 
 func (c *stddetachedConn) Read(p []byte) (n int, err error) {
@@ -371,32 +1050,162 @@ func (c *stddetachedConn) Close() error {
 
 func (c *stddetachedConn) Wake() {}
 
+func (c *stddetachedConn) Context() interface{} { return c.ctx }
+
+func (c *stddetachedConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *stddetachedConn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *stddetachedConn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *stddetachedConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *stddetachedConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// stdloopResume resumes the reads that SuspendUntil paused once the last
+// of its channels was closed, and passes on the input that was held.
+func stdloopResume(s *stdserver, l *stdloop, c *stdconn) error {
+	if atomic.AddInt32(&c.suspends, -1) > 0 {
+		return nil
+	}
+	in := c.held
+	c.held = nil
+	select {
+	case c.resume <- struct{}{}:
+	default:
+	}
+	if len(in) == 0 {
+		return nil
+	}
+	return stdloopRead(s, l, c, in)
+}
+
 func stdloopRead(s *stdserver, l *stdloop, c *stdconn, in []byte) error {
 	if atomic.LoadInt32(&c.done) == 2 {
 		// should not ignore reads for detached connections
 		c.donein = append(c.donein, in...)
 		return nil
 	}
+	if c.draining || atomic.LoadInt32(&c.done) == 1 {
+		// closing, the input that was read before the deadline is dropped
+		return nil
+	}
+	if len(in) > 0 && atomic.LoadInt32(&c.suspends) > 0 {
+		c.held = append(c.held, in...)
+		return nil
+	}
+	if in != nil && s.trace.enabled() {
+		s.trace.printf("read %d bytes from conn %d", len(in), c.id)
+	}
 	if s.events.Data != nil {
-		out, action := s.events.Data(c, in)
-		if len(out) > 0 {
-			if s.events.PreWrite != nil {
-				s.events.PreWrite()
+		var more bool
+		for first := true; first || len(in) > 0; first = false {
+			chunk := in
+			if c.chunk > 0 && len(chunk) > c.chunk {
+				chunk = chunk[:c.chunk]
+			}
+			in = in[len(chunk):]
+			out, action := s.events.Data(c, chunk)
+			stdloopWrite(s, c, out)
+			if action >= UserAction {
+				action = userAction(s.events.Actions, c, action)
+			}
+			switch action {
+			case Shutdown:
+				return errClosing
+			case Detach:
+				c.donein = append(c.donein, in...)
+				return stdloopDetach(s, l, c)
+			case Close:
+				return stdloopClose(s, l, c)
+			case More:
+				more = true
+			}
+			if c.draining {
+				return stdloopDrain(s, l, c)
 			}
-			c.conn.Write(out)
 		}
-		switch action {
-		case Shutdown:
-			return errClosing
-		case Detach:
-			return stdloopDetach(s, l, c)
-		case Close:
-			return stdloopClose(s, l, c)
+		if more {
+			stdloopMore(l, c)
 		}
 	}
 	return nil
 }
 
+// stdloopDeadline calls the deadline function of the connection, like an
+// event.
+func stdloopDeadline(s *stdserver, l *stdloop, c *stdconn) error {
+	fn := c.deadlineFn
+	c.deadlineTm, c.deadlineFn = nil, nil
+	if fn == nil || c.draining || atomic.LoadInt32(&c.done) != 0 {
+		return nil
+	}
+	atomic.AddInt64(&l.ctr.timeouts, 1)
+	out, action := fn(c)
+	stdloopWrite(s, c, out)
+	if action >= UserAction {
+		action = userAction(s.events.Actions, c, action)
+	}
+	switch action {
+	case Shutdown:
+		return errClosing
+	case Detach:
+		return stdloopDetach(s, l, c)
+	case Close:
+		return stdloopClose(s, l, c)
+	case More:
+		stdloopMore(l, c)
+	}
+	if c.draining {
+		return stdloopDrain(s, l, c)
+	}
+	return nil
+}
+
+// stdloopMore calls the Data event again once the loop is free, which lets
+// the other connections run between the steps. The output was written
+// already, because the writes block.
+func stdloopMore(l *stdloop, c *stdconn) {
+	go func() { l.ch <- moreReq{c} }()
+}
+
+// stdloopWrite writes data to the connection, followed by the reader of
+// WriteFrom. The writes block, so the buffer events fire around them.
+func stdloopWrite(s *stdserver, c *stdconn, data []byte) {
+	src := c.src
+	c.src = nil
+	if len(data) == 0 && src == nil {
+		return
+	}
+	if s.events.OnBufferFull != nil {
+		s.events.OnBufferFull(c)
+	}
+	high := c.high > 0 && len(data) >= c.high
+	if high && s.events.OnWriteHigh != nil {
+		s.events.OnWriteHigh(c)
+	}
+	if s.events.PreWrite != nil {
+		s.events.PreWrite()
+	}
+	n, err := c.conn.Write(data)
+	atomic.AddInt64(&c.loop.ctr.bytesOut, int64(n))
+	if s.trace.enabled() {
+		s.trace.printf("wrote %d of %d bytes to conn %d: %v", n, len(data), c.id, err)
+	}
+	if src != nil {
+		n, err := io.CopyBuffer(c.conn, src, make([]byte, writeFromChunk))
+		atomic.AddInt64(&c.loop.ctr.bytesOut, n)
+		if s.trace.enabled() {
+			s.trace.printf("wrote %d bytes from a reader to conn %d: %v", n, c.id, err)
+		}
+		if err != nil {
+			c.conn.Close()
+		}
+	}
+	if high && s.events.OnWriteLow != nil {
+		s.events.OnWriteLow(c)
+	}
+	if s.events.OnBufferEmpty != nil {
+		s.events.OnBufferEmpty(c)
+	}
+}
+
 func stdloopReadUDP(s *stdserver, l *stdloop, c *stdudpconn) error {
 	if s.events.Data != nil {
 		out, action := s.events.Data(c, c.in)
@@ -404,7 +1213,12 @@ func stdloopReadUDP(s *stdserver, l *stdloop, c *stdudpconn) error {
 			if s.events.PreWrite != nil {
 				s.events.PreWrite()
 			}
-			s.lns[c.addrIndex].pconn.WriteTo(out, c.remoteAddr)
+			pconn := s.lns[c.addrIndex].pconn
+			for seg := s.events.UDPSegment; seg > 0 && len(out) > seg; {
+				pconn.WriteTo(out[:seg], c.remoteAddr)
+				out = out[seg:]
+			}
+			pconn.WriteTo(out, c.remoteAddr)
 		}
 		switch action {
 		case Shutdown:
@@ -417,35 +1231,70 @@ func stdloopReadUDP(s *stdserver, l *stdloop, c *stdudpconn) error {
 func stdloopDetach(s *stdserver, l *stdloop, c *stdconn) error {
 	atomic.StoreInt32(&c.done, 2)
 	c.conn.SetReadDeadline(time.Now())
+	c.unpause()
 	return nil
 }
 
 func stdloopClose(s *stdserver, l *stdloop, c *stdconn) error {
 	atomic.StoreInt32(&c.done, 1)
 	c.conn.SetReadDeadline(time.Now())
+	c.unpause()
+	// wake the reader when SuspendUntil paused it
+	select {
+	case c.resume <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
 func stdloopAccept(s *stdserver, l *stdloop, c *stdconn) error {
 	l.conns[c] = true
+	atomic.AddInt32(&l.count, 1)
+	atomic.AddInt64(&l.ctr.accepts, 1)
 	c.addrIndex = c.lnidx
-	c.localAddr = s.lns[c.lnidx].lnaddr
+	if c.lnidx >= 0 {
+		c.localAddr = s.lns[c.lnidx].lnaddr
+	} else {
+		c.localAddr = c.conn.LocalAddr()
+	}
 	c.remoteAddr = c.conn.RemoteAddr()
+	if s.trace.enabled() {
+		s.trace.printf("accepted conn %d %v -> %v on listener %d loop %d",
+			c.id, c.remoteAddr, c.localAddr, c.lnidx, l.idx)
+	}
 
 	if s.events.Opened != nil {
 		out, opts, action := s.events.Opened(c)
-		if len(out) > 0 {
-			if s.events.PreWrite != nil {
-				s.events.PreWrite()
-			}
-			c.conn.Write(out)
-		}
+		stdloopWrite(s, c, out)
+		c.chunk = opts.MaxDataChunk
+		c.maxflight = opts.MaxInFlight
+		c.label = opts.Label
 		if opts.TCPKeepAlive > 0 {
 			if c, ok := c.conn.(*net.TCPConn); ok {
 				c.SetKeepAlive(true)
 				c.SetKeepAlivePeriod(opts.TCPKeepAlive)
 			}
 		}
+		if opts.TCPUserTimeout > 0 {
+			if c, ok := c.conn.(*net.TCPConn); ok {
+				sysControl(c, func(fd int) error {
+					return internal.SetUserTimeout(fd, int(opts.TCPUserTimeout/time.Millisecond))
+				})
+			}
+		}
+		if opts.Mark != 0 {
+			sysControl(c.conn, func(fd int) error {
+				return internal.SetMark(fd, opts.Mark)
+			})
+		}
+		if opts.OpenTimeout > 0 && !c.ready {
+			c.openTimer = s.clock.AfterFunc(opts.OpenTimeout, func() {
+				l.ch <- openTimeoutReq{c}
+			})
+		}
+		if action >= UserAction {
+			action = userAction(s.events.Actions, c, action)
+		}
 		switch action {
 		case Shutdown:
 			return errClosing
@@ -453,7 +1302,34 @@ func stdloopAccept(s *stdserver, l *stdloop, c *stdconn) error {
 			return stdloopDetach(s, l, c)
 		case Close:
 			return stdloopClose(s, l, c)
+		case More:
+			stdloopMore(l, c)
+		}
+		if c.draining {
+			return stdloopDrain(s, l, c)
 		}
 	}
 	return nil
 }
+
+// stdloopDrain shuts down the write side of a draining connection once its
+// output was written. The input is discarded until the peer closes, and the
+// open timer closes the connection if the peer doesn't.
+func stdloopDrain(s *stdserver, l *stdloop, c *stdconn) error {
+	if frame := c.closeFrame; frame != nil {
+		c.closeFrame = nil
+		stdloopWrite(s, c, frame)
+	}
+	cw, ok := c.conn.(interface{ CloseWrite() error })
+	if !ok || cw.CloseWrite() != nil {
+		return stdloopClose(s, l, c)
+	}
+	if c.openTimer != nil {
+		c.openTimer.Stop()
+	}
+	c.ready = false
+	c.openTimer = s.clock.AfterFunc(drainLinger, func() {
+		l.ch <- openTimeoutReq{c}
+	})
+	return nil
+}
@@ -6,11 +6,22 @@ package evio
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"math/rand"
 	"net"
 	"os"
+	"runtime"
+	"runtime/pprof"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -77,12 +88,17 @@ func TestServe(t *testing.T) {
 }
 
 func testServe(network, addr string, unix bool, nclients, nloops int, balance LoadBalance) {
+	testServeBackend(network, addr, unix, nclients, nloops, balance, DefaultBackend)
+}
+
+func testServeBackend(network, addr string, unix bool, nclients, nloops int, balance LoadBalance, backend Backend) {
 	var started int32
 	var connected int32
 	var disconnected int32
 
 	var events Events
 	events.LoadBalance = balance
+	events.Backend = backend
 	events.NumLoops = nloops
 	events.Serving = func(srv Server) (action Action) {
 		return
@@ -476,3 +492,3970 @@ func TestReuseport(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestTimestamping(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_TIMESTAMPING is only supported on linux")
+	}
+	var ts time.Time
+	start := time.Now()
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.Timestamping = true
+		return []byte("ready\r\n"), opts, None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		// the kernel may enable timestamping lazily, so the first few
+		// packets might not carry one.
+		if ts = c.Timestamp(); ts.IsZero() {
+			return []byte("again\r\n"), None
+		}
+		return nil, Shutdown
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9960")
+			must(err)
+			defer c.Close()
+			rd := bufio.NewReader(c)
+			for i := 0; i < 50; i++ {
+				if _, err := rd.ReadBytes('\n'); err != nil {
+					return
+				}
+				time.Sleep(time.Millisecond * 10)
+				c.Write([]byte("packet"))
+			}
+		}()
+		return
+	}
+	must(Serve(events, "tcp://:9960"))
+	if ts.IsZero() {
+		t.Fatal("expected a receive timestamp")
+	}
+	if ts.Before(start.Add(-time.Second)) || ts.After(time.Now().Add(time.Second)) {
+		t.Fatalf("timestamp %v out of range", ts)
+	}
+}
+
+func TestServeFiles(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		testServeFiles(t, "tcp", ":9961")
+	})
+	t.Run("unix", func(t *testing.T) {
+		testServeFiles(t, "unix", "socket9961")
+	})
+}
+
+func testServeFiles(t *testing.T, network, addr string) {
+	// the first server hands its listener to the second one and shuts down,
+	// like a process that re-executes itself.
+	var files []*os.File
+	var events Events
+	events.Serving = func(srv Server) (action Action) {
+		var err error
+		files, err = srv.ListenerFiles()
+		must(err)
+		return Shutdown
+	}
+	must(Serve(events, network+"://"+addr))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files))
+	}
+
+	var greeting string
+	events = Events{}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte("second\r\n"), opts, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial(network, addr)
+			must(err)
+			defer c.Close()
+			line, err := bufio.NewReader(c).ReadString('\n')
+			must(err)
+			greeting = line
+			c.Write([]byte("bye"))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return nil, Shutdown
+	}
+	must(ServeFiles(events, files...))
+	if greeting != "second\r\n" {
+		t.Fatalf("expected greeting from the second server, got %q", greeting)
+	}
+}
+
+func TestReadableBytes(t *testing.T) {
+	var readable int
+	var events Events
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9963")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("0123456789"))
+			c.Read([]byte{0})
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		for i := 0; i < 100; i++ {
+			n, err := c.ReadableBytes()
+			must(err)
+			if readable = n; n == 10 {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return nil, Shutdown
+	}
+	must(Serve(events, "tcp://:9963"))
+	if readable != 10 {
+		t.Fatalf("expected 10 readable bytes, got %d", readable)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Peek is not supported on windows")
+	}
+	var peeked, data string
+	var negErr error
+	var events Events
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9982")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("HELO world"))
+			c.Read([]byte{0})
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		_, negErr = c.Peek(-1)
+		for i := 0; i < 100; i++ {
+			p, err := c.Peek(4)
+			must(err)
+			if peeked = string(p); len(p) == 4 {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		data = string(in)
+		return nil, Shutdown
+	}
+	must(Serve(events, "tcp://:9982"))
+	if negErr != errPeekSize {
+		t.Fatalf("expected errPeekSize for a negative size, got %v", negErr)
+	}
+	if peeked != "HELO" {
+		t.Fatalf("expected to peek %q, got %q", "HELO", peeked)
+	}
+	if data != "HELO world" {
+		t.Fatalf("expected Data to get %q, got %q", "HELO world", data)
+	}
+}
+
+func TestBufferEvents(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testBufferEvents(t, "tcp", ":9965") })
+	t.Run("stdlib", func(t *testing.T) { testBufferEvents(t, "tcp-net", ":9966") })
+}
+
+func testBufferEvents(t *testing.T, network, addr string) {
+	big := make([]byte, 8*1024*1024)
+	var seq []string
+	var events Events
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			_, err = io.ReadFull(c, make([]byte, len(big)))
+			must(err)
+			c.Write([]byte("again"))
+			_, err = io.ReadFull(c, make([]byte, len(big)))
+			must(err)
+			c.Write([]byte("done"))
+		}()
+		return
+	}
+	events.OnBufferFull = func(c Conn) {
+		seq = append(seq, "full")
+	}
+	events.OnBufferEmpty = func(c Conn) {
+		seq = append(seq, "empty")
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return big, opts, None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "done" {
+			return nil, Shutdown
+		}
+		return big, None
+	}
+	must(Serve(events, network+"://"+addr))
+	if strings.Join(seq, ",") != "full,empty,full,empty" {
+		t.Fatalf("unexpected buffer events: %v", seq)
+	}
+}
+
+func TestOpenTimeout(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testOpenTimeout(t, "tcp", ":9972") })
+	t.Run("stdlib", func(t *testing.T) { testOpenTimeout(t, "tcp-net", ":9973") })
+}
+
+func testOpenTimeout(t *testing.T, network, addr string) {
+	const timeout = time.Millisecond * 200
+	var reaped time.Duration
+	var echoed string
+	var events Events
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			// never sends the prologue
+			start := time.Now()
+			idle, err := net.Dial("tcp", addr)
+			must(err)
+			defer idle.Close()
+			if _, err := idle.Read(make([]byte, 1)); err == io.EOF {
+				reaped = time.Since(start)
+			}
+
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("hello"))
+			time.Sleep(timeout * 2)
+			c.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(c, buf)
+			must(err)
+			echoed = string(buf)
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.OpenTimeout = timeout
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "hello":
+			c.Ready()
+		case "quit":
+			action = Shutdown
+		default:
+			out = in
+		}
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	if reaped < timeout || reaped > timeout*5 {
+		t.Fatalf("expected idle connection to be closed after %v, got %v", timeout, reaped)
+	}
+	if echoed != "ping" {
+		t.Fatalf("expected ready connection to stay open, got %q", echoed)
+	}
+}
+
+func TestPool(t *testing.T) {
+	pool := NewPool(2)
+	defer pool.Close()
+	var wg sync.WaitGroup
+	serve := func(addr, prefix string) {
+		defer wg.Done()
+		var reply string
+		var events Events
+		events.Pool = pool
+		events.Serving = func(srv Server) (action Action) {
+			if srv.NumLoops != 2 {
+				t.Errorf("expected 2 loops, got %d", srv.NumLoops)
+			}
+			go func() {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				defer c.Close()
+				c.Write([]byte("ping"))
+				buf := make([]byte, len(prefix)+4)
+				_, err = io.ReadFull(c, buf)
+				must(err)
+				reply = string(buf)
+				c.Write([]byte("quit"))
+			}()
+			return
+		}
+		events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+			if string(in) == "quit" {
+				return nil, Shutdown
+			}
+			return append([]byte(prefix), in...), None
+		}
+		must(Serve(events, "tcp://"+addr))
+		if reply != prefix+"ping" {
+			t.Errorf("expected %q, got %q", prefix+"ping", reply)
+		}
+	}
+	wg.Add(2)
+	go serve(":9974", "one:")
+	go serve(":9975", "two:")
+	wg.Wait()
+}
+
+func TestDetachedDeadline(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testDetachedDeadline(t, "tcp", ":9976") })
+	t.Run("stdlib", func(t *testing.T) { testDetachedDeadline(t, "tcp-net", ":9977") })
+}
+
+func testDetachedDeadline(t *testing.T, network, addr string) {
+	const timeout = time.Millisecond * 100
+	var rerr error
+	var elapsed time.Duration
+	var events Events
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("detach"))
+			// never sends anything else
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return nil, Detach
+	}
+	events.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+		conn, ok := rwc.(net.Conn)
+		if !ok {
+			t.Errorf("detached conn does not implement net.Conn")
+			return Shutdown
+		}
+		defer conn.Close()
+		if conn.RemoteAddr() == nil {
+			t.Errorf("nil remote addr")
+		}
+		start := time.Now()
+		conn.SetReadDeadline(start.Add(timeout))
+		_, rerr = conn.Read(make([]byte, 1))
+		elapsed = time.Since(start)
+		return Shutdown
+	}
+	must(Serve(events, network+"://"+addr))
+	if !os.IsTimeout(rerr) {
+		t.Fatalf("expected timeout error, got %v", rerr)
+	}
+	if elapsed < timeout || elapsed > timeout*10 {
+		t.Fatalf("expected read to time out after %v, got %v", timeout, elapsed)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testPriority(t, "tcp", ":9806") })
+}
+
+func testPriority(t *testing.T, network, addr string) {
+	names := []string{"blocker", "lowest", "low", "high"}
+	prios := map[string]int{"lowest": -10, "high": 10}
+	holding := make(chan bool)
+	release := make(chan bool)
+	var opened int
+	var order []string
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		if opened < len(names) {
+			name := names[opened]
+			c.SetContext(name)
+			opts.Priority = prios[name]
+		}
+		opened++
+		return []byte("ready"), opts, None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if c.Context() == "blocker" {
+			// the loop is busy while the other connections become ready
+			holding <- true
+			<-release
+			return
+		}
+		order = append(order, c.Context().(string))
+		return
+	}
+	serveClient(events, network, addr, func() {
+		var conns []net.Conn
+		for range names {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Read(make([]byte, 5))
+			conns = append(conns, c)
+		}
+		conns[0].Write([]byte("hold"))
+		<-holding
+		for _, c := range conns[1:] {
+			c.Write([]byte("data"))
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		time.Sleep(50 * time.Millisecond)
+	})
+	want := []string{"high", "low", "lowest"}
+	if strings.Join(order, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected the reads in the order %v, got %v", want, order)
+	}
+}
+
+func TestInboundLimit(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testInboundLimit(t, "tcp", ":9808") })
+	t.Run("stdlib", func(t *testing.T) { testInboundLimit(t, "tcp-net", ":9807") })
+}
+
+func testInboundLimit(t *testing.T, network, addr string) {
+	const max = 64 << 10
+	limit := NewInboundLimit(max)
+	var peak int64
+	var events Events
+	events.InboundLimit = limit
+	// the buffers are counted apart even when the IDs are the same
+	events.ConnIDGen = func() uint64 { return 1 }
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		b := NewInBuffer(0)
+		b.Track(limit, c)
+		c.SetContext(b)
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		b := c.Context().(*InBuffer)
+		if err := b.Append(in); err != nil {
+			return nil, Close
+		}
+		if used := int64(limit.Used()); used > atomic.LoadInt64(&peak) {
+			atomic.StoreInt64(&peak, used)
+		}
+		if i := bytes.IndexByte(b.Bytes(), '\n'); i >= 0 {
+			b.Consume(i + 1)
+			return []byte("ok\n"), None
+		}
+		return
+	}
+	// send writes n bytes of a frame that doesn't complete, and waits until
+	// the server has buffered them
+	send := func(c net.Conn, n int) {
+		want := limit.Used() + n
+		_, err := c.Write(bytes.Repeat([]byte("x"), n))
+		must(err)
+		for i := 0; i < 200 && limit.Used() < want; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	var shed, kept error
+	var used int
+	serveClient(events, network, addr, func() {
+		var conns []net.Conn
+		for i := 0; i < 3; i++ {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			conns = append(conns, c)
+		}
+		send(conns[0], 40<<10)
+		send(conns[1], 16<<10)
+		// going over the limit sheds the largest buffer
+		conns[2].Write(bytes.Repeat([]byte("x"), 16<<10))
+		conns[0].SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, shed = conns[0].Read(make([]byte, 1))
+		for i := 0; i < 200 && limit.Used() != 32<<10; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		used = limit.Used()
+		conns[1].Write([]byte("\n"))
+		conns[1].SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, kept = bufio.NewReader(conns[1]).ReadString('\n')
+	})
+	if err, ok := shed.(net.Error); shed == nil || ok && err.Timeout() {
+		t.Fatalf("expected the largest buffer to be shed, got %v", shed)
+	}
+	if kept != nil {
+		t.Fatalf("expected the smaller buffers to be kept, got %v", kept)
+	}
+	if used != 32<<10 {
+		t.Fatalf("expected %d bytes buffered after shedding, got %d", 32<<10, used)
+	}
+	if atomic.LoadInt64(&peak) > max {
+		t.Fatalf("expected at most %d bytes buffered, got %d", max, peak)
+	}
+	if limit.Used() != 0 {
+		t.Fatalf("expected the closed connections to stop counting, got %d", limit.Used())
+	}
+}
+
+func TestDrainBacklog(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testDrainBacklog(t, "tcp", ":9810") })
+	t.Run("stdlib", func(t *testing.T) { testDrainBacklog(t, "tcp-net", ":9809") })
+}
+
+func testDrainBacklog(t *testing.T, network, addr string) {
+	const queued = 4
+	holding := make(chan bool)
+	release := make(chan bool)
+	type result struct {
+		got []byte
+		err error
+	}
+	results := make(chan result, queued)
+	var events Events
+	events.DrainBacklog = func(c Conn) (out []byte) {
+		return []byte("shutting down\n")
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		// the loop is busy while the clients queue up
+		holding <- true
+		<-release
+		return nil, Shutdown
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("shutdown"))
+			<-holding
+			var conns []net.Conn
+			for i := 0; i < queued; i++ {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				conns = append(conns, c)
+			}
+			close(release)
+			for _, c := range conns {
+				go func(c net.Conn) {
+					defer c.Close()
+					c.SetReadDeadline(time.Now().Add(2 * time.Second))
+					got, err := ioutil.ReadAll(c)
+					results <- result{got, err}
+				}(c)
+			}
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	for i := 0; i < queued; i++ {
+		res := <-results
+		if res.err != nil {
+			t.Fatalf("expected a clean close of a queued connection, got %v", res.err)
+		}
+		if string(res.got) != "shutting down\n" {
+			t.Fatalf("expected the shutdown response, got %q", res.got)
+		}
+	}
+}
+
+func TestAcceptDecision(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		t.Run("round-robin", func(t *testing.T) { testAcceptDecision(t, "tcp", ":9813", RoundRobin) })
+		t.Run("least-conns", func(t *testing.T) { testAcceptDecision(t, "tcp", ":9812", LeastConnections) })
+	})
+	t.Run("stdlib", func(t *testing.T) { testAcceptDecision(t, "tcp-net", ":9811", RoundRobin) })
+}
+
+func testAcceptDecision(t *testing.T, network, addr string, balance LoadBalance) {
+	const numLoops = 3
+	var mu sync.Mutex
+	decisions := make(map[uint64]AcceptDecision)
+	opened := make(chan uint64, 16)
+	closed := make(chan uint64, 16)
+	var events Events
+	events.NumLoops = numLoops
+	events.LoadBalance = balance
+	events.OnAcceptDecision = func(d AcceptDecision) {
+		mu.Lock()
+		decisions[d.ID] = d
+		mu.Unlock()
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opened <- c.ID()
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		closed <- c.ID()
+		return
+	}
+	// dial opens a connection and returns its decision
+	dial := func() (net.Conn, AcceptDecision) {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		id := <-opened
+		mu.Lock()
+		defer mu.Unlock()
+		return c, decisions[id]
+	}
+	var got []AcceptDecision
+	serveClient(events, network, addr, func() {
+		var conns []net.Conn
+		for i := 0; i < 2*numLoops; i++ {
+			c, d := dial()
+			conns = append(conns, c)
+			got = append(got, d)
+			if balance == LeastConnections && i == numLoops-1 {
+				// the loop of the closed connection has the fewest
+				conns[1].Close()
+				<-closed
+			}
+		}
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	for i, d := range got {
+		if d.Balance != balance || d.AddrIndex != 0 || d.RemoteAddr == nil || len(d.Conns) != numLoops {
+			t.Fatalf("connection %d: unexpected decision %+v", i, d)
+		}
+		switch balance {
+		case RoundRobin:
+			if i > 0 && d.Loop != (got[i-1].Loop+1)%numLoops {
+				t.Fatalf("connection %d: expected loop %d, got %d", i, (got[i-1].Loop+1)%numLoops, d.Loop)
+			}
+		case LeastConnections:
+			for j, n := range d.Conns {
+				if n < d.Conns[d.Loop] {
+					t.Fatalf("connection %d: loop %d has %d connections, fewer than %d on loop %d",
+						i, j, n, d.Conns[d.Loop], d.Loop)
+				}
+			}
+		}
+	}
+	if balance == LeastConnections {
+		if got[0].Loop == got[1].Loop || got[1].Loop == got[2].Loop || got[0].Loop == got[2].Loop {
+			t.Fatalf("expected the first connections on different loops, got %d, %d and %d",
+				got[0].Loop, got[1].Loop, got[2].Loop)
+		}
+		if got[3].Loop != got[1].Loop {
+			t.Fatalf("expected the loop of the closed connection, %d, got %d", got[1].Loop, got[3].Loop)
+		}
+	}
+}
+
+func TestSetDeadline(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testSetDeadline(t, "tcp", ":9815") })
+	t.Run("stdlib", func(t *testing.T) { testSetDeadline(t, "tcp-net", ":9814") })
+}
+
+func testSetDeadline(t *testing.T, network, addr string) {
+	const interval = 30 * time.Millisecond
+	const pings = 8
+	var events Events
+	var keepalive func(c Conn) (out []byte, action Action)
+	keepalive = func(c Conn) (out []byte, action Action) {
+		n := c.Context().(int) + 1
+		c.SetContext(n)
+		if n == pings {
+			return []byte("bye\n"), Close
+		}
+		if err := c.SetDeadline(time.Now().Add(interval), keepalive); err != nil {
+			return nil, Close
+		}
+		return []byte("ping\n"), None
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		c.SetContext(0)
+		if err := c.SetDeadline(time.Now().Add(interval), keepalive); err != nil {
+			return []byte(err.Error()), opts, Close
+		}
+		return
+	}
+	var got []byte
+	var elapsed time.Duration
+	var rerr error
+	serveClient(events, network, addr, func() {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		start := time.Now()
+		c.SetReadDeadline(start.Add(5 * time.Second))
+		got, rerr = ioutil.ReadAll(c)
+		elapsed = time.Since(start)
+	})
+	if rerr != nil {
+		t.Fatalf("expected the connection to be closed by the deadline, got %v", rerr)
+	}
+	want := strings.Repeat("ping\n", pings-1) + "bye\n"
+	if string(got) != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	if elapsed < pings*interval {
+		t.Fatalf("expected the connection to stay open for %v, got %v", pings*interval, elapsed)
+	}
+}
+
+func TestLoopCounters(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testLoopCounters(t, "tcp", ":9803") })
+	t.Run("stdlib", func(t *testing.T) { testLoopCounters(t, "tcp-net", ":9802") })
+}
+
+func testLoopCounters(t *testing.T, network, addr string) {
+	var opened int
+	counts := make(chan LoopStats, 1)
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		// the second connection is closed by its open timeout
+		if opened++; opened == 2 {
+			opts.OpenTimeout = time.Millisecond * 20
+		} else {
+			c.Ready()
+		}
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			sum := func() (ls LoopStats) {
+				for _, l := range srv.Stats().Loops {
+					ls.Accepts += l.Accepts
+					ls.Closes += l.Closes
+					ls.BytesIn += l.BytesIn
+					ls.BytesOut += l.BytesOut
+					ls.Timeouts += l.Timeouts
+				}
+				return ls
+			}
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("ping"))
+			_, err = io.ReadFull(c, make([]byte, 4))
+			must(err)
+			c2, err := net.Dial("tcp", addr)
+			must(err)
+			defer c2.Close()
+			c2.Read(make([]byte, 1))
+			for i := 0; i < 100 && sum().Closes == 0; i++ {
+				time.Sleep(time.Millisecond)
+			}
+			counts <- sum()
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	ls := <-counts
+	if ls.Accepts != 2 || ls.Closes != 1 || ls.BytesIn != 4 || ls.BytesOut != 4 || ls.Timeouts != 1 {
+		t.Fatalf("expected 2 accepts, 1 close, 4 bytes each way and 1 timeout, got %+v", ls)
+	}
+}
+
+func TestStatsInterval(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testStatsInterval(t, "tcp", ":9819") })
+	t.Run("stdlib", func(t *testing.T) { testStatsInterval(t, "tcp-net", ":9818") })
+}
+
+func testStatsInterval(t *testing.T, network, addr string) {
+	const interval = 20 * time.Millisecond
+	type snapshot struct {
+		at time.Time
+		st Stats
+	}
+	snaps := make(chan snapshot, 1024)
+	var events Events
+	events.NumLoops = 2
+	events.StatsInterval = interval
+	events.OnStats = func(st Stats) {
+		select {
+		case snaps <- snapshot{time.Now(), st}:
+		default:
+		}
+	}
+	// wait reads the snapshots until one has n connections
+	wait := func(n int) []snapshot {
+		var got []snapshot
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case sn := <-snaps:
+				got = append(got, sn)
+				if sn.st.Conns == n {
+					return got
+				}
+			case <-timeout:
+				t.Errorf("expected a snapshot with %d connections, got %d snapshots", n, len(got))
+				return got
+			}
+		}
+	}
+	var got []snapshot
+	serveClient(events, network, addr, func() {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		got = append(got, wait(1)...)
+		c.Close()
+		got = append(got, wait(0)...)
+	})
+	if len(got) < 2 {
+		t.Fatalf("expected snapshots, got %d", len(got))
+	}
+	for i, sn := range got {
+		if len(sn.st.Loops) != 2 {
+			t.Fatalf("expected 2 loops, got %d", len(sn.st.Loops))
+		}
+		if sn.st.Conns < 0 || sn.st.Conns > 1 {
+			t.Fatalf("expected at most 1 connection, got %d", sn.st.Conns)
+		}
+		if i > 0 && sn.at.Sub(got[i-1].at) < interval/2 {
+			t.Fatalf("expected snapshots %v apart, got %v", interval, sn.at.Sub(got[i-1].at))
+		}
+	}
+}
+
+func TestCloseWithReason(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testCloseWithReason(t, "tcp", ":9821") })
+	t.Run("stdlib", func(t *testing.T) { testCloseWithReason(t, "tcp-net", ":9820") })
+}
+
+func testCloseWithReason(t *testing.T, network, addr string) {
+	var cerr, rerr error
+	var got []byte
+	var events Events
+	// the close message of a line based protocol, the WebSocket one is
+	// tested by the websocket package
+	events.CloseFrame = func(c Conn, code int, reason string) []byte {
+		return []byte(fmt.Sprintf("CLOSE %d %s\r\n", code, reason))
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		cerr = c.CloseWithReason(1001, "going away")
+		return []byte("last message"), None
+	}
+	serveClient(events, network, addr, func() {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		c.Write([]byte("bye"))
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		// the peer closes once the close frame was sent
+		got, rerr = ioutil.ReadAll(c)
+	})
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if rerr != nil {
+		t.Fatalf("expected the connection to be closed after the frame, got %v", rerr)
+	}
+	want := "last messageCLOSE 1001 going away\r\n"
+	if string(got) != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testRateLimits(t, "tcp", ":9825", ":9824") })
+	t.Run("stdlib", func(t *testing.T) { testRateLimits(t, "tcp-net", ":9823", ":9822") })
+}
+
+func testRateLimits(t *testing.T, network, addra, addrb string) {
+	const window = 500 * time.Millisecond
+	tenants := []string{"a", "b"}
+	rates := map[string]int{"a": 1 << 20, "b": 4 << 20}
+	var limits RateLimits
+	for _, tenant := range tenants {
+		limits.Set(tenant, rates[tenant], 64<<10)
+	}
+	var mu sync.Mutex
+	start := make(map[string]time.Time)
+	read := make(map[string]int)
+	var events Events
+	events.RateLimits = &limits
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.Label = tenants[c.AddrIndex()]
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		tenant := tenants[c.AddrIndex()]
+		mu.Lock()
+		if start[tenant].IsZero() {
+			start[tenant] = time.Now()
+		}
+		if time.Since(start[tenant]) < window {
+			read[tenant] += len(in)
+		}
+		mu.Unlock()
+		return
+	}
+	serveClient(events, network, addra, func() {
+		var wg sync.WaitGroup
+		// two connections for each tenant share its limit
+		for _, addr := range []string{addra, addra, addrb, addrb} {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				defer c.Close()
+				buf := make([]byte, 16<<10)
+				for end := time.Now().Add(window * 2); time.Now().Before(end); {
+					c.SetWriteDeadline(end)
+					if _, err := c.Write(buf); err != nil {
+						return
+					}
+				}
+			}(addr)
+		}
+		wg.Wait()
+	}, addrb)
+	mu.Lock()
+	defer mu.Unlock()
+	for _, tenant := range tenants {
+		rate := float64(rates[tenant]) * window.Seconds()
+		// a burst and a read per connection may come on top of the rate,
+		// and the timing of a busy test machine is loose
+		max := int(rate*1.25) + 64<<10 + 2*0xFFFF
+		if read[tenant] > max || float64(read[tenant]) < rate/2 {
+			t.Fatalf("expected tenant %s to read about %d bytes in %v, got %d",
+				tenant, int(rate), window, read[tenant])
+		}
+	}
+}
+
+func TestSuspendUntil(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testSuspendUntil(t, "tcp", ":9827") })
+	t.Run("stdlib", func(t *testing.T) { testSuspendUntil(t, "tcp-net", ":9826") })
+}
+
+func testSuspendUntil(t *testing.T, network, addr string) {
+	var completed int32
+	var early, serr error
+	var events Events
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "":
+		case "lookup":
+			done := make(chan struct{})
+			serr = c.SuspendUntil(done)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				atomic.StoreInt32(&completed, 1)
+				close(done)
+			}()
+			out = []byte("wait")
+		default:
+			if atomic.LoadInt32(&completed) == 0 {
+				early = fmt.Errorf("got %q before the lookup completed", in)
+			}
+			out = in
+		}
+		return
+	}
+	var reply string
+	serveClient(events, network, addr, func() {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		buf := make([]byte, 4)
+		c.Write([]byte("lookup"))
+		_, err = io.ReadFull(c, buf)
+		must(err)
+		c.Write([]byte("next"))
+		_, err = io.ReadFull(c, buf)
+		must(err)
+		reply = string(buf)
+	})
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	if early != nil {
+		t.Fatal(early)
+	}
+	if reply != "next" {
+		t.Fatalf("expected the input after the lookup to be handled, got %q", reply)
+	}
+}
+
+func TestConnIDGen(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testConnIDGen(t, "tcp", ":9829") })
+	t.Run("stdlib", func(t *testing.T) { testConnIDGen(t, "tcp-net", ":9828") })
+}
+
+func testConnIDGen(t *testing.T, network, addr string) {
+	var next uint64 = 1000
+	var mu sync.Mutex
+	var ids []uint64
+	var events Events
+	events.ConnIDGen = func() uint64 {
+		return atomic.AddUint64(&next, 1)
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		mu.Lock()
+		ids = append(ids, c.ID())
+		mu.Unlock()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	serveClient(events, network, addr, func() {
+		for i := 0; i < 2; i++ {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			c.Write([]byte("ping"))
+			_, err = io.ReadFull(c, make([]byte, 4))
+			must(err)
+			c.Close()
+		}
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ids) != 2 || ids[0] != 1001 || ids[1] != 1002 {
+		t.Fatalf("expected the IDs 1001 and 1002 from the generator, got %v", ids)
+	}
+}
+
+func TestLameDuck(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testLameDuck(t, "tcp", ":9833") })
+	t.Run("stdlib", func(t *testing.T) { testLameDuck(t, "tcp-net", ":9832") })
+}
+
+func testLameDuck(t *testing.T, network, addr string) {
+	var srv Server
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		srv = s
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "health" {
+			if srv.LameDuck() {
+				return []byte("lame"), None
+			}
+			return []byte("good"), None
+		}
+		return in, None
+	}
+	request := func(c net.Conn, req string) string {
+		c.Write([]byte(req))
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(c, buf)
+		must(err)
+		return string(buf)
+	}
+	health := func() string {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		return request(c, "health")
+	}
+	var replies []string
+	var stats []bool
+	serveClient(events, network, addr, func() {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		replies = append(replies, health(), request(c, "ping"))
+		must(srv.SetLameDuck(true))
+		stats = append(stats, srv.Stats().LameDuck)
+		// new connections are still accepted and the old ones served
+		replies = append(replies, health(), request(c, "pong"))
+		must(srv.SetLameDuck(false))
+		stats = append(stats, srv.Stats().LameDuck)
+		replies = append(replies, health())
+	})
+	want := []string{"good", "ping", "lame", "pong", "good"}
+	if strings.Join(replies, " ") != strings.Join(want, " ") {
+		t.Fatalf("expected %q, got %q", want, replies)
+	}
+	if len(stats) != 2 || !stats[0] || stats[1] {
+		t.Fatalf("expected the stats to report the lame duck mode, got %v", stats)
+	}
+}
+
+func TestDetachedContext(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testDetachedContext(t, "tcp", ":9835") })
+	t.Run("stdlib", func(t *testing.T) { testDetachedContext(t, "tcp-net", ":9834") })
+}
+
+func testDetachedContext(t *testing.T, network, addr string) {
+	var ctx interface{}
+	var laddr, raddr, want string
+	var events Events
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("detach"))
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		c.SetContext("session")
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return nil, Detach
+	}
+	events.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+		defer rwc.Close()
+		if dc, ok := rwc.(interface{ Context() interface{} }); ok {
+			ctx = dc.Context()
+		}
+		conn := rwc.(net.Conn)
+		laddr, raddr = conn.LocalAddr().String(), conn.RemoteAddr().String()
+		want = c.RemoteAddr().String()
+		return Shutdown
+	}
+	must(Serve(events, network+"://"+addr))
+	if ctx != "session" {
+		t.Fatalf("expected the context of the connection, got %v", ctx)
+	}
+	if laddr == "" || raddr != want {
+		t.Fatalf("expected the remote address %s, got %s (local %s)", want, raddr, laddr)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testAttach(t, "tcp", ":9978") })
+	t.Run("stdlib", func(t *testing.T) { testAttach(t, "tcp-net", ":9979") })
+}
+
+func testAttach(t *testing.T, network, addr string) {
+	var srv Server
+	var opened []int
+	var reply string
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		srv = s
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			buf := make([]byte, 4)
+			for _, req := range []string{"detach", "block", "ping"} {
+				c.Write([]byte(req))
+				_, err = io.ReadFull(c, buf)
+				must(err)
+				reply += string(buf)
+			}
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opened = append(opened, c.AddrIndex())
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "detach":
+			return []byte("ok.."), Detach
+		case "ping":
+			return []byte("pong"), None
+		case "quit":
+			return nil, Shutdown
+		}
+		return
+	}
+	events.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+		go func() {
+			// a blocking exchange outside of the loop
+			buf := make([]byte, 5)
+			_, err := io.ReadFull(rwc, buf)
+			must(err)
+			rwc.Write([]byte("done"))
+			must(srv.Attach(rwc))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	if reply != "ok..donepong" {
+		t.Fatalf("unexpected replies %q", reply)
+	}
+	if len(opened) != 2 || opened[0] != 0 || opened[1] != -1 {
+		t.Fatalf("expected opened twice with addr index 0 and -1, got %v", opened)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sockets can't be passed over unix sockets on windows")
+	}
+	t.Run("poll", func(t *testing.T) { testHandoff(t, "tcp", ":9937", ":9936") })
+	t.Run("stdlib", func(t *testing.T) { testHandoff(t, "tcp-net", ":9935", ":9934") })
+}
+
+func testHandoff(t *testing.T, network, addr, frontAddr string) {
+	sock := "handoff" + addr[1:] + ".sock"
+	os.RemoveAll(sock)
+	hln, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	must(err)
+	defer hln.Close()
+	var opened []int
+	var reply string
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go s.ServeHandoff(hln)
+		go func() {
+			// the front-end accepts the connection and hands it off
+			fln, err := net.Listen("tcp", frontAddr)
+			must(err)
+			defer fln.Close()
+			c, err := net.Dial("tcp", frontAddr)
+			must(err)
+			defer c.Close()
+			fc, err := fln.Accept()
+			must(err)
+			uc, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: sock, Net: "unix"})
+			must(err)
+			must(HandoffConn(uc, fc.(*net.TCPConn)))
+			uc.Close()
+			fc.Close()
+			buf := make([]byte, 4)
+			c.Write([]byte("ping"))
+			_, err = io.ReadFull(c, buf)
+			must(err)
+			reply = string(buf)
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opened = append(opened, c.AddrIndex())
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "ping":
+			return []byte("pong"), None
+		case "quit":
+			return nil, Shutdown
+		}
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	if reply != "pong" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if len(opened) != 1 || opened[0] != -1 {
+		t.Fatalf("expected opened once with addr index -1, got %v", opened)
+	}
+}
+
+func TestMigrateConn(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sockets can't be passed over unix sockets on windows")
+	}
+	t.Run("poll", func(t *testing.T) { testMigrateConn(t, "tcp", ":9858", ":9857") })
+	t.Run("stdlib", func(t *testing.T) { testMigrateConn(t, "tcp-net", ":9856", ":9855") })
+}
+
+func testMigrateConn(t *testing.T, network, addr, toAddr string) {
+	sock := "migrate" + addr[1:] + ".sock"
+	os.RemoveAll(sock)
+	hln, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	must(err)
+	defer hln.Close()
+
+	// the server that the connection moves to
+	ready := make(chan struct{})
+	done := make(chan struct{})
+	var to Events
+	to.Serving = func(s Server) (action Action) {
+		go s.ServeHandoff(hln)
+		close(ready)
+		return
+	}
+	to.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		state, _ := c.Context().([]byte)
+		return append(append(state, ':'), in...), None
+	}
+	go func() {
+		must(Serve(to, network+"://"+toAddr))
+		close(done)
+	}()
+	<-ready
+
+	var replies []string
+	var from Events
+	from.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		// leaves the input after "move" unread
+		opts.MaxDataChunk = 4
+		return
+	}
+	from.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "move" {
+			return nil, Detach
+		}
+		return in, None
+	}
+	from.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+		defer rwc.Close()
+		uc, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: sock, Net: "unix"})
+		must(err)
+		defer uc.Close()
+		must(MigrateConn(uc, rwc, []byte("session")))
+		return Shutdown
+	}
+	from.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("movedata"))
+			rd := bufio.NewReader(c)
+			for _, req := range []string{"ping", "quit"} {
+				buf := make([]byte, len("session:")+4)
+				_, err := io.ReadFull(rd, buf)
+				must(err)
+				replies = append(replies, string(buf))
+				c.Write([]byte(req))
+			}
+		}()
+		return
+	}
+	must(Serve(from, network+"://"+addr))
+	<-done
+	expected := []string{"session:data", "session:ping"}
+	if strings.Join(replies, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %q, got %q", expected, replies)
+	}
+}
+
+// testTLSConfig returns a server config with a self-signed certificate.
+func testTLSConfig() *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	must(err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	must(err)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func TestListenerTLS(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testListenerTLS(t, "tcp", ":9983", ":9984") })
+	t.Run("stdlib", func(t *testing.T) { testListenerTLS(t, "tcp-net", ":9985", ":9986") })
+}
+
+func testListenerTLS(t *testing.T, network, plainAddr, tlsAddr string) {
+	var replies [2]string
+	var events Events
+	events.Listeners = map[int]ListenerConfig{
+		1: {TLSConfig: testTLSConfig()},
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			exchange := func(c net.Conn, i int) {
+				defer c.Close()
+				greeting := make([]byte, 6)
+				_, err := io.ReadFull(c, greeting)
+				must(err)
+				c.Write([]byte("hello"))
+				buf := make([]byte, 5)
+				_, err = io.ReadFull(c, buf)
+				must(err)
+				replies[i] = string(greeting) + string(buf)
+			}
+			c, err := net.Dial("tcp", plainAddr)
+			must(err)
+			exchange(c, 0)
+			tc, err := tls.Dial("tcp", tlsAddr, &tls.Config{InsecureSkipVerify: true})
+			must(err)
+			exchange(tc, 1)
+
+			c, err = net.Dial("tcp", plainAddr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte("hello:"), opts, None
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	must(Serve(events, network+"://"+plainAddr, network+"://"+tlsAddr))
+	for i, reply := range replies {
+		if reply != "hello:hello" {
+			t.Fatalf("listener %d: expected %q, got %q", i, "hello:hello", reply)
+		}
+	}
+}
+
+func TestTLSEcho(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testTLSEcho(t, "tcp", ":9943") })
+	t.Run("stdlib", func(t *testing.T) { testTLSEcho(t, "tcp-net", ":9944") })
+}
+
+// testTLSEcho echoes more than a record on many TLS connections, and checks
+// that the poll servers don't keep a goroutine per connection once the
+// handshakes are done.
+func testTLSEcho(t *testing.T, network, addr string) {
+	const conns, size = 20, 1 << 20
+	var extra int
+	var events Events
+	events.Listeners = map[int]ListenerConfig{
+		0: {TLSConfig: testTLSConfig()},
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			base := runtime.NumGoroutine()
+			var wg sync.WaitGroup
+			var cs []net.Conn
+			for i := 0; i < conns; i++ {
+				c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+				must(err)
+				defer c.Close()
+				cs = append(cs, c)
+				wg.Add(1)
+				go func(c net.Conn, b byte) {
+					defer wg.Done()
+					data := bytes.Repeat([]byte{b}, size)
+					go c.Write(data)
+					buf := make([]byte, size)
+					_, err := io.ReadFull(c, buf)
+					must(err)
+					if !bytes.Equal(buf, data) {
+						t.Error("the echo doesn't match the input")
+					}
+				}(c, byte('a'+i))
+			}
+			wg.Wait()
+			time.Sleep(time.Second / 10)
+			extra = runtime.NumGoroutine() - base
+			c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	must(Serve(events, network+"://"+addr))
+	if network == "tcp" && extra >= conns {
+		t.Fatalf("expected no goroutine per connection, got %d more for %d connections", extra, conns)
+	}
+}
+
+func TestALPN(t *testing.T) {
+	var replies []string
+	var events Events
+	handler := func(name string) func(c Conn, in []byte) (out []byte, action Action) {
+		return func(c Conn, in []byte) (out []byte, action Action) {
+			state, ok := TLSConnectionState(c)
+			if !ok {
+				t.Errorf("missing tls connection state")
+			}
+			return []byte(name + ":" + state.NegotiatedProtocol), None
+		}
+	}
+	events.Listeners = map[int]ListenerConfig{
+		1: {
+			TLSConfig: testTLSConfig(),
+			Protocols: map[string]func(c Conn, in []byte) (out []byte, action Action){
+				"h2":       handler("h2 handler"),
+				"http/1.1": handler("http handler"),
+			},
+		},
+	}
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			for _, proto := range []string{"h2", "http/1.1", "other"} {
+				c, err := tls.Dial("tcp", ":9958", &tls.Config{
+					InsecureSkipVerify: true,
+					NextProtos:         []string{proto},
+				})
+				if err != nil {
+					replies = append(replies, "error")
+					continue
+				}
+				c.Write([]byte("data"))
+				buf := make([]byte, 64)
+				n, err := c.Read(buf)
+				must(err)
+				replies = append(replies, string(buf[:n]))
+				c.Close()
+			}
+			c, err := net.Dial("tcp", ":9959")
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return nil, Shutdown
+	}
+	must(Serve(events, "tcp://:9959", "tcp://:9958"))
+	expected := "h2 handler:h2,http handler:http/1.1,error"
+	if strings.Join(replies, ",") != expected {
+		t.Fatalf("expected %q, got %q", expected, strings.Join(replies, ","))
+	}
+}
+
+func TestWakeQueueSize(t *testing.T) {
+	testWakeQueueSize(t, "tcp", ":9950")
+	testWakeQueueSize(t, "tcp-net", ":9949")
+}
+
+func testWakeQueueSize(t *testing.T, network, addr string) {
+	const size, flood = 4, 10
+	var full, woken int
+	var events Events
+	events.WakeQueueSize = size
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("flood"))
+			c.SetReadDeadline(time.Now().Add(time.Second * 5))
+			var buf []byte
+			for string(buf) != "woken" {
+				p := make([]byte, 64)
+				n, err := c.Read(p)
+				must(err)
+				buf = append(buf, p[:n]...)
+			}
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch {
+		case in == nil:
+			if woken++; woken == size {
+				out = []byte("woken")
+			}
+		case string(in) == "flood":
+			// the loop is busy, so the wakes stay pending until it returns.
+			// wakes that fit in the queue may block on stdlib servers.
+			errs := make(chan error, flood)
+			for i := 0; i < flood; i++ {
+				go func() { errs <- c.Wake() }()
+			}
+			timeout := time.After(time.Second)
+			for full < flood-size {
+				select {
+				case err := <-errs:
+					if err == ErrQueueFull {
+						full++
+					}
+				case <-timeout:
+					return nil, Close
+				}
+			}
+		case string(in) == "shutdown":
+			action = Shutdown
+		}
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	if full != flood-size || woken != size {
+		t.Fatalf("%s: expected %d full and %d woken, got %d and %d",
+			network, flood-size, size, full, woken)
+	}
+}
+
+func TestLoopStats(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("loop stats require epoll or kqueue")
+	}
+	testLoopStats(t, true, ":9948")
+	testLoopStats(t, false, ":9947")
+}
+
+func testLoopStats(t *testing.T, enabled bool, addr string) {
+	var before, after Stats
+	var events Events
+	events.LoopStats = enabled
+	events.Serving = func(srv Server) (action Action) {
+		before = srv.Stats()
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			for i := 0; i < 10; i++ {
+				c.Write([]byte("hello"))
+				_, err := c.Read(make([]byte, 5))
+				must(err)
+			}
+			after = srv.Stats()
+			c.Write([]byte("shutdown"))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "shutdown" {
+			return nil, Shutdown
+		}
+		time.Sleep(time.Millisecond)
+		return in, None
+	}
+	must(Serve(events, "tcp://"+addr))
+	if len(before.Loops) != 0 {
+		t.Fatalf("expected empty stats before serving, got %+v", before)
+	}
+	if after.Conns != 1 || len(after.Loops) != 1 {
+		t.Fatalf("expected one connection on one loop, got %+v", after)
+	}
+	ls := after.Loops[0]
+	if !enabled {
+		if ls.Iterations != 0 || ls.WaitMax != 0 || ls.DispatchMax != 0 {
+			t.Fatalf("expected no timing when disabled, got %+v", ls)
+		}
+		return
+	}
+	if ls.Iterations < 10 || ls.WaitAvg <= 0 || ls.WaitMax < ls.WaitAvg ||
+		ls.DispatchMax < time.Millisecond || ls.DispatchAvg <= 0 {
+		t.Fatalf("unexpected loop stats %+v", ls)
+	}
+}
+
+func TestInputBuffer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the input buffer is only reused by the epoll and kqueue loops")
+	}
+	defer func(enabled bool) { poisonInput = enabled }(poisonInput)
+	poisonInput = true
+	for i, mode := range []InputBuffer{DefaultInputBuffer, ReuseInput, CopyInput} {
+		var retained []byte
+		var events Events
+		events.InputBuffer = mode
+		addr := fmt.Sprintf(":%d", 9945-i)
+		events.Serving = func(srv Server) (action Action) {
+			go func() {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				defer c.Close()
+				c.Write([]byte("hello"))
+				c.Read(make([]byte, 1))
+				c.Write([]byte("shutdown"))
+			}()
+			return
+		}
+		events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+			opts.ReuseInputBuffer = true
+			return
+		}
+		events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+			if retained == nil {
+				// keeping the input breaks the reuse contract
+				retained = in
+				return []byte{'!'}, None
+			}
+			return nil, Shutdown
+		}
+		must(Serve(events, "tcp://"+addr))
+		poisoned := string(retained) == string(bytes.Repeat([]byte{poisonByte}, 5))
+		if mode == CopyInput {
+			if string(retained) != "hello" {
+				t.Fatalf("mode %d: expected a copy of the input, got %q", mode, retained)
+			}
+		} else if !poisoned {
+			t.Fatalf("mode %d: expected the retained input to be poisoned, got %q", mode, retained)
+		}
+	}
+}
+
+func TestMaxDataChunk(t *testing.T) {
+	testMaxDataChunk(t, "tcp", ":9940")
+	testMaxDataChunk(t, "tcp-net", ":9939")
+}
+
+func testMaxDataChunk(t *testing.T, network, addr string) {
+	const chunk = 4096
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	var sizes []int
+	var received, detached []byte
+	var events Events
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write(data)
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.MaxDataChunk = chunk
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		sizes = append(sizes, len(in))
+		received = append(received, in...)
+		if len(received) >= len(data)/2 {
+			// the rest of the input, including the chunks that weren't
+			// passed to Data, is read from the detached connection
+			return nil, Detach
+		}
+		return
+	}
+	events.Detached = func(c Conn, rwc io.ReadWriteCloser) (action Action) {
+		detached = make([]byte, len(data)-len(received))
+		_, err := io.ReadFull(rwc, detached)
+		must(err)
+		rwc.Write([]byte{'!'})
+		rwc.Close()
+		return Shutdown
+	}
+	must(Serve(events, network+"://"+addr))
+	var full bool
+	for _, size := range sizes {
+		if size > chunk {
+			t.Fatalf("%s: expected chunks of at most %d bytes, got %d", network, chunk, size)
+		}
+		full = full || size == chunk
+	}
+	if !full {
+		t.Fatalf("%s: expected full chunks, got %v", network, sizes)
+	}
+	if !bytes.Equal(append(received, detached...), data) {
+		t.Fatalf("%s: input was reordered or lost", network)
+	}
+}
+
+func TestReadBudget(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stdlib servers have no read budget")
+	}
+	addr := ":9931"
+	var flooded int64
+	var slowest time.Duration
+	var events Events
+	events.NumLoops = 1
+	events.MaxReadsPerWait = 4
+	events.MaxBytesPerWait = 128 * 1024
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			stop := make(chan struct{})
+			flood, err := net.Dial("tcp", addr)
+			must(err)
+			defer flood.Close()
+			flood.Write([]byte("flood"))
+			go func() {
+				buf := make([]byte, 0xFFFF)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if _, err := flood.Write(buf); err != nil {
+						return
+					}
+				}
+			}()
+			// the other connections keep getting timely replies
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c, err := net.Dial("tcp", addr)
+					must(err)
+					defer c.Close()
+					buf := make([]byte, 4)
+					for j := 0; j < 20; j++ {
+						start := time.Now()
+						c.Write([]byte("ping"))
+						_, err := io.ReadFull(c, buf)
+						must(err)
+						mu.Lock()
+						if d := time.Since(start); d > slowest {
+							slowest = d
+						}
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			close(stop)
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch {
+		case c.Context() != nil:
+			flooded += int64(len(in))
+		case strings.HasPrefix(string(in), "flood"):
+			c.SetContext(true)
+			flooded += int64(len(in) - 5)
+		case string(in) == "quit":
+			return nil, Shutdown
+		default:
+			return in, None
+		}
+		return
+	}
+	must(Serve(events, "tcp://"+addr))
+	if flooded == 0 {
+		t.Fatal("expected the flooding connection to be read")
+	}
+	if slowest > time.Second {
+		t.Fatalf("expected timely replies while flooded, slowest took %v", slowest)
+	}
+}
+
+func TestSessionTicketKeys(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testSessionTicketKeys(t, "tcp", ":9930") })
+	t.Run("stdlib", func(t *testing.T) { testSessionTicketKeys(t, "tcp-net", ":9929") })
+}
+
+func testSessionTicketKeys(t *testing.T, network, addr string) {
+	var oldKey, newKey [32]byte
+	oldKey[0], newKey[0] = 1, 2
+	var resumed []bool
+	var events Events
+	events.Listeners = map[int]ListenerConfig{
+		0: {TLSConfig: testTLSConfig(), SessionTicketKeys: [][32]byte{oldKey}},
+	}
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			connect := func(cache tls.ClientSessionCache) {
+				tc, err := tls.Dial("tcp", addr, &tls.Config{
+					InsecureSkipVerify: true,
+					ServerName:         "localhost",
+					ClientSessionCache: cache,
+				})
+				must(err)
+				defer tc.Close()
+				// the exchange reads the ticket that's sent after the
+				// handshake
+				tc.Write([]byte("ping"))
+				_, err = io.ReadFull(tc, make([]byte, 4))
+				must(err)
+				resumed = append(resumed, tc.ConnectionState().DidResume)
+			}
+			a := tls.NewLRUClientSessionCache(8)
+			b := tls.NewLRUClientSessionCache(8)
+			connect(a)
+			connect(b)
+			// new tickets use the new key and old ones still resume
+			s.SetSessionTicketKeys([][32]byte{newKey, oldKey})
+			connect(a)
+			// old tickets stop resuming once the old key is dropped
+			s.SetSessionTicketKeys([][32]byte{newKey})
+			connect(b)
+			connect(a)
+			tc, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+			must(err)
+			defer tc.Close()
+			tc.Write([]byte("quit"))
+			tc.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	must(Serve(events, network+"://"+addr))
+	expected := []bool{false, false, true, false, true}
+	if fmt.Sprint(resumed) != fmt.Sprint(expected) {
+		t.Fatalf("expected resumptions %v, got %v", expected, resumed)
+	}
+}
+
+// patternReader reads n bytes of a repeating pattern and counts how many
+// were read.
+type patternReader struct {
+	n, read int64
+}
+
+func (r *patternReader) Read(b []byte) (int, error) {
+	read := atomic.LoadInt64(&r.read)
+	if read == r.n {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > r.n-read {
+		b = b[:r.n-read]
+	}
+	for i := range b {
+		b[i] = byte((read + int64(i)) % 251)
+	}
+	atomic.AddInt64(&r.read, int64(len(b)))
+	return len(b), nil
+}
+
+func TestWriteFrom(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testWriteFrom(t, "tcp", ":9927") })
+	t.Run("stdlib", func(t *testing.T) { testWriteFrom(t, "tcp-net", ":9926") })
+}
+
+func testWriteFrom(t *testing.T, network, addr string) {
+	const size = 64 << 20
+	src := &patternReader{n: size}
+	var ahead int64
+	var received int64
+	var mismatch bool
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("send"))
+			rd := bufio.NewReader(c)
+			head, err := rd.ReadString('\n')
+			must(err)
+			if head != "header\n" {
+				mismatch = true
+			}
+			// the reader is only pulled as the socket drains
+			time.Sleep(time.Second / 5)
+			ahead = atomic.LoadInt64(&src.read)
+			buf := make([]byte, 0x10000)
+			for received < size {
+				n, err := rd.Read(buf)
+				must(err)
+				for i := 0; i < n; i++ {
+					if buf[i] != byte((received+int64(i))%251) {
+						mismatch = true
+					}
+				}
+				received += int64(n)
+			}
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "send":
+			must(c.WriteFrom(src))
+			return []byte("header\n"), None
+		case "quit":
+			return nil, Shutdown
+		}
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	if mismatch || received != size {
+		t.Fatalf("expected %d ordered bytes, got %d (mismatch %v)", size, received, mismatch)
+	}
+	if ahead >= size/2 {
+		t.Fatalf("expected the reader to be pulled as the socket drains, %d bytes were read ahead", ahead)
+	}
+}
+
+func TestConnID(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testConnID(t, "tcp", ":9925") })
+	t.Run("stdlib", func(t *testing.T) { testConnID(t, "tcp-net", ":9924") })
+}
+
+func testConnID(t *testing.T, network, addr string) {
+	// the ids seen by each event, keyed by the connection
+	ids := make(map[Conn][]uint64)
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			for i := 0; i < 3; i++ {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				c.Write([]byte("ping"))
+				_, err = io.ReadFull(c, make([]byte, 4))
+				must(err)
+				c.Close()
+			}
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		ids[c] = append(ids[c], c.ID())
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		ids[c] = append(ids[c], c.ID())
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		ids[c] = append(ids[c], c.ID())
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	unique := make(map[uint64]bool)
+	for _, seen := range ids {
+		for _, id := range seen {
+			if id == 0 || id != seen[0] {
+				t.Fatalf("expected a stable id across the events, got %v", seen)
+			}
+		}
+		unique[seen[0]] = true
+	}
+	if len(ids) != 4 || len(unique) != 4 {
+		t.Fatalf("expected 4 connections with unique ids, got %v", ids)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testDrain(t, "tcp", ":9923") })
+	t.Run("stdlib", func(t *testing.T) { testDrain(t, "tcp-net", ":9922") })
+}
+
+func testDrain(t *testing.T, network, addr string) {
+	payload := bytes.Repeat([]byte("x"), 1<<20)
+	var inputs []string
+	var closed bool
+	var reply []byte
+	drained := make(chan struct{})
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("bad"))
+			time.Sleep(time.Millisecond * 10)
+			// more than a packet, which is discarded over several events
+			go c.Write(bytes.Repeat([]byte("ignored"), 1<<16))
+			reply, err = io.ReadAll(c)
+			must(err)
+			c.Close()
+			select {
+			case <-drained:
+				closed = true
+			case <-time.After(time.Second):
+			}
+			c, err = net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		inputs = append(inputs, string(in))
+		switch string(in) {
+		case "bad":
+			c.Drain()
+			return append([]byte("error\n"), payload...), None
+		case "quit":
+			return nil, Shutdown
+		}
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if len(inputs) == 1 {
+			close(drained)
+		}
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	if !bytes.Equal(reply, append([]byte("error\n"), payload...)) {
+		t.Fatalf("expected the pending output to be flushed, got %d bytes", len(reply))
+	}
+	if len(inputs) != 2 || inputs[0] != "bad" || inputs[1] != "quit" {
+		t.Fatalf("expected the input after draining to be discarded, got %q", inputs)
+	}
+	if !closed {
+		t.Fatal("expected the drained connection to close")
+	}
+}
+
+func TestSendUrgent(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testSendUrgent(t, "tcp", ":9919") })
+	t.Run("stdlib", func(t *testing.T) { testSendUrgent(t, "tcp-net", ":9918") })
+}
+
+func testSendUrgent(t *testing.T, network, addr string) {
+	const size = 8 << 20
+	var order string
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			c.Write([]byte("bulk"))
+			buf := make([]byte, size*2+len("URGENT")+len("tail"))
+			_, err = io.ReadFull(c, buf[:1])
+			must(err)
+			if network == "tcp" {
+				// the bulk output fills the socket and the rest waits in
+				// the loop behind it.
+				time.Sleep(time.Second / 10)
+				c.Write([]byte("more"))
+				time.Sleep(time.Second / 10)
+				c.Write([]byte("urgent"))
+			} else {
+				// the writes block, so nothing is queued behind the bulk
+				// output.
+				c.Write([]byte("moreurgent"))
+			}
+			_, err = io.ReadFull(c, buf[1:])
+			must(err)
+			c.Close()
+			// collapse the runs of bulk bytes
+			var b []byte
+			for i := range buf {
+				if i == 0 || buf[i] != buf[i-1] {
+					b = append(b, buf[i])
+				}
+			}
+			order = string(b)
+			c, err = net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		cmds := string(in)
+		for len(cmds) > 0 {
+			switch {
+			case strings.HasPrefix(cmds, "bulk"):
+				out = append(out, bytes.Repeat([]byte{'x'}, size)...)
+			case strings.HasPrefix(cmds, "more"):
+				out = append(out, bytes.Repeat([]byte{'y'}, size)...)
+			case strings.HasPrefix(cmds, "urgent"):
+				must(c.SendUrgent([]byte("URGENT")))
+				out = append(out, "tail"...)
+				cmds = cmds[2:]
+			case strings.HasPrefix(cmds, "quit"):
+				return nil, Shutdown
+			default:
+				return nil, Close
+			}
+			cmds = cmds[4:]
+		}
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	if order != "xURGENTytail" {
+		t.Fatalf("expected the urgent output after the bulk output that was being written, got %q", order)
+	}
+}
+
+func TestMore(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testMore(t, "tcp", ":9917") })
+	t.Run("stdlib", func(t *testing.T) { testMore(t, "tcp-net", ":9916") })
+}
+
+func testMore(t *testing.T, network, addr string) {
+	const steps, step = 100, 0x10000
+	var calls int
+	var received []byte
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("send"))
+			received = make([]byte, steps*step)
+			_, err = io.ReadFull(c, received)
+			must(err)
+			c.Write([]byte("quit"))
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "quit":
+			return nil, Shutdown
+		case "send":
+			c.SetContext(0)
+		case "":
+		default:
+			return nil, Close
+		}
+		n, ok := c.Context().(int)
+		if !ok {
+			return
+		}
+		calls++
+		c.SetContext(n + 1)
+		out = bytes.Repeat([]byte{byte(n)}, step)
+		if n+1 < steps {
+			action = More
+		}
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	if calls != steps {
+		t.Fatalf("expected %d steps, got %d", steps, calls)
+	}
+	for i, b := range received {
+		if b != byte(i/step) {
+			t.Fatalf("unexpected byte %d at %d", b, i)
+		}
+	}
+}
+
+func TestCloseWhere(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testCloseWhere(t, "tcp", ":9912") })
+	t.Run("stdlib", func(t *testing.T) { testCloseWhere(t, "tcp-net", ":9911") })
+}
+
+func testCloseWhere(t *testing.T, network, addr string) {
+	var mu sync.Mutex
+	var closedLabels []string
+	var n int
+	var alive []bool
+	var events Events
+	events.NumLoops = 2
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			var conns []net.Conn
+			for i := 0; i < 6; i++ {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				defer c.Close()
+				c.Write([]byte("ab"[i%2 : i%2+1]))
+				_, err = io.ReadFull(c, make([]byte, 2))
+				must(err)
+				conns = append(conns, c)
+			}
+			n = srv.CloseWhere(func(c Conn) bool { return c.Context() == "a" })
+			for _, c := range conns {
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				c.Write([]byte("ping"))
+				_, err := io.ReadFull(c, make([]byte, 4))
+				alive = append(alive, err == nil)
+			}
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch string(in) {
+		case "a", "b":
+			c.SetContext(string(in))
+			return []byte("ok"), None
+		case "quit":
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if label, ok := c.Context().(string); ok {
+			mu.Lock()
+			closedLabels = append(closedLabels, label)
+			mu.Unlock()
+		}
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	if n != 3 {
+		t.Fatalf("expected 3 connections to close, got %d", n)
+	}
+	for i, ok := range alive {
+		if ok != (i%2 == 1) {
+			t.Fatalf("expected only the connections labeled b to stay open, got %v", alive)
+		}
+	}
+	var a int
+	for _, label := range closedLabels[:3] {
+		if label == "a" {
+			a++
+		}
+	}
+	if a != 3 {
+		t.Fatalf("expected the connections labeled a to close first, got %v", closedLabels)
+	}
+}
+
+func TestDrainLoopWake(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("loops can't be drained on windows")
+	}
+	const n = 16
+	opened := make(chan Conn, n)
+	release := make(chan struct{})
+	result := make(chan string, 1)
+	var events Events
+	events.NumLoops = 4
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		c.SetContext(new(int32))
+		opened <- c
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		switch {
+		case in == nil:
+			atomic.AddInt32(c.Context().(*int32), 1)
+		case string(in) == "hold":
+			c.SuspendUntil(release)
+			out = []byte("held")
+		case string(in) == "quit":
+			action = Shutdown
+		default:
+			out = in
+		}
+		return
+	}
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			var conns []net.Conn
+			var cs []Conn
+			for i := 0; i < n; i++ {
+				c, err := net.Dial("tcp", ":9804")
+				must(err)
+				defer c.Close()
+				// the reads of every connection are suspended until
+				// the loops are being drained
+				c.Write([]byte("hold"))
+				_, err = io.ReadFull(c, make([]byte, 4))
+				must(err)
+				conns = append(conns, c)
+				cs = append(cs, <-opened)
+			}
+			// the connections are woken while their loops retire
+			sent := make([]int32, n)
+			stop := make(chan struct{})
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					for i, c := range cs {
+						if c.Wake() == nil {
+							sent[i]++
+						}
+					}
+					time.Sleep(time.Millisecond / 10)
+				}
+			}()
+			for i := 3; i > 0; i-- {
+				must(srv.DrainLoop(i))
+				if i == 2 {
+					close(release)
+				}
+			}
+			close(stop)
+			<-stopped
+			msg := ""
+			for i, c := range conns {
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				c.Write([]byte("ping"))
+				if _, err := io.ReadFull(c, make([]byte, 4)); err != nil {
+					msg = fmt.Sprintf("connection %d wasn't resumed: %v", i, err)
+					break
+				}
+			}
+			for i, c := range cs {
+				woken := c.Context().(*int32)
+				for j := 0; j < 100 && atomic.LoadInt32(woken) != sent[i]; j++ {
+					time.Sleep(time.Millisecond * 10)
+				}
+				if msg == "" && atomic.LoadInt32(woken) != sent[i] {
+					msg = fmt.Sprintf("connection %d was woken %d times of %d",
+						i, atomic.LoadInt32(woken), sent[i])
+				}
+			}
+			result <- msg
+			conns[0].Write([]byte("quit"))
+		}()
+		return
+	}
+	must(Serve(events, "tcp://:9804"))
+	if msg := <-result; msg != "" {
+		t.Fatal(msg)
+	}
+}
+
+func TestDrainLoop(t *testing.T) {
+	t.Run("poll", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("loops can't be drained on windows")
+		}
+		testDrainLoop(t, "tcp", ":9907")
+	})
+	t.Run("stdlib", func(t *testing.T) { testDrainLoop(t, "tcp-net", ":9906") })
+}
+
+func testDrainLoop(t *testing.T, network, addr string) {
+	var drainErr, rangeErr, lastErr error
+	var before, after Stats
+	var echoed int
+	var closed int32
+	var events Events
+	events.NumLoops = 3
+	events.Serving = func(srv Server) (action Action) {
+		go func() {
+			var conns []net.Conn
+			ping := func(c net.Conn) bool {
+				c.SetReadDeadline(time.Now().Add(time.Second))
+				c.Write([]byte("ping"))
+				_, err := io.ReadFull(c, make([]byte, 4))
+				return err == nil
+			}
+			for i := 0; i < 9; i++ {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				defer c.Close()
+				ping(c)
+				conns = append(conns, c)
+			}
+			before = srv.Stats()
+			if drainErr = srv.DrainLoop(1); drainErr == nil {
+				// the other loops adopt the connections in the background
+				for i := 0; i < 100; i++ {
+					if after = srv.Stats(); after.Conns == 9 {
+						break
+					}
+					time.Sleep(time.Millisecond)
+				}
+				rangeErr = srv.DrainLoop(2)
+				srv.DrainLoop(0)
+				lastErr = srv.DrainLoop(0)
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				defer c.Close()
+				conns = append(conns, c)
+				for _, c := range conns {
+					if ping(c) {
+						echoed++
+					}
+				}
+			}
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		atomic.AddInt32(&closed, 1)
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	if network == "tcp-net" {
+		if drainErr != ErrUnsupported {
+			t.Fatalf("expected ErrUnsupported, got %v", drainErr)
+		}
+		return
+	}
+	if drainErr != nil {
+		t.Fatal(drainErr)
+	}
+	if len(before.Loops) != 3 || before.Conns != 9 {
+		t.Fatalf("expected 9 connections on 3 loops, got %+v", before)
+	}
+	if len(after.Loops) != 2 || after.Conns != 9 {
+		t.Fatalf("expected the 9 connections on 2 loops, got %+v", after)
+	}
+	if rangeErr == nil || lastErr == nil {
+		t.Fatalf("expected errors for a loop out of range and the last loop, got %v and %v", rangeErr, lastErr)
+	}
+	if echoed != 10 {
+		t.Fatalf("expected all of the connections to keep working, %d of 10 did", echoed)
+	}
+	// the connections were only closed at shutdown
+	if n := atomic.LoadInt32(&closed); n != 11 {
+		t.Fatalf("expected 11 closed connections at shutdown, got %d", n)
+	}
+}
+
+// serveClient serves the events and runs the client once the server is
+// serving, on addr and the more addresses. The server shuts down when the
+// client returns.
+func serveClient(events Events, network, addr string, client func(), more ...string) {
+	var done int32
+	opened := events.Opened
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return nil, opts, Shutdown
+		}
+		if opened != nil {
+			return opened(c)
+		}
+		return
+	}
+	serving := events.Serving
+	events.Serving = func(srv Server) (action Action) {
+		if serving != nil {
+			serving(srv)
+		}
+		go func() {
+			client()
+			atomic.StoreInt32(&done, 1)
+			if c, err := net.Dial("tcp", addr); err == nil {
+				c.Close()
+			}
+		}()
+		return
+	}
+	addrs := []string{network + "://" + addr}
+	for _, addr := range more {
+		addrs = append(addrs, network+"://"+addr)
+	}
+	must(Serve(events, addrs...))
+}
+
+func TestEchoEvents(t *testing.T) {
+	for _, network := range []string{"tcp", "tcp-net"} {
+		var echo []byte
+		serveClient(EchoEvents(), network, ":9892", func() {
+			c, err := net.Dial("tcp", ":9892")
+			must(err)
+			defer c.Close()
+			msg := bytes.Repeat([]byte("echo"), 1<<14)
+			go c.Write(msg)
+			echo = make([]byte, len(msg))
+			_, err = io.ReadFull(c, echo)
+			must(err)
+		})
+		if !bytes.Equal(echo, bytes.Repeat([]byte("echo"), 1<<14)) {
+			t.Fatalf("%s: expected the input to be echoed", network)
+		}
+	}
+}
+
+func BenchmarkAccept(b *testing.B) {
+	serveClient(BenchEvents([]byte("!")), "tcp", ":9895", func() {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			c, err := net.Dial("tcp", ":9895")
+			must(err)
+			c.Write([]byte("?"))
+			_, err = io.ReadFull(c, make([]byte, 1))
+			must(err)
+			c.Close()
+		}
+		b.StopTimer()
+	})
+}
+
+func BenchmarkAcceptBurst(b *testing.B) {
+	b.Run("loops=1", func(b *testing.B) { benchmarkAcceptBurst(b, 1, ":9849") })
+	b.Run("loops=2", func(b *testing.B) { benchmarkAcceptBurst(b, 2, ":9848") })
+}
+
+// benchmarkAcceptBurst dials connections in bursts, so that the accept
+// queue holds many of them when the loops wake.
+func benchmarkAcceptBurst(b *testing.B, loops int, addr string) {
+	const burst = 32
+	events := BenchEvents([]byte("!"))
+	events.NumLoops = loops
+	serveClient(events, "tcp", addr, func() {
+		b.ResetTimer()
+		for i := 0; i < b.N; i += burst {
+			var wg sync.WaitGroup
+			for j := 0; j < burst; j++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c, err := net.Dial("tcp", addr)
+					must(err)
+					defer c.Close()
+					c.Write([]byte("?"))
+					_, err = io.ReadFull(c, make([]byte, 1))
+					must(err)
+				}()
+			}
+			wg.Wait()
+		}
+		b.StopTimer()
+	})
+}
+
+func BenchmarkEcho(b *testing.B) {
+	serveClient(EchoEvents(), "tcp", ":9894", func() {
+		c, err := net.Dial("tcp", ":9894")
+		must(err)
+		defer c.Close()
+		msg := make([]byte, 4096)
+		b.SetBytes(int64(len(msg)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			c.Write(msg)
+			_, err := io.ReadFull(c, msg)
+			must(err)
+		}
+		b.StopTimer()
+	})
+}
+
+func BenchmarkFanOut(b *testing.B) {
+	const nconns = 64
+	reply := make([]byte, 512)
+	serveClient(BenchEvents(reply), "tcp", ":9893", func() {
+		conns := make([]net.Conn, nconns)
+		for i := range conns {
+			c, err := net.Dial("tcp", ":9893")
+			must(err)
+			defer c.Close()
+			conns[i] = c
+		}
+		buf := make([]byte, len(reply))
+		b.SetBytes(nconns * int64(len(reply)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, c := range conns {
+				c.Write([]byte("?"))
+			}
+			for _, c := range conns {
+				_, err := io.ReadFull(c, buf)
+				must(err)
+			}
+		}
+		b.StopTimer()
+	})
+}
+
+func TestDuplicateAddrs(t *testing.T) {
+	var events Events
+	for _, addrs := range [][]string{
+		{"tcp://:9890", "tcp://:9890"},
+		{"tcp://:9890", "tcp-net://:9890"},
+		{"tcp://:9890?reuseport=true", "tcp://:9890"},
+	} {
+		err := Serve(events, addrs...)
+		if err == nil || err.Error() != "duplicate listener address tcp://:9890" {
+			t.Fatalf("%v: expected a duplicate address error, got %v", addrs, err)
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	// intentional duplicates share the port with reuseport
+	var naddrs int
+	events.Serving = func(s Server) (action Action) {
+		naddrs = len(s.Addrs)
+		return Shutdown
+	}
+	must(Serve(events, "tcp://:9890?reuseport=true", "tcp://:9890?reuseport=true"))
+	if naddrs != 2 {
+		t.Fatalf("expected two listeners, got %d", naddrs)
+	}
+}
+
+func TestWriteString(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testWriteString(t, "tcp", ":9889") })
+	t.Run("stdlib", func(t *testing.T) { testWriteString(t, "tcp-net", ":9888") })
+}
+
+func testWriteString(t *testing.T, network, addr string) {
+	var reply string
+	events := BenchEvents(nil)
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if in == nil {
+			return
+		}
+		must(c.WriteString("hello, "))
+		must(c.WriteString(""))
+		return []byte("world"), None
+	}
+	serveClient(events, network, addr, func() {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		c.Write([]byte("hi"))
+		buf := make([]byte, len("hello, world"))
+		_, err = io.ReadFull(c, buf)
+		must(err)
+		reply = string(buf)
+	})
+	if reply != "hello, world" {
+		t.Fatalf("expected %q, got %q", "hello, world", reply)
+	}
+}
+
+func TestPartialBind(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testPartialBind(t, "tcp") })
+	t.Run("stdlib", func(t *testing.T) { testPartialBind(t, "tcp-net") })
+}
+
+func testPartialBind(t *testing.T, network string) {
+	busy, err := net.Listen("tcp", "127.0.0.1:9885")
+	must(err)
+	defer busy.Close()
+	addrs := []string{network + "://127.0.0.1:9886", network + "://127.0.0.1:9885"}
+	var events Events
+	if err := Serve(events, addrs...); err == nil {
+		t.Fatal("expected the address in use to fail Serve")
+	}
+	results := make(map[string]error)
+	var served []string
+	events.PartialBind = true
+	events.OnBind = func(addr string, err error) {
+		results[addr] = err
+	}
+	events.Serving = func(s Server) (action Action) {
+		for _, addr := range s.Addrs {
+			served = append(served, addr.String())
+		}
+		return Shutdown
+	}
+	must(Serve(events, addrs...))
+	if len(results) != 2 || results[addrs[0]] != nil || results[addrs[1]] == nil {
+		t.Fatalf("expected the first address to bind and the second to fail, got %v", results)
+	}
+	if !strings.Contains(results[addrs[1]].Error(), "in use") {
+		t.Fatalf("expected an address in use error, got %v", results[addrs[1]])
+	}
+	if len(served) != 1 || served[0] != "127.0.0.1:9886" {
+		t.Fatalf("expected to serve the first address, got %v", served)
+	}
+	// it fails when nothing binds
+	if err := Serve(events, addrs[1]); err == nil {
+		t.Fatal("expected Serve to fail without any listener")
+	}
+}
+
+// traceLog is a Logger that keeps the traces.
+type traceLog struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *traceLog) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func (l *traceLog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.lines)
+}
+
+// snapshot returns a copy of the traces.
+func (l *traceLog) snapshot() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func TestTrace(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testTrace(t, "tcp", ":9882") })
+	t.Run("stdlib", func(t *testing.T) { testTrace(t, "tcp-net", ":9881") })
+}
+
+func testTrace(t *testing.T, network, addr string) {
+	var events Events
+	events.Serving = func(s Server) (action Action) {
+		if err := s.SetTrace(true); err == nil {
+			t.Fatal("expected tracing to need a logger")
+		}
+		return Shutdown
+	}
+	must(Serve(events, network+"://"+addr))
+
+	logs := new(traceLog)
+	var counts []int
+	events.Logger = logs
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if string(in) == "quit" {
+			return nil, Shutdown
+		}
+		return in, None
+	}
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			buf := make([]byte, 4)
+			ping := func() {
+				_, err := c.Write([]byte("ping"))
+				must(err)
+				_, err = io.ReadFull(c, buf)
+				must(err)
+				counts = append(counts, logs.len())
+			}
+			ping()
+			must(s.SetTrace(true))
+			if !s.Tracing() {
+				panic("expected tracing to be on")
+			}
+			ping()
+			must(s.SetTrace(false))
+			ping()
+			ping()
+			c.Write([]byte("quit"))
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	if counts[0] != 0 {
+		t.Fatalf("expected no traces before tracing is on, got %q", logs.lines)
+	}
+	if counts[1] == 0 {
+		t.Fatal("expected traces while tracing is on")
+	}
+	var read, wrote bool
+	for _, line := range logs.lines {
+		read = read || strings.HasPrefix(line, "evio: read 4 bytes")
+		wrote = wrote || strings.HasPrefix(line, "evio: wrote 4 of 4 bytes")
+	}
+	if !read || !wrote {
+		t.Fatalf("expected read and write traces, got %q", logs.lines)
+	}
+	if counts[3] != counts[2] {
+		t.Fatalf("expected no traces once tracing is off, got %q", logs.lines[counts[2]:])
+	}
+}
+
+func TestPending(t *testing.T) {
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		c.SetContext(new(Pending))
+		go c.Wake()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		p := c.Context().(*Pending)
+		if in == nil {
+			// push a request and wait for the answer
+			p.Expect(func(c Conn, in []byte) (out []byte, action Action) {
+				return append([]byte("answer "), in...), None
+			})
+			return []byte("question\n"), None
+		}
+		if out, action, ok := p.Next(c, in); ok {
+			return out, action
+		}
+		if string(in) == "quit\n" {
+			return nil, Shutdown
+		}
+		return []byte("unexpected " + string(in)), None
+	}
+	var got []string
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9880")
+			must(err)
+			defer c.Close()
+			rd := bufio.NewReader(c)
+			line, err := rd.ReadString('\n')
+			must(err)
+			got = append(got, line)
+			_, err = c.Write([]byte("42\n"))
+			must(err)
+			line, err = rd.ReadString('\n')
+			must(err)
+			got = append(got, line)
+			c.Write([]byte("quit\n"))
+		}()
+		return
+	}
+	must(Serve(events, "tcp://:9880"))
+	if len(got) != 2 || got[0] != "question\n" || got[1] != "answer 42\n" {
+		t.Fatalf("expected the answer to be handled by the pending handler, got %q", got)
+	}
+}
+
+func TestDump(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testDump(t, "tcp", ":9879") })
+	t.Run("stdlib", func(t *testing.T) { testDump(t, "tcp-net", ":9878") })
+}
+
+func testDump(t *testing.T, network, addr string) {
+	// the writes of stdlib servers block, so only the poll has output pending
+	pending := network == "tcp" && runtime.GOOS != "windows"
+	logs := new(traceLog)
+	var events Events
+	events.Logger = logs
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		if pending {
+			out = make([]byte, 16<<20)
+		}
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	events.Serving = func(s Server) (action Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			// the client doesn't read, so the output stays pending
+			for s.Stats().Conns != 1 {
+				time.Sleep(time.Millisecond)
+			}
+			s.dump()
+			c.Close()
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	// the client goroutine wrote the dump, so read it under the lock
+	lines := logs.snapshot()
+	if len(lines) == 0 || lines[0] != "evio: loop 0: 1 conns, 0 queued notes" {
+		t.Fatalf("expected the state of the loop, got %q", lines)
+	}
+	if pending {
+		if len(lines) != 2 || !strings.HasSuffix(lines[1], "bytes pending") ||
+			!strings.HasPrefix(lines[1], "evio: loop 0: conn ") {
+			t.Fatalf("expected the connection with pending output, got %q", lines)
+		}
+	}
+}
+
+// fakeClock is a Clock whose time only moves when it's advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c       *fakeClock
+	when    time.Time
+	fn      func()
+	stopped bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.stopped = true
+	return true
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, fn func()) ClockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, when: c.now.Add(d), fn: fn}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// pending returns the number of timers that are waiting.
+func (c *fakeClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for _, t := range c.timers {
+		if !t.stopped {
+			n++
+		}
+	}
+	return n
+}
+
+// Advance moves the time forward by d and fires the timers that expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	timers := c.timers[:0]
+	for _, t := range c.timers {
+		switch {
+		case t.stopped:
+		case !t.when.After(c.now):
+			t.stopped = true
+			due = append(due, t)
+		default:
+			timers = append(timers, t)
+		}
+	}
+	c.timers = timers
+	c.mu.Unlock()
+	for _, t := range due {
+		go t.fn()
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testFakeClock(t, "tcp", ":9877") })
+	t.Run("stdlib", func(t *testing.T) { testFakeClock(t, "tcp-net", ":9876") })
+}
+
+func testFakeClock(t *testing.T, network, addr string) {
+	clock := &fakeClock{now: time.Unix(1e9, 0)}
+	waitTimer := func() {
+		for clock.pending() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	var events Events
+	events.Clock = clock
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		opts.OpenTimeout = time.Hour
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return in, None
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		return Shutdown
+	}
+	start := time.Now()
+	var alive bool
+	var closed error
+	done := make(chan bool)
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			defer close(done)
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			waitTimer()
+			clock.Advance(time.Minute * 30)
+			waitTimer()
+			_, err = c.Write([]byte("ping"))
+			must(err)
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(c, buf)
+			alive = err == nil && string(buf) == "ping"
+			clock.Advance(time.Minute * 30)
+			_, closed = c.Read(buf)
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+addr))
+	<-done
+	if !alive {
+		t.Fatal("expected the connection to be open before the timeout")
+	}
+	if closed != io.EOF {
+		t.Fatalf("expected the open timeout to close the connection, got %v", closed)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Fatalf("expected the fake clock to skip the wait, took %s", elapsed)
+	}
+}
+
+func TestInBuffer(t *testing.T) {
+	t.Run("frames", func(t *testing.T) {
+		// one byte length prefixed frames, split at every possible offset
+		var stream []byte
+		var frames []string
+		for i := 0; i < 200; i++ {
+			frame := strings.Repeat(string(rune('a'+i%26)), i%17)
+			frames = append(frames, frame)
+			stream = append(append(stream, byte(len(frame))), frame...)
+		}
+		for step := 1; step < 40; step++ {
+			b := NewInBuffer(64)
+			var got []string
+			for i := 0; i < len(stream); i += step {
+				end := i + step
+				if end > len(stream) {
+					end = len(stream)
+				}
+				must(b.Append(stream[i:end]))
+				for b.Len() > 0 && b.Len() > int(b.Bytes()[0]) {
+					n := int(b.Bytes()[0])
+					got = append(got, string(b.Bytes()[1:1+n]))
+					b.Consume(1 + n)
+				}
+			}
+			if b.Len() != 0 || strings.Join(got, ",") != strings.Join(frames, ",") {
+				t.Fatalf("step %d: expected the frames, got %q with %d bytes left", step, got, b.Len())
+			}
+			if cap(b.buf) > 256 {
+				t.Fatalf("step %d: expected the consumed space to be reused, got a capacity of %d", step, cap(b.buf))
+			}
+		}
+	})
+	t.Run("limit", func(t *testing.T) {
+		b := NewInBuffer(10)
+		must(b.Append([]byte("12345")))
+		must(b.Append([]byte("67890")))
+		if err := b.Append([]byte("x")); err != ErrBufferFull {
+			t.Fatalf("expected ErrBufferFull, got %v", err)
+		}
+		if string(b.Bytes()) != "1234567890" {
+			t.Fatalf("expected the input to be kept, got %q", b.Bytes())
+		}
+		b.Consume(4)
+		must(b.Append([]byte("abcd")))
+		if string(b.Bytes()) != "567890abcd" {
+			t.Fatalf("expected the input after the consumed bytes, got %q", b.Bytes())
+		}
+		b.Reset()
+		if b.Len() != 0 {
+			t.Fatalf("expected no input after a reset, got %d bytes", b.Len())
+		}
+	})
+}
+
+func TestInPlace(t *testing.T) {
+	defer func(enabled bool) { debugInput = enabled }(debugInput)
+	debugInput = true
+	t.Run("frames", func(t *testing.T) {
+		// one byte length prefixed frames, split at every possible offset
+		var stream []byte
+		var frames []string
+		for i := 0; i < 100; i++ {
+			frame := strings.Repeat(string(rune('a'+i%26)), i%13)
+			frames = append(frames, frame)
+			stream = append(append(stream, byte(len(frame))), frame...)
+		}
+		for step := 1; step < 30; step++ {
+			var p InPlace
+			var got []string
+			var borrowed int
+			for i := 0; i < len(stream); i += step {
+				end := i + step
+				if end > len(stream) {
+					end = len(stream)
+				}
+				data := p.Begin(stream[i:end])
+				if p.Borrowed() {
+					borrowed++
+					if &data[0] != &stream[i] {
+						t.Fatalf("step %d: expected the borrowed input to be parsed in place", step)
+					}
+				}
+				for len(data) > 0 && len(data) > int(data[0]) {
+					n := int(data[0])
+					got = append(got, string(data[1:1+n]))
+					data = data[1+n:]
+				}
+				p.End(data)
+			}
+			if p.Len() != 0 || strings.Join(got, ",") != strings.Join(frames, ",") {
+				t.Fatalf("step %d: expected the frames, got %q with %d bytes left", step, got, p.Len())
+			}
+			if borrowed == 0 {
+				t.Fatalf("step %d: expected some of the input to be borrowed", step)
+			}
+		}
+	})
+	t.Run("misuse", func(t *testing.T) {
+		panics := func(name string, fn func()) {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%s: expected a panic", name)
+				}
+			}()
+			fn()
+		}
+		panics("end without begin", func() {
+			var p InPlace
+			p.End(nil)
+		})
+		panics("begin twice", func() {
+			var p InPlace
+			p.Begin([]byte("abc"))
+			p.Begin([]byte("def"))
+		})
+		panics("not the tail", func() {
+			var p InPlace
+			data := p.Begin([]byte("abcdef"))
+			p.End(data[1:3])
+		})
+		panics("copied tail", func() {
+			var p InPlace
+			data := p.Begin([]byte("abcdef"))
+			p.End([]byte(string(data[3:])))
+		})
+	})
+	t.Run("poll", func(t *testing.T) { testInPlace(t, "tcp", ":9854") })
+	t.Run("stdlib", func(t *testing.T) { testInPlace(t, "tcp-net", ":9853") })
+}
+
+func testInPlace(t *testing.T, network, addr string) {
+	defer func(enabled bool) { poisonInput = enabled }(poisonInput)
+	poisonInput = true
+	var p InPlace
+	var events Events
+	events.InputBuffer = ReuseInput
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		data := p.Begin(in)
+		for {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			out = append(out, bytes.ToUpper(data[:i+1])...)
+			data = data[i+1:]
+		}
+		p.End(data)
+		return
+	}
+	var got string
+	serveClient(events, network, addr, func() {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		for _, s := range []string{"hel", "lo\nwor", "ld\n"} {
+			_, err = c.Write([]byte(s))
+			must(err)
+			time.Sleep(time.Second / 20)
+		}
+		rd := bufio.NewReader(c)
+		for i := 0; i < 2; i++ {
+			line, err := rd.ReadString('\n')
+			must(err)
+			got += line
+		}
+	})
+	if got != "HELLO\nWORLD\n" {
+		t.Fatalf("expected the lines across reads, got %q", got)
+	}
+}
+
+func TestUserAction(t *testing.T) {
+	events := Events{Actions: map[Action]func(c Conn) Action{
+		Close: func(c Conn) Action { return None },
+	}}
+	if err := Serve(events, "tcp://:9851"); err != errReservedAction {
+		t.Fatalf("expected errReservedAction, got %v", err)
+	}
+	t.Run("poll", func(t *testing.T) { testUserAction(t, "tcp", ":9851") })
+	t.Run("stdlib", func(t *testing.T) { testUserAction(t, "tcp-net", ":9850") })
+}
+
+func testUserAction(t *testing.T, network, addr string) {
+	const (
+		upgrade = UserAction + iota
+		unhandled
+	)
+	var mu sync.Mutex
+	var log []string
+	record := func(s string) {
+		mu.Lock()
+		log = append(log, s)
+		mu.Unlock()
+	}
+	var events Events
+	events.Actions = map[Action]func(c Conn) Action{
+		upgrade: func(c Conn) Action {
+			record("upgrade")
+			return Close
+		},
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		record("data " + strings.TrimSpace(string(in)))
+		switch string(in) {
+		case "upgrade\n":
+			return []byte("ok\n"), upgrade
+		default:
+			return in, unhandled
+		}
+	}
+	var got string
+	serveClient(events, network, addr, func() {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		rd := bufio.NewReader(c)
+		for _, req := range []string{"ping\n", "upgrade\n"} {
+			_, err = c.Write([]byte(req))
+			must(err)
+			line, err := rd.ReadString('\n')
+			must(err)
+			got += line
+		}
+		if _, err := rd.ReadByte(); err != io.EOF {
+			t.Errorf("expected the handler to close the connection, got %v", err)
+		}
+	})
+	if got != "ping\nok\n" {
+		t.Fatalf("expected the output of both events, got %q", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(log, ",") != "data ping,data upgrade,upgrade" {
+		t.Fatalf("expected the handler to run after Data, got %q", log)
+	}
+}
+
+func TestFDHeadroom(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testFDHeadroom(t, "tcp", ":9847") })
+	t.Run("stdlib", func(t *testing.T) { testFDHeadroom(t, "tcp-net", ":9846") })
+}
+
+func testFDHeadroom(t *testing.T, network, addr string) {
+	defer func(counts func() (int, int, error)) { fdCounts = counts }(fdCounts)
+	// leave room for two connections
+	fdCounts = func() (limit, open int, err error) { return 12, 0, nil }
+	var paused int32
+	var events Events
+	events.FDHeadroom = 10
+	events.OnAcceptError = func(err error) (action Action) {
+		if err == ErrFDHeadroom {
+			atomic.AddInt32(&paused, 1)
+		}
+		return
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		return []byte("hi\n"), opts, None
+	}
+	greeted := func(c net.Conn, wait time.Duration) bool {
+		c.SetReadDeadline(time.Now().Add(wait))
+		_, err := io.ReadFull(c, make([]byte, 3))
+		return err == nil
+	}
+	serveClient(events, network, addr, func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for i := 0; i < 3; i++ {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			conns = append(conns, c)
+		}
+		if !greeted(conns[0], time.Second) || !greeted(conns[1], time.Second) {
+			t.Error("expected the first two connections to be accepted")
+			return
+		}
+		if greeted(conns[2], time.Second/4) {
+			t.Error("expected the third connection to wait for room")
+			return
+		}
+		if atomic.LoadInt32(&paused) == 0 {
+			t.Error("expected ErrFDHeadroom to be passed to OnAcceptError")
+		}
+		conns[0].Close()
+		if !greeted(conns[2], time.Second*2) {
+			t.Error("expected the third connection to be accepted once there's room")
+		}
+	})
+}
+
+func TestStream(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testStream(t, "tcp", ":9844") })
+	t.Run("stdlib", func(t *testing.T) { testStream(t, "tcp-net", ":9843") })
+}
+
+func testStream(t *testing.T, network, addr string) {
+	type request struct{ A, B int }
+	type response struct{ Sum int }
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		s := NewStream(c)
+		c.SetContext(s)
+		go func() {
+			defer s.Done()
+			dec, enc := json.NewDecoder(s), json.NewEncoder(s)
+			for {
+				var req request
+				if err := dec.Decode(&req); err != nil {
+					return
+				}
+				must(enc.Encode(response{req.A + req.B}))
+				if req.A == 0 {
+					return
+				}
+			}
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		s := c.Context().(*Stream)
+		s.Feed(in)
+		return s.Flush()
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if s, ok := c.Context().(*Stream); ok {
+			s.Close()
+		}
+		return
+	}
+	var got []byte
+	serveClient(events, network, addr, func() {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		// the requests are split across reads
+		for _, part := range []string{`{"A":1,`, `"B":2}{"A":`, `3,"B":4}`, `{"A":0,"B":5}`} {
+			_, err := c.Write([]byte(part))
+			must(err)
+			time.Sleep(time.Second / 20)
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second * 2))
+		got, err = ioutil.ReadAll(c)
+		must(err)
+	})
+	if string(got) != "{\"Sum\":3}\n{\"Sum\":7}\n{\"Sum\":5}\n" {
+		t.Fatalf("expected the sums and a close, got %q", got)
+	}
+}
+
+func TestStreamWatermark(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testStreamWatermark(t, "tcp", ":9864") })
+	t.Run("stdlib", func(t *testing.T) { testStreamWatermark(t, "tcp-net", ":9863") })
+}
+
+// testStreamWatermark sends more than the worker reads for a while, and
+// checks that the unread input stays near the watermark.
+func testStreamWatermark(t *testing.T, network, addr string) {
+	const high = 64 << 10
+	const total = 4 << 20
+	var peak int
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		s := NewStream(c)
+		s.SetReadWatermark(high)
+		c.SetContext(s)
+		go func() {
+			defer s.Done()
+			// the worker falls behind before it reads
+			time.Sleep(time.Second / 5)
+			n, _ := io.CopyN(ioutil.Discard, s, total)
+			fmt.Fprintf(s, "%d\n", n)
+		}()
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		s := c.Context().(*Stream)
+		s.Feed(in)
+		s.mu.Lock()
+		if len(s.in) > peak {
+			peak = len(s.in)
+		}
+		s.mu.Unlock()
+		return s.Flush()
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if s, ok := c.Context().(*Stream); ok {
+			s.Close()
+		}
+		return
+	}
+	var got string
+	serveClient(events, network, addr, func() {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		go c.Write(make([]byte, total))
+		c.SetReadDeadline(time.Now().Add(time.Second * 5))
+		got, err = bufio.NewReader(c).ReadString('\n')
+		must(err)
+	})
+	if got != fmt.Sprintf("%d\n", total) {
+		t.Fatalf("expected the worker to read all of the input, got %q", got)
+	}
+	// the input of a read can go past the watermark before the reads pause
+	if peak > high+256<<10 {
+		t.Fatalf("expected the unread input to stay near %d bytes, got %d", high, peak)
+	}
+}
+
+func TestListenerOnAccept(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testListenerOnAccept(t, "tcp", ":9842", ":9841") })
+	t.Run("stdlib", func(t *testing.T) { testListenerOnAccept(t, "tcp-net", ":9840", ":9839") })
+}
+
+func testListenerOnAccept(t *testing.T, network, limited, blocked string) {
+	var done int32
+	var accepted int32
+	var events Events
+	events.Listeners = map[int]ListenerConfig{
+		// the first listener takes two connections
+		0: {OnAccept: func(remote net.Addr) bool {
+			return atomic.LoadInt32(&done) == 1 || atomic.AddInt32(&accepted, 1) <= 2
+		}},
+		// the second listener blocks loopback addresses
+		1: {OnAccept: func(remote net.Addr) bool {
+			return !remote.(*net.TCPAddr).IP.IsLoopback()
+		}},
+	}
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		if atomic.LoadInt32(&done) == 1 {
+			return nil, opts, Shutdown
+		}
+		return []byte("hi\n"), opts, None
+	}
+	greeted := func(addr string) bool {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = io.ReadFull(c, make([]byte, 3))
+		return err == nil
+	}
+	var got []bool
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			got = append(got, greeted(limited), greeted(limited), greeted(limited), greeted(blocked))
+			atomic.StoreInt32(&done, 1)
+			if c, err := net.Dial("tcp", limited); err == nil {
+				c.Close()
+			}
+		}()
+		return
+	}
+	must(Serve(events, network+"://"+limited, network+"://"+blocked))
+	if fmt.Sprint(got) != "[true true false false]" {
+		t.Fatalf("expected each listener to apply its own policy, got %v", got)
+	}
+}
+
+func TestConnPool(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testConnPool(t, "tcp", ":9838") })
+	t.Run("stdlib", func(t *testing.T) { testConnPool(t, "tcp-net", ":9837") })
+}
+
+func testConnPool(t *testing.T, network, addr string) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err)
+	defer up.Close()
+	go func() {
+		for {
+			c, err := up.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	upaddr := up.Addr().String()
+	pool := &ConnPool{MaxIdle: 1, IdleTimeout: time.Second / 4}
+	closed := make(chan uint64, 4)
+	var events Events
+	events.Closed = func(c Conn, err error) (action Action) {
+		if c.AddrIndex() == -1 {
+			closed <- c.ID()
+		}
+		return
+	}
+	expectClosed := func(id uint64) {
+		select {
+		case got := <-closed:
+			if got != id {
+				t.Errorf("expected conn %d to close, got %d", id, got)
+			}
+		case <-time.After(time.Second * 2):
+			t.Errorf("expected conn %d to close", id)
+		}
+	}
+	serveClient(pool.Events(events), network, addr, func() {
+		c1, err := pool.Get("tcp", upaddr)
+		must(err)
+		c2, err := pool.Get("tcp", upaddr)
+		must(err)
+		if c1 == c2 {
+			t.Error("expected a new connection while the first one is taken")
+			return
+		}
+		pool.Put(c1)
+		// over MaxIdle
+		pool.Put(c2)
+		expectClosed(c2.ID())
+		c3, err := pool.Get("tcp", upaddr)
+		must(err)
+		if c3 != c1 {
+			t.Error("expected the idle connection to be reused")
+			return
+		}
+		pool.Put(c3)
+		if n := pool.Idle("tcp", upaddr); n != 1 {
+			t.Errorf("expected one idle connection, got %d", n)
+		}
+		expectClosed(c1.ID())
+		if n := pool.Idle("tcp", upaddr); n != 0 {
+			t.Errorf("expected the idle connection to expire, got %d", n)
+		}
+	})
+}
+
+func TestConnPoolTimeout(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testConnPoolTimeout(t, "tcp", ":9866") })
+	t.Run("stdlib", func(t *testing.T) { testConnPoolTimeout(t, "tcp-net", ":9865") })
+}
+
+// testConnPoolTimeout gives up on a connection before its Opened event, on
+// the clock of the server, and checks that it's closed rather than leaked.
+func testConnPoolTimeout(t *testing.T, network, addr string) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err)
+	defer up.Close()
+	go func() {
+		for {
+			c, err := up.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	upaddr := up.Addr().String()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	pool := &ConnPool{DialTimeout: time.Minute}
+	closed := make(chan bool, 1)
+	var events Events
+	events.Clock = clock
+	events.Closed = func(c Conn, err error) (action Action) {
+		if c.AddrIndex() == -1 {
+			closed <- true
+		}
+		return
+	}
+	events = pool.Events(events)
+	// the Opened event of the pool waits until Get gave up
+	release := make(chan struct{})
+	opened := events.Opened
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		if c.AddrIndex() == -1 {
+			<-release
+		}
+		return opened(c)
+	}
+	var getErr error
+	var wasClosed bool
+	serveClient(events, network, addr, func() {
+		got := make(chan error, 1)
+		go func() {
+			_, err := pool.Get("tcp", upaddr)
+			got <- err
+		}()
+		for i := 0; i < 200 && clock.pending() == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		clock.Advance(time.Minute)
+		getErr = <-got
+		close(release)
+		select {
+		case wasClosed = <-closed:
+		case <-time.After(2 * time.Second):
+		}
+	})
+	if getErr == nil {
+		t.Fatal("expected Get to time out")
+	}
+	if !wasClosed {
+		t.Fatal("expected the connection that Get gave up on to be closed")
+	}
+	// the pool stops with the server
+	for i := 0; i < 200; i++ {
+		if _, err = pool.Get("tcp", upaddr); err == errPoolNotServing {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != errPoolNotServing {
+		t.Fatalf("expected the pool to stop with the server, got %v", err)
+	}
+}
+
+func TestWriteBuffers(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testWriteBuffers(t, "tcp", ":9874") })
+	t.Run("stdlib", func(t *testing.T) { testWriteBuffers(t, "tcp-net", ":9873") })
+}
+
+func testWriteBuffers(t *testing.T, network, addr string) {
+	var writes int32
+	var events Events
+	events.PreWrite = func() {
+		atomic.AddInt32(&writes, 1)
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		bufs := net.Buffers{[]byte("header "), nil, []byte("body "), []byte("trailer\n")}
+		must(c.WriteBuffers(bufs))
+		return []byte("output\n"), None
+	}
+	var got string
+	serveClient(events, network, addr, func() {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		_, err = c.Write([]byte("get"))
+		must(err)
+		rd := bufio.NewReader(c)
+		for i := 0; i < 2; i++ {
+			line, err := rd.ReadString('\n')
+			must(err)
+			got += line
+		}
+	})
+	if got != "header body trailer\noutput\n" {
+		t.Fatalf("expected the buffers in order before the output, got %q", got)
+	}
+	if network == "tcp" && runtime.GOOS != "windows" {
+		if n := atomic.LoadInt32(&writes); n != 1 {
+			t.Fatalf("expected a single write, got %d", n)
+		}
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testMaxInFlight(t, "tcp", ":9872") })
+	t.Run("stdlib", func(t *testing.T) { testMaxInFlight(t, "tcp-net", ":9871") })
+}
+
+func testMaxInFlight(t *testing.T, network, addr string) {
+	var reads int32
+	conns := make(chan Conn, 1)
+	var pending []string
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		conns <- c
+		opts.MaxInFlight = 2
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if in == nil {
+			// answer the requests in flight
+			for _, req := range pending {
+				out = append(out, req...)
+				c.EndRequest()
+			}
+			pending = pending[:0]
+			return
+		}
+		for _, req := range strings.SplitAfter(string(in), "\n") {
+			if req != "" {
+				c.BeginRequest()
+				pending = append(pending, req)
+				atomic.AddInt32(&reads, 1)
+			}
+		}
+		return
+	}
+	waitReads := func(n int32) bool {
+		for i := 0; i < 100; i++ {
+			if atomic.LoadInt32(&reads) >= n {
+				return true
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		return false
+	}
+	var got string
+	var paused bool
+	serveClient(events, network, addr, func() {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		sc := <-conns
+		for i, req := range []string{"1\n", "2\n", "3\n"} {
+			_, err = c.Write([]byte(req))
+			must(err)
+			if i < 2 && !waitReads(int32(i+1)) {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond * 50)
+		paused = atomic.LoadInt32(&reads) == 2
+		rd := bufio.NewReader(c)
+		must(sc.Wake())
+		for i := 0; i < 2; i++ {
+			line, err := rd.ReadString('\n')
+			must(err)
+			got += line
+		}
+		if !waitReads(3) {
+			return
+		}
+		must(sc.Wake())
+		line, err := rd.ReadString('\n')
+		must(err)
+		got += line
+	})
+	if network == "tcp" && !paused {
+		t.Fatalf("expected the reads to pause at 2 requests in flight, got %d", atomic.LoadInt32(&reads))
+	}
+	if got != "1\n2\n3\n" {
+		t.Fatalf("expected all of the requests answered, got %q", got)
+	}
+}
+
+func TestParallelClose(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testParallelClose(t, "tcp", ":9868") })
+	t.Run("stdlib", func(t *testing.T) { testParallelClose(t, "tcp-net", ":9867") })
+}
+
+func testParallelClose(t *testing.T, network, addr string) {
+	const n = 200
+	var opened, closed int32
+	var events Events
+	events.NumLoops = 4
+	events.ParallelClose = true
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		atomic.AddInt32(&opened, 1)
+		return
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		return nil, Shutdown
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		atomic.AddInt32(&closed, 1)
+		return
+	}
+	var conns []net.Conn
+	events.Serving = func(_ Server) (action Action) {
+		go func() {
+			for i := 0; i < n; i++ {
+				c, err := net.Dial("tcp", addr)
+				must(err)
+				conns = append(conns, c)
+			}
+			for atomic.LoadInt32(&opened) < n {
+				time.Sleep(time.Millisecond)
+			}
+			_, err := conns[0].Write([]byte("quit"))
+			must(err)
+		}()
+		return
+	}
+	start := time.Now()
+	must(Serve(events, network+"://"+addr))
+	t.Logf("served and closed %d connections in %v", n, time.Since(start))
+	for _, c := range conns {
+		c.Close()
+	}
+	if got := atomic.LoadInt32(&closed); got != n {
+		t.Fatalf("expected %d Closed events before Serve returned, got %d", n, got)
+	}
+}
+
+func TestTryWrite(t *testing.T) {
+	const chunk, low, high = 16 << 10, 64 << 10, 256 << 10
+	var queued int
+	var blocked, resumed bool
+	var events Events
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		must(c.SetWriteWatermarks(low, high))
+		return
+	}
+	events.OnWriteLow = func(c Conn) {
+		c.Wake()
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if in == nil {
+			// the reader caught up
+			resumed = c.TryWrite([]byte("done\n")) == nil
+			return
+		}
+		b := make([]byte, chunk)
+		for {
+			err := c.TryWrite(b)
+			if err == ErrWouldBlock {
+				blocked = true
+				break
+			}
+			must(err)
+			queued += len(b)
+		}
+		return
+	}
+	var tail string
+	serveClient(events, "tcp", ":9862", func() {
+		c, err := net.Dial("tcp", ":9862")
+		must(err)
+		defer c.Close()
+		_, err = c.Write([]byte("go"))
+		must(err)
+		// a slow reader
+		time.Sleep(time.Millisecond * 50)
+		_, err = io.ReadFull(c, make([]byte, high))
+		must(err)
+		b := make([]byte, 5)
+		_, err = io.ReadFull(c, b)
+		must(err)
+		tail = string(b)
+	})
+	if !blocked || queued != high {
+		t.Fatalf("expected ErrWouldBlock once %d bytes were queued, got %d queued", high, queued)
+	}
+	if !resumed || tail != "done\n" {
+		t.Fatalf("expected the write to resume once the output drained, got %q", tail)
+	}
+}
+
+func TestProfileLabels(t *testing.T) {
+	t.Run("poll", func(t *testing.T) { testProfileLabels(t, "tcp", ":9861") })
+	t.Run("stdlib", func(t *testing.T) { testProfileLabels(t, "tcp-net", ":9860") })
+}
+
+func testProfileLabels(t *testing.T, network, addr string) {
+	var profile bytes.Buffer
+	var events Events
+	events.NumLoops = 2
+	events.ProfileLabels = true
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		pprof.Lookup("goroutine").WriteTo(&profile, 1)
+		return nil, Shutdown
+	}
+	serveClient(events, network, addr, func() {
+		c, err := net.Dial("tcp", addr)
+		must(err)
+		defer c.Close()
+		_, err = c.Write([]byte("profile"))
+		must(err)
+		io.Copy(ioutil.Discard, c)
+	})
+	for i := 0; i < 2; i++ {
+		label := fmt.Sprintf(`"evio.loop":"%d"`, i)
+		if !strings.Contains(profile.String(), label) {
+			t.Fatalf("expected the profile to have the label %s", label)
+		}
+	}
+	if network == "tcp-net" && !strings.Contains(profile.String(), `"evio.role":"listener"`) {
+		t.Fatal("expected the profile to have the listener label")
+	}
+}
@@ -0,0 +1,478 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package evio
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ListenerConfig holds the settings of one of the listeners passed to Serve.
+type ListenerConfig struct {
+	// TLSConfig enables TLS for the connections that are accepted on the
+	// listener. The input is decrypted before it's passed to the Data event
+	// and the output of the events is encrypted. Output that's returned
+	// before the handshake completes is sent once it does. TLS connections
+	// can't be detached, a Detach action closes them.
+	TLSConfig *tls.Config
+	// Protocols routes the decrypted input of TLS connections to a Data
+	// handler by the protocol that was negotiated with ALPN, such as "h2" or
+	// "http/1.1". The protocols are advertised in addition to the ones in
+	// TLSConfig.NextProtos. Connections that negotiated another protocol, or
+	// none, use the Data event.
+	Protocols map[string]func(c Conn, in []byte) (out []byte, action Action)
+	// SessionTicketKeys are the keys that encrypt and decrypt the session
+	// tickets of TLS connections, which clients use to resume sessions.
+	// The first key encrypts new tickets and all of them decrypt. Sharing
+	// the keys lets sessions resume across servers and restarts. They can
+	// be rotated with Server.SetSessionTicketKeys. When empty, crypto/tls
+	// manages the keys.
+	SessionTicketKeys [][32]byte
+	// ReusePortCPU attaches a BPF program to the reuseport group of the
+	// listener that hands each connection to the socket whose index in the
+	// group is the CPU that received it, instead of hashing the addresses
+	// (SO_ATTACH_REUSEPORT_CBPF). Sockets join the group in the order that
+	// they're bound, so starting one server per CPU, in CPU order, keeps a
+	// connection on the CPU that handles its packets. It needs the
+	// reuseport address option and Linux.
+	ReusePortCPU bool
+	// ReusePortProgram is the file descriptor of a loaded eBPF program of
+	// type BPF_PROG_TYPE_SOCKET_FILTER or BPF_PROG_TYPE_SK_REUSEPORT that's
+	// attached to the reuseport group of the listener to pick the socket
+	// of each connection (SO_ATTACH_REUSEPORT_EBPF). Zero means none. It's
+	// used instead of ReusePortCPU when both are set, and it needs the
+	// reuseport address option and Linux.
+	ReusePortProgram int
+	// OnAccept decides whether a connection that was accepted on the
+	// listener is kept, such as for an allow list or a rate limit of the
+	// listener's own. It's passed the remote address, and the connection
+	// is closed without any events when it returns false. It's called
+	// before Events.MaxConnsPerIP is checked, from the loops or, on stdlib
+	// ("-net") servers, the listener's goroutine, so it must be quick and
+	// safe for concurrent use.
+	OnAccept func(remote net.Addr) bool
+}
+
+// SetSessionTicketKeys replaces the session ticket keys of the server's TLS
+// listeners. To rotate the keys without dropping sessions, pass the new key
+// first followed by the keys that should still resume, and drop an old key
+// once its tickets should stop resuming. It may be called from any
+// goroutine, and it has no effect on servers without TLS listeners.
+func (s Server) SetSessionTicketKeys(keys [][32]byte) {
+	for _, config := range s.tlsConfigs {
+		config.SetSessionTicketKeys(keys)
+	}
+}
+
+// tlsConfigs returns the TLS configs of the listeners, in listener order.
+func tlsConfigs(events Events) []*tls.Config {
+	var idxs []int
+	for i, lc := range events.Listeners {
+		if lc.TLSConfig != nil {
+			idxs = append(idxs, i)
+		}
+	}
+	sort.Ints(idxs)
+	var configs []*tls.Config
+	for _, i := range idxs {
+		configs = append(configs, events.Listeners[i].TLSConfig)
+	}
+	return configs
+}
+
+// TLSConnectionState returns the state of a TLS connection, which includes
+// the protocol that was negotiated with ALPN. The ok result is false until
+// the handshake completes and for connections that don't use TLS.
+func TLSConnectionState(c Conn) (state tls.ConnectionState, ok bool) {
+	if t, ok := c.(*tlsconn); ok && t.flushed {
+		return t.state, true
+	}
+	return state, false
+}
+
+// tlsconn is a connection that's terminated with TLS. The crypto/tls
+// connection runs on top of an in-memory pipe. The handshake runs in a
+// goroutine of its own, which wakes the loop when it has output and ends
+// with the handshake, and the loop decrypts the input after it.
+type tlsconn struct {
+	Conn                   // underlying connection
+	ctx     interface{}    // user-defined context
+	tc      *tls.Conn      // tls connection
+	lc      ListenerConfig // listener settings
+	data    func(c Conn, in []byte) (out []byte, action Action)
+	mu      sync.Mutex          // guards the fields below
+	cond    *sync.Cond          // signals input and close
+	in      []byte              // encrypted input
+	out     []byte              // encrypted output
+	err     error               // read or handshake error
+	ready   bool                // handshake completed
+	state   tls.ConnectionState // state after the handshake
+	closed  bool                // underlying connection closed
+	wake    bool                // a wake is pending
+	user    bool                // user requested a wake
+	inloop  bool                // the loop is processing the connection
+	pending []byte              // output waiting for the handshake, loop only
+	flushed bool                // pending output was written, loop only
+	more    bool                // the data handler returned More, loop only
+	buf     []byte              // decrypted input, loop only
+}
+
+func (t *tlsconn) Context() interface{}           { return t.ctx }
+func (t *tlsconn) SetContext(ctx interface{})     { t.ctx = ctx }
+func (t *tlsconn) ReadableBytes() (int, error)    { return 0, ErrUnsupported }
+func (t *tlsconn) Peek(n int) ([]byte, error)     { return nil, ErrUnsupported }
+func (t *tlsconn) WriteFrom(io.Reader) error      { return ErrUnsupported }
+func (t *tlsconn) SendUrgent([]byte) error        { return ErrUnsupported }
+func (t *tlsconn) WriteString(string) error       { return ErrUnsupported }
+func (t *tlsconn) WriteBuffers(net.Buffers) error { return ErrUnsupported }
+func (t *tlsconn) TryWrite([]byte) error          { return ErrUnsupported }
+func (t *tlsconn) SetWriteWatermarks(low, high int) error {
+	return ErrUnsupported
+}
+
+// trackInBuffer keeps the buffer on the underlying connection, which
+// releases it when it closes.
+func (t *tlsconn) trackInBuffer(b *InBuffer) *InBuffer {
+	if ic, ok := t.Conn.(inboundConn); ok {
+		return ic.trackInBuffer(b)
+	}
+	return nil
+}
+func (t *tlsconn) CloseWithReason(int, string) error {
+	return ErrUnsupported
+}
+func (t *tlsconn) SetDeadline(time.Time, func(c Conn) ([]byte, Action)) error {
+	return ErrUnsupported
+}
+func (t *tlsconn) Wake() error {
+	t.mu.Lock()
+	t.user = true
+	t.mu.Unlock()
+	err := t.Conn.Wake()
+	if err != nil {
+		t.mu.Lock()
+		t.user = false
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// wakeLoop wakes the loop of the underlying connection. The tls connection
+// relies on these wakes, so they bypass the wake queue size.
+func (t *tlsconn) wakeLoop() {
+	if c, ok := t.Conn.(interface{ wake() }); ok {
+		c.wake()
+	} else {
+		t.Conn.Wake()
+	}
+}
+
+// errTLSWouldBlock is returned by the reads of the loop once the input is
+// used up. It's temporary, so crypto/tls passes it on without failing the
+// connection, and it keeps the partial record for the next read.
+var errTLSWouldBlock error = tlsWouldBlock{}
+
+type tlsWouldBlock struct{}
+
+func (tlsWouldBlock) Error() string   { return "evio: tls input would block" }
+func (tlsWouldBlock) Timeout() bool   { return true }
+func (tlsWouldBlock) Temporary() bool { return true }
+
+// tlspipe is the net.Conn that the tls connection reads from and writes to.
+type tlspipe struct{ t *tlsconn }
+
+func (p tlspipe) Read(b []byte) (int, error) {
+	t := p.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// the handshake blocks, since crypto/tls can't resume it
+	for len(t.in) == 0 && !t.closed && !t.ready {
+		t.cond.Wait()
+	}
+	if len(t.in) == 0 && !t.closed {
+		return 0, errTLSWouldBlock
+	}
+	if len(t.in) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, t.in)
+	t.in = t.in[n:]
+	return n, nil
+}
+
+func (p tlspipe) Write(b []byte) (int, error) {
+	t := p.t
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	t.out = append(t.out, b...)
+	// the output of the loop is picked up when it's done, and the loop
+	// doesn't wait on the handshake, so the handshake can wake it here
+	wake := !t.inloop && !t.wake
+	t.wake = t.wake || wake
+	t.mu.Unlock()
+	if wake {
+		t.wakeLoop()
+	}
+	return len(b), nil
+}
+
+func (p tlspipe) Close() error {
+	p.t.close()
+	return nil
+}
+
+func (p tlspipe) LocalAddr() net.Addr                { return p.t.LocalAddr() }
+func (p tlspipe) RemoteAddr() net.Addr               { return p.t.RemoteAddr() }
+func (p tlspipe) SetDeadline(t time.Time) error      { return nil }
+func (p tlspipe) SetReadDeadline(t time.Time) error  { return nil }
+func (p tlspipe) SetWriteDeadline(t time.Time) error { return nil }
+
+func newTLSConn(c Conn, lc ListenerConfig,
+	data func(c Conn, in []byte) (out []byte, action Action)) *tlsconn {
+	t := &tlsconn{Conn: c, lc: lc, data: data}
+	t.cond = sync.NewCond(&t.mu)
+	t.tc = tls.Server(tlspipe{t}, lc.TLSConfig)
+	return t
+}
+
+// handshake performs the handshake. crypto/tls fails a handshake whose
+// read would block, so it runs in its own goroutine, which ends with it.
+func (t *tlsconn) handshake() {
+	err := t.tc.Handshake()
+	t.mu.Lock()
+	if err == nil {
+		t.state = t.tc.ConnectionState()
+		t.ready = true
+	}
+	t.err = err
+	t.mu.Unlock()
+	t.notify()
+}
+
+// notify wakes the loop unless a wake is already pending.
+func (t *tlsconn) notify() {
+	t.mu.Lock()
+	if t.wake || t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.wake = true
+	t.mu.Unlock()
+	t.wakeLoop()
+}
+
+func (t *tlsconn) close() {
+	t.mu.Lock()
+	t.closed = true
+	t.cond.Broadcast()
+	t.mu.Unlock()
+}
+
+// write encrypts the output, or holds on to it until the handshake is done.
+func (t *tlsconn) write(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	if !t.flushed {
+		t.pending = append(t.pending, b...)
+		return
+	}
+	t.tc.Write(b)
+}
+
+// process feeds the encrypted input to the tls connection and passes the
+// decrypted input to the Data event. It returns the encrypted output.
+func (t *tlsconn) process(in []byte) (out []byte, action Action) {
+	t.mu.Lock()
+	if len(in) > 0 {
+		t.in = append(t.in, in...)
+		t.cond.Signal()
+	}
+	user, ready, err := t.user, t.ready, t.err
+	t.user, t.wake = false, false
+	t.inloop = true
+	t.mu.Unlock()
+
+	if ready && !t.flushed {
+		t.flushed = true
+		if data := t.lc.Protocols[t.state.NegotiatedProtocol]; data != nil {
+			t.data = data
+		}
+		t.write(t.pending)
+		t.pending = nil
+	}
+	var more bool
+	if ready {
+		if t.buf == nil {
+			t.buf = make([]byte, 0xFFFF)
+		}
+		// the input that the handshake read past its end is decrypted
+		// along with the new input
+		for action == None {
+			var n int
+			n, err = t.tc.Read(t.buf)
+			if n > 0 && t.data != nil {
+				o, a := t.data(t, t.buf[:n])
+				t.write(o)
+				if a == More {
+					more = true
+				} else {
+					action = a
+				}
+			}
+			if err == errTLSWouldBlock {
+				err = nil
+				break
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	if data := t.data; data != nil {
+		if (user || t.more) && action == None {
+			o, a := data(t, nil)
+			t.write(o)
+			if a == More {
+				more = true
+			} else {
+				action = a
+			}
+		}
+		// the underlying connection calls back once the output is written
+		if t.more = more && action == None; t.more {
+			action = More
+		}
+	}
+
+	t.mu.Lock()
+	out, t.out = t.out, nil
+	t.inloop = false
+	t.mu.Unlock()
+	if err != nil && action == None {
+		action = Close
+	}
+	if action == Detach {
+		action = Close
+	}
+	return out, action
+}
+
+// tlsEvents wraps the events to terminate TLS for the listeners that have a
+// TLSConfig. The events are returned as is when none of them do.
+func tlsEvents(events Events) Events {
+	var enabled bool
+	for _, lc := range events.Listeners {
+		enabled = enabled || lc.TLSConfig != nil
+	}
+	if !enabled {
+		return events
+	}
+	wrap := userConn
+	opened, data, closed := events.Opened, events.Data, events.Closed
+	bufferFull, bufferEmpty := events.OnBufferFull, events.OnBufferEmpty
+	listeners := make(map[int]ListenerConfig)
+	for i, lc := range events.Listeners {
+		if lc.TLSConfig != nil && len(lc.SessionTicketKeys) > 0 {
+			lc.TLSConfig = lc.TLSConfig.Clone()
+			lc.TLSConfig.SetSessionTicketKeys(lc.SessionTicketKeys)
+		}
+		if lc.TLSConfig != nil && len(lc.Protocols) > 0 {
+			lc.TLSConfig = lc.TLSConfig.Clone()
+			var protos []string
+			for proto := range lc.Protocols {
+				protos = append(protos, proto)
+			}
+			sort.Strings(protos)
+			for _, proto := range protos {
+				if !hasProto(lc.TLSConfig.NextProtos, proto) {
+					lc.TLSConfig.NextProtos = append(lc.TLSConfig.NextProtos, proto)
+				}
+			}
+		}
+		listeners[i] = lc
+	}
+	// the servers rotate the ticket keys of the configs in use
+	events.Listeners = listeners
+	events.Opened = func(c Conn) (out []byte, opts Options, action Action) {
+		lc := listeners[c.AddrIndex()]
+		if lc.TLSConfig == nil {
+			if opened != nil {
+				return opened(c)
+			}
+			return
+		}
+		t := newTLSConn(c, lc, data)
+		c.SetContext(t)
+		if opened != nil {
+			out, opts, action = opened(t)
+			t.write(out)
+			t.more = action == More
+		}
+		go t.handshake()
+		if action == Detach {
+			action = Close
+		}
+		return nil, opts, action
+	}
+	events.Data = func(c Conn, in []byte) (out []byte, action Action) {
+		if t, ok := c.Context().(*tlsconn); ok {
+			return t.process(in)
+		}
+		if data != nil {
+			return data(c, in)
+		}
+		return
+	}
+	events.Closed = func(c Conn, err error) (action Action) {
+		if t, ok := c.Context().(*tlsconn); ok {
+			t.close()
+		}
+		if closed != nil {
+			return closed(wrap(c), err)
+		}
+		return
+	}
+	if bufferFull != nil {
+		events.OnBufferFull = func(c Conn) { bufferFull(wrap(c)) }
+	}
+	if bufferEmpty != nil {
+		events.OnBufferEmpty = func(c Conn) { bufferEmpty(wrap(c)) }
+	}
+	if len(events.Actions) > 0 {
+		actions := make(map[Action]func(c Conn) Action, len(events.Actions))
+		for action, fn := range events.Actions {
+			fn := fn
+			actions[action] = func(c Conn) Action { return fn(wrap(c)) }
+		}
+		events.Actions = actions
+	}
+	return events
+}
+
+// userConn returns the connection that the events see, which is the tls
+// connection of a connection that's terminated with TLS.
+func userConn(c Conn) Conn {
+	if t, ok := c.Context().(*tlsconn); ok {
+		return t
+	}
+	return c
+}
+
+func hasProto(protos []string, proto string) bool {
+	for _, p := range protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
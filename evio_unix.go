@@ -7,6 +7,8 @@
 package evio
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"net"
 	"os"
@@ -15,16 +17,44 @@ import (
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/jursonmo/evio/internal"
 	reuseport "github.com/kavu/go_reuseport"
 )
 
+// acceptFunc and readFunc are replaced by tests to inject errors.
+var (
+	acceptFunc = (*internal.Poll).Accept
+	readFunc   = (*internal.Poll).Read
+)
+
+// scaleInterval is how often the autoscaler checks the load. The load must
+// hold for scaleSustain checks in a row before a loop is added or retired.
+var scaleInterval = time.Second
+
+const (
+	scaleSustain        = 3
+	defaultConnsPerLoop = 1024
+)
+
+// errRetired stops a loop that was retired by the autoscaler or
+// Server.DrainLoop.
+var errRetired = errors.New("retired")
+
+// errNoLoop and errLastLoop are returned by Server.DrainLoop.
+var (
+	errNoLoop   = errors.New("no such loop")
+	errLastLoop = errors.New("the last loop can't be drained")
+)
+
 type conn struct {
+	id         uint64           // connection id
 	fd         int              // file descriptor
 	lnidx      int              // listener index in the server lns list
 	out        []byte           // write buffer
 	sa         syscall.Sockaddr // remote socket address
+	udpfd      int              // socket of a UDP packet
 	reuse      bool             // should reuse input buffer
 	opened     bool             // connection opened event fired
 	action     Action           // next user action
@@ -33,17 +63,292 @@ type conn struct {
 	localAddr  net.Addr         // local addre
 	remoteAddr net.Addr         // remote addr
 	loop       *loop            // connected loop
+	srv        *server          // owning server
+	tstamp     bool             // read with receive timestamps
+	ts         time.Time        // last receive timestamp
+	ready      bool             // handshake completed
+	openTimer  *timer           // open timeout
+	openDue    time.Time        // when the open timeout expires
+	ip         string           // source ip counted by the server's iplimit
+	inbuf      *InBuffer        // tracked by an InboundLimit
+	trusted    bool             // from a peer of Events.Trusted
+	chunk      int              // max size of the Data input
+	detachin   []byte           // input left over when detached
+	src        io.Reader        // streamed into the output by WriteFrom
+	srcbuf     []byte           // read buffer of src
+	draining   bool             // close once the output is written
+	drained    bool             // output written, waiting for the peer to close
+	closeFrame []byte           // written by the drain, for CloseWithReason
+	chunks     []int            // sizes of the queued output chunks that make up out
+	partial    bool             // the first chunk was partly written
+	urgent     []byte           // output of SendUrgent, written between the chunks
+	low, high  int              // write watermarks
+	above      bool             // the output reached the high watermark
+	batchBytes int              // input that's batched before Data
+	batchDelay time.Duration    // longest wait of batched input
+	batch      []byte           // batched input
+	batchTimer *timer           // passes on the batched input
+	attachin   []byte           // input of a migrated connection
+	inflight   int              // requests in flight
+	maxflight  int              // requests in flight at which reads pause
+	paused     bool             // reads are paused
+	suspends   int              // SuspendUntil calls that wait for their channel
+	label      string           // Options.Label
+	priority   int              // Options.Priority
+	deadline   time.Time        // set by SetDeadline
+	deadlineTm *timer           // calls deadlineFn at the deadline
+	deadlineFn func(c Conn) (out []byte, action Action)
 }
 
+func (c *conn) ID() uint64                 { return c.id }
 func (c *conn) Context() interface{}       { return c.ctx }
 func (c *conn) SetContext(ctx interface{}) { c.ctx = ctx }
 func (c *conn) AddrIndex() int             { return c.addrIndex }
 func (c *conn) LocalAddr() net.Addr        { return c.localAddr }
 func (c *conn) RemoteAddr() net.Addr       { return c.remoteAddr }
-func (c *conn) Wake() {
-	if c.loop != nil {
-		c.loop.poll.Trigger(c)
+func (c *conn) Wake() error {
+	return c.trigger(c, true)
+}
+
+// wake is like Wake but isn't limited by the wake queue size.
+func (c *conn) wake() {
+	c.trigger(c, false)
+}
+
+// trigger passes a note of the connection to its loop. A loop that retired
+// closes its poll once the connection moved, so a note that fails to reach
+// it goes to the connection's new loop instead.
+func (c *conn) trigger(note interface{}, try bool) error {
+	for {
+		l := c.getLoop()
+		if l == nil {
+			return nil
+		}
+		var err error
+		if try {
+			err = l.poll.TryTrigger(note)
+		} else {
+			err = l.poll.Trigger(note)
+		}
+		if err == nil || c.getLoop() == l {
+			return err
+		}
+	}
+}
+
+// getLoop returns the loop of the connection. The loop changes when the
+// connection is migrated, so it's loaded atomically for the wakes from
+// other goroutines.
+func (c *conn) getLoop() *loop {
+	return (*loop)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&c.loop))))
+}
+
+func (c *conn) setLoop(l *loop) {
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&c.loop)), unsafe.Pointer(l))
+}
+func (c *conn) Timestamp() time.Time { return c.ts }
+func (c *conn) Drain() {
+	if c.fd != 0 {
+		c.draining = true
+	}
+}
+func (c *conn) CloseWithReason(code int, reason string) error {
+	if c.fd == 0 || c.srv.events.CloseFrame == nil {
+		return ErrUnsupported
+	}
+	c.closeFrame = c.srv.events.CloseFrame(c, code, reason)
+	c.draining = true
+	return nil
+}
+func (c *conn) WriteFrom(r io.Reader) error {
+	if c.fd == 0 {
+		return ErrUnsupported
+	}
+	if c.src != nil {
+		r = io.MultiReader(c.src, r)
+	}
+	c.src = r
+	return nil
+}
+func (c *conn) SendUrgent(b []byte) error {
+	if c.fd == 0 {
+		return ErrUnsupported
+	}
+	c.push(true, func(out []byte) []byte { return append(out, b...) })
+	return nil
+}
+func (c *conn) WriteString(s string) error {
+	if c.fd == 0 {
+		return ErrUnsupported
+	}
+	c.push(false, func(out []byte) []byte { return append(out, s...) })
+	return nil
+}
+func (c *conn) TryWrite(b []byte) error {
+	if c.fd == 0 {
+		return ErrUnsupported
+	}
+	if c.high > 0 && c.pending() >= c.high {
+		return ErrWouldBlock
+	}
+	c.push(false, func(out []byte) []byte { return append(out, b...) })
+	return nil
+}
+func (c *conn) WriteBuffers(bufs net.Buffers) error {
+	if c.fd == 0 {
+		if c.sa == nil {
+			return ErrUnsupported
+		}
+		return sendUDPBuffers(c.udpfd, bufs, c.sa)
+	}
+	// one chunk, so that urgent output doesn't split the buffers
+	c.push(false, func(out []byte) []byte {
+		var n int
+		for _, b := range bufs {
+			n += len(b)
+		}
+		if cap(out)-len(out) < n {
+			grown := make([]byte, len(out), len(out)+n)
+			copy(grown, out)
+			out = grown
+		}
+		for _, b := range bufs {
+			out = append(out, b...)
+		}
+		return out
+	})
+	return nil
+}
+func (c *conn) BeginRequest() {
+	c.inflight++
+	if c.fd != 0 && c.maxflight > 0 && c.inflight >= c.maxflight {
+		loopPause(c.getLoop(), c, true)
+	}
+}
+func (c *conn) EndRequest() {
+	if c.inflight > 0 {
+		c.inflight--
+	}
+	if c.paused && c.inflight < c.maxflight && c.suspends == 0 {
+		loopPause(c.getLoop(), c, false)
+	}
+}
+func (c *conn) SuspendUntil(done <-chan struct{}) error {
+	if c.fd == 0 {
+		return ErrUnsupported
+	}
+	c.suspends++
+	loopPause(c.getLoop(), c, true)
+	go func() {
+		<-done
+		c.trigger(resumeNote{c}, false)
+	}()
+	return nil
+}
+func (c *conn) SetDeadline(t time.Time, fn func(c Conn) (out []byte, action Action)) error {
+	if c.fd == 0 {
+		return ErrUnsupported
+	}
+	c.deadlineTm.Stop()
+	c.deadlineTm = nil
+	if t.IsZero() || fn == nil {
+		c.deadline, c.deadlineFn = time.Time{}, nil
+		return nil
+	}
+	c.deadline, c.deadlineFn = t, fn
+	loopDeadlineTimer(c.srv, c.getLoop(), c)
+	return nil
+}
+func (c *conn) SetWriteWatermarks(low, high int) error {
+	if c.fd == 0 {
+		return ErrUnsupported
+	}
+	if err := checkWatermarks(low, high); err != nil {
+		return err
+	}
+	c.low, c.high = low, high
+	if high == 0 {
+		c.above = false
+	}
+	c.watermark()
+	return nil
+}
+func (c *conn) Ready() {
+	c.ready = true
+	c.openTimer.Stop()
+	c.openTimer = nil
+}
+func (c *conn) trackInBuffer(b *InBuffer) (old *InBuffer) {
+	old, c.inbuf = c.inbuf, b
+	return old
+}
+func (c *conn) ReadableBytes() (int, error) {
+	if c.fd == 0 {
+		return 0, ErrUnsupported
+	}
+	n, err := internal.Readable(c.fd)
+	return n + len(c.getLoop().poll.Buffered(c.fd)), err
+}
+func (c *conn) Peek(n int) ([]byte, error) {
+	if c.fd == 0 {
+		return nil, ErrUnsupported
+	}
+	if n < 0 {
+		return nil, errPeekSize
+	}
+	buf := make([]byte, n)
+	// the input that the poll holds comes before the input of the socket
+	held := copy(buf, c.getLoop().poll.Buffered(c.fd))
+	if held == n {
+		return buf, nil
+	}
+	nn, _, err := syscall.Recvfrom(c.fd, buf[held:], syscall.MSG_PEEK)
+	switch {
+	case held > 0 && err != nil:
+		return buf[:held], nil
+	case err == syscall.EAGAIN:
+		return buf[:0], nil
+	case err != nil:
+		return nil, err
+	case nn == 0 && n > 0 && held == 0:
+		return nil, io.EOF
+	}
+	return buf[:held+nn], nil
+}
+func (c *conn) SetNoDelay(noDelay bool) error {
+	if c.fd == 0 || !c.tcp(c.srv) {
+		return ErrUnsupported
 	}
+	var v int
+	if noDelay {
+		v = 1
+	}
+	return syscall.SetsockoptInt(c.fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, v)
+}
+func (c *conn) SetKeepAlive(period time.Duration) error {
+	if c.fd == 0 || !c.tcp(c.srv) {
+		return ErrUnsupported
+	}
+	if period <= 0 {
+		return syscall.SetsockoptInt(c.fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 0)
+	}
+	secs := int(period / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return internal.SetKeepAlive(c.fd, secs)
+}
+func (c *conn) PeerCred() (pid, uid, gid int, err error) {
+	if c.fd == 0 || !c.unix(c.srv) {
+		return 0, 0, 0, ErrUnsupported
+	}
+	return internal.PeerCred(c.fd)
+}
+func (c *conn) OriginalDst() (net.Addr, error) {
+	if c.fd == 0 || c.unix(c.srv) {
+		return nil, ErrUnsupported
+	}
+	return internal.OriginalDst(c.fd)
 }
 
 type server struct {
@@ -54,17 +359,108 @@ type server struct {
 	cond     *sync.Cond         // shutdown signaler
 	balance  LoadBalance        // load balancing method
 	accepted uintptr            // accept counter
+	rand     *loopRand          // seeded Random balance, nil without a seed
 	tch      chan time.Duration // ticker channel
+	done     chan struct{}      // closed when the server stops
+	trace    *tracer            // traces while tracing is on
+	lameDuck int32              // set by Server.SetLameDuck
+	clock    Clock              // time of the timers
+	started  chan struct{}      // closed when the loops are running
+	iplimit  *ipLimit           // connections per source ip
+	fds      *fdGuard           // connections allowed by the fd headroom
+	loopsMu  sync.RWMutex       // guards loops while autoscaling
+	resizeMu sync.Mutex         // serializes adding and retiring loops
+	scaling  chan struct{}      // closed to stop the autoscaler
+	scalewg  sync.WaitGroup     // autoscaler close waitgroup
 
 	//ticktm   time.Time      // next tick time
 }
 
 type loop struct {
-	idx     int            // loop index in the server loops list
-	poll    *internal.Poll // epoll or kqueue
-	packet  []byte         // read packet buffer
-	fdconns map[int]*conn  // loop connections fd -> conn
-	count   int32          // connection count
+	idx     int                 // loop index when it was created
+	poll    *internal.Poll      // epoll or kqueue
+	packet  []byte              // read packet buffer
+	oob     []byte              // read control message buffer
+	fdconns map[int]*conn       // loop connections fd -> conn
+	count   int32               // connection count
+	timers                      // connection timers
+	clock   Clock               // time of the timers
+	servers map[*server]bool    // servers attached to a pool loop
+	lnsrvs  map[int]*server     // pool loop listeners fd -> server
+	paused  map[int]bool        // listeners that stopped accepting
+	stats   *internal.WaitStats // poll timing, nil when disabled
+	cycle   uint64              // poll cycle of cycleIn
+	cycleIn int                 // bytes read in the poll cycle
+	retired bool                // the connections moved to the other loops
+	ctr     loopCounters        // connection and byte counts
+	heirs   []*loop             // the loops that took over when retired
+	udpBufs map[int][]byte      // UDP listeners fd -> sized receive buffer
+	udpfds  map[int]int         // UDP sockets read by this loop only -> listener index
+	udpown  []*os.File          // UDP sockets that were opened for this loop
+	prio    bool                // the poll orders the reads by priority
+}
+
+// wheelNote is triggered to advance the loop's timing wheel.
+type wheelNote struct{}
+
+// tickNote is triggered to fire the Tick event of a server.
+type tickNote struct{ s *server }
+
+// udpSocketNote passes the socket of a per loop UDP listener to a loop, when
+// the loop that read it was retired.
+type udpSocketNote struct{ fd, lnidx int }
+
+// attachNote and detachNote add and remove a server from a pool loop.
+type attachNote struct{ s *server }
+type detachNote struct{ s *server }
+
+// migrateNote asks a loop to move up to n of its connections to another
+// loop. The done channel is closed once they're handed off.
+type migrateNote struct {
+	to   *loop
+	n    int
+	done chan struct{}
+}
+
+// retireNote asks a loop to move its connections to the other loops and to
+// stop.
+type retireNote struct {
+	to   []*loop
+	done chan struct{}
+}
+
+// adoptNote hands a migrated connection to its new loop.
+type adoptNote struct{ c *conn }
+
+// resumeNote tells the loop of a connection that a channel passed to
+// SuspendUntil was closed.
+type resumeNote struct{ c *conn }
+
+// closeWhereNote asks a loop to close the connections of a server that
+// match the predicate, and to send the number it closed.
+type closeWhereNote struct {
+	s    *server
+	pred func(c Conn) bool
+	done chan int
+}
+
+// dumpNote asks a loop to send its state for a dump.
+type dumpNote struct {
+	s    *server
+	done chan loopDump
+}
+
+// attachConnNote is triggered to add a connection with Server.Attach.
+type attachConnNote struct {
+	s     *server
+	fd    int
+	in    []byte // input of a migrated connection
+	state []byte // context of a migrated connection
+}
+
+type pool struct {
+	loops []*loop        // all the loops
+	wg    sync.WaitGroup // loop close waitgroup
 }
 
 // waitForShutdown waits for a signal to shutdown
@@ -92,17 +488,60 @@ func serve(events Events, listeners []*listener) error {
 		}
 	}
 
+	autoscale := events.Pool == nil && events.MaxLoops > events.MinLoops
+	if autoscale {
+		numLoops = events.MinLoops
+		if numLoops < 1 {
+			numLoops = 1
+		}
+	}
+	if events.Pool != nil {
+		numLoops = len(events.Pool.p.loops)
+	}
+
 	s := &server{}
 	s.events = events
 	s.lns = listeners
 	s.cond = sync.NewCond(&sync.Mutex{})
 	s.balance = events.LoadBalance
+	s.rand = newLoopRand(events.Seed)
 	s.tch = make(chan time.Duration)
+	s.done = make(chan struct{})
+	s.started = make(chan struct{})
+	s.iplimit = newIPLimit(events.MaxConnsPerIP)
+	s.fds = newFDGuard(events.FDHeadroom)
+	s.trace = &tracer{log: events.Logger}
+	s.clock = eventsClock(events)
+	defer close(s.done)
+	if events.UDPGRO {
+		for _, ln := range listeners {
+			if ln.pconn != nil {
+				ln.gro = internal.SetUDPGRO(ln.fd) == nil
+			}
+		}
+	}
+	if events.Pool == nil {
+		for _, ln := range listeners {
+			ln.perLoop = ln.pconn != nil && ln.opts.reusePort
+		}
+	}
 
 	//println("-- server starting")
 	if s.events.Serving != nil {
 		var svr Server
 		svr.NumLoops = numLoops
+		svr.lns = listeners
+		svr.attach = s.attach
+		svr.stats = s.stats
+		svr.closeWhere = s.closeWhere
+		if events.Pool == nil {
+			svr.drainLoop = s.drainLoop
+		}
+		svr.tlsConfigs = tlsConfigs(s.events)
+		svr.trace = s.trace
+		svr.lameDuck = &s.lameDuck
+		svr.dump = s.dump
+		svr.done = s.done
 		svr.Addrs = make([]net.Addr, len(listeners))
 		for i, ln := range listeners {
 			svr.Addrs[i] = ln.lnaddr
@@ -115,10 +554,31 @@ func serve(events Events, listeners []*listener) error {
 		}
 	}
 
+	if events.DumpSignal != nil && events.Logger != nil {
+		watchDumpSignal(events.DumpSignal, s.dump, s.done)
+	}
+	if events.Pool != nil {
+		// the loops of a pool keep the system clock
+		s.clock = systemClock{}
+	}
+	if events.StatsInterval > 0 && events.OnStats != nil {
+		svr := Server{stats: s.stats, lameDuck: &s.lameDuck}
+		watchStats(s.clock, events.StatsInterval, svr.Stats, events.OnStats, s.done)
+	}
+	if events.Pool != nil {
+		return serveShared(s, events.Pool.p)
+	}
+
 	defer func() {
 		// wait on a signal for shutdown
 		s.waitForShutdown()
 
+		// stop adding and retiring loops
+		if s.scaling != nil {
+			close(s.scaling)
+			s.scalewg.Wait()
+		}
+
 		// notify all loops to close by closing all listeners
 		for _, l := range s.loops {
 			l.poll.Trigger(errClosing)
@@ -127,284 +587,1767 @@ func serve(events Events, listeners []*listener) error {
 		// wait on all loops to complete reading events
 		s.wg.Wait()
 
+		// answer the connections that the loops didn't get to
+		if s.events.DrainBacklog != nil {
+			drainBacklog(s)
+		}
+
 		// close loops and all outstanding connections
-		for _, l := range s.loops {
-			for _, c := range l.fdconns {
-				loopCloseConn(s, l, c, nil)
+		if s.events.ParallelClose {
+			var wg sync.WaitGroup
+			wg.Add(len(s.loops))
+			for _, l := range s.loops {
+				go func(l *loop) {
+					loopCloseAll(s, l)
+					wg.Done()
+				}(l)
+			}
+			wg.Wait()
+		} else {
+			for _, l := range s.loops {
+				loopCloseAll(s, l)
 			}
-			l.poll.Close()
 		}
 		//println("-- server stopped")
 	}()
 
 	// create loops locally and bind the listeners.
 	for i := 0; i < numLoops; i++ {
-		l := &loop{
-			idx:     i,
-			poll:    internal.OpenPoll(),
-			packet:  make([]byte, 0xFFFF),
-			fdconns: make(map[int]*conn),
-		}
-		//mo:每个线程都把所有的listen fd都加到epoll,且是水平模式EPOLLLT, 即有新连接到来,所有线程都会唤醒,
-		//按道理,reuseport 模式下,就可以运行多个服务程序，每个程序内部的所有线程也会因为新连接到来而全部被唤醒
-		//reuseport的作用就是水平扩展。
-		for _, ln := range listeners {
-			l.poll.AddRead(ln.fd)
-		}
-		s.loops = append(s.loops, l)
+		s.loops = append(s.loops, s.openLoop(i))
 	}
 	// start loops in background
 	s.wg.Add(len(s.loops))
 	for _, l := range s.loops {
-		go loopRun(s, l)
+		l := l
+		goLabeled(events.ProfileLabels, "loop", l.idx, func() { loopRun(s, l) })
 	}
+	if autoscale {
+		s.scaling = make(chan struct{})
+		s.scalewg.Add(1)
+		go s.autoscale()
+	}
+	close(s.started)
 	return nil
 }
 
-func loopCloseConn(s *server, l *loop, c *conn, err error) error {
-	atomic.AddInt32(&l.count, -1)
-	delete(l.fdconns, c.fd)
-	syscall.Close(c.fd)
-	if s.events.Closed != nil {
-		switch s.events.Closed(c, err) {
-		case None:
-		case Shutdown:
-			return errClosing
-		}
+// loopCloseAll closes the connections of a loop that stopped, and its poll.
+func loopCloseAll(s *server, l *loop) {
+	for _, c := range l.fdconns {
+		loopCloseConn(s, l, c, nil)
 	}
-	return nil
+	for _, f := range l.udpown {
+		f.Close()
+	}
+	l.poll.Close()
 }
 
-func loopDetachConn(s *server, l *loop, c *conn, err error) error {
-	if s.events.Detached == nil {
-		return loopCloseConn(s, l, c, err)
+// loopPos returns the position of the loop in the list, or -1 when it's not
+// in it.
+func loopPos(loops []*loop, l *loop) int {
+	for i, lp := range loops {
+		if lp == l {
+			return i
+		}
 	}
-	l.poll.ModDetach(c.fd)
+	return -1
+}
 
-	atomic.AddInt32(&l.count, -1)
-	delete(l.fdconns, c.fd)
-	if err := syscall.SetNonblock(c.fd, false); err != nil {
-		return err
+// openLoop creates a loop of the server with the listeners bound to it.
+func (s *server) openLoop(idx int) *loop {
+	l := newLoop(idx, s.events.Backend)
+	l.clock = s.clock
+	l.poll.SetNoteCapacity(s.events.WakeQueueSize)
+	if s.events.BusyPoll > 0 {
+		l.poll.SetBusyPoll(s.events.BusyPoll, func() bool {
+			return atomic.LoadInt32(&l.count) > 0
+		})
 	}
-	switch s.events.Detached(c, &detachedConn{fd: c.fd}) {
-	case None:
-	case Shutdown:
-		return errClosing
+	if s.events.LoopStats {
+		l.stats = new(internal.WaitStats)
+		l.poll.SetWaitStats(l.stats)
 	}
-	return nil
+	//mo:每个线程都把所有的listen fd都加到epoll,且是水平模式EPOLLLT, 即有新连接到来,所有线程都会唤醒,
+	//按道理,reuseport 模式下,就可以运行多个服务程序，每个程序内部的所有线程也会因为新连接到来而全部被唤醒
+	//reuseport的作用就是水平扩展。
+	for i, ln := range s.lns {
+		fd := ln.fd
+		if ln.perLoop {
+			if idx > 0 {
+				f, err := ln.loopSocket(s.events)
+				if err != nil {
+					// the other loops read the listener
+					continue
+				}
+				l.udpown = append(l.udpown, f)
+				fd = int(f.Fd())
+			}
+			l.udpfds[fd] = i
+		}
+		l.poll.AddRead(fd)
+	}
+	return l
 }
 
-func loopNote(s *server, l *loop, note interface{}) error {
-	var err error
-	switch v := note.(type) {
-	case time.Duration:
-		delay, action := s.events.Tick()
-		switch action {
-		case None:
-		case Shutdown:
-			err = errClosing
-		}
-		s.tch <- delay
-	case error: // shutdown
-		err = v
-	case *conn:
-		// Wake called for connection
-		if l.fdconns[v.fd] != v {
-			return nil // ignore stale wakes
-		}
-		return loopWake(s, l, v) //(c *conn) Wake()-->c.loop.poll.Trigger(c)就是让loopWake来执行event.Data()
+// loopSocket opens another socket on the address of a UDP reuseport
+// listener, for a loop to read on its own. The kernel spreads the flows
+// over the sockets by their hash, so the datagrams of a flow stay on one
+// loop and the loops don't contend for one socket.
+func (ln *listener) loopSocket(events Events) (*os.File, error) {
+	pconn, err := reuseportListenPacket(ln.network, ln.lnaddr.String())
+	if err != nil {
+		return nil, err
 	}
-	return err
+	defer pconn.Close()
+	f, err := pconn.(*net.UDPConn).File()
+	if err != nil {
+		return nil, err
+	}
+	fd := int(f.Fd())
+	err = syscall.SetNonblock(fd, true)
+	if err == nil && ln.opts.mark != 0 {
+		err = internal.SetMark(fd, ln.opts.mark)
+	}
+	if err == nil {
+		err = applyListenOptions(events.ListenOptions, fd)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if ln.gro {
+		internal.SetUDPGRO(fd)
+	}
+	return f, nil
 }
 
-//events.Data 是数据处理回调函数，读到数据时会调用它，(c *conn) Wake()也会调用它
-func loopRun(s *server, l *loop) {
-	defer func() {
-		//fmt.Println("-- loop stopped --", l.idx)
-		s.signalShutdown()
-		s.wg.Done()
-	}()
+// loopList returns the running loops of the server. The list is replaced
+// rather than modified when loops are added or retired.
+func (s *server) loopList() []*loop {
+	s.loopsMu.RLock()
+	defer s.loopsMu.RUnlock()
+	return s.loops
+}
 
-	//如果events.Tick不为空，就由第一个线程定期执行events.Tick()
-	if l.idx == 0 && s.events.Tick != nil {
-		go loopTicker(s, l) //定期Trigger-->loopNote--> 执行events.Tick()，也就是定期执行events.Tick()，时间间隔看events.Tick()返回值。
-	}
+func (s *server) setLoops(loops []*loop) {
+	s.loopsMu.Lock()
+	s.loops = loops
+	s.loopsMu.Unlock()
+}
 
-	//fmt.Println("-- loop started --", l.idx)
-	l.poll.Wait(func(fd int, note interface{}) error {
-		if fd == 0 {
-			//l.poll.Trigger-> syscall.Write(p.wfd),只是想让EpollWait 醒来,遍历q.notes 执行iter(0, note), 就走到这里，
-			//l.poll.Trigger(errClosing) 就是把一个error 加到q.notes,
-			return loopNote(s, l, note) //loopNote 里面判断是err,就shutdown
+// autoscale adds a loop when the connections per loop stay above the
+// threshold, and retires one when they'd stay well below it with one loop
+// less.
+func (s *server) autoscale() {
+	defer s.scalewg.Done()
+	per := s.events.ConnsPerLoop
+	if per <= 0 {
+		per = defaultConnsPerLoop
+	}
+	min, max := s.events.MinLoops, s.events.MaxLoops
+	t := time.NewTicker(scaleInterval)
+	defer t.Stop()
+	var high, low int
+	for {
+		select {
+		case <-t.C:
+		case <-s.scaling:
+			return
+		}
+		loops := s.loopList()
+		n, conns := len(loops), 0
+		for _, l := range loops {
+			conns += int(atomic.LoadInt32(&l.count))
 		}
-		c := l.fdconns[fd]
 		switch {
-		case c == nil:
-			return loopAccept(s, l, fd) //新的连接到来，是会注册AddReadWrite 读写事件的,写事件肯定能立即返回啊
-		case !c.opened:
-			//c的初始值c.opened==false,即c第一次可读写时(由于新的连接注册读写事件,写事件一定返回,这里肯定执行),
-			//就会先调用loopOpened,执行用户定义的events.Opened(),它可能发送一些数据,如果没有要发送的，就只注册ModRead
-			//也就是大多情况下只在注册读事件的状态，没有注册写的状态，如果要写的操作，(c *conn) Wake()->event.Data()这个回调返回out内容,就注册写事件
-			return loopOpened(s, l, c)
-		case len(c.out) > 0:
-			return loopWrite(s, l, c)
-		case c.action != None:
-			return loopAction(s, l, c)
+		case n < max && conns > n*per:
+			high, low = high+1, 0
+		case n > min && n > 1 && conns <= (n-1)*per/2:
+			high, low = 0, low+1
 		default:
-			//如果上面条件都不满足,那就是有数据可读,尝试执行events.Data,如果执行的结果需要写数据,就注册ModReadWrite
-			//如果events.Data处理函数返回的action 不为none,也注册ModReadWrite,注册write事件的另一个作用就再次唤醒epoll_wait,
-			//然后再判断c.action != None: 执行 loopAction
-			return loopRead(s, l, c)
+			high, low = 0, 0
 		}
-	})
+		if high >= scaleSustain {
+			high = 0
+			s.resizeMu.Lock()
+			s.addLoop(s.loopList(), conns)
+			s.resizeMu.Unlock()
+		} else if low >= scaleSustain {
+			low = 0
+			s.resizeMu.Lock()
+			if loops = s.loopList(); len(loops) > 1 {
+				s.retireLoop(loops, len(loops)-1)
+			}
+			s.resizeMu.Unlock()
+		}
+	}
 }
 
-func loopTicker(s *server, l *loop) {
-	for {
-		if err := l.poll.Trigger(time.Duration(0)); err != nil {
-			break
+// addLoop starts a new loop and moves connections to it from the loops that
+// have more than their share.
+func (s *server) addLoop(loops []*loop, conns int) {
+	l := s.openLoop(len(loops))
+	s.wg.Add(1)
+	goLabeled(s.events.ProfileLabels, "loop", l.idx, func() { loopRun(s, l) })
+	share := conns / (len(loops) + 1)
+	for _, from := range loops {
+		if n := int(atomic.LoadInt32(&from.count)) - share; n > 0 {
+			s.waitNote(from, migrateNote{to: l, n: n, done: make(chan struct{})})
 		}
-		time.Sleep(<-s.tch)
 	}
+	s.setLoops(append(loops[:len(loops):len(loops)], l))
 }
 
-//epoll_event 的event默认为LT（水平触发）模式。
-func loopAccept(s *server, l *loop, fd int) error {
-	for i, ln := range s.lns {
-		if ln.fd == fd {
-			if len(s.loops) > 1 {
-				switch s.balance {
-				case LeastConnections: //由处理连接数最少的线程处理
-					n := atomic.LoadInt32(&l.count)
-					for _, lp := range s.loops {
-						if lp.idx != l.idx {
-							if atomic.LoadInt32(&lp.count) < n {
-								return nil // do not accept,
-								//有一个lp 处理的连接数比当前的少，那么当前的epoll 就不接受这个连接，由于是EPOLLLT模式，所有的epoll都醒来处理，所以count最小的那个epoll会处理
-							}
-						}
-					}
-				case RoundRobin: //轮询调度
-					idx := int(atomic.LoadUintptr(&s.accepted)) % len(s.loops)
-					if idx != l.idx {
-						return nil // do not accept，所有的epoll线程都醒来，发现没有轮询到自己，就不接受这个新连接。
-					}
-					atomic.AddUintptr(&s.accepted, 1)
-				}
-			}
-			if ln.pconn != nil {
-				return loopUDPRead(s, l, i, fd)
-			}
-			nfd, sa, err := syscall.Accept(fd)
-			if err != nil {
-				if err == syscall.EAGAIN {
-					return nil
-				}
-				return err
-			}
-			if err := syscall.SetNonblock(nfd, true); err != nil {
-				return err
-			}
-			c := &conn{fd: nfd, sa: sa, lnidx: i, loop: l}
-			l.fdconns[c.fd] = c
-			l.poll.AddReadWrite(c.fd)
-			atomic.AddInt32(&l.count, 1)
-			break
-		}
+// retireLoop stops a loop after moving its connections to the other loops.
+func (s *server) retireLoop(loops []*loop, idx int) {
+	l := loops[idx]
+	rest := append(loops[:idx:idx], loops[idx+1:]...)
+	s.setLoops(rest)
+	s.waitNote(l, retireNote{to: rest, done: make(chan struct{})})
+}
+
+// drainLoop retires the loop at idx in the list.
+func (s *server) drainLoop(idx int) error {
+	<-s.started
+	s.resizeMu.Lock()
+	defer s.resizeMu.Unlock()
+	loops := s.loopList()
+	if idx < 0 || idx >= len(loops) {
+		return errNoLoop
 	}
+	if len(loops) == 1 {
+		return errLastLoop
+	}
+	s.retireLoop(loops, idx)
 	return nil
 }
 
-func loopUDPRead(s *server, l *loop, lnidx, fd int) error {
-	n, sa, err := syscall.Recvfrom(fd, l.packet, 0)
-	if err != nil || n == 0 {
-		return nil
+// waitNote triggers a migrate or retire note and waits for the loop to
+// handle it, unless the server is shutting down.
+func (s *server) waitNote(l *loop, note interface{}) {
+	var done chan struct{}
+	switch v := note.(type) {
+	case migrateNote:
+		done = v.done
+	case retireNote:
+		done = v.done
 	}
-	if s.events.Data != nil {
-		var sa6 syscall.SockaddrInet6
-		switch sa := sa.(type) {
-		case *syscall.SockaddrInet4:
-			sa6.ZoneId = 0
-			sa6.Port = sa.Port
-			for i := 0; i < 12; i++ {
-				sa6.Addr[i] = 0
-			}
-			sa6.Addr[12] = sa.Addr[0]
-			sa6.Addr[13] = sa.Addr[1]
+	if l.poll.Trigger(note) != nil {
+		return
+	}
+	select {
+	case <-done:
+	case <-s.scaling:
+	case <-s.done:
+	}
+}
+
+// loopHandoff removes a connection from the loop and hands it to another.
+func loopHandoff(l *loop, c *conn, to *loop) {
+	// the input that the poll held moves along with the connection
+	c.attachin = append(c.attachin, l.poll.ModDetach(c.fd)...)
+	delete(l.fdconns, c.fd)
+	atomic.AddInt32(&l.count, -1)
+	c.openTimer.Stop()
+	c.openTimer = nil
+	c.batchTimer.Stop()
+	c.batchTimer = nil
+	c.deadlineTm.Stop()
+	c.deadlineTm = nil
+	to.poll.Trigger(adoptNote{c})
+	// the wakes that reach this loop until now are passed on after the
+	// adopt note, and the later ones go to the new loop directly.
+	c.setLoop(to)
+}
+
+// loopAdopt registers a connection that was migrated from another loop.
+func loopAdopt(s *server, l *loop, c *conn) {
+	c.setLoop(l)
+	l.fdconns[c.fd] = c
+	atomic.AddInt32(&l.count, 1)
+	if !c.opened || c.busy() {
+		l.poll.AddReadWrite(c.fd)
+	} else {
+		l.poll.AddRead(c.fd)
+	}
+	if c.opened && len(c.attachin) > 0 {
+		// an opened connection reads it before the input of its socket
+		l.poll.Unread(c.fd, c.attachin)
+		c.attachin = nil
+	}
+	if c.paused {
+		loopModReadWrite(l, c)
+	}
+	if !c.ready && !c.openDue.IsZero() {
+		loopOpenTimer(l, c, c.openDue.Sub(s.clock.Now()))
+	}
+	if len(c.batch) > 0 {
+		loopBatchTimer(s, l, c)
+	}
+	if c.deadlineFn != nil {
+		loopDeadlineTimer(s, l, c)
+	}
+	if c.priority != 0 {
+		loopPrioritize(l)
+	}
+}
+
+// loopPrioritize makes the poll of the loop order the reads by the priority
+// of the connections, once a connection has one.
+func loopPrioritize(l *loop) {
+	if l.prio {
+		return
+	}
+	l.prio = true
+	l.poll.SetPriority(func(fd int) int {
+		if c := l.fdconns[fd]; c != nil {
+			return c.priority
+		}
+		return 0
+	})
+}
+
+// loopMigrate moves up to n connections to another loop.
+func loopMigrate(s *server, l *loop, to *loop, n int) {
+	for _, c := range l.fdconns {
+		if n == 0 {
+			break
+		}
+		loopHandoff(l, c, to)
+		n--
+	}
+}
+
+// loopRetire removes the listeners from the loop and moves its connections
+// to the other loops.
+func loopRetire(s *server, l *loop, to []*loop) {
+	for fd, lnidx := range l.udpfds {
+		l.poll.ModDetach(fd)
+		if fd == s.lns[lnidx].fd {
+			to[0].poll.Trigger(udpSocketNote{fd, lnidx})
+		}
+	}
+	// the flows of the loop's own sockets move to the other sockets
+	for _, f := range l.udpown {
+		f.Close()
+	}
+	l.udpfds, l.udpown = nil, nil
+	for _, ln := range s.lns {
+		if ln.perLoop {
+			continue
+		}
+		if l.paused[ln.fd] {
+			delete(l.paused, ln.fd)
+		} else {
+			l.poll.ModDetach(ln.fd)
+		}
+	}
+	var i int
+	for _, c := range l.fdconns {
+		loopHandoff(l, c, to[i%len(to)])
+		i++
+	}
+	l.retired = true
+	l.heirs = to
+}
+
+// loopForwardNote passes on a note that reached a loop after it retired, so
+// that the wakes and resumes of the connections that moved, and the
+// connections that were attached to it, aren't lost. The requests that wait
+// for an answer from each loop are answered for the empty loop.
+func loopForwardNote(l *loop, note interface{}) {
+	switch v := note.(type) {
+	case *conn:
+		if to := v.getLoop(); to != l && to != nil {
+			to.poll.Trigger(v)
+		}
+	case resumeNote:
+		if to := v.c.getLoop(); to != l && to != nil {
+			to.poll.Trigger(v)
+		}
+	case attachConnNote:
+		if l.heirs[0].poll.Trigger(v) != nil {
+			syscall.Close(v.fd)
+		}
+	case tickNote:
+		l.heirs[0].poll.Trigger(v)
+	case closeWhereNote:
+		v.done <- 0
+	case dumpNote:
+		loopDumpState(v.s, l, v.done)
+	}
+}
+
+func newLoop(idx int, backend Backend) *loop {
+	return &loop{
+		idx:     idx,
+		poll:    openPoll(backend),
+		packet:  make([]byte, 0xFFFF),
+		oob:     make([]byte, 256),
+		fdconns: make(map[int]*conn),
+		udpfds:  make(map[int]int),
+		clock:   systemClock{},
+	}
+}
+
+// serveShared runs the server on the loops of a pool until it shuts down.
+func serveShared(s *server, p *pool) error {
+	s.loops = p.loops
+	s.wg.Add(len(p.loops))
+	for _, l := range p.loops {
+		l.poll.Trigger(attachNote{s})
+	}
+	close(s.started)
+	if s.events.Tick != nil {
+		go loopTicker(s)
+	}
+	s.waitForShutdown()
+	for _, l := range p.loops {
+		l.poll.Trigger(detachNote{s})
+	}
+	s.wg.Wait()
+	return nil
+}
+
+func newPool(numLoops int) *pool {
+	p := &pool{}
+	for i := 0; i < numLoops; i++ {
+		p.loops = append(p.loops, newLoop(i, DefaultBackend))
+	}
+	p.wg.Add(len(p.loops))
+	for _, l := range p.loops {
+		l.servers = make(map[*server]bool)
+		l.lnsrvs = make(map[int]*server)
+		go poolRun(p, l)
+	}
+	return p
+}
+
+func (p *pool) close() {
+	for _, l := range p.loops {
+		l.poll.Trigger(errClosing)
+	}
+	p.wg.Wait()
+	for _, l := range p.loops {
+		l.poll.Close()
+	}
+}
+
+// poolRun runs a loop that's shared by the servers of a pool. Events are
+// routed to the server that owns the listener or connection, and an error
+// returned while handling them only shuts down that server.
+func poolRun(p *pool, l *loop) {
+	defer func() {
+		for s := range l.servers {
+			loopDetachServer(l, s)
+			s.signalShutdown()
+		}
+		p.wg.Done()
+	}()
+	l.poll.Wait(func(fd int, note interface{}) error {
+		var s *server
+		if fd == 0 {
+			switch v := note.(type) {
+			case error: // pool closing
+				return v
+			case attachNote:
+				l.servers[v.s] = true
+				for _, ln := range v.s.lns {
+					l.lnsrvs[ln.fd] = v.s
+					l.poll.AddRead(ln.fd)
+				}
+				return nil
+			case detachNote:
+				if l.servers[v.s] {
+					loopDetachServer(l, v.s)
+				}
+				return nil
+			case tickNote:
+				s = v.s
+			case attachConnNote:
+				s = v.s
+			case closeWhereNote:
+				s = v.s
+			case dumpNote:
+				s = v.s
+			case *conn:
+				s = v.srv
+			}
+			if s != nil && !l.servers[s] {
+				switch v := note.(type) {
+				case closeWhereNote:
+					v.done <- 0
+				case dumpNote:
+					v.done <- loopDump{idx: l.idx}
+				}
+				return nil // server is gone
+			}
+			if err := loopNote(s, l, note); err != nil {
+				s.signalShutdown()
+			}
+			return nil
+		}
+		if c := l.fdconns[fd]; c != nil {
+			s = c.srv
+		} else if s = l.lnsrvs[fd]; s == nil {
+			return nil
+		}
+		if err := loopEvent(s, l, fd); err != nil {
+			s.signalShutdown()
+		}
+		return nil
+	})
+}
+
+// loopDetachServer removes the server's listeners and connections from a
+// pool loop.
+func loopDetachServer(l *loop, s *server) {
+	for _, ln := range s.lns {
+		if l.paused[ln.fd] {
+			delete(l.paused, ln.fd)
+		} else {
+			l.poll.ModDetach(ln.fd)
+		}
+		delete(l.lnsrvs, ln.fd)
+	}
+	for _, c := range l.fdconns {
+		if c.srv == s {
+			loopCloseConn(s, l, c, nil)
+		}
+	}
+	delete(l.servers, s)
+	s.wg.Done()
+}
+
+// stats returns a snapshot of the server's loops.
+func (s *server) stats() Stats {
+	var st Stats
+	select {
+	case <-s.started:
+	default:
+		return st
+	}
+	for _, l := range s.loopList() {
+		ls := LoopStats{Conns: int(atomic.LoadInt32(&l.count))}
+		l.ctr.fill(&ls)
+		if l.stats != nil {
+			ls.Iterations = l.stats.Iterations()
+			ls.PollCalls = l.stats.Calls()
+			ls.WaitAvg, ls.WaitMax = l.stats.Wait()
+			ls.DispatchAvg, ls.DispatchMax = l.stats.Dispatch()
+		}
+		st.Conns += ls.Conns
+		st.Loops = append(st.Loops, ls)
+	}
+	listenStats(&st, s.lns)
+	return st
+}
+
+// closeWhere closes the matching connections on all of the loops.
+func (s *server) closeWhere(pred func(c Conn) bool) int {
+	<-s.started
+	loops := s.loopList()
+	done := make(chan int, len(loops))
+	var n, pending int
+	for _, l := range loops {
+		if l.poll.Trigger(closeWhereNote{s, pred, done}) == nil {
+			pending++
+		}
+	}
+	for ; pending > 0; pending-- {
+		select {
+		case closed := <-done:
+			n += closed
+		case <-s.done:
+			return n
+		}
+	}
+	return n
+}
+
+// loopCloseWhere closes the connections of the loop that match the
+// predicate.
+func loopCloseWhere(s *server, l *loop, pred func(c Conn) bool, done chan int) error {
+	var n int
+	var err error
+	for _, c := range l.fdconns {
+		if c.srv != s || !c.opened || !pred(userConn(c)) {
+			continue
+		}
+		n++
+		if err = loopCloseConn(s, l, c, nil); err != nil {
+			break
+		}
+	}
+	done <- n
+	return err
+}
+
+// dump writes the state of the loops to the logger. It waits for the
+// loops, so it must not be called from an event.
+func (s *server) dump() {
+	select {
+	case <-s.started:
+	default:
+		return
+	}
+	loops := s.loopList()
+	done := make(chan loopDump, len(loops))
+	var pending int
+	for _, l := range loops {
+		if l.poll.Trigger(dumpNote{s, done}) == nil {
+			pending++
+		}
+	}
+	var dumps []loopDump
+	for ; pending > 0; pending-- {
+		select {
+		case d := <-done:
+			dumps = append(dumps, d)
+		case <-s.done:
+			return
+		}
+	}
+	writeDump(s.events.Logger, dumps)
+}
+
+// loopDumpState sends the state of the loop for a dump.
+func loopDumpState(s *server, l *loop, done chan loopDump) {
+	d := loopDump{idx: l.idx, notes: l.poll.Pending()}
+	for _, c := range l.fdconns {
+		if c.srv != s {
+			continue
+		}
+		d.conns++
+		if c.pending() > 0 {
+			d.busy = append(d.busy, connDump{c.id, c.remoteAddr, c.pending()})
+		}
+	}
+	done <- d
+}
+
+// attach hands the socket of a connection to one of the loops.
+func (s *server) attach(rwc io.ReadWriteCloser) error {
+	var fd int
+	var err error
+	if f, ok := rwc.(interface{ Fd() uintptr }); ok {
+		fd, err = syscall.Dup(int(f.Fd()))
+	} else {
+		err = sysControl(rwc, func(sfd int) error {
+			var err error
+			fd, err = syscall.Dup(sfd)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+	note := attachConnNote{s: s, fd: fd}
+	if hc, ok := rwc.(*handoffConn); ok {
+		note.in, note.state = hc.in, hc.state
+	}
+	rwc.Close()
+	<-s.started
+	loops := s.loopList()
+	l := loops[int(atomic.AddUintptr(&s.accepted, 1))%len(loops)]
+	if err := l.poll.Trigger(note); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	return nil
+}
+
+// loopAttach registers an attached connection with the loop.
+func loopAttach(s *server, l *loop, note attachConnNote) error {
+	fd := note.fd
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil
+	}
+	sa, _ := syscall.Getpeername(fd)
+	s.fds.acquire()
+	c := &conn{id: nextConnID(s.events.ConnIDGen), fd: fd, sa: sa, lnidx: -1, loop: l, srv: s,
+		attachin: note.in}
+	if len(note.state) > 0 {
+		c.ctx = note.state
+	}
+	if lsa, err := syscall.Getsockname(fd); err == nil {
+		c.localAddr = internal.SockaddrToAddr(lsa)
+	}
+	l.fdconns[c.fd] = c
+	l.poll.AddReadWrite(c.fd)
+	// the count stays atomic without balancing, as Stats and the
+	// autoscaler read it from other goroutines
+	atomic.AddInt32(&l.count, 1)
+	atomic.AddInt64(&l.ctr.accepts, 1)
+	return nil
+}
+
+// openPoll opens the poll for a loop using the requested backend.
+func openPoll(backend Backend) *internal.Poll {
+	if backend == IOUring {
+		if p, err := internal.OpenURingPoll(); err == nil {
+			return p
+		}
+	}
+	return internal.OpenPoll()
+}
+
+func loopCloseConn(s *server, l *loop, c *conn, err error) error {
+	c.openTimer.Stop()
+	c.batchTimer.Stop()
+	c.deadlineTm.Stop()
+	s.iplimit.release(c.ip)
+	s.events.InboundLimit.release(c.inbuf)
+	s.fds.release()
+	atomic.AddInt32(&l.count, -1)
+	atomic.AddInt64(&l.ctr.closes, 1)
+	delete(l.fdconns, c.fd)
+	l.poll.Forget(c.fd)
+	syscall.Close(c.fd)
+	if s.trace.enabled() {
+		s.trace.printf("closed conn %d on loop %d: %v", c.id, l.idx, err)
+	}
+	if s.events.Closed != nil {
+		switch s.events.Closed(c, err) {
+		case None:
+		case Shutdown:
+			return errClosing
+		}
+	}
+	return nil
+}
+
+func loopDetachConn(s *server, l *loop, c *conn, err error) error {
+	if s.events.Detached == nil {
+		return loopCloseConn(s, l, c, err)
+	}
+	if err := syscall.SetNonblock(c.fd, false); err != nil {
+		return loopCloseConn(s, l, c, err)
+	}
+	held := l.poll.ModDetach(c.fd)
+	c.openTimer.Stop()
+	c.batchTimer.Stop()
+	c.deadlineTm.Stop()
+	s.iplimit.release(c.ip)
+	s.events.InboundLimit.release(c.inbuf)
+	s.fds.release()
+
+	atomic.AddInt32(&l.count, -1)
+	delete(l.fdconns, c.fd)
+	// the batched input came before the input that wasn't passed to Data,
+	// and the input that the poll held for the socket comes last
+	in := append(append(c.batch, c.detachin...), held...)
+	dc := &detachedConn{fd: c.fd, laddr: c.localAddr, raddr: c.remoteAddr, ctx: c.ctx, in: in}
+	if s.trace.enabled() {
+		s.trace.printf("detached conn %d on loop %d", c.id, l.idx)
+	}
+	switch s.events.Detached(c, dc) {
+	case None:
+	case Shutdown:
+		return errClosing
+	}
+	return nil
+}
+
+func loopNote(s *server, l *loop, note interface{}) error {
+	var err error
+	switch v := note.(type) {
+	case tickNote:
+		delay, action := s.events.Tick()
+		switch action {
+		case None:
+		case Shutdown:
+			err = errClosing
+		}
+		s.tch <- delay
+	case attachConnNote:
+		if l.retired {
+			loopForwardNote(l, v)
+			return nil
+		}
+		return loopAttach(s, l, v)
+	case closeWhereNote:
+		return loopCloseWhere(s, l, v.pred, v.done)
+	case dumpNote:
+		loopDumpState(s, l, v.done)
+	case wheelNote:
+		loopAdvanceWheel(l)
+	case migrateNote:
+		loopMigrate(s, l, v.to, v.n)
+		close(v.done)
+	case retireNote:
+		loopRetire(s, l, v.to)
+		close(v.done)
+		// pass on the notes that are already queued, such as the wakes of
+		// the connections that moved, before stopping.
+		l.poll.Trigger(errRetired)
+	case adoptNote:
+		loopAdopt(s, l, v.c)
+	case resumeNote:
+		if l.fdconns[v.c.fd] != v.c {
+			// pass on the notes of migrated connections
+			if to := v.c.getLoop(); to != l && to != nil {
+				to.poll.Trigger(v)
+			}
+			return nil
+		}
+		loopResume(l, v.c)
+	case udpSocketNote:
+		l.udpfds[v.fd] = v.lnidx
+		l.poll.AddRead(v.fd)
+	case error: // shutdown
+		err = v
+	case *conn:
+		// Wake called for connection
+		if l.fdconns[v.fd] != v {
+			// pass on the wakes of migrated connections
+			if to := v.getLoop(); to != l && to != nil {
+				to.poll.Trigger(v)
+			}
+			return nil // ignore stale wakes
+		}
+		return loopWake(s, l, v) //(c *conn) Wake()-->c.loop.poll.Trigger(c)就是让loopWake来执行event.Data()
+	}
+	return err
+}
+
+//events.Data 是数据处理回调函数，读到数据时会调用它，(c *conn) Wake()也会调用它
+func loopRun(s *server, l *loop) {
+	var err error
+	defer func() {
+		//fmt.Println("-- loop stopped --", l.idx)
+		if err == errRetired {
+			l.poll.Close()
+			l.poll.DrainNotes(func(note interface{}) {
+				loopForwardNote(l, note)
+			})
+		} else {
+			s.signalShutdown()
+		}
+		s.wg.Done()
+	}()
+
+	//如果events.Tick不为空，就由第一个线程定期执行events.Tick()
+	if l.idx == 0 && s.events.Tick != nil {
+		go loopTicker(s) //定期Trigger-->loopNote--> 执行events.Tick()，也就是定期执行events.Tick()，时间间隔看events.Tick()返回值。
+	}
+
+	//fmt.Println("-- loop started --", l.idx)
+	err = l.poll.Wait(func(fd int, note interface{}) error {
+		if fd == 0 {
+			//l.poll.Trigger-> syscall.Write(p.wfd),只是想让EpollWait 醒来,遍历q.notes 执行iter(0, note), 就走到这里，
+			//l.poll.Trigger(errClosing) 就是把一个error 加到q.notes,
+			return loopNote(s, l, note) //loopNote 里面判断是err,就shutdown
+		}
+		if l.retired {
+			return nil // reported before the loop retired
+		}
+		return loopEvent(s, l, fd)
+	})
+}
+
+// loopEvent handles a socket event of a listener or connection.
+func loopEvent(s *server, l *loop, fd int) error {
+	c := l.fdconns[fd]
+	if c != nil && c.opened && c.action == None && !c.writing() &&
+		l.poll.Failed() && !loopReadable(l, c) {
+		// close with the error of the socket, such as a reset, instead of
+		// waiting for a read to fail. The input that arrived before the
+		// reset is read first, and pending output or actions find the
+		// error on their own.
+		if err := sockError(c.fd); err != nil {
+			if err == syscall.EPIPE {
+				// reset after the peer closed, reported like a read of EOF
+				err = nil
+			}
+			if s.trace.enabled() {
+				s.trace.printf("conn %d failed: %v", c.id, err)
+			}
+			return loopCloseConn(s, l, c, err)
+		}
+	}
+	switch {
+	case c == nil:
+		return loopAccept(s, l, fd) //新的连接到来，是会注册AddReadWrite 读写事件的,写事件肯定能立即返回啊
+	case !c.opened:
+		//c的初始值c.opened==false,即c第一次可读写时(由于新的连接注册读写事件,写事件一定返回,这里肯定执行),
+		//就会先调用loopOpened,执行用户定义的events.Opened(),它可能发送一些数据,如果没有要发送的，就只注册ModRead
+		//也就是大多情况下只在注册读事件的状态，没有注册写的状态，如果要写的操作，(c *conn) Wake()->event.Data()这个回调返回out内容,就注册写事件
+		return loopOpened(s, l, c)
+	case c.writing():
+		return loopWrite(s, l, c)
+	case c.action != None:
+		return loopAction(s, l, c)
+	case c.draining:
+		return loopDrain(s, l, c)
+	default:
+		//如果上面条件都不满足,那就是有数据可读,尝试执行events.Data,如果执行的结果需要写数据,就注册ModReadWrite
+		//如果events.Data处理函数返回的action 不为none,也注册ModReadWrite,注册write事件的另一个作用就再次唤醒epoll_wait,
+		//然后再判断c.action != None: 执行 loopAction
+		return loopRead(s, l, c)
+	}
+}
+
+// loopTicker fires the Tick event on the first loop, which changes when it's
+// retired.
+func loopTicker(s *server) {
+	for {
+		if err := s.loopList()[0].poll.Trigger(tickNote{s}); err != nil {
+			break
+		}
+		select {
+		case delay := <-s.tch:
+			clockSleep(s.clock, delay)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// acceptBatch is the most connections that the loop of a single loop
+// server accepts when a listener wakes it.
+const acceptBatch = 16
+
+//epoll_event 的event默认为LT（水平触发）模式。
+func loopAccept(s *server, l *loop, fd int) error {
+	if lnidx, ok := l.udpfds[fd]; ok {
+		// the socket is this loop's alone
+		return loopUDPRead(s, l, lnidx, fd)
+	}
+	for i, ln := range s.lns {
+		if ln.fd == fd {
+			loops := s.loopList()
+			if len(loops) == 1 {
+				// there's nothing to balance, so the queue is taken in one go
+				if ln.pconn != nil {
+					return loopUDPRead(s, l, i, fd)
+				}
+				for n := 0; n < acceptBatch; n++ {
+					if ok, err := loopAcceptConn(s, l, i, ln, fd); !ok || err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			var turn int // number of loops when it was this loop's turn, -1 for RoundRobin
+			switch s.balance {
+			case LeastConnections: //由处理连接数最少的线程处理
+				n := atomic.LoadInt32(&l.count)
+				for _, lp := range loops {
+					if lp != l {
+						if atomic.LoadInt32(&lp.count) < n {
+							return nil // do not accept,
+							//有一个lp 处理的连接数比当前的少，那么当前的epoll 就不接受这个连接，由于是EPOLLLT模式，所有的epoll都醒来处理，所以count最小的那个epoll会处理
+						}
+					}
+				}
+			case RoundRobin: //轮询调度
+				idx := int(atomic.LoadUintptr(&s.accepted)) % len(loops)
+				if loops[idx] != l {
+					return nil // do not accept，所有的epoll线程都醒来，发现没有轮询到自己，就不接受这个新连接。
+				}
+				turn = -1
+			case Random:
+				if s.rand != nil {
+					if !s.rand.turn(loopPos(loops, l), len(loops)) {
+						return nil // do not accept, another loop was picked.
+					}
+					turn = len(loops)
+				}
+			}
+			if ln.pconn != nil {
+				if turn < 0 {
+					atomic.AddUintptr(&s.accepted, 1)
+				}
+				return loopUDPRead(s, l, i, fd)
+			}
+			ok, err := loopAcceptConn(s, l, i, ln, fd)
+			if ok {
+				// only the loop whose turn it is accepts, so the next one is
+				// picked once the connection is taken. A loop that woke
+				// after the connection was taken by another doesn't lose
+				// its turn.
+				switch {
+				case turn < 0:
+					atomic.AddUintptr(&s.accepted, 1)
+				case turn > 0:
+					s.rand.advance(turn)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// loopAcceptConn accepts a connection from the listener at lnidx and adds
+// it to the loop. It reports whether a connection was taken from the
+// accept queue, which is false when the queue is empty.
+func loopAcceptConn(s *server, l *loop, lnidx int, ln *listener, fd int) (bool, error) {
+	if s.fds.full() {
+		return false, loopAcceptError(s, l, fd, ErrFDHeadroom)
+	}
+	var nfd int
+	var sa syscall.Sockaddr
+	var raddr net.Addr
+	var err error
+	if ln.network == "vsock" {
+		nfd, raddr, err = acceptVsock(fd)
+	} else {
+		nfd, sa, err = acceptFunc(l.poll, fd)
+	}
+	if err != nil {
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			return false, nil
+		}
+		return false, loopAcceptError(s, l, fd, err)
+	}
+	if err := syscall.SetNonblock(nfd, true); err != nil {
+		// only this connection is affected
+		syscall.Close(nfd)
+		return true, nil
+	}
+	if err := applyListenOptions(s.events.ListenOptions, nfd); err != nil {
+		syscall.Close(nfd)
+		if s.events.OnAcceptError != nil && s.events.OnAcceptError(err) == Shutdown {
+			return true, errClosing
+		}
+		return true, nil
+	}
+	if accept := s.events.Listeners[lnidx].OnAccept; accept != nil {
+		if raddr == nil {
+			raddr = internal.SockaddrToAddr(sa)
+		}
+		if !accept(raddr) {
+			syscall.Close(nfd)
+			return true, nil
+		}
+	}
+	ip := sockaddrIP(sa)
+	trusted := trustedIP(s.events.Trusted, ip)
+	if trusted {
+		// trusted peers aren't counted
+		ip = ""
+	}
+	if !s.iplimit.acquire(ip) {
+		syscall.Close(nfd)
+		return true, nil
+	}
+	s.fds.acquire()
+	c := &conn{id: nextConnID(s.events.ConnIDGen), fd: nfd, sa: sa, lnidx: lnidx, loop: l, srv: s, ip: ip,
+		trusted: trusted}
+	c.remoteAddr = raddr
+	if s.events.OnAcceptDecision != nil {
+		loopAcceptDecision(s, l, c)
+	}
+	l.fdconns[c.fd] = c
+	l.poll.AddReadWrite(c.fd)
+	// the count stays atomic without balancing, as Stats and the
+	// autoscaler read it from other goroutines
+	atomic.AddInt32(&l.count, 1)
+	atomic.AddInt64(&l.ctr.accepts, 1)
+	if s.trace.enabled() {
+		s.trace.printf("accepted conn %d fd %d on listener %d loop %d", c.id, nfd, lnidx, l.idx)
+	}
+	return true, nil
+}
+
+// loopAcceptDecision passes the balance decision of a connection that the
+// loop accepted to the OnAcceptDecision event.
+func loopAcceptDecision(s *server, l *loop, c *conn) {
+	loops := s.loopList()
+	raddr := c.remoteAddr
+	if raddr == nil {
+		raddr = internal.SockaddrToAddr(c.sa)
+	}
+	d := AcceptDecision{ID: c.id, AddrIndex: c.lnidx, RemoteAddr: raddr,
+		Balance: s.balance, Loop: loopPos(loops, l), Conns: make([]int, len(loops))}
+	for i, lp := range loops {
+		d.Conns[i] = int(atomic.LoadInt32(&lp.count))
+	}
+	s.events.OnAcceptDecision(d)
+}
+
+// drainBacklog passes the connections that wait in the accept queues of the
+// listeners to the DrainBacklog event once the loops have stopped.
+func drainBacklog(s *server) {
+	for i, ln := range s.lns {
+		if ln.fd == 0 || ln.pconn != nil || ln.network == "vsock" {
+			continue
+		}
+		acceptBacklog(ln.fd, func(nfd int, sa syscall.Sockaddr) {
+			c := &conn{id: nextConnID(s.events.ConnIDGen), fd: nfd, sa: sa, lnidx: i, srv: s}
+			c.addrIndex = i
+			c.localAddr = ln.lnaddr
+			c.remoteAddr = internal.SockaddrToAddr(sa)
+			closeBacklogConn(nfd, s.events.DrainBacklog(c))
+		})
+	}
+}
+
+// acceptBacklog accepts the connections that wait in the queue of the
+// listener until it's empty.
+func acceptBacklog(fd int, fn func(nfd int, sa syscall.Sockaddr)) {
+	for {
+		nfd, sa, err := syscall.Accept(fd)
+		if err == syscall.EINTR || err == syscall.ECONNABORTED {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		fn(nfd, sa)
+	}
+}
+
+// closeBacklogConn writes out to a connection of the backlog and closes it
+// without a reset. The write side is shut down first, and the input that
+// the peer sent is discarded, since closing a socket with unread input
+// resets the connection.
+func closeBacklogConn(fd int, out []byte) {
+	syscall.SetNonblock(fd, false)
+	for len(out) > 0 {
+		n, err := syscall.Write(fd, out)
+		if err != nil && err != syscall.EINTR {
+			break
+		}
+		if n > 0 {
+			out = out[n:]
+		}
+	}
+	syscall.Shutdown(fd, syscall.SHUT_WR)
+	syscall.SetNonblock(fd, true)
+	var buf [512]byte
+	for {
+		if n, _ := syscall.Read(fd, buf[:]); n <= 0 {
+			break
+		}
+	}
+	syscall.Close(fd)
+}
+
+// stdDrainBacklog passes the connections that wait in the accept queues of
+// the listeners of a stdlib server to the DrainBacklog event.
+func stdDrainBacklog(s *stdserver) {
+	for i, ln := range s.lns {
+		if ln.ln == nil {
+			continue
+		}
+		sysControl(ln.ln, func(fd int) error {
+			acceptBacklog(fd, func(nfd int, sa syscall.Sockaddr) {
+				f := os.NewFile(uintptr(nfd), "")
+				conn, err := net.FileConn(f)
+				f.Close()
+				if err == nil {
+					stdBacklogConn(s, &stdconn{id: nextConnID(s.events.ConnIDGen), conn: conn, srv: s, lnidx: i})
+				}
+			})
+			return nil
+		})
+	}
+}
+
+// loopAcceptError reports a transient accept error and keeps the loop
+// running. When out of file descriptors the listener is removed from the
+// loop for a while, because it stays readable until a connection is
+// accepted.
+func loopAcceptError(s *server, l *loop, fd int, err error) error {
+	transient, pause := transientAcceptError(err)
+	if !transient {
+		return err
+	}
+	if s.events.OnAcceptError != nil {
+		switch s.events.OnAcceptError(err) {
+		case None:
+		case Shutdown:
+			return errClosing
+		}
+	}
+	if pause {
+		if l.paused == nil {
+			l.paused = make(map[int]bool)
+		}
+		l.paused[fd] = true
+		l.poll.ModDetach(fd)
+		loopAfter(l, acceptPause, func() {
+			if l.paused[fd] {
+				delete(l.paused, fd)
+				l.poll.AddRead(fd)
+			}
+		})
+	}
+	return nil
+}
+
+// loopUDPBuf returns the buffer that the datagrams of the listener are
+// received into. The loop's packet buffer is used unless the listener has
+// a udpbuf size of its own.
+func loopUDPBuf(l *loop, ln *listener, fd int) []byte {
+	if ln.opts.udpBuf <= 0 {
+		return l.packet
+	}
+	// the fd may have been reused by a listener of another pool server
+	buf := l.udpBufs[fd]
+	if len(buf) != ln.udpBufSize() {
+		if l.udpBufs == nil {
+			l.udpBufs = make(map[int][]byte)
+		}
+		buf = make([]byte, ln.udpBufSize())
+		l.udpBufs[fd] = buf
+	}
+	return buf
+}
+
+func loopUDPRead(s *server, l *loop, lnidx, fd int) error {
+	var n, seg int
+	var sa syscall.Sockaddr
+	var err error
+	buf := loopUDPBuf(l, s.lns[lnidx], fd)
+	if s.lns[lnidx].gro {
+		n, seg, sa, err = internal.ReadGRO(fd, buf, l.oob)
+	} else {
+		n, sa, err = syscall.Recvfrom(fd, buf, 0)
+	}
+	if err != nil || n == 0 {
+		return nil
+	}
+	if s.events.Data != nil {
+		var sa6 syscall.SockaddrInet6
+		switch sa := sa.(type) {
+		case *syscall.SockaddrInet4:
+			sa6.ZoneId = 0
+			sa6.Port = sa.Port
+			for i := 0; i < 12; i++ {
+				sa6.Addr[i] = 0
+			}
+			sa6.Addr[12] = sa.Addr[0]
+			sa6.Addr[13] = sa.Addr[1]
 			sa6.Addr[14] = sa.Addr[2]
 			sa6.Addr[15] = sa.Addr[3]
 		case *syscall.SockaddrInet6:
 			sa6 = *sa
 		}
-		c := &conn{}
-		c.addrIndex = lnidx
-		c.localAddr = s.lns[lnidx].lnaddr
-		c.remoteAddr = internal.SockaddrToAddr(&sa6)
-		in := append([]byte{}, l.packet[:n]...)
-		out, action := s.events.Data(c, in)
-		if len(out) > 0 {
-			if s.events.PreWrite != nil {
-				s.events.PreWrite()
+		if seg <= 0 {
+			seg = n
+		}
+		// coalesced datagrams are passed one at a time
+		for packet := buf[:n]; len(packet) > 0; {
+			dgram := packet
+			if len(dgram) > seg {
+				dgram = dgram[:seg]
+			}
+			packet = packet[len(dgram):]
+			c := &conn{}
+			c.addrIndex = lnidx
+			c.localAddr = s.lns[lnidx].lnaddr
+			c.remoteAddr = internal.SockaddrToAddr(&sa6)
+			c.sa, c.udpfd = sa, fd
+			in := dgram
+			if s.events.InputBuffer != ReuseInput {
+				in = append([]byte{}, in...)
+			}
+			out, action := s.events.Data(c, in)
+			if len(out) > 0 {
+				if s.events.PreWrite != nil {
+					s.events.PreWrite()
+				}
+				sendUDP(fd, out, s.events.UDPSegment, sa)
+			}
+			if action == Shutdown {
+				err = errClosing
+				break
 			}
-			syscall.Sendto(fd, out, 0, sa)
 		}
-		switch action {
-		case Shutdown:
-			return errClosing
+		if s.events.InputBuffer == ReuseInput {
+			poison(buf[:n])
 		}
 	}
-	return nil
+	return err
+}
+
+// sendUDP sends the output of a UDP Data event, as datagrams of seg bytes
+// when seg is set.
+func sendUDP(fd int, out []byte, seg int, sa syscall.Sockaddr) {
+	if seg <= 0 || len(out) <= seg {
+		syscall.Sendto(fd, out, 0, sa)
+		return
+	}
+	n, _ := internal.WriteGSO(fd, out, seg, sa)
+	for out = out[n:]; len(out) > 0; {
+		dgram := out
+		if len(dgram) > seg {
+			dgram = dgram[:seg]
+		}
+		syscall.Sendto(fd, dgram, 0, sa)
+		out = out[len(dgram):]
+	}
+}
+
+// sendUDPBuffers sends the buffers as a single datagram. They're copied
+// together where sendmsg can't take them apart.
+func sendUDPBuffers(fd int, bufs net.Buffers, sa syscall.Sockaddr) error {
+	err := internal.SendBuffers(fd, bufs, sa)
+	if err == syscall.ENOPROTOOPT {
+		err = syscall.Sendto(fd, bytes.Join(bufs, nil), 0, sa)
+	}
+	return err
+}
+
+// tcp reports whether the connection is a TCP socket.
+// acceptVsock accepts a connection on a vsock listener. syscall.Accept
+// can't be used because it rejects the unknown address family.
+func acceptVsock(fd int) (nfd int, raddr net.Addr, err error) {
+	nfd, cid, port, err := internal.VsockAccept(fd)
+	if err != nil {
+		return 0, nil, err
+	}
+	return nfd, &VsockAddr{CID: cid, Port: port}, nil
+}
+
+// rightsSpace is the size of the control messages that are received on a
+// handoff connection, which is room for 16 sockets.
+var rightsSpace = syscall.CmsgSpace(16 * 4)
+
+// unixRights encodes a socket in an SCM_RIGHTS control message.
+func unixRights(fd int) ([]byte, error) {
+	return syscall.UnixRights(fd), nil
+}
+
+// parseUnixRights returns the sockets of the SCM_RIGHTS control messages.
+func parseUnixRights(oob []byte) ([]int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for _, msg := range msgs {
+		rights, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+// sockaddrIP returns the IP of an inet socket address.
+func sockaddrIP(sa syscall.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.IP(sa.Addr[:]).String()
+	case *syscall.SockaddrInet6:
+		return net.IP(sa.Addr[:]).String()
+	}
+	return ""
+}
+
+func (c *conn) tcp(s *server) bool {
+	if c.lnidx < 0 {
+		switch c.sa.(type) {
+		case *syscall.SockaddrInet4, *syscall.SockaddrInet6:
+			return true
+		}
+		return false
+	}
+	_, ok := s.lns[c.lnidx].ln.(*net.TCPListener)
+	return ok
+}
+
+// unix reports whether the connection is a unix socket.
+func (c *conn) unix(s *server) bool {
+	if c.lnidx < 0 {
+		_, ok := c.sa.(*syscall.SockaddrUnix)
+		return ok
+	}
+	_, ok := s.lns[c.lnidx].ln.(*net.UnixListener)
+	return ok
 }
 
 //第一次c开始工作时,先执行events.Opened(), 因为接受到一个新连接是默认注册读写事件的,写事件可以马上唤醒epoll_wait,再走到loopOpened处理
 func loopOpened(s *server, l *loop, c *conn) error {
 	c.opened = true
 	c.addrIndex = c.lnidx
-	c.localAddr = s.lns[c.lnidx].lnaddr
-	c.remoteAddr = internal.SockaddrToAddr(c.sa)
+	if c.lnidx >= 0 {
+		c.localAddr = s.lns[c.lnidx].lnaddr
+	}
+	if c.remoteAddr == nil {
+		c.remoteAddr = internal.SockaddrToAddr(c.sa)
+	}
 	if s.events.Opened != nil {
 		out, opts, action := s.events.Opened(c)
-		if len(out) > 0 {
-			c.out = append([]byte{}, out...)
-		}
+		loopQueue(s, c, out)
 		c.action = action
 		c.reuse = opts.ReuseInputBuffer
+		c.chunk = opts.MaxDataChunk
+		c.maxflight = opts.MaxInFlight
+		c.label = opts.Label
+		if c.priority = opts.Priority; c.priority != 0 {
+			loopPrioritize(l)
+		}
+		if opts.ReadBatchBytes > 0 && c.fd != 0 {
+			c.batchBytes, c.batchDelay = opts.ReadBatchBytes, opts.ReadBatchDelay
+			if c.batchDelay <= 0 {
+				c.batchDelay = readBatchDelay
+			}
+		}
 		if opts.TCPKeepAlive > 0 {
-			if _, ok := s.lns[c.lnidx].ln.(*net.TCPListener); ok {
+			if c.tcp(s) {
 				internal.SetKeepAlive(c.fd, int(opts.TCPKeepAlive/time.Second))
 			}
 		}
+		if opts.TCPUserTimeout > 0 {
+			if c.tcp(s) {
+				internal.SetUserTimeout(c.fd, int(opts.TCPUserTimeout/time.Millisecond))
+			}
+		}
+		if opts.Timestamping {
+			c.tstamp = internal.SetTimestamping(c.fd) == nil
+		}
+		if opts.Mark != 0 {
+			internal.SetMark(c.fd, opts.Mark)
+		}
+		if opts.OpenTimeout > 0 && !c.ready {
+			c.openDue = s.clock.Now().Add(opts.OpenTimeout)
+			loopOpenTimer(l, c, opts.OpenTimeout)
+		}
+	}
+	switch s.events.InputBuffer {
+	case ReuseInput:
+		c.reuse = true
+	case CopyInput:
+		c.reuse = false
+	}
+	if in := c.attachin; len(in) > 0 {
+		// the input that came with a migrated connection goes first
+		c.attachin = nil
+		if c.action == None {
+			loopData(s, c, in)
+		}
+	}
+	if !c.busy() { //只有没有数据可写,action也为none,才剔除写事件, ModRead就是剔除写事件，只留读事件
+		loopModRead(l, c)
 	}
-	if len(c.out) == 0 && c.action == None { //只有没有数据可写,action也为none,才剔除写事件, ModRead就是剔除写事件，只留读事件
+	if s.trace.enabled() {
+		s.trace.printf("opened conn %d %v -> %v, action %d, %d bytes queued",
+			c.id, c.remoteAddr, c.localAddr, c.action, c.pending())
+	}
+	return nil
+}
+
+// loopModRead polls the connection for reads, unless they're paused.
+func loopModRead(l *loop, c *conn) {
+	if c.paused {
+		l.poll.ModNone(c.fd)
+	} else {
 		l.poll.ModRead(c.fd)
 	}
+}
+
+// loopModReadWrite polls the connection for writes, and for reads unless
+// they're paused.
+func loopModReadWrite(l *loop, c *conn) {
+	if c.paused {
+		l.poll.ModWrite(c.fd)
+	} else {
+		l.poll.ModReadWrite(c.fd)
+	}
+}
+
+// loopPause pauses or resumes the reads of the connection.
+func loopPause(l *loop, c *conn, paused bool) {
+	if c.paused == paused {
+		return
+	}
+	c.paused = paused
+	if c.busy() {
+		loopModReadWrite(l, c)
+	} else {
+		loopModRead(l, c)
+	}
+}
+
+// loopResume resumes the reads that SuspendUntil paused once the last of
+// its channels was closed, unless Options.MaxInFlight keeps them paused.
+func loopResume(l *loop, c *conn) {
+	if c.suspends > 0 {
+		c.suspends--
+	}
+	if c.suspends == 0 && (c.maxflight == 0 || c.inflight < c.maxflight) {
+		loopPause(l, c, false)
+	}
+}
+
+// loopOpenTimer closes the connection unless it's ready within d.
+func loopOpenTimer(l *loop, c *conn, d time.Duration) {
+	c.openTimer = loopAfter(l, d, func() {
+		atomic.AddInt64(&l.ctr.timeouts, 1)
+		if c.action == None || c.action == More {
+			c.action = Close
+		}
+		loopModReadWrite(l, c)
+	})
+}
+
+// loopQueue appends data to the connection's write buffer.
+func loopQueue(s *server, c *conn, data []byte) {
+	c.push(false, func(out []byte) []byte { return append(out, data...) })
+}
+
+// push queues the output that add appends, like queue, and fires the
+// buffer and watermark events.
+func (c *conn) push(urgent bool, add func(out []byte) []byte) {
+	n := c.pending()
+	c.queue(urgent, add)
+	if c.pending() == n {
+		return
+	}
+	if n == 0 && c.srv.events.OnBufferFull != nil {
+		c.srv.events.OnBufferFull(c)
+	}
+	c.watermark()
+}
+
+// watermark fires the watermark events when the output crossed one of the
+// marks.
+func (c *conn) watermark() {
+	switch {
+	case c.high == 0:
+	case !c.above && c.pending() >= c.high:
+		c.above = true
+		if c.srv.events.OnWriteHigh != nil {
+			c.srv.events.OnWriteHigh(c)
+		}
+	case c.above && c.pending() <= c.low:
+		c.above = false
+		if c.srv.events.OnWriteLow != nil {
+			c.srv.events.OnWriteLow(c)
+		}
+	}
+}
+
+// loopReadable reports whether the connection has input that wasn't read
+// yet, in its socket or held by the poll.
+func loopReadable(l *loop, c *conn) bool {
+	if len(l.poll.Buffered(c.fd)) > 0 {
+		return true
+	}
+	n, err := internal.Readable(c.fd)
+	return err == nil && n > 0
+}
+
+// sockError returns the pending error of the socket (SO_ERROR), which
+// clears it.
+func sockError(fd int) error {
+	errno, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
 	return nil
 }
 
 func loopWrite(s *server, l *loop, c *conn) error {
-	if s.events.PreWrite != nil {
-		s.events.PreWrite()
+	if len(c.out) == 0 && c.src != nil {
+		if err := c.fill(); err != nil {
+			return loopCloseConn(s, l, c, err)
+		}
 	}
-	n, err := syscall.Write(c.fd, c.out)
-	if err != nil {
-		if err == syscall.EAGAIN {
-			return nil
+	if c.pending() > 0 {
+		if s.events.PreWrite != nil {
+			s.events.PreWrite()
 		}
-		return loopCloseConn(s, l, c, err)
+		// urgent output goes out between the chunks, so that it isn't
+		// interleaved with a chunk that's partly written
+		out, urgent := c.out, len(c.urgent) > 0
+		switch {
+		case urgent && c.partial:
+			out, urgent = c.out[:c.chunks[0]], false
+		case urgent:
+			out = c.urgent
+		}
+		n, err := writeSpin(l.poll, c.fd, out, s.events.WriteSpin)
+		atomic.AddInt64(&l.ctr.bytesOut, int64(n))
+		if s.trace.enabled() {
+			s.trace.printf("wrote %d of %d bytes to conn %d: %v", n, len(out), c.id, err)
+		}
+		if err != nil {
+			if err == syscall.EAGAIN {
+				return nil
+			}
+			if err == syscall.EPIPE {
+				// the peer closed, which is reported like a read of EOF
+				err = nil
+			}
+			return loopCloseConn(s, l, c, err)
+		}
+		switch {
+		case urgent && n == len(out):
+			c.urgent = nil
+		case urgent:
+			c.urgent = c.urgent[n:]
+		case n == len(c.out):
+			c.out = nil
+			c.chunks, c.partial = c.chunks[:0], false
+			if c.src != nil {
+				// the next chunk is written once the socket drains
+				if err := c.fill(); err != nil {
+					return loopCloseConn(s, l, c, err)
+				}
+			}
+		default:
+			c.out = c.out[n:]
+			c.sent(n)
+		}
+		if c.pending() == 0 && s.events.OnBufferEmpty != nil {
+			s.events.OnBufferEmpty(c)
+		}
+		c.watermark()
 	}
-	if n == len(c.out) {
-		c.out = nil
-	} else {
-		c.out = c.out[n:]
+	//如果还有数据没发送完，就继续保留读写事件，等待下次发送，之后的输出会追加在未发送完的数据后面
+	if !c.busy() {
+		loopModRead(l, c)
+	}
+	return nil
+}
+
+// writeSpin writes as much of out as it can, retrying up to spin times
+// while the socket is full. The error is EAGAIN only when nothing was
+// written.
+func writeSpin(p *internal.Poll, fd int, out []byte, spin int) (int, error) {
+	var written int
+	for i := 0; ; i++ {
+		n, err := p.Write(fd, out[written:])
+		if n > 0 {
+			written += n
+		}
+		if err == syscall.EAGAIN && written > 0 {
+			err = nil
+		}
+		if written == len(out) || (err != nil && err != syscall.EAGAIN) || i >= spin {
+			return written, err
+		}
+		runtime.Gosched()
+	}
+}
+
+// queue appends the output that add appends to the buffer it's passed,
+// to the urgent output or as a chunk of the output. It's the only place
+// that adds to the chunks, so that they always add up to out.
+func (c *conn) queue(urgent bool, add func(out []byte) []byte) {
+	if urgent {
+		c.urgent = add(c.urgent)
+		return
+	}
+	n := len(c.out)
+	c.out = add(c.out)
+	if len(c.out) > n {
+		c.chunks = append(c.chunks, len(c.out)-n)
+	}
+}
+
+// pending returns the size of the output that's waiting to be written.
+func (c *conn) pending() int {
+	return len(c.out) + len(c.urgent)
+}
+
+// sent drops the n bytes that were written from the output chunks.
+func (c *conn) sent(n int) {
+	for n > 0 {
+		if n < c.chunks[0] {
+			c.chunks[0] -= n
+			c.partial = true
+			return
+		}
+		n -= c.chunks[0]
+		c.chunks = c.chunks[1:]
+		c.partial = false
+	}
+}
+
+// writing reports whether the connection has output to write.
+func (c *conn) writing() bool {
+	return c.pending() > 0 || c.src != nil
+}
+
+// busy reports whether the loop has work to do on the connection other than
+// reading, so it waits for it to be writable.
+func (c *conn) busy() bool {
+	return c.writing() || c.action != None || (c.draining && !c.drained)
+}
+
+// loopDrain shuts down the write side of a draining connection once its
+// output was written, and then discards the input until the peer closes.
+// Closing right away would reset the connection when the peer sends more,
+// which can drop the output that it hasn't read yet.
+func loopDrain(s *server, l *loop, c *conn) error {
+	if frame := c.closeFrame; frame != nil {
+		// the close message goes after the rest of the output
+		c.closeFrame = nil
+		loopQueue(s, c, frame)
+		loopModReadWrite(l, c)
+		return nil
 	}
-	//如果还有数据没发送完，就继续保留读写事件，等待下次发送，这可能发生bug,即如果收到数据需要回应，就会替换未发送完的数据
-	if len(c.out) == 0 && c.action == None {
+	if !c.drained {
+		c.drained = true
+		if err := syscall.Shutdown(c.fd, syscall.SHUT_WR); err != nil {
+			return loopCloseConn(s, l, c, nil)
+		}
+		// the input is discarded, so it's read even when reads are paused
+		c.paused = false
 		l.poll.ModRead(c.fd)
+		// the open timer closes the connection if the peer doesn't
+		c.openTimer.Stop()
+		c.ready = false
+		c.openDue = s.clock.Now().Add(drainLinger)
+		loopOpenTimer(l, c, drainLinger)
+	}
+	// a packet is discarded per event so that a peer that keeps sending
+	// can't starve the loop, the poll is level triggered and fires again
+	n, err := l.poll.Read(c.fd, l.packet)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return nil
+	}
+	if n == 0 || err != nil {
+		return loopCloseConn(s, l, c, nil)
 	}
 	return nil
 }
 
+// fill queues the next chunk of the WriteFrom reader. The reader is dropped
+// at EOF or when it fails, and the error is returned in the latter case.
+func (c *conn) fill() error {
+	if c.srcbuf == nil {
+		c.srcbuf = make([]byte, writeFromChunk)
+	}
+	for i := 0; i < 100; i++ {
+		n, err := c.src.Read(c.srcbuf)
+		c.queue(false, func(out []byte) []byte { return append(out, c.srcbuf[:n]...) })
+		if err != nil {
+			c.src, c.srcbuf = nil, nil
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if n > 0 {
+			return nil
+		}
+	}
+	c.src, c.srcbuf = nil, nil
+	return io.ErrNoProgress
+}
+
 func loopAction(s *server, l *loop, c *conn) error {
+	if c.action >= UserAction {
+		c.action = userAction(s.events.Actions, c, c.action)
+		if c.writing() {
+			// the handler wrote to the connection
+			loopModReadWrite(l, c)
+			return nil
+		}
+	}
 	switch c.action {
 	default:
 		c.action = None
@@ -414,58 +2357,270 @@ func loopAction(s *server, l *loop, c *conn) error {
 		return errClosing
 	case Detach:
 		return loopDetachConn(s, l, c, nil)
+	case More:
+		// the output was written
+		c.action = None
+		return loopWake(s, l, c)
 	}
-	if len(c.out) == 0 && c.action == None {
-		l.poll.ModRead(c.fd)
+	if !c.busy() {
+		loopModRead(l, c)
 	}
 	return nil
 }
 
 func loopWake(s *server, l *loop, c *conn) error {
-	if s.events.Data == nil {
+	if s.events.Data == nil || c.draining {
 		return nil
 	}
 	out, action := s.events.Data(c, nil)
 	c.action = action
-	if len(out) > 0 {
-		c.out = append([]byte{}, out...)
-	}
-	if len(c.out) != 0 || c.action != None {
+	loopQueue(s, c, out)
+	if c.busy() {
 		//如果有数据要发送，则注册写事件，如果action是close,注册读写事件后epoll wait也会立刻返回
-		l.poll.ModReadWrite(c.fd)
+		loopModReadWrite(l, c)
 	}
 	return nil
 }
 
+// loopRead reads from a connection until it would block or it has used up
+// its read budget for this wake up of the loop.
 func loopRead(s *server, l *loop, c *conn) error {
+	var total int
+	for reads := 1; ; reads++ {
+		n, err := loopReadOnce(s, l, c)
+		total += n
+		if err != nil || n < len(l.packet) || c.busy() || c.paused ||
+			reads >= s.events.MaxReadsPerWait ||
+			(s.events.MaxBytesPerWait > 0 && total >= s.events.MaxBytesPerWait) {
+			return err
+		}
+	}
+}
+
+// loopReadOnce reads once from a connection and passes the input to the
+// Data event. It returns the number of bytes that were read, which is zero
+// when there was no input or the connection was closed.
+func loopReadOnce(s *server, l *loop, c *conn) (int, error) {
 	var in []byte
-	n, err := syscall.Read(c.fd, l.packet)
+	var n int
+	var err error
+	packet := l.packet
+	if max := s.events.MaxReadPerCycle; max > 0 {
+		if cycle := l.poll.Cycle(); cycle != l.cycle {
+			l.cycle, l.cycleIn = cycle, 0
+		}
+		if l.cycleIn >= max {
+			// deferred to the next cycle, the poll reports it again
+			return 0, nil
+		}
+		if max-l.cycleIn < len(packet) {
+			packet = packet[:max-l.cycleIn]
+		}
+	}
+	if c.tstamp && len(l.poll.Buffered(c.fd)) == 0 {
+		n, c.ts, err = internal.ReadTimestamp(c.fd, packet, l.oob)
+	} else {
+		n, err = readFunc(l.poll, c.fd, packet)
+	}
+	if n > 0 {
+		l.cycleIn += n
+		atomic.AddInt64(&l.ctr.bytesIn, int64(n))
+	}
+	if s.trace.enabled() && err != syscall.EAGAIN {
+		s.trace.printf("read %d bytes from conn %d: %v", n, c.id, err)
+	}
 	//由于是水平触发模式，不需要读完所有数据，只要还有数据没读完，就会有读事件触发
 	if n == 0 || err != nil {
-		if err == syscall.EAGAIN {
-			return nil
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			return 0, nil
 		}
-		return loopCloseConn(s, l, c, err)
+		if len(c.batch) > 0 {
+			// the batched input is passed on before closing
+			loopData(s, c, c.batch)
+			c.batch = nil
+			if c.action == Shutdown {
+				loopCloseConn(s, l, c, err)
+				return 0, errClosing
+			}
+		}
+		// errors such as ECONNRESET only close this connection
+		return 0, loopCloseConn(s, l, c, err)
+	}
+	if !c.trusted {
+		rateLimit(s.events.RateLimits, s.clock, c, c.label, n)
 	}
 	in = l.packet[:n]
-	if !c.reuse {
+	var batched bool
+	if c.batchBytes > 0 {
+		c.batch = append(c.batch, in...)
+		if len(c.batch) < c.batchBytes {
+			if c.batchTimer == nil {
+				loopBatchTimer(s, l, c)
+			}
+			in = nil
+		} else {
+			c.batchTimer.Stop()
+			c.batchTimer = nil
+			in, c.batch, batched = c.batch, nil, true
+		}
+	} else if !c.reuse {
 		in = append([]byte{}, in...)
 	}
-	if s.events.Data != nil {
-		out, action := s.events.Data(c, in)
+	loopData(s, c, in)
+	if batched && c.reuse {
+		c.batch = in[:0]
+	}
+	if c.reuse {
+		poison(l.packet[:n])
+	}
+	if c.busy() { //c.action != None把写事件加上,这样epoll_wait可以快速醒来去执行loopAction
+		loopModReadWrite(l, c)
+	}
+	return n, nil
+}
+
+// loopBatchTimer passes the batched input to the Data event once it has
+// waited long enough.
+func loopBatchTimer(s *server, l *loop, c *conn) {
+	c.batchTimer = loopAfter(l, c.batchDelay, func() {
+		c.batchTimer = nil
+		if len(c.batch) == 0 {
+			return
+		}
+		if c.action != None || c.draining {
+			// try again once the pending action is done
+			loopBatchTimer(s, l, c)
+			return
+		}
+		in := c.batch
+		c.batch = nil
+		loopData(s, c, in)
+		if c.reuse {
+			c.batch = in[:0]
+		}
+		if c.busy() {
+			loopModReadWrite(l, c)
+		}
+	})
+}
+
+// loopDeadlineTimer calls the deadline function of the connection once its
+// deadline is reached.
+func loopDeadlineTimer(s *server, l *loop, c *conn) {
+	c.deadlineTm = loopAfter(l, c.deadline.Sub(s.clock.Now()), func() {
+		c.deadlineTm = nil
+		if c.draining {
+			return
+		}
+		if c.action != None {
+			// try again once the pending action is done
+			loopDeadlineTimer(s, l, c)
+			return
+		}
+		fn := c.deadlineFn
+		c.deadline, c.deadlineFn = time.Time{}, nil
+		atomic.AddInt64(&l.ctr.timeouts, 1)
+		out, action := fn(c)
 		c.action = action
-		if len(out) > 0 {
-			c.out = append([]byte{}, out...)
+		loopQueue(s, c, out)
+		if c.busy() {
+			loopModReadWrite(l, c)
+		}
+	})
+}
+
+// loopData passes the input to the Data event, in chunks of MaxDataChunk,
+// and queues the output.
+func loopData(s *server, c *conn, in []byte) {
+	if s.events.Data != nil && len(in) > 0 {
+		var more bool
+		for len(in) > 0 {
+			chunk := in
+			if c.chunk > 0 && len(chunk) > c.chunk {
+				chunk = chunk[:c.chunk]
+			}
+			in = in[len(chunk):]
+			out, action := s.events.Data(c, chunk)
+			if action == More {
+				// the rest of the input goes first
+				more, action = true, None
+			}
+			c.action = action
+			loopQueue(s, c, out)
+			if action != None || c.draining {
+				break
+			}
+		}
+		if more && c.action == None {
+			c.action = More
+		}
+		if c.action == Detach && len(in) > 0 {
+			c.detachin = append([]byte{}, in...)
 		}
 	}
-	if len(c.out) != 0 || c.action != None { //c.action != None把写事件加上,这样epoll_wait可以快速醒来去执行loopAction
-		l.poll.ModReadWrite(c.fd)
-	}
-	return nil
 }
 
+// detachedConn is a blocking connection that implements net.Conn. The
+// deadlines are applied with the SO_RCVTIMEO and SO_SNDTIMEO socket options,
+// set to the time that's left before each read and write system call, which
+// differs from net.Conn in that a deadline set while a Read or Write is
+// blocked doesn't unblock it: it applies from the next call.
 type detachedConn struct {
-	fd int
+	fd        int
+	laddr     net.Addr
+	raddr     net.Addr
+	ctx       interface{} // context of the connection when it was detached
+	rdeadline time.Time   // read deadline
+	wdeadline time.Time   // write deadline
+	rtimeo    bool        // SO_RCVTIMEO is set
+	wtimeo    bool        // SO_SNDTIMEO is set
+	in        []byte      // input that wasn't passed to the Data event
+}
+
+func (c *detachedConn) Fd() uintptr          { return uintptr(c.fd) }
+func (c *detachedConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *detachedConn) RemoteAddr() net.Addr { return c.raddr }
+func (c *detachedConn) Context() interface{} { return c.ctx }
+
+// SetDeadline sets the read and write deadlines. Unlike net.Conn, it doesn't
+// affect a Read or Write that's already blocked.
+func (c *detachedConn) SetDeadline(t time.Time) error {
+	c.rdeadline, c.wdeadline = t, t
+	return nil
+}
+
+func (c *detachedConn) SetReadDeadline(t time.Time) error {
+	c.rdeadline = t
+	return nil
+}
+
+func (c *detachedConn) SetWriteDeadline(t time.Time) error {
+	c.wdeadline = t
+	return nil
+}
+
+// timeout sets the socket timeout option to the time that's left until the
+// deadline. A zero deadline clears the timeout.
+func (c *detachedConn) timeout(opt int, deadline time.Time, set *bool) error {
+	if deadline.IsZero() && !*set {
+		return nil
+	}
+	var tv syscall.Timeval
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		if d < time.Microsecond {
+			d = time.Microsecond // a zero timeval never times out
+		}
+		tv = syscall.NsecToTimeval(int64(d))
+	}
+	if err := syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, opt, &tv); err != nil {
+		return err
+	}
+	*set = !deadline.IsZero()
+	return nil
 }
 
 func (c *detachedConn) Close() error {
@@ -477,10 +2632,30 @@ func (c *detachedConn) Close() error {
 	return nil
 }
 
+// unread returns the input that the loop read but didn't pass to Data.
+func (c *detachedConn) unread() []byte { return c.in }
+
 func (c *detachedConn) Read(p []byte) (n int, err error) {
-	n, err = syscall.Read(c.fd, p)
+	if len(c.in) > 0 {
+		n = copy(p, c.in)
+		c.in = c.in[n:]
+		return n, nil
+	}
+	for {
+		// the timeout is what's left of the deadline after an interrupt
+		if err := c.timeout(syscall.SO_RCVTIMEO, c.rdeadline, &c.rtimeo); err != nil {
+			return 0, err
+		}
+		n, err = syscall.Read(c.fd, p)
+		if err != syscall.EINTR {
+			break
+		}
+	}
 	if err != nil {
-		return n, err
+		if err == syscall.EAGAIN {
+			err = os.ErrDeadlineExceeded
+		}
+		return 0, err
 	}
 	if n == 0 {
 		if len(p) == 0 {
@@ -492,13 +2667,23 @@ func (c *detachedConn) Read(p []byte) (n int, err error) {
 }
 
 func (c *detachedConn) Write(p []byte) (n int, err error) {
-	n = len(p)
-	for len(p) > 0 {
-		nn, err := syscall.Write(c.fd, p)
+	for n < len(p) {
+		// the timeout is what's left of the deadline after the short writes
+		// and the interrupts
+		if err := c.timeout(syscall.SO_SNDTIMEO, c.wdeadline, &c.wtimeo); err != nil {
+			return n, err
+		}
+		nn, err := syscall.Write(c.fd, p[n:])
+		if err == syscall.EINTR {
+			continue
+		}
 		if err != nil {
+			if err == syscall.EAGAIN {
+				err = os.ErrDeadlineExceeded
+			}
 			return n, err
 		}
-		p = p[nn:]
+		n += nn
 	}
 	return n, nil
 }
@@ -516,7 +2701,7 @@ func (ln *listener) close() {
 	if ln.pconn != nil {
 		ln.pconn.Close()
 	}
-	if ln.network == "unix" {
+	if ln.network == "unix" && !ln.handoff {
 		os.RemoveAll(ln.addr)
 	}
 }
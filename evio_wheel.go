@@ -0,0 +1,57 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux
+
+package evio
+
+import (
+	"time"
+
+	"github.com/jursonmo/evio/internal"
+)
+
+const (
+	wheelTick = 10 * time.Millisecond // resolution of connection timers
+	wheelSize = 512                   // timing wheel slots
+)
+
+// timers holds the connection timers of a loop, which are kept on a timing
+// wheel that's advanced by wheel notes.
+type timers struct {
+	wheel   *internal.TimingWheel // created with the first timer
+	wheelon bool                  // a wheel advance is scheduled
+}
+
+// timer is a connection timer.
+type timer = internal.Timer
+
+// loopAfter calls fn on the loop once d has elapsed.
+func loopAfter(l *loop, d time.Duration, fn func()) *timer {
+	if l.wheel == nil {
+		l.wheel = internal.NewTimingWheel(wheelTick, wheelSize, l.clock.Now)
+	}
+	t := l.wheel.AfterFunc(d, fn)
+	loopScheduleWheel(l)
+	return t
+}
+
+// loopScheduleWheel schedules the next advance of the timing wheel. The
+// wheel only ticks while it has active timers.
+func loopScheduleWheel(l *loop) {
+	if l.wheelon || l.wheel.Len() == 0 {
+		return
+	}
+	l.wheelon = true
+	l.clock.AfterFunc(l.wheel.Tick(), func() {
+		l.poll.Trigger(wheelNote{})
+	})
+}
+
+// loopAdvanceWheel fires the expired timers.
+func loopAdvanceWheel(l *loop) {
+	l.wheelon = false
+	l.wheel.Advance(l.clock.Now())
+	loopScheduleWheel(l)
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package handshake runs the multi-step handshake of a binary protocol on
+// the input of an evio connection before passing the rest of the input to
+// the Data event.
+//
+//	h := &handshake.Handshake{
+//		Steps:   []handshake.Step{hello, auth},
+//		Timeout: 5 * time.Second,
+//	}
+//	events.Opened = h.Opened(nil)
+//	events.Data = h.Data(func(c evio.Conn, in []byte) ([]byte, evio.Action) {
+//		// the handshake completed
+//		return in, evio.None
+//	})
+//
+// Each step is passed the buffered input until it has a complete message.
+// A step that fails, input that outgrows MaxSize and a handshake that
+// doesn't complete within Timeout close the connection. The state of a
+// connection is stored in its context, so the context must not be used for
+// anything else.
+package handshake
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jursonmo/evio"
+)
+
+// ErrTooLarge is passed to Violation when the input of a step grows past
+// MaxSize without being complete.
+var ErrTooLarge = errors.New("handshake message too large")
+
+// Step validates one message of a handshake. It returns the length of the
+// message at the start of in, or zero when in doesn't hold all of it yet,
+// and the reply to send. An error is a protocol violation.
+type Step func(c evio.Conn, in []byte) (n int, reply []byte, err error)
+
+// Handshake is a sequence of steps that the input of a connection must pass
+// in order.
+type Handshake struct {
+	// Steps are the messages of the handshake, in order.
+	Steps []Step
+	// MaxSize is the most input that's buffered for a step. It defaults to
+	// 64 KB.
+	MaxSize int
+	// Timeout closes the connection when the handshake doesn't complete in
+	// time. It's applied by the Opened event, as Options.OpenTimeout.
+	Timeout time.Duration
+	// Complete is called once all of the steps passed. Its output follows
+	// the reply of the last step.
+	Complete func(c evio.Conn) (out []byte, action evio.Action)
+	// Violation is called with the error of a step that failed, before
+	// the connection is closed. Its output is sent before closing.
+	Violation func(c evio.Conn, err error) (out []byte)
+}
+
+// conn is the state of a connection.
+type conn struct {
+	is   evio.InputStream
+	step int  // current step
+	done bool // all of the steps passed
+}
+
+// Done reports whether the handshake of the connection completed.
+func Done(c evio.Conn) bool {
+	hc, ok := c.Context().(*conn)
+	return ok && hc.done
+}
+
+// Opened returns an Opened event that sets the handshake timeout and calls
+// opened, which may be nil.
+func (h *Handshake) Opened(opened func(c evio.Conn) (out []byte, opts evio.Options, action evio.Action)) func(c evio.Conn) (out []byte, opts evio.Options, action evio.Action) {
+	return func(c evio.Conn) (out []byte, opts evio.Options, action evio.Action) {
+		c.SetContext(&conn{})
+		if opened != nil {
+			out, opts, action = opened(c)
+		}
+		if opts.OpenTimeout == 0 {
+			opts.OpenTimeout = h.Timeout
+		}
+		return
+	}
+}
+
+// Data returns a Data event that runs the handshake and passes the input
+// that follows it to data, which may be nil.
+func (h *Handshake) Data(data func(c evio.Conn, in []byte) (out []byte, action evio.Action)) func(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+	max := h.MaxSize
+	if max <= 0 {
+		max = 64 << 10
+	}
+	return func(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+		hc, ok := c.Context().(*conn)
+		if !ok {
+			hc = &conn{}
+			c.SetContext(hc)
+		}
+		if hc.done {
+			if data != nil {
+				return data(c, in)
+			}
+			return
+		}
+		if in == nil {
+			return
+		}
+		buf := hc.is.Begin(in)
+		for hc.step < len(h.Steps) {
+			n, reply, err := h.Steps[hc.step](c, buf)
+			if err == nil && n == 0 && len(buf) > max {
+				err = ErrTooLarge
+			}
+			if err != nil {
+				if h.Violation != nil {
+					out = append(out, h.Violation(c, err)...)
+				}
+				hc.is.End(nil)
+				return out, evio.Close
+			}
+			if n == 0 {
+				hc.is.End(buf)
+				return out, evio.None
+			}
+			out = append(out, reply...)
+			buf = buf[n:]
+			hc.step++
+		}
+		hc.done = true
+		c.Ready()
+		if h.Complete != nil {
+			o, a := h.Complete(c)
+			out = append(out, o...)
+			if a != evio.None {
+				return out, a
+			}
+		}
+		if len(buf) > 0 && data != nil {
+			o, a := data(c, buf)
+			out = append(out, o...)
+			action = a
+		}
+		hc.is = evio.InputStream{}
+		return out, action
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package handshake
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jursonmo/evio"
+)
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// testHandshake has three steps: a magic, a version byte and a length
+// prefixed token.
+var testHandshake = &Handshake{
+	Steps: []Step{
+		func(c evio.Conn, in []byte) (int, []byte, error) {
+			if len(in) < 4 {
+				return 0, nil, nil
+			}
+			if string(in[:4]) != "EVIO" {
+				return 0, nil, errors.New("bad magic")
+			}
+			return 4, []byte("OK1"), nil
+		},
+		func(c evio.Conn, in []byte) (int, []byte, error) {
+			if len(in) < 1 {
+				return 0, nil, nil
+			}
+			if in[0] != 1 {
+				return 0, nil, errors.New("bad version")
+			}
+			return 1, []byte("OK2"), nil
+		},
+		func(c evio.Conn, in []byte) (int, []byte, error) {
+			if len(in) < 2 {
+				return 0, nil, nil
+			}
+			n := int(binary.BigEndian.Uint16(in))
+			if len(in) < 2+n {
+				return 0, nil, nil
+			}
+			if string(in[2:2+n]) != "secret" {
+				return 0, nil, errors.New("bad token")
+			}
+			return 2 + n, []byte("OK3"), nil
+		},
+	},
+	Timeout: time.Second / 5,
+	Complete: func(c evio.Conn) ([]byte, evio.Action) {
+		return []byte("READY"), evio.None
+	},
+	Violation: func(c evio.Conn, err error) []byte {
+		return []byte("BAD " + err.Error())
+	},
+}
+
+// testServe serves the handshake and returns what the client read after
+// sending the input, until the connection closed or the read timed out.
+func testServe(addr string, input []byte) string {
+	var got []byte
+	var events evio.Events
+	events.Serving = func(srv evio.Server) (action evio.Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			// send the input a byte at a time
+			for i := range input {
+				c.Write(input[i : i+1])
+				time.Sleep(time.Millisecond)
+			}
+			c.SetReadDeadline(time.Now().Add(time.Second))
+			got, _ = ioutil.ReadAll(c)
+			c.Close()
+			c, err = net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("EVIO\x01\x00\x06secretquit"))
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	events.Opened = testHandshake.Opened(nil)
+	events.Data = testHandshake.Data(func(c evio.Conn, in []byte) ([]byte, evio.Action) {
+		if !Done(c) {
+			panic("input passed before the handshake completed")
+		}
+		if bytes.HasSuffix(in, []byte("quit")) {
+			return nil, evio.Shutdown
+		}
+		return in, evio.None
+	})
+	must(evio.Serve(events, "tcp://"+addr))
+	return string(got)
+}
+
+func TestHandshake(t *testing.T) {
+	got := testServe(":9910", []byte("EVIO\x01\x00\x06secretping"))
+	if got != "OK1OK2OK3READYping" {
+		t.Fatalf("unexpected output %q", got)
+	}
+}
+
+func TestViolation(t *testing.T) {
+	got := testServe(":9909", []byte("EVIO\x02\x00\x06secretping"))
+	if got != "OK1BAD bad version" {
+		t.Fatalf("unexpected output %q", got)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	start := time.Now()
+	got := testServe(":9908", []byte("EVIO\x01"))
+	// the client reads until the connection closes or for a second
+	if got != "OK1OK2" || time.Since(start) > time.Second*3/4 {
+		t.Fatalf("expected the handshake to time out, got %q after %v", got, time.Since(start))
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import "time"
+
+// busyPoll decides whether a Poll waits without blocking. It polls for a
+// window after each wake up that had events, but only while active
+// reports that there's something to poll for, so a poll with nothing to do
+// blocks in the kernel.
+type busyPoll struct {
+	window time.Duration
+	active func() bool
+	last   time.Time // the last wake up with events
+}
+
+// spin reports whether the next wait should return right away.
+func (b *busyPoll) spin() bool {
+	return b.window > 0 && b.active() && time.Since(b.last) < b.window
+}
+
+// woke records a wake up, which extends the window when it had events.
+func (b *busyPoll) woke(events bool) {
+	if b.window > 0 && events {
+		b.last = time.Now()
+	}
+}
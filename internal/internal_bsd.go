@@ -7,7 +7,10 @@
 package internal
 
 import (
+	"errors"
+	"sync"
 	"syscall"
+	"time"
 )
 
 // Poll ...
@@ -15,6 +18,25 @@ type Poll struct {
 	fd      int
 	changes []syscall.Kevent_t
 	notes   noteQueue
+	mu      sync.RWMutex          // guards closed
+	closed  bool                  // the descriptor was closed
+	stats   *WaitStats            // wait timing, nil when disabled
+	cycle   uint64                // number of times Wait woke up
+	timers  map[uint64]*PollTimer // pending timers by ident
+	timerID uint64                // last timer ident
+	noread  map[int]bool          // descriptors with the read filter disabled
+	failed  bool                  // the descriptor passed to iter has an error
+	busy    busyPoll
+	prio    priority
+	ahead   map[int]*ahead // input held for the owners of descriptors
+}
+
+// PollTimer is a pending function call that's scheduled with an
+// EVFILT_TIMER filter on the kqueue of a Poll.
+type PollTimer struct {
+	p  *Poll
+	id uint64
+	fn func()
 }
 
 // OpenPoll ...
@@ -39,12 +61,63 @@ func OpenPoll() *Poll {
 
 // Close ...
 func (p *Poll) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
 	return syscall.Close(p.fd)
 }
 
 // Trigger ...
 func (p *Poll) Trigger(note interface{}) error {
-	p.notes.Add(note)
+	return p.trigger(note, false)
+}
+
+// TryTrigger is like Trigger but fails with ErrQueueFull when the number of
+// pending notes is at the capacity set with SetNoteCapacity.
+func (p *Poll) TryTrigger(note interface{}) error {
+	return p.trigger(note, true)
+}
+
+// SetNoteCapacity sets the number of pending notes at which TryTrigger
+// fails. Zero means no limit. Trigger is never limited.
+func (p *Poll) SetNoteCapacity(n int) {
+	p.notes.SetCapacity(n)
+}
+
+// Pending returns the number of notes that are waiting to be passed to
+// Wait.
+func (p *Poll) Pending() int {
+	return p.notes.Len()
+}
+
+// DrainNotes passes the notes that are still queued to iter, such as the
+// ones that were added after the note that stopped Wait. Once the poll is
+// closed no notes can be added, so the queue is drained for good.
+func (p *Poll) DrainNotes(iter func(note interface{})) {
+	p.notes.ForEach(func(note interface{}) error {
+		iter(note)
+		return nil
+	})
+}
+
+func (p *Poll) trigger(note interface{}, try bool) error {
+	// the descriptors may be reused once the poll is closed.
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return syscall.EBADF
+	}
+	var one, ok bool
+	if !try {
+		one = p.notes.Add(note)
+	} else if ok, one = p.notes.TryAdd(note); !ok {
+		return ErrQueueFull
+	}
+	if !one {
+		// the earlier notes triggered the user event, and Wait takes
+		// all of the notes once it wakes up.
+		return nil
+	}
 	_, err := syscall.Kevent(p.fd, []syscall.Kevent_t{{
 		Ident:  0,
 		Filter: syscall.EVFILT_USER,
@@ -53,32 +126,142 @@ func (p *Poll) Trigger(note interface{}) error {
 	return err
 }
 
+// SetBusyPoll makes Wait poll without blocking for the window after each
+// wake up that had events, as long as active returns true. It trades CPU
+// for latency. Wait blocks as usual when active returns false. It must be
+// called before Wait.
+func (p *Poll) SetBusyPoll(window time.Duration, active func() bool) {
+	p.busy = busyPoll{window: window, active: active}
+}
+
+// SetPriority makes Wait pass the descriptors that are ready at the same
+// time to iter by the priority that fn returns for them, highest first. It
+// must be called before Wait or from the iter function passed to Wait.
+func (p *Poll) SetPriority(fn func(fd int) int) {
+	p.prio.fn = fn
+}
+
+// SetWaitStats makes Wait record its timing in s, along with the system
+// calls of the poll.
+func (p *Poll) SetWaitStats(s *WaitStats) {
+	p.stats = s
+}
+
+// Cycle returns the number of times Wait has woken up. It must only be
+// called from the iter function passed to Wait.
+func (p *Poll) Cycle() uint64 {
+	return p.cycle
+}
+
+// Failed reports whether the poll reported an error for the descriptor
+// that's being passed to iter, such as a connection reset. The error is read
+// with SO_ERROR. It must only be called from the iter function passed to
+// Wait.
+func (p *Poll) Failed() bool {
+	return p.failed
+}
+
 // Wait ...
 func (p *Poll) Wait(iter func(fd int, note interface{}) error) error {
 	events := make([]syscall.Kevent_t, 128)
 	for {
-		n, err := syscall.Kevent(p.fd, p.changes, events, nil)
+		var timeout *syscall.Timespec
+		spin := p.busy.spin()
+		if spin || p.aheadReady() {
+			timeout = new(syscall.Timespec)
+		}
+		t0 := p.stats.now()
+		p.stats.call()
+		n, err := syscall.Kevent(p.fd, p.changes, events, timeout)
 		if err != nil && err != syscall.EINTR {
 			return err
 		}
 		p.changes = p.changes[:0]
+		if spin && n <= 0 {
+			continue
+		}
+		p.busy.woke(n > 0)
+		t1 := p.stats.now()
+		p.cycle++
+		p.failed = false
 		if err := p.notes.ForEach(func(note interface{}) error {
 			return iter(0, note)
 		}); err != nil {
 			return err
 		}
+		p.prio.order(n, func(i int) int {
+			if events[i].Filter == syscall.EVFILT_TIMER {
+				return -1 // not a descriptor
+			}
+			return int(events[i].Ident)
+		}, func(i, j int) {
+			events[i], events[j] = events[j], events[i]
+		})
 		for i := 0; i < n; i++ {
+			if events[i].Filter == syscall.EVFILT_TIMER {
+				p.fire(events[i].Ident)
+				continue
+			}
 			if fd := int(events[i].Ident); fd != 0 {
+				// EV_EOF comes with the socket error in fflags
+				p.failed = events[i].Flags&syscall.EV_EOF != 0 && events[i].Fflags != 0
+				p.passed(fd)
 				if err := iter(fd, nil); err != nil {
 					return err
 				}
 			}
 		}
+		if err := p.passAhead(iter); err != nil {
+			return err
+		}
+		p.stats.record(t0, t1)
+	}
+}
+
+// AfterFunc schedules fn to be called by Wait once d has elapsed. It must
+// only be called from the iter function passed to Wait.
+func (p *Poll) AfterFunc(d time.Duration, fn func()) *PollTimer {
+	if p.timers == nil {
+		p.timers = make(map[uint64]*PollTimer)
+	}
+	p.timerID++
+	t := &PollTimer{p: p, id: p.timerID, fn: fn}
+	p.timers[t.id] = t
+	ms := int64((d + time.Millisecond - 1) / time.Millisecond)
+	p.changes = append(p.changes, syscall.Kevent_t{
+		Ident: t.id, Flags: syscall.EV_ADD | syscall.EV_ONESHOT,
+		Filter: syscall.EVFILT_TIMER, Data: ms,
+	})
+	return t
+}
+
+// Stop prevents the timer from firing. It returns false if the timer has
+// already fired or been stopped.
+func (t *PollTimer) Stop() bool {
+	if t == nil || t.p.timers[t.id] != t {
+		return false
+	}
+	delete(t.p.timers, t.id)
+	t.p.changes = append(t.p.changes, syscall.Kevent_t{
+		Ident: t.id, Flags: syscall.EV_DELETE, Filter: syscall.EVFILT_TIMER,
+	})
+	return true
+}
+
+// fire calls the function of a timer that expired. The timer may have been
+// stopped after it expired, and the deletion of a timer that already fired
+// is reported as an error event, so unknown timers are ignored.
+func (p *Poll) fire(id uint64) {
+	if t := p.timers[id]; t != nil {
+		delete(p.timers, id)
+		t.fn()
 	}
 }
 
 // AddRead ...
 func (p *Poll) AddRead(fd int) {
+	delete(p.noread, fd)
+	p.pauseAhead(fd, false)
 	p.changes = append(p.changes,
 		syscall.Kevent_t{
 			Ident: uint64(fd), Flags: syscall.EV_ADD, Filter: syscall.EVFILT_READ,
@@ -88,6 +271,8 @@ func (p *Poll) AddRead(fd int) {
 
 // AddReadWrite ...
 func (p *Poll) AddReadWrite(fd int) {
+	delete(p.noread, fd)
+	p.pauseAhead(fd, false)
 	p.changes = append(p.changes,
 		syscall.Kevent_t{
 			Ident: uint64(fd), Flags: syscall.EV_ADD, Filter: syscall.EVFILT_READ,
@@ -100,6 +285,7 @@ func (p *Poll) AddReadWrite(fd int) {
 
 // ModRead ...
 func (p *Poll) ModRead(fd int) {
+	p.enableRead(fd)
 	p.changes = append(p.changes, syscall.Kevent_t{
 		Ident: uint64(fd), Flags: syscall.EV_DELETE, Filter: syscall.EVFILT_WRITE,
 	})
@@ -107,13 +293,58 @@ func (p *Poll) ModRead(fd int) {
 
 // ModReadWrite ...
 func (p *Poll) ModReadWrite(fd int) {
+	p.enableRead(fd)
 	p.changes = append(p.changes, syscall.Kevent_t{
 		Ident: uint64(fd), Flags: syscall.EV_ADD, Filter: syscall.EVFILT_WRITE,
 	})
 }
 
-// ModDetach ...
-func (p *Poll) ModDetach(fd int) {
+// ModWrite polls the descriptor for writes only, which pauses its reads.
+func (p *Poll) ModWrite(fd int) {
+	p.disableRead(fd)
+	p.changes = append(p.changes, syscall.Kevent_t{
+		Ident: uint64(fd), Flags: syscall.EV_ADD, Filter: syscall.EVFILT_WRITE,
+	})
+}
+
+// ModNone keeps the descriptor registered without polling it for reads or
+// writes.
+func (p *Poll) ModNone(fd int) {
+	p.disableRead(fd)
+	p.changes = append(p.changes, syscall.Kevent_t{
+		Ident: uint64(fd), Flags: syscall.EV_DELETE, Filter: syscall.EVFILT_WRITE,
+	})
+}
+
+func (p *Poll) disableRead(fd int) {
+	p.pauseAhead(fd, true)
+	if p.noread[fd] {
+		return
+	}
+	if p.noread == nil {
+		p.noread = make(map[int]bool)
+	}
+	p.noread[fd] = true
+	p.changes = append(p.changes, syscall.Kevent_t{
+		Ident: uint64(fd), Flags: syscall.EV_DISABLE, Filter: syscall.EVFILT_READ,
+	})
+}
+
+func (p *Poll) enableRead(fd int) {
+	p.pauseAhead(fd, false)
+	if !p.noread[fd] {
+		return
+	}
+	delete(p.noread, fd)
+	p.changes = append(p.changes, syscall.Kevent_t{
+		Ident: uint64(fd), Flags: syscall.EV_ENABLE, Filter: syscall.EVFILT_READ,
+	})
+}
+
+// ModDetach stops polling the descriptor. It returns the input that the
+// poll holds for it, which wasn't read yet.
+func (p *Poll) ModDetach(fd int) []byte {
+	delete(p.noread, fd)
 	p.changes = append(p.changes,
 		syscall.Kevent_t{
 			Ident: uint64(fd), Flags: syscall.EV_DELETE, Filter: syscall.EVFILT_READ,
@@ -122,4 +353,39 @@ func (p *Poll) ModDetach(fd int) {
 			Ident: uint64(fd), Flags: syscall.EV_DELETE, Filter: syscall.EVFILT_WRITE,
 		},
 	)
+	return p.dropAhead(fd)
+}
+
+// OpenURingPoll is not supported on this platform.
+func OpenURingPoll() (*Poll, error) {
+	return nil, errors.New("io_uring is not supported")
+}
+
+// Forget must be called before closing a file descriptor that's registered
+// with the poll. Kqueue drops closed descriptors on its own.
+func (p *Poll) Forget(fd int) {
+	delete(p.noread, fd)
+	p.dropAhead(fd)
+}
+
+// Read reads from a registered descriptor, starting with the input that the
+// poll holds for it.
+func (p *Poll) Read(fd int, b []byte) (int, error) {
+	if n, err, ok := p.readAhead(fd, b); ok {
+		return n, err
+	}
+	p.stats.call()
+	return syscall.Read(fd, b)
+}
+
+// Write writes to a registered descriptor.
+func (p *Poll) Write(fd int, b []byte) (int, error) {
+	p.stats.call()
+	return syscall.Write(fd, b)
+}
+
+// Accept accepts a connection on a listener.
+func (p *Poll) Accept(fd int) (int, syscall.Sockaddr, error) {
+	p.stats.call()
+	return syscall.Accept(fd)
 }
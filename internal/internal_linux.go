@@ -5,14 +5,25 @@
 package internal
 
 import (
+	"sync"
 	"syscall"
+	"time"
 )
 
 // Poll ...
 type Poll struct {
-	fd    int // epoll fd
-	wfd   int // wake fd
-	notes noteQueue
+	fd     int    // epoll fd
+	wfd    int    // wake fd
+	ring   *uring // io_uring, used in place of epoll when not nil
+	notes  noteQueue
+	mu     sync.RWMutex // guards closed
+	closed bool         // the descriptors were closed
+	stats  *WaitStats   // wait timing, nil when disabled
+	cycle  uint64       // number of times Wait woke up
+	failed bool         // the descriptor passed to iter has an error
+	busy   busyPoll
+	prio   priority
+	ahead  map[int]*ahead // input held for the owners of descriptors
 }
 
 // OpenPoll ...
@@ -23,58 +34,200 @@ func OpenPoll() *Poll {
 		panic(err)
 	}
 	l.fd = p
-	r0, _, e0 := syscall.Syscall(syscall.SYS_EVENTFD2, 0, 0, 0)
-	if e0 != 0 {
+	l.wfd, err = openEventfd()
+	if err != nil {
 		syscall.Close(p)
 		panic(err)
 	}
-	l.wfd = int(r0)
 	l.AddRead(l.wfd)
 	return l
 }
 
+// openEventfd opens the eventfd that wakes Wait. It's non-blocking so that
+// Wait can reset its counter without blocking.
+func openEventfd() (int, error) {
+	r0, _, e0 := syscall.Syscall(syscall.SYS_EVENTFD2, 0,
+		syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if e0 != 0 {
+		return -1, e0
+	}
+	return int(r0), nil
+}
+
 // Close ...
 func (p *Poll) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
 	if err := syscall.Close(p.wfd); err != nil {
 		return err
 	}
+	if p.ring != nil {
+		p.ring.cancel()
+		return p.ring.close()
+	}
 	return syscall.Close(p.fd)
 }
 
-// Trigger ...ͨwfdepoll_wait, ߳ȥѾעnote,
+// Trigger ...是通过向wfd发送数据来唤醒epoll_wait, 让线程去处理已经注册的note,
 func (p *Poll) Trigger(note interface{}) error {
-	p.notes.Add(note)
+	return p.trigger(note, false)
+}
+
+// TryTrigger is like Trigger but fails with ErrQueueFull when the number of
+// pending notes is at the capacity set with SetNoteCapacity.
+func (p *Poll) TryTrigger(note interface{}) error {
+	return p.trigger(note, true)
+}
+
+// SetNoteCapacity sets the number of pending notes at which TryTrigger
+// fails. Zero means no limit. Trigger is never limited.
+func (p *Poll) SetNoteCapacity(n int) {
+	p.notes.SetCapacity(n)
+}
+
+// Pending returns the number of notes that are waiting to be passed to
+// Wait.
+func (p *Poll) Pending() int {
+	return p.notes.Len()
+}
+
+// DrainNotes passes the notes that are still queued to iter, such as the
+// ones that were added after the note that stopped Wait. Once the poll is
+// closed no notes can be added, so the queue is drained for good.
+func (p *Poll) DrainNotes(iter func(note interface{})) {
+	p.notes.ForEach(func(note interface{}) error {
+		iter(note)
+		return nil
+	})
+}
+
+func (p *Poll) trigger(note interface{}, try bool) error {
+	// the descriptors may be reused once the poll is closed.
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return syscall.EBADF
+	}
+	var one, ok bool
+	if !try {
+		one = p.notes.Add(note)
+	} else if ok, one = p.notes.TryAdd(note); !ok {
+		return ErrQueueFull
+	}
+	if !one {
+		// the earlier notes wrote to the eventfd, and Wait takes all of
+		// the notes once it wakes up.
+		return nil
+	}
 	_, err := syscall.Write(p.wfd, []byte{0, 0, 0, 0, 0, 0, 0, 1})
 	return err
 }
 
+// SetBusyPoll makes Wait poll without blocking for the window after each
+// wake up that had events, as long as active returns true. It trades CPU
+// for latency. Wait blocks as usual when active returns false. It must be
+// called before Wait.
+func (p *Poll) SetBusyPoll(window time.Duration, active func() bool) {
+	p.busy = busyPoll{window: window, active: active}
+}
+
+// SetPriority makes Wait pass the descriptors that are ready at the same
+// time to iter by the priority that fn returns for them, highest first. It
+// must be called before Wait or from the iter function passed to Wait.
+func (p *Poll) SetPriority(fn func(fd int) int) {
+	p.prio.fn = fn
+}
+
+// SetWaitStats makes Wait record its timing in s, along with the system
+// calls of the poll.
+func (p *Poll) SetWaitStats(s *WaitStats) {
+	p.stats = s
+	if p.ring != nil {
+		p.ring.stats = s
+	}
+}
+
+// Cycle returns the number of times Wait has woken up. It must only be
+// called from the iter function passed to Wait.
+func (p *Poll) Cycle() uint64 {
+	return p.cycle
+}
+
+// Failed reports whether the poll reported an error for the descriptor
+// that's being passed to iter, such as a connection reset. The error is read
+// with SO_ERROR. It must only be called from the iter function passed to
+// Wait.
+func (p *Poll) Failed() bool {
+	return p.failed
+}
+
 // Wait ...
 func (p *Poll) Wait(iter func(fd int, note interface{}) error) error {
+	if p.ring != nil {
+		return p.waitRing(iter)
+	}
 	events := make([]syscall.EpollEvent, 64)
+	var buf [8]byte
 	for {
-		n, err := syscall.EpollWait(p.fd, events, -1)
+		timeout, spin := -1, p.busy.spin()
+		if spin || p.aheadReady() {
+			timeout = 0
+		}
+		t0 := p.stats.now()
+		p.stats.call()
+		n, err := syscall.EpollWait(p.fd, events, timeout)
 		if err != nil && err != syscall.EINTR {
 			return err
 		}
+		if spin && n <= 0 {
+			continue
+		}
+		p.busy.woke(n > 0)
+		t1 := p.stats.now()
+		p.cycle++
+		for i := 0; i < n; i++ {
+			if int(events[i].Fd) == p.wfd {
+				// reset the counter before taking the notes, so that
+				// the notes that are added later write to it again.
+				syscall.Read(p.wfd, buf[:])
+			}
+		}
+		p.failed = false
 		if err := p.notes.ForEach(func(note interface{}) error {
 			return iter(0, note)
 		}); err != nil {
 			return err
 		}
+		p.prio.order(n, func(i int) int { return int(events[i].Fd) }, func(i, j int) {
+			events[i], events[j] = events[j], events[i]
+		})
 		for i := 0; i < n; i++ {
 			if fd := int(events[i].Fd); fd != p.wfd {
+				p.failed = events[i].Events&syscall.EPOLLERR != 0
+				p.passed(fd)
 				if err := iter(fd, nil); err != nil {
 					return err
 				}
-			} else {
-
 			}
 		}
+		if err := p.passAhead(iter); err != nil {
+			return err
+		}
+		p.stats.record(t0, t1)
 	}
 }
 
 // AddReadWrite ...
 func (p *Poll) AddReadWrite(fd int) {
+	p.pauseAhead(fd, false)
+	if p.ring != nil {
+		if err := p.ring.add(fd, pollIn|pollOut); err != nil {
+			panic(err)
+		}
+		return
+	}
+	p.stats.call()
 	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
 			Events: syscall.EPOLLIN | syscall.EPOLLOUT,
@@ -86,6 +239,14 @@ func (p *Poll) AddReadWrite(fd int) {
 
 // AddRead ...
 func (p *Poll) AddRead(fd int) {
+	p.pauseAhead(fd, false)
+	if p.ring != nil {
+		if err := p.ring.add(fd, pollIn); err != nil {
+			panic(err)
+		}
+		return
+	}
+	p.stats.call()
 	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
 			Events: syscall.EPOLLIN,
@@ -97,6 +258,14 @@ func (p *Poll) AddRead(fd int) {
 
 // ModRead ...
 func (p *Poll) ModRead(fd int) {
+	p.pauseAhead(fd, false)
+	if p.ring != nil {
+		if err := p.ring.mod(fd, pollIn); err != nil {
+			panic(err)
+		}
+		return
+	}
+	p.stats.call()
 	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
 			Events: syscall.EPOLLIN,
@@ -108,6 +277,14 @@ func (p *Poll) ModRead(fd int) {
 
 // ModReadWrite ...
 func (p *Poll) ModReadWrite(fd int) {
+	p.pauseAhead(fd, false)
+	if p.ring != nil {
+		if err := p.ring.mod(fd, pollIn|pollOut); err != nil {
+			panic(err)
+		}
+		return
+	}
+	p.stats.call()
 	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
 			Events: syscall.EPOLLIN | syscall.EPOLLOUT,
@@ -117,8 +294,53 @@ func (p *Poll) ModReadWrite(fd int) {
 	}
 }
 
-// ModDetach ...
-func (p *Poll) ModDetach(fd int) {
+// ModWrite polls the descriptor for writes only, which pauses its reads.
+func (p *Poll) ModWrite(fd int) {
+	p.pauseAhead(fd, true)
+	if p.ring != nil {
+		if err := p.ring.mod(fd, pollOut); err != nil {
+			panic(err)
+		}
+		return
+	}
+	p.stats.call()
+	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
+		&syscall.EpollEvent{Fd: int32(fd),
+			Events: syscall.EPOLLOUT,
+		},
+	); err != nil {
+		panic(err)
+	}
+}
+
+// ModNone keeps the descriptor registered without polling it for reads or
+// writes. Errors and hang ups are still reported.
+func (p *Poll) ModNone(fd int) {
+	p.pauseAhead(fd, true)
+	if p.ring != nil {
+		if err := p.ring.mod(fd, 0); err != nil {
+			panic(err)
+		}
+		return
+	}
+	p.stats.call()
+	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd,
+		&syscall.EpollEvent{Fd: int32(fd)},
+	); err != nil {
+		panic(err)
+	}
+}
+
+// ModDetach stops polling the descriptor. It returns the input that the
+// poll holds for it, which wasn't read yet.
+func (p *Poll) ModDetach(fd int) []byte {
+	if p.ring != nil {
+		if err := p.ring.del(fd, true); err != nil {
+			panic(err)
+		}
+		return p.dropAhead(fd)
+	}
+	p.stats.call()
 	if err := syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd,
 		&syscall.EpollEvent{Fd: int32(fd),
 			Events: syscall.EPOLLIN | syscall.EPOLLOUT,
@@ -126,4 +348,59 @@ func (p *Poll) ModDetach(fd int) {
 	); err != nil {
 		panic(err)
 	}
+	return p.dropAhead(fd)
+}
+
+// Forget must be called before closing a file descriptor that's registered
+// with the poll. Epoll drops closed descriptors on its own, but io_uring
+// keeps polling them.
+func (p *Poll) Forget(fd int) {
+	p.dropAhead(fd)
+	if p.ring != nil {
+		if err := p.ring.del(fd, false); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Read reads from a registered descriptor, starting with the input that the
+// poll holds for it. With io_uring the descriptor is received into the
+// buffers of the ring from then on, along with the wait, and it's only
+// read with a system call when the buffers run out.
+func (p *Poll) Read(fd int, b []byte) (int, error) {
+	if n, err, ok := p.readAhead(fd, b); ok {
+		if p.ring != nil {
+			if err := p.ring.consumed(fd); err != nil {
+				panic(err)
+			}
+		}
+		return n, err
+	}
+	if p.ring != nil {
+		return p.ring.read(fd, b)
+	}
+	p.stats.call()
+	return syscall.Read(fd, b)
+}
+
+// Write writes to a registered descriptor without blocking. With io_uring
+// it's submitted to the ring, along with the changes to the interest set
+// that are pending.
+func (p *Poll) Write(fd int, b []byte) (int, error) {
+	if p.ring != nil {
+		return p.ring.write(fd, b)
+	}
+	p.stats.call()
+	return syscall.Write(fd, b)
+}
+
+// Accept accepts a connection on a listener without blocking. With
+// io_uring it's submitted to the ring, on kernels that can fail an accept
+// that would block (Linux 6.10).
+func (p *Poll) Accept(fd int) (int, syscall.Sockaddr, error) {
+	if p.ring != nil {
+		return p.ring.accept(fd)
+	}
+	p.stats.call()
+	return syscall.Accept(fd)
 }
@@ -5,10 +5,14 @@
 package internal
 
 import (
+	"errors"
 	"runtime"
 	"sync/atomic"
 )
 
+// ErrQueueFull is returned by TryTrigger when the notes queue is full.
+var ErrQueueFull = errors.New("note queue full")
+
 // this is a good candiate for a lock-free structure.
 
 type spinlock struct{ lock uintptr }
@@ -25,8 +29,11 @@ func (l *spinlock) Unlock() {
 type noteQueue struct {
 	mu    spinlock
 	notes []interface{}
+	max   int // capacity for TryAdd, zero is unbounded
 }
 
+// Add adds the note. The one result reports whether it's the only note in
+// the queue, meaning that the queue was drained since the last wake.
 func (q *noteQueue) Add(note interface{}) (one bool) {
 	q.mu.Lock()
 	q.notes = append(q.notes, note)
@@ -35,6 +42,37 @@ func (q *noteQueue) Add(note interface{}) (one bool) {
 	return n == 1
 }
 
+// TryAdd adds the note unless the queue is at its capacity. The one result
+// is like the one of Add.
+func (q *noteQueue) TryAdd(note interface{}) (ok, one bool) {
+	q.mu.Lock()
+	if q.max > 0 && len(q.notes) >= q.max {
+		q.mu.Unlock()
+		return false, false
+	}
+	q.notes = append(q.notes, note)
+	n := len(q.notes)
+	q.mu.Unlock()
+	return true, n == 1
+}
+
+func (q *noteQueue) SetCapacity(n int) {
+	q.mu.Lock()
+	q.max = n
+	q.mu.Unlock()
+}
+
+// Len returns the number of pending notes.
+func (q *noteQueue) Len() int {
+	q.mu.Lock()
+	n := len(q.notes)
+	q.mu.Unlock()
+	return n
+}
+
+// ForEach takes the pending notes and passes them to iter. It stops at the
+// first error, and the notes that follow stay in the queue ahead of the ones
+// added since.
 func (q *noteQueue) ForEach(iter func(note interface{}) error) error {
 	q.mu.Lock()
 	if len(q.notes) == 0 {
@@ -44,8 +82,11 @@ func (q *noteQueue) ForEach(iter func(note interface{}) error) error {
 	notes := q.notes
 	q.notes = nil
 	q.mu.Unlock()
-	for _, note := range notes {
+	for i, note := range notes {
 		if err := iter(note); err != nil {
+			q.mu.Lock()
+			q.notes = append(notes[i+1:len(notes):len(notes)], q.notes...)
+			q.mu.Unlock()
 			return err
 		}
 	}
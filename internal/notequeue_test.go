@@ -0,0 +1,41 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestNoteQueueStop(t *testing.T) {
+	errStop := errors.New("stop")
+	var q noteQueue
+	for _, note := range []interface{}{1, errStop, 2, 3} {
+		q.Add(note)
+	}
+	var got []interface{}
+	iter := func(note interface{}) error {
+		if err, ok := note.(error); ok {
+			return err
+		}
+		got = append(got, note)
+		return nil
+	}
+	if err := q.ForEach(iter); err != errStop {
+		t.Fatalf("expected %v, got %v", errStop, err)
+	}
+	// the notes after the error come before the ones added later
+	q.Add(4)
+	if n := q.Len(); n != 3 {
+		t.Fatalf("expected 3 pending notes, got %d", n)
+	}
+	if err := q.ForEach(iter); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[1 2 3 4]" {
+		t.Fatalf("expected [1 2 3 4], got %v", got)
+	}
+}
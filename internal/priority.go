@@ -0,0 +1,32 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+// priority orders the descriptors that are ready in a wake up of a Poll by
+// their priority, so that the higher ones are passed to iter first.
+type priority struct {
+	fn   func(fd int) int // nil when the order of the kernel is kept
+	keys []int
+}
+
+// order sorts the n ready events, highest priority first, where fd returns
+// the descriptor of the event at i and swap swaps two events. Events of the
+// same priority keep the order of the kernel. It's an insertion sort, since
+// a wake up has few events and they're usually of the same priority.
+func (pr *priority) order(n int, fd func(i int) int, swap func(i, j int)) {
+	if pr.fn == nil || n < 2 {
+		return
+	}
+	pr.keys = pr.keys[:0]
+	for i := 0; i < n; i++ {
+		pr.keys = append(pr.keys, pr.fn(fd(i)))
+	}
+	for i := 1; i < n; i++ {
+		for j := i; j > 0 && pr.keys[j-1] < pr.keys[j]; j-- {
+			pr.keys[j-1], pr.keys[j] = pr.keys[j], pr.keys[j-1]
+			swap(j-1, j)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly linux
+
+package internal
+
+// ahead is input of a descriptor that the poll holds for its owner, such as
+// the input that io_uring received before the owner read it, or the input
+// that came along with a descriptor from another poll. Read returns it
+// before reading the descriptor, and Wait reports the descriptor as
+// readable while there's some, as long as it's polled for reads.
+type ahead struct {
+	in     []byte
+	err    error  // the receive failed, returned once the input is read
+	eof    bool   // the peer closed, reported once the input is read
+	paused bool   // the descriptor isn't polled for reads
+	cycle  uint64 // last cycle that passed the descriptor to iter
+}
+
+// ready reports whether the input should be passed to iter.
+func (a *ahead) ready() bool {
+	return !a.paused && (len(a.in) > 0 || a.err != nil || a.eof)
+}
+
+// Unread makes the poll return in from the reads of the descriptor before
+// its own input, such as the input that the poll of another loop read
+// ahead of a connection that moved. The descriptor must be registered.
+func (p *Poll) Unread(fd int, in []byte) {
+	if len(in) == 0 {
+		return
+	}
+	if p.ahead == nil {
+		p.ahead = make(map[int]*ahead)
+	}
+	a := p.ahead[fd]
+	if a == nil {
+		a = &ahead{}
+		p.ahead[fd] = a
+	}
+	a.in = append(append([]byte{}, in...), a.in...)
+}
+
+// Buffered returns the input that the poll holds for the descriptor, which
+// its reads return before the input of the descriptor. It's valid until
+// the next read.
+func (p *Poll) Buffered(fd int) []byte {
+	if a := p.ahead[fd]; a != nil {
+		return a.in
+	}
+	return nil
+}
+
+// readAhead reads the input that the poll holds for the descriptor. It
+// reports false when there's none, and the descriptor is read instead.
+func (p *Poll) readAhead(fd int, b []byte) (int, error, bool) {
+	a := p.ahead[fd]
+	if a == nil {
+		return 0, nil, false
+	}
+	if len(a.in) > 0 {
+		n := copy(b, a.in)
+		a.in = a.in[n:]
+		if len(a.in) == 0 && a.err == nil && !a.eof {
+			delete(p.ahead, fd)
+		}
+		return n, nil, true
+	}
+	if err := a.err; err != nil {
+		// the descriptor is read again after the error, like a socket
+		delete(p.ahead, fd)
+		return 0, err, true
+	}
+	// the end of the input stays, like it does on a socket
+	return 0, nil, true
+}
+
+// pauseAhead records whether the descriptor is polled for reads, which
+// holds back the report of its input.
+func (p *Poll) pauseAhead(fd int, paused bool) {
+	if a := p.ahead[fd]; a != nil {
+		a.paused = paused
+	}
+}
+
+// dropAhead forgets the input of the descriptor and returns it.
+func (p *Poll) dropAhead(fd int) []byte {
+	a := p.ahead[fd]
+	if a == nil {
+		return nil
+	}
+	delete(p.ahead, fd)
+	return a.in
+}
+
+// aheadReady reports whether there's input to pass to iter, in which case
+// the wait doesn't block.
+func (p *Poll) aheadReady() bool {
+	for _, a := range p.ahead {
+		if a.ready() {
+			return true
+		}
+	}
+	return false
+}
+
+// passAhead passes the descriptors with input to iter, except for the ones
+// that the cycle passed already.
+func (p *Poll) passAhead(iter func(fd int, note interface{}) error) error {
+	if len(p.ahead) == 0 {
+		return nil
+	}
+	var fds []int
+	for fd, a := range p.ahead {
+		if a.ready() && a.cycle != p.cycle {
+			fds = append(fds, fd)
+		}
+	}
+	p.failed = false
+	for _, fd := range fds {
+		if a := p.ahead[fd]; a != nil && a.cycle != p.cycle {
+			a.cycle = p.cycle
+			if err := iter(fd, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// passed marks the descriptor as passed to iter in this cycle.
+func (p *Poll) passed(fd int) {
+	if a := p.ahead[fd]; a != nil {
+		a.cycle = p.cycle
+	}
+}
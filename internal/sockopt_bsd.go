@@ -0,0 +1,151 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package internal
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	fionread      = 0x4004667f
+	solLocal      = 0 // SOL_LOCAL
+	localPeerCred = 1 // LOCAL_PEERCRED
+)
+
+// SetTimestamping is not supported on this platform.
+func SetTimestamping(fd int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// ReadTimestamp is not supported on this platform.
+func ReadTimestamp(fd int, p, oob []byte) (n int, ts time.Time, err error) {
+	return 0, ts, syscall.ENOPROTOOPT
+}
+
+// SetMark is not supported on this platform.
+func SetMark(fd, mark int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// Readable returns the number of bytes that can be read from the socket
+// without blocking (FIONREAD).
+func Readable(fd int) (int, error) {
+	var n int32
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		fionread, uintptr(unsafe.Pointer(&n)))
+	if e != 0 {
+		return 0, e
+	}
+	return int(n), nil
+}
+
+// xucred is the struct xucred that LOCAL_PEERCRED returns.
+type xucred struct {
+	version uint32
+	uid     uint32
+	ngroups int16
+	groups  [16]uint32
+}
+
+// SetBacklog changes the size of the accept queue of a listening socket by
+// calling listen again.
+func SetBacklog(fd, backlog int) error {
+	return syscall.Listen(fd, backlog)
+}
+
+// ListenQueue is not supported on this platform.
+func ListenQueue(fd int) (queued, backlog int, err error) {
+	return 0, 0, syscall.ENOPROTOOPT
+}
+
+// ListenOverflows is not supported on this platform.
+func ListenOverflows() (overflows, drops int64, err error) {
+	return 0, 0, syscall.ENOPROTOOPT
+}
+
+// FDLimit returns the limit of open file descriptors of the process
+// (RLIMIT_NOFILE).
+func FDLimit() (int, error) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, err
+	}
+	return int(rl.Cur), nil
+}
+
+// OpenFDs returns the number of open file descriptors of the process, which
+// are listed in /dev/fd.
+func OpenFDs() (int, error) {
+	f, err := os.Open("/dev/fd")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return 0, err
+	}
+	// the directory itself is open while it's read
+	return len(names) - 1, nil
+}
+
+// PeerCred returns the credentials of the peer of a unix socket
+// (LOCAL_PEERCRED). The pid isn't reported, so it's -1.
+func PeerCred(fd int) (pid, uid, gid int, err error) {
+	var cred xucred
+	n := uint32(unsafe.Sizeof(cred))
+	_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), solLocal,
+		localPeerCred, uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&n)), 0)
+	if e != 0 {
+		return 0, 0, 0, e
+	}
+	return -1, int(cred.uid), int(cred.groups[0]), nil
+}
+
+// OriginalDst is not supported on this platform.
+func OriginalDst(fd int) (net.Addr, error) {
+	return nil, syscall.ENOPROTOOPT
+}
+
+// SetUserTimeout is not supported on this platform.
+func SetUserTimeout(fd, msecs int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// SetUDPGRO is not supported on this platform.
+func SetUDPGRO(fd int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// ReadGRO is not supported on this platform.
+func ReadGRO(fd int, p, oob []byte) (n, seg int, from syscall.Sockaddr, err error) {
+	return 0, 0, nil, syscall.ENOPROTOOPT
+}
+
+// WriteGSO is not supported on this platform.
+func WriteGSO(fd int, p []byte, seg int, to syscall.Sockaddr) (n int, err error) {
+	return 0, syscall.ENOPROTOOPT
+}
+
+// SendBuffers is not supported on this platform.
+func SendBuffers(fd int, bufs [][]byte, to syscall.Sockaddr) error {
+	return syscall.ENOPROTOOPT
+}
+
+// AttachReuseportCPU is not supported on this platform.
+func AttachReuseportCPU(fd int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// AttachReuseportEBPF is not supported on this platform.
+func AttachReuseportEBPF(fd, progFD int) error {
+	return syscall.ENOPROTOOPT
+}
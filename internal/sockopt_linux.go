@@ -0,0 +1,384 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	fionread       = 0x541B
+	tcpUserTimeout = 0x12
+	solUDP         = 0x11
+	udpGRO         = 0x68
+	udpSegment     = 0x67
+
+	soOriginalDst   = 80 // SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	sizeofSockaddr4 = 16
+	sizeofSockaddr6 = 28
+
+	soAttachReuseportCBPF = 51
+	soAttachReuseportEBPF = 52
+)
+
+// gsoMaxSegs and gsoMaxBytes are the kernel's limits on a segmented send.
+const (
+	gsoMaxSegs  = 64
+	gsoMaxBytes = 0xFFFF - 8 - 40
+)
+
+const (
+	sofTimestampingRxHardware  = 1 << 2
+	sofTimestampingRxSoftware  = 1 << 3
+	sofTimestampingSoftware    = 1 << 4
+	sofTimestampingRawHardware = 1 << 6
+)
+
+// SetTimestamping enables hardware and software receive timestamps for the
+// socket.
+func SetTimestamping(fd int) error {
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING,
+		sofTimestampingRxHardware|sofTimestampingRxSoftware|
+			sofTimestampingSoftware|sofTimestampingRawHardware)
+}
+
+// ReadTimestamp reads from the socket like syscall.Read and also returns the
+// receive timestamp that the kernel attached to the data. The oob buffer is
+// used to receive the control messages. A raw hardware timestamp is
+// preferred over a software one when both are available.
+func ReadTimestamp(fd int, p, oob []byte) (n int, ts time.Time, err error) {
+	n, oobn, _, _, err := syscall.Recvmsg(fd, p, oob, 0)
+	if err != nil || oobn == 0 {
+		return n, ts, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, ts, nil
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.SOL_SOCKET &&
+			m.Header.Type == syscall.SO_TIMESTAMPING {
+			ts = parseTimestamping(m.Data)
+		}
+	}
+	return n, ts, nil
+}
+
+// parseTimestamping decodes a SCM_TIMESTAMPING payload, which is three
+// timespecs: software, deprecated, and raw hardware.
+func parseTimestamping(data []byte) time.Time {
+	var tss [3]syscall.Timespec
+	if len(data) < int(unsafe.Sizeof(tss)) {
+		return time.Time{}
+	}
+	copy((*[unsafe.Sizeof(tss)]byte)(unsafe.Pointer(&tss))[:], data)
+	ts := tss[2]
+	if ts.Sec == 0 && ts.Nsec == 0 {
+		ts = tss[0]
+	}
+	if ts.Sec == 0 && ts.Nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts.Unix())
+}
+
+// SetMark sets the firewall mark (SO_MARK) of the socket.
+func SetMark(fd, mark int) error {
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+}
+
+// Readable returns the number of bytes that can be read from the socket
+// without blocking (FIONREAD).
+func Readable(fd int) (int, error) {
+	var n int32
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		fionread, uintptr(unsafe.Pointer(&n)))
+	if e != 0 {
+		return 0, e
+	}
+	return int(n), nil
+}
+
+// SetBacklog changes the size of the accept queue of a listening socket by
+// calling listen again.
+func SetBacklog(fd, backlog int) error {
+	return syscall.Listen(fd, backlog)
+}
+
+// ListenQueue returns the number of connections that wait in the accept
+// queue of a listening TCP socket, and the size of the queue (TCP_INFO).
+func ListenQueue(fd int) (queued, backlog int, err error) {
+	var info syscall.TCPInfo
+	n := uint32(syscall.SizeofTCPInfo)
+	_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.SOL_TCP,
+		syscall.TCP_INFO, uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&n)), 0)
+	if e != 0 {
+		return 0, 0, e
+	}
+	// a listener reports its queue in the unacked and sacked fields
+	return int(info.Unacked), int(info.Sacked), nil
+}
+
+// ListenOverflows returns the number of connections that the host dropped
+// because an accept queue was full, and the number that were dropped by
+// listeners for any reason (TcpExtListenOverflows and TcpExtListenDrops in
+// /proc/net/netstat).
+func ListenOverflows() (overflows, drops int64, err error) {
+	data, err := ioutil.ReadFile("/proc/net/netstat")
+	if err != nil {
+		return 0, 0, err
+	}
+	// the counters come in pairs of lines, the names and then the values
+	lines := bytes.Split(data, []byte("\n"))
+	for i := 0; i+1 < len(lines); i += 2 {
+		names, values := bytes.Fields(lines[i]), bytes.Fields(lines[i+1])
+		if len(names) == 0 || string(names[0]) != "TcpExt:" || len(names) != len(values) {
+			continue
+		}
+		for j, name := range names {
+			v, _ := strconv.ParseInt(string(values[j]), 10, 64)
+			switch string(name) {
+			case "ListenOverflows":
+				overflows = v
+			case "ListenDrops":
+				drops = v
+			}
+		}
+		return overflows, drops, nil
+	}
+	return 0, 0, syscall.ENOPROTOOPT
+}
+
+// FDLimit returns the limit of open file descriptors of the process
+// (RLIMIT_NOFILE).
+func FDLimit() (int, error) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, err
+	}
+	return int(rl.Cur), nil
+}
+
+// OpenFDs returns the number of open file descriptors of the process, which
+// are listed in /proc/self/fd.
+func OpenFDs() (int, error) {
+	f, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return 0, err
+	}
+	// the directory itself is open while it's read
+	return len(names) - 1, nil
+}
+
+// PeerCred returns the credentials of the peer of a unix socket
+// (SO_PEERCRED).
+func PeerCred(fd int) (pid, uid, gid int, err error) {
+	cred, err := syscall.GetsockoptUcred(fd, syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return int(cred.Pid), int(cred.Uid), int(cred.Gid), nil
+}
+
+// OriginalDst returns the destination that a connection redirected by
+// iptables REDIRECT or TPROXY had before it was redirected
+// (SO_ORIGINAL_DST).
+func OriginalDst(fd int) (net.Addr, error) {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return nil, err
+	}
+	level, size := syscall.SOL_IP, sizeofSockaddr4
+	if sa, ok := sa.(*syscall.SockaddrInet6); ok && !isV4Mapped(sa.Addr[:]) {
+		level, size = syscall.SOL_IPV6, sizeofSockaddr6
+	}
+	var raw [sizeofSockaddr6]byte
+	n := uint32(size)
+	_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), uintptr(level),
+		soOriginalDst, uintptr(unsafe.Pointer(&raw[0])), uintptr(unsafe.Pointer(&n)), 0)
+	if e != 0 {
+		return nil, e
+	}
+	return parseSockaddr(raw[:n])
+}
+
+// isV4Mapped reports whether the IPv6 address is an IPv4-mapped address.
+func isV4Mapped(ip []byte) bool {
+	return net.IP(ip).To4() != nil
+}
+
+// parseSockaddr decodes a raw sockaddr_in or sockaddr_in6.
+func parseSockaddr(b []byte) (*net.TCPAddr, error) {
+	if len(b) < 4 {
+		return nil, syscall.EINVAL
+	}
+	family := *(*uint16)(unsafe.Pointer(&b[0]))
+	port := int(b[2])<<8 | int(b[3])
+	switch {
+	case family == syscall.AF_INET && len(b) >= sizeofSockaddr4:
+		return &net.TCPAddr{IP: net.IP(append([]byte{}, b[4:8]...)), Port: port}, nil
+	case family == syscall.AF_INET6 && len(b) >= sizeofSockaddr6:
+		a := &net.TCPAddr{IP: net.IP(append([]byte{}, b[8:24]...)), Port: port}
+		if id := *(*uint32)(unsafe.Pointer(&b[24])); id != 0 {
+			if ifi, err := net.InterfaceByIndex(int(id)); err == nil {
+				a.Zone = ifi.Name
+			}
+		}
+		return a, nil
+	}
+	return nil, syscall.EAFNOSUPPORT
+}
+
+// SetUserTimeout sets the TCP user timeout (TCP_USER_TIMEOUT) of the socket
+// in milliseconds.
+func SetUserTimeout(fd, msecs int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpUserTimeout, msecs)
+}
+
+// SetUDPGRO enables UDP generic receive offload (UDP_GRO) for the socket, so
+// that the kernel may coalesce datagrams of the same size from the same
+// peer into a single read. It needs Linux 5.0 or later.
+func SetUDPGRO(fd int) error {
+	return syscall.SetsockoptInt(fd, solUDP, udpGRO, 1)
+}
+
+// ReadGRO reads datagrams from a socket with UDP_GRO enabled. When the
+// kernel coalesced several datagrams into p, seg is the size of each of
+// them except the last, which may be shorter. Otherwise seg is zero and p
+// holds a single datagram.
+func ReadGRO(fd int, p, oob []byte) (n, seg int, from syscall.Sockaddr, err error) {
+	n, oobn, _, from, err := syscall.Recvmsg(fd, p, oob, 0)
+	if err != nil || oobn == 0 {
+		return n, 0, from, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, 0, from, nil
+	}
+	for _, m := range msgs {
+		if m.Header.Level == solUDP && m.Header.Type == udpGRO &&
+			len(m.Data) >= 4 {
+			seg = int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+	return n, seg, from, nil
+}
+
+// WriteGSO sends p to the peer as datagrams of seg bytes, except for the last
+// one which may be shorter, and lets the kernel do the segmentation
+// (UDP_SEGMENT). It needs Linux 4.18 or later. Large buffers take more than
+// one send, and n is the number of bytes that were sent when one of them
+// fails.
+func WriteGSO(fd int, p []byte, seg int, to syscall.Sockaddr) (n int, err error) {
+	oob := make([]byte, syscall.CmsgSpace(2))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = solUDP
+	h.Type = udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[syscall.CmsgLen(0)])) = uint16(seg)
+	max := gsoMaxBytes / seg * seg
+	if max > gsoMaxSegs*seg {
+		max = gsoMaxSegs * seg
+	}
+	if max == 0 {
+		return 0, syscall.EINVAL
+	}
+	for n < len(p) {
+		b := p[n:]
+		if len(b) > max {
+			b = b[:max]
+		}
+		if err := syscall.Sendmsg(fd, b, oob, to, 0); err != nil {
+			return n, err
+		}
+		n += len(b)
+	}
+	return n, nil
+}
+
+// SendBuffers sends the buffers to the peer as a single datagram with
+// sendmsg, with an iovec for each buffer, so they aren't copied together
+// first.
+func SendBuffers(fd int, bufs [][]byte, to syscall.Sockaddr) error {
+	var rsa syscall.RawSockaddrAny
+	var salen uint32
+	switch sa := to.(type) {
+	case *syscall.SockaddrInet4:
+		raw := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&rsa))
+		raw.Family = syscall.AF_INET
+		port := (*[2]byte)(unsafe.Pointer(&raw.Port))
+		port[0], port[1] = byte(sa.Port>>8), byte(sa.Port)
+		raw.Addr = sa.Addr
+		salen = syscall.SizeofSockaddrInet4
+	case *syscall.SockaddrInet6:
+		raw := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&rsa))
+		raw.Family = syscall.AF_INET6
+		port := (*[2]byte)(unsafe.Pointer(&raw.Port))
+		port[0], port[1] = byte(sa.Port>>8), byte(sa.Port)
+		raw.Scope_id = sa.ZoneId
+		raw.Addr = sa.Addr
+		salen = syscall.SizeofSockaddrInet6
+	default:
+		return syscall.EAFNOSUPPORT
+	}
+	iov := make([]syscall.Iovec, 0, len(bufs))
+	for _, b := range bufs {
+		if len(b) > 0 {
+			v := syscall.Iovec{Base: &b[0]}
+			v.SetLen(len(b))
+			iov = append(iov, v)
+		}
+	}
+	msg := syscall.Msghdr{Name: (*byte)(unsafe.Pointer(&rsa)), Namelen: salen}
+	if len(iov) > 0 {
+		msg.Iov = &iov[0]
+		// msg_iovlen is a size_t, whose type differs between the arches
+		*(*uintptr)(unsafe.Pointer(&msg.Iovlen)) = uintptr(len(iov))
+	}
+	_, _, e := syscall.Syscall(syscall.SYS_SENDMSG, uintptr(fd), uintptr(unsafe.Pointer(&msg)), 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// AttachReuseportCPU attaches a classic BPF program to the reuseport group
+// of the socket that picks the socket at the index of the CPU that handles
+// the incoming packet (SO_ATTACH_REUSEPORT_CBPF). The index is the order in
+// which the sockets joined the group, and packets on CPUs without a socket
+// fall back to the kernel's hash.
+func AttachReuseportCPU(fd int) error {
+	const skfAdCPU = -0x1000 + 36 // SKF_AD_OFF + SKF_AD_CPU
+	prog := []syscall.SockFilter{
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: uint32(skfAdCPU & 0xFFFFFFFF)},
+		{Code: syscall.BPF_RET | syscall.BPF_A},
+	}
+	fprog := syscall.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	_, _, e0 := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd),
+		syscall.SOL_SOCKET, soAttachReuseportCBPF,
+		uintptr(unsafe.Pointer(&fprog)), unsafe.Sizeof(fprog), 0)
+	if e0 != 0 {
+		return e0
+	}
+	return nil
+}
+
+// AttachReuseportEBPF attaches a loaded eBPF program to the reuseport group
+// of the socket (SO_ATTACH_REUSEPORT_EBPF).
+func AttachReuseportEBPF(fd, progFD int) error {
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soAttachReuseportEBPF, progFD)
+}
@@ -0,0 +1,42 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestParseSockaddr(t *testing.T) {
+	var b4 [sizeofSockaddr4]byte
+	*(*uint16)(unsafe.Pointer(&b4[0])) = syscall.AF_INET
+	copy(b4[2:], []byte{0x1f, 0x90, 10, 0, 0, 7})
+	a, err := parseSockaddr(b4[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.IP.Equal(net.IPv4(10, 0, 0, 7)) || a.Port != 8080 {
+		t.Fatalf("expected 10.0.0.7:8080, got %v", a)
+	}
+
+	var b6 [sizeofSockaddr6]byte
+	*(*uint16)(unsafe.Pointer(&b6[0])) = syscall.AF_INET6
+	copy(b6[2:], []byte{0x01, 0xbb})
+	ip := net.ParseIP("2001:db8::1")
+	copy(b6[8:], ip)
+	a, err = parseSockaddr(b6[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.IP.Equal(ip) || a.Port != 443 || a.Zone != "" {
+		t.Fatalf("expected [2001:db8::1]:443, got %v", a)
+	}
+
+	if _, err := parseSockaddr(b6[:sizeofSockaddr4]); err != syscall.EAFNOSUPPORT {
+		t.Fatalf("expected EAFNOSUPPORT for a short sockaddr_in6, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build !darwin,!netbsd,!freebsd,!openbsd,!dragonfly,!linux
+
+package internal
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// SetTimestamping is not supported on this platform.
+func SetTimestamping(fd int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// ReadTimestamp is not supported on this platform.
+func ReadTimestamp(fd int, p, oob []byte) (n int, ts time.Time, err error) {
+	return 0, ts, syscall.ENOPROTOOPT
+}
+
+// SetMark is not supported on this platform.
+func SetMark(fd, mark int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// Readable is not supported on this platform.
+func Readable(fd int) (int, error) {
+	return 0, syscall.ENOPROTOOPT
+}
+
+// SetBacklog is not supported on this platform.
+func SetBacklog(fd, backlog int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// ListenQueue is not supported on this platform.
+func ListenQueue(fd int) (queued, backlog int, err error) {
+	return 0, 0, syscall.ENOPROTOOPT
+}
+
+// ListenOverflows is not supported on this platform.
+func ListenOverflows() (overflows, drops int64, err error) {
+	return 0, 0, syscall.ENOPROTOOPT
+}
+
+// FDLimit is not supported on this platform.
+func FDLimit() (int, error) {
+	return 0, syscall.ENOPROTOOPT
+}
+
+// OpenFDs is not supported on this platform.
+func OpenFDs() (int, error) {
+	return 0, syscall.ENOPROTOOPT
+}
+
+// PeerCred is not supported on this platform.
+func PeerCred(fd int) (pid, uid, gid int, err error) {
+	return 0, 0, 0, syscall.ENOPROTOOPT
+}
+
+// OriginalDst is not supported on this platform.
+func OriginalDst(fd int) (net.Addr, error) {
+	return nil, syscall.ENOPROTOOPT
+}
+
+// SetUserTimeout is not supported on this platform.
+func SetUserTimeout(fd, msecs int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// SetUDPGRO is not supported on this platform.
+func SetUDPGRO(fd int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// ReadGRO is not supported on this platform.
+func ReadGRO(fd int, p, oob []byte) (n, seg int, from syscall.Sockaddr, err error) {
+	return 0, 0, nil, syscall.ENOPROTOOPT
+}
+
+// WriteGSO is not supported on this platform.
+func WriteGSO(fd int, p []byte, seg int, to syscall.Sockaddr) (n int, err error) {
+	return 0, syscall.ENOPROTOOPT
+}
+
+// SendBuffers is not supported on this platform.
+func SendBuffers(fd int, bufs [][]byte, to syscall.Sockaddr) error {
+	return syscall.ENOPROTOOPT
+}
+
+// AttachReuseportCPU is not supported on this platform.
+func AttachReuseportCPU(fd int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// AttachReuseportEBPF is not supported on this platform.
+func AttachReuseportEBPF(fd, progFD int) error {
+	return syscall.ENOPROTOOPT
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import "time"
+
+// TimingWheel is a hashed timing wheel. Timers are hashed into slots by the
+// tick they expire on and fire when the wheel advances past them, so adding
+// and stopping a timer is O(1). It's owned by a single loop and isn't safe
+// for concurrent use.
+type TimingWheel struct {
+	tick  time.Duration // duration of a slot
+	slots [][]*Timer    // timers by expiration slot
+	pos   int           // current slot
+	last  time.Time     // time of the current slot
+	count int           // number of active timers
+	now   func() time.Time
+}
+
+// Timer is a pending function call on a TimingWheel.
+type Timer struct {
+	w      *TimingWheel
+	fn     func()
+	rounds int  // full turns of the wheel left before firing
+	active bool // not yet fired or stopped
+}
+
+// NewTimingWheel returns a wheel with the provided resolution and number of
+// slots, which tells the time with now.
+func NewTimingWheel(tick time.Duration, size int, now func() time.Time) *TimingWheel {
+	return &TimingWheel{tick: tick, slots: make([][]*Timer, size), now: now}
+}
+
+// Tick returns the resolution of the wheel.
+func (w *TimingWheel) Tick() time.Duration { return w.tick }
+
+// Len returns the number of active timers.
+func (w *TimingWheel) Len() int { return w.count }
+
+// AfterFunc schedules fn to be called by Advance once d has elapsed. Timers
+// never fire early but may fire up to one tick late.
+func (w *TimingWheel) AfterFunc(d time.Duration, fn func()) *Timer {
+	now := w.now()
+	if w.count == 0 {
+		w.last = now
+	}
+	ticks := int((now.Sub(w.last) + d + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	t := &Timer{w: w, fn: fn, rounds: (ticks - 1) / len(w.slots), active: true}
+	slot := (w.pos + ticks) % len(w.slots)
+	w.slots[slot] = append(w.slots[slot], t)
+	w.count++
+	return t
+}
+
+// Stop prevents the timer from firing. It returns false if the timer has
+// already fired or been stopped.
+func (t *Timer) Stop() bool {
+	if t == nil || !t.active {
+		return false
+	}
+	t.active = false
+	t.w.count--
+	return true
+}
+
+// Advance moves the wheel up to now, calling the functions of the expired
+// timers.
+func (w *TimingWheel) Advance(now time.Time) {
+	for w.count > 0 && now.Sub(w.last) >= w.tick {
+		w.last = w.last.Add(w.tick)
+		w.pos = (w.pos + 1) % len(w.slots)
+		timers := w.slots[w.pos]
+		w.slots[w.pos] = nil
+		for _, t := range timers {
+			switch {
+			case !t.active:
+			case t.rounds > 0:
+				t.rounds--
+				w.slots[w.pos] = append(w.slots[w.pos], t)
+			default:
+				t.active = false
+				w.count--
+				t.fn()
+			}
+		}
+	}
+	if w.count == 0 {
+		// drop the stopped timers
+		for i := range w.slots {
+			w.slots[i] = nil
+		}
+	}
+}
@@ -0,0 +1,832 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysIOURingSetup = 425
+	sysIOURingEnter = 426
+
+	iouringOffSQRing = 0
+	iouringOffCQRing = 0x8000000
+	iouringOffSQEs   = 0x10000000
+
+	iouringSetupCoopTaskrun = 1 << 8
+
+	iouringOpNop            = 0
+	iouringOpPollAdd        = 6
+	iouringOpPollRemove     = 7
+	iouringOpAccept         = 13
+	iouringOpAsyncCancel    = 14
+	iouringOpSend           = 26
+	iouringOpRecv           = 27
+	iouringOpProvideBuffers = 31
+
+	iouringEnterGetEvents  = 1
+	iouringSQEBufferSelect = 1 << 5
+	iouringCQEFBuffer      = 1
+	iouringCQEBufferShift  = 16
+	iouringAcceptDontWait  = 1 << 1
+
+	pollIn  = 0x1
+	pollOut = 0x4
+	pollErr = 0x8
+
+	uringEntries  = 1024
+	uringBufs     = 128      // receive buffers of a ring
+	uringBufSize  = 16 << 10 // size of a receive buffer
+	uringBufGroup = 1
+
+	uringRemove  = ^uint64(0) // user data of poll remove and cancel requests
+	uringProvide = ^uint64(1) // user data of the requests that return buffers
+	uringSync    = ^uint64(2) // user data of the requests that are waited for
+)
+
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        struct {
+		head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+		resv2                                                           uint64
+	}
+	cqOff struct {
+		head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+		resv2                                                           uint64
+	}
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opflags     uint32
+	userData    uint64
+	bufGroup    uint16
+	personality uint16
+	spliceFdIn  int32
+	pad         [2]uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uringFd is a file descriptor that's registered with the ring.
+type uringFd struct {
+	events  uint32 // poll mask
+	gen     uint32 // generation of the armed poll request
+	armed   bool   // a poll request is in flight
+	mask    uint32 // mask of the armed poll request
+	recv    bool   // the reads go through the ring
+	rgen    uint32 // generation of the last receive
+	rarmed  bool   // a receive is in flight
+	rcancel bool   // a receive that was canceled is in flight
+	nobufs  bool   // the buffers ran out, so it's polled for reads instead
+	bid     int    // buffer that holds the input of the receive, or -1
+}
+
+// uringEvent is a descriptor that's passed to iter.
+type uringEvent struct {
+	fd     int
+	failed bool
+}
+
+// uring runs the loops on io_uring. Readiness is polled with one-shot poll
+// requests, which are re-armed every time they complete to behave like
+// level triggered polling. A descriptor that's read through the poll is
+// received into a group of buffers that the ring provides instead, with
+// a receive request that's armed while it's polled for reads, so the
+// input arrives along with the wait. The input is held for the owner
+// until it's read, and copied out of the buffer at the end of the cycle.
+// The writes and accepts are submitted as requests that fail instead of
+// blocking, and are waited for. All of the requests that are queued are
+// handed to the kernel with the next io_uring_enter call.
+type uring struct {
+	p         *Poll
+	fd        int
+	sqRing    []byte
+	cqRing    []byte
+	sqesMem   []byte
+	sqHead    *uint32
+	sqTail    *uint32
+	sqMask    uint32
+	sqEntries uint32
+	sqArray   []uint32
+	sqes      []uringSQE
+	cqHead    *uint32
+	cqTail    *uint32
+	cqMask    uint32
+	cqes      []uringCQE
+	pending   uint32 // queued submissions
+	gen       uint32 // last request generation
+	fds       map[int]*uringFd
+	ready     []uringCQE
+	stash     []uringCQE // completions that were reaped by a request
+	events    []uringEvent
+	held      []int  // descriptors whose input is in a buffer
+	bufs      []byte // receive buffers, nil when they're not supported
+	noAccept  bool   // accepts can't fail instead of blocking
+	noSend    bool   // sends aren't supported
+	sa        syscall.RawSockaddrAny
+	salen     uint32
+	stats     *WaitStats // counts the system calls, nil when disabled
+}
+
+func openURing(entries uint32) (*uring, error) {
+	// the completions don't interrupt the thread, they're handled when it
+	// waits. Kernels before Linux 5.19 don't have it.
+	params := uringParams{flags: iouringSetupCoopTaskrun}
+	r0, _, e0 := syscall.Syscall(sysIOURingSetup, uintptr(entries),
+		uintptr(unsafe.Pointer(&params)), 0)
+	if e0 == syscall.EINVAL {
+		params = uringParams{}
+		r0, _, e0 = syscall.Syscall(sysIOURingSetup, uintptr(entries),
+			uintptr(unsafe.Pointer(&params)), 0)
+	}
+	if e0 != 0 {
+		return nil, e0
+	}
+	r := &uring{fd: int(r0), fds: make(map[int]*uringFd)}
+	var err error
+	r.sqRing, err = syscall.Mmap(r.fd, iouringOffSQRing,
+		int(params.sqOff.array+params.sqEntries*4),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	r.cqRing, err = syscall.Mmap(r.fd, iouringOffCQRing,
+		int(params.cqOff.cqes+params.cqEntries*uint32(unsafe.Sizeof(uringCQE{}))),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	r.sqesMem, err = syscall.Mmap(r.fd, iouringOffSQEs,
+		int(params.sqEntries*uint32(unsafe.Sizeof(uringSQE{}))),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.ringMask]))
+	r.sqEntries = params.sqEntries
+	r.sqArray = (*[1 << 20]uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.array]))[:params.sqEntries:params.sqEntries]
+	r.sqes = (*[1 << 20]uringSQE)(unsafe.Pointer(&r.sqesMem[0]))[:params.sqEntries:params.sqEntries]
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.ringMask]))
+	r.cqes = (*[1 << 20]uringCQE)(unsafe.Pointer(&r.cqRing[params.cqOff.cqes]))[:params.cqEntries:params.cqEntries]
+	return r, nil
+}
+
+// cancel drops the requests in flight. They hold references to the files
+// of the descriptors, which keeps them open after they're closed until the
+// requests complete, and the ring doesn't cancel them until it's torn down
+// in the background. The removals complete by the time a request that's
+// submitted after them is waited for.
+func (r *uring) cancel() error {
+	for fd := range r.fds {
+		if err := r.del(fd, false); err != nil {
+			return err
+		}
+	}
+	_, err := r.do(uringSQE{opcode: iouringOpNop})
+	return err
+}
+
+func (r *uring) close() error {
+	for _, mem := range [][]byte{r.sqRing, r.cqRing, r.sqesMem} {
+		if mem != nil {
+			syscall.Munmap(mem)
+		}
+	}
+	return syscall.Close(r.fd)
+}
+
+// enter submits the queued requests and, when wait is set, blocks until at
+// least one completion is available.
+func (r *uring) enter(wait bool) error {
+	var min, flags uintptr
+	if wait {
+		min, flags = 1, iouringEnterGetEvents
+	}
+	for {
+		r.stats.call()
+		n, _, e := syscall.Syscall6(sysIOURingEnter, uintptr(r.fd),
+			uintptr(r.pending), min, flags, 0, 0)
+		if e == 0 {
+			r.pending -= uint32(n)
+			return nil
+		}
+		if e != syscall.EINTR {
+			return e
+		}
+	}
+}
+
+// push queues a submission. A full queue is flushed to the kernel first,
+// and the submission fails when that doesn't make room for it.
+func (r *uring) push(sqe uringSQE) error {
+	tail := *r.sqTail
+	if tail-atomic.LoadUint32(r.sqHead) == r.sqEntries {
+		if err := r.enter(false); err != nil {
+			return err
+		}
+		if tail-atomic.LoadUint32(r.sqHead) == r.sqEntries {
+			return syscall.EBUSY
+		}
+	}
+	idx := tail & r.sqMask
+	r.sqes[idx] = sqe
+	r.sqArray[idx] = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.pending++
+	return nil
+}
+
+// reap appends the available completions to cqes and releases them to the
+// kernel.
+func (r *uring) reap(cqes []uringCQE) []uringCQE {
+	head := *r.cqHead
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		cqes = append(cqes, r.cqes[head&r.cqMask])
+	}
+	atomic.StoreUint32(r.cqHead, head)
+	return cqes
+}
+
+// waitFor waits for the completion of the request with the user data. The
+// other completions are kept for the next wait.
+func (r *uring) waitFor(userData uint64) (uringCQE, error) {
+	for i := 0; ; i++ {
+		if i > 0 || r.pending > 0 {
+			if err := r.enter(true); err != nil {
+				return uringCQE{}, err
+			}
+			r.stash = r.reap(r.stash)
+		}
+		for j, cqe := range r.stash {
+			if cqe.userData == userData {
+				r.stash = append(r.stash[:j], r.stash[j+1:]...)
+				return cqe, nil
+			}
+		}
+	}
+}
+
+// do submits a request and waits for its result. The requests are made
+// not to block, so they complete with the submission.
+func (r *uring) do(sqe uringSQE) (int32, error) {
+	sqe.userData = uringSync
+	if err := r.push(sqe); err != nil {
+		return 0, err
+	}
+	cqe, err := r.waitFor(uringSync)
+	return cqe.res, err
+}
+
+// provide returns a receive buffer to the group.
+func (r *uring) provide(bid int) error {
+	return r.push(uringSQE{
+		opcode:   iouringOpProvideBuffers,
+		fd:       1,
+		addr:     uint64(uintptr(unsafe.Pointer(&r.bufs[bid*uringBufSize]))),
+		len:      uringBufSize,
+		off:      uint64(bid),
+		bufGroup: uringBufGroup,
+		userData: uringProvide,
+	})
+}
+
+// probe provides the receive buffers and checks whether sends are supported
+// and accepts can fail instead of blocking. The ring works without them,
+// with system calls.
+func (r *uring) probe() error {
+	bufs := make([]byte, uringBufs*uringBufSize)
+	res, err := r.do(uringSQE{
+		opcode:   iouringOpProvideBuffers,
+		fd:       uringBufs,
+		addr:     uint64(uintptr(unsafe.Pointer(&bufs[0]))),
+		len:      uringBufSize,
+		bufGroup: uringBufGroup,
+	})
+	if err != nil {
+		return err
+	}
+	if res >= 0 {
+		r.bufs = bufs
+	}
+	// an unknown request or flag fails before the descriptor is checked
+	res, err = r.do(uringSQE{opcode: iouringOpAccept, ioprio: iouringAcceptDontWait, fd: -1})
+	if err != nil {
+		return err
+	}
+	r.noAccept = res == -int32(syscall.EINVAL)
+	res, err = r.do(uringSQE{opcode: iouringOpSend, fd: -1})
+	if err != nil {
+		return err
+	}
+	r.noSend = res == -int32(syscall.EINVAL)
+	return nil
+}
+
+func (r *uring) arm(fd int, f *uringFd, mask uint32) error {
+	gen := r.gen + 1
+	if err := r.push(uringSQE{
+		opcode:   iouringOpPollAdd,
+		fd:       int32(fd),
+		opflags:  mask,
+		userData: uint64(fd)<<32 | uint64(gen),
+	}); err != nil {
+		return err
+	}
+	r.gen = gen
+	f.gen = gen
+	f.mask = mask
+	f.armed = true
+	return nil
+}
+
+func (r *uring) disarm(fd int, f *uringFd) error {
+	if !f.armed {
+		return nil
+	}
+	if err := r.push(uringSQE{
+		opcode:   iouringOpPollRemove,
+		addr:     uint64(fd)<<32 | uint64(f.gen),
+		userData: uringRemove,
+	}); err != nil {
+		return err
+	}
+	f.armed = false
+	return nil
+}
+
+func (r *uring) armRecv(fd int, f *uringFd) error {
+	gen := r.gen + 1
+	if err := r.push(uringSQE{
+		opcode:   iouringOpRecv,
+		flags:    iouringSQEBufferSelect,
+		fd:       int32(fd),
+		len:      uringBufSize,
+		bufGroup: uringBufGroup,
+		userData: uint64(fd)<<32 | uint64(gen),
+	}); err != nil {
+		return err
+	}
+	r.gen = gen
+	f.rgen = gen
+	f.rarmed = true
+	return nil
+}
+
+// cancelRecv cancels the receive in flight. It may still complete with
+// input, so another one isn't armed until it completes.
+func (r *uring) cancelRecv(fd int, f *uringFd) error {
+	if !f.rarmed {
+		return nil
+	}
+	if err := r.push(uringSQE{
+		opcode:   iouringOpAsyncCancel,
+		addr:     uint64(fd)<<32 | uint64(f.rgen),
+		userData: uringRemove,
+	}); err != nil {
+		return err
+	}
+	f.rarmed, f.rcancel = false, true
+	return nil
+}
+
+// update arms the requests that the interest of the descriptor calls for. A
+// descriptor that's read through the ring is received while it's polled
+// for reads and no input is held for it, and it's polled for the rest.
+// The receive reports errors and hang ups too.
+func (r *uring) update(fd int, f *uringFd) error {
+	mask, poll, recv := f.events, true, false
+	if f.recv && !f.nobufs && r.bufs != nil && mask&pollIn != 0 {
+		mask &^= pollIn
+		poll = mask != 0
+		recv = r.p.ahead[fd] == nil
+	}
+	if f.armed && (!poll || f.mask != mask) {
+		if err := r.disarm(fd, f); err != nil {
+			return err
+		}
+	}
+	if poll && !f.armed {
+		if err := r.arm(fd, f, mask); err != nil {
+			return err
+		}
+	}
+	if f.rarmed && !recv {
+		return r.cancelRecv(fd, f)
+	}
+	if recv && !f.rarmed && !f.rcancel {
+		return r.armRecv(fd, f)
+	}
+	return nil
+}
+
+// received handles the completion of a receive, holding its input for the
+// owner of the descriptor.
+func (r *uring) received(fd int, cqe uringCQE) error {
+	bid := -1
+	if cqe.flags&iouringCQEFBuffer != 0 {
+		bid = int(cqe.flags >> iouringCQEBufferShift)
+	}
+	f := r.fds[fd]
+	if f == nil || uint32(cqe.userData) != f.rgen {
+		// the descriptor was closed or registered again
+		if bid >= 0 {
+			return r.provide(bid)
+		}
+		return nil
+	}
+	f.rarmed, f.rcancel = false, false
+	switch cqe.res {
+	case -int32(syscall.ENOBUFS):
+		// polled for reads until the buffers are back
+		f.nobufs = true
+		return nil
+	case -int32(syscall.ECANCELED):
+		return nil
+	case -int32(syscall.ENOTSOCK):
+		// read with system calls, like a pipe
+		f.recv = false
+		return nil
+	}
+	p := r.p
+	a := p.ahead[fd]
+	if a == nil {
+		if p.ahead == nil {
+			p.ahead = make(map[int]*ahead)
+		}
+		a = &ahead{paused: f.events&pollIn == 0}
+		p.ahead[fd] = a
+	}
+	switch {
+	case cqe.res > 0 && len(a.in) == 0:
+		// capped, so that appending to it doesn't overwrite the next buffer
+		off := bid * uringBufSize
+		a.in = r.bufs[off : off+int(cqe.res) : off+int(cqe.res)]
+		f.bid = bid
+		r.held = append(r.held, fd)
+	case cqe.res > 0:
+		off := bid * uringBufSize
+		a.in = append(a.in, r.bufs[off:off+int(cqe.res)]...)
+		return r.provide(bid)
+	case cqe.res == 0:
+		a.eof = true
+	default:
+		a.err = syscall.Errno(-cqe.res)
+	}
+	return nil
+}
+
+// release copies the input that's held in a buffer for the descriptor out
+// of it, and returns the buffer to the group.
+func (r *uring) release(fd int, f *uringFd) error {
+	if f.bid < 0 {
+		return nil
+	}
+	bid := f.bid
+	f.bid = -1
+	if a := r.p.ahead[fd]; a != nil && len(a.in) > 0 {
+		a.in = append([]byte{}, a.in...)
+	}
+	return r.provide(bid)
+}
+
+// consumed returns the buffer of the descriptor once its input was read,
+// and receives again.
+func (r *uring) consumed(fd int) error {
+	f := r.fds[fd]
+	if f == nil || r.p.ahead[fd] != nil {
+		return nil
+	}
+	if f.bid >= 0 {
+		bid := f.bid
+		f.bid = -1
+		if err := r.provide(bid); err != nil {
+			return err
+		}
+	}
+	return r.update(fd, f)
+}
+
+func (r *uring) add(fd int, events uint32) error {
+	if f := r.fds[fd]; f != nil {
+		if err := r.del(fd, false); err != nil {
+			return err
+		}
+	}
+	f := &uringFd{events: events, bid: -1}
+	r.fds[fd] = f
+	return r.update(fd, f)
+}
+
+func (r *uring) mod(fd int, events uint32) error {
+	f := r.fds[fd]
+	if f == nil || f.events == events {
+		return nil
+	}
+	f.events = events
+	return r.update(fd, f)
+}
+
+// del stops polling and receiving the descriptor. With wait, it waits for
+// the receive in flight to complete, so that the input that it received
+// is held for the owner.
+func (r *uring) del(fd int, wait bool) error {
+	f := r.fds[fd]
+	if f == nil {
+		return nil
+	}
+	if err := r.disarm(fd, f); err != nil {
+		return err
+	}
+	if err := r.cancelRecv(fd, f); err != nil {
+		return err
+	}
+	if wait && f.rcancel {
+		cqe, err := r.waitFor(uint64(fd)<<32 | uint64(f.rgen))
+		if err != nil {
+			return err
+		}
+		if err := r.received(fd, cqe); err != nil {
+			return err
+		}
+	}
+	if err := r.release(fd, f); err != nil {
+		return err
+	}
+	delete(r.fds, fd)
+	return nil
+}
+
+// read reads from the descriptor, which is received through the ring from
+// then on. The input of the receive in flight comes with the next wait.
+func (r *uring) read(fd int, b []byte) (int, error) {
+	f := r.fds[fd]
+	if f != nil && (f.rarmed || f.rcancel) {
+		return 0, syscall.EAGAIN
+	}
+	r.stats.call()
+	n, err := syscall.Read(fd, b)
+	if f != nil && r.bufs != nil {
+		f.recv = true
+		if uerr := r.update(fd, f); uerr != nil {
+			return n, uerr
+		}
+	}
+	return n, err
+}
+
+// write sends b without blocking.
+func (r *uring) write(fd int, b []byte) (int, error) {
+	if r.noSend {
+		r.stats.call()
+		return syscall.Write(fd, b)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(b) > 1<<30 {
+		b = b[:1<<30]
+	}
+	res, err := r.do(uringSQE{
+		opcode:  iouringOpSend,
+		fd:      int32(fd),
+		addr:    uint64(uintptr(unsafe.Pointer(&b[0]))),
+		len:     uint32(len(b)),
+		opflags: syscall.MSG_DONTWAIT | syscall.MSG_NOSIGNAL,
+	})
+	runtime.KeepAlive(b)
+	if err != nil {
+		return 0, err
+	}
+	if res == -int32(syscall.ENOTSOCK) {
+		r.stats.call()
+		return syscall.Write(fd, b)
+	}
+	if res < 0 {
+		return 0, syscall.Errno(-res)
+	}
+	return int(res), nil
+}
+
+// accept accepts a connection without blocking.
+func (r *uring) accept(fd int) (int, syscall.Sockaddr, error) {
+	if r.noAccept {
+		r.stats.call()
+		return syscall.Accept(fd)
+	}
+	r.salen = uint32(unsafe.Sizeof(r.sa))
+	res, err := r.do(uringSQE{
+		opcode:  iouringOpAccept,
+		ioprio:  iouringAcceptDontWait,
+		fd:      int32(fd),
+		addr:    uint64(uintptr(unsafe.Pointer(&r.sa))),
+		off:     uint64(uintptr(unsafe.Pointer(&r.salen))),
+		opflags: syscall.SOCK_CLOEXEC,
+	})
+	if err != nil {
+		return -1, nil, err
+	}
+	if res < 0 {
+		return -1, nil, syscall.Errno(-res)
+	}
+	return int(res), anyToSockaddr(&r.sa, r.salen), nil
+}
+
+// anyToSockaddr converts the address of an accepted connection.
+func anyToSockaddr(rsa *syscall.RawSockaddrAny, n uint32) syscall.Sockaddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		pp := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		return &syscall.SockaddrInet4{Port: int(port[0])<<8 | int(port[1]), Addr: pp.Addr}
+	case syscall.AF_INET6:
+		pp := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		return &syscall.SockaddrInet6{Port: int(port[0])<<8 | int(port[1]),
+			ZoneId: pp.Scope_id, Addr: pp.Addr}
+	case syscall.AF_UNIX:
+		pp := (*syscall.RawSockaddrUnix)(unsafe.Pointer(rsa))
+		sa := &syscall.SockaddrUnix{}
+		path := pp.Path[:]
+		if l := int(n) - 2; l >= 0 && l < len(path) {
+			path = path[:l]
+		}
+		if len(path) > 0 && path[0] == 0 {
+			// an abstract address
+			sa.Name = "@"
+			path = path[1:]
+		}
+		for _, c := range path {
+			if c == 0 {
+				break
+			}
+			sa.Name += string(rune(byte(c)))
+		}
+		return sa
+	}
+	return nil
+}
+
+// OpenURingPoll opens a poll that runs on io_uring instead of epoll. It
+// fails when the kernel doesn't support io_uring.
+func OpenURingPoll() (*Poll, error) {
+	r, err := openURing(uringEntries)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.probe(); err != nil {
+		r.close()
+		return nil, err
+	}
+	wfd, err := openEventfd()
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	l := &Poll{fd: r.fd, wfd: wfd, ring: r}
+	r.p = l
+	if err := r.add(l.wfd, pollIn); err != nil {
+		r.close()
+		syscall.Close(wfd)
+		return nil, err
+	}
+	return l, nil
+}
+
+func (p *Poll) waitRing(iter func(fd int, note interface{}) error) error {
+	r := p.ring
+	var buf [8]byte
+	for {
+		spin := p.busy.spin()
+		t0 := p.stats.now()
+		if err := r.enter(!spin && len(r.stash) == 0 && !p.aheadReady()); err != nil {
+			return err
+		}
+		cqes := r.reap(append(r.ready[:0], r.stash...))
+		r.ready, r.stash = cqes, r.stash[:0]
+		if spin && len(cqes) == 0 && !p.aheadReady() {
+			continue
+		}
+		p.busy.woke(len(cqes) > 0)
+		t1 := p.stats.now()
+		p.cycle++
+		events := r.events[:0]
+		var woken bool
+		for _, cqe := range cqes {
+			if cqe.userData >= uringSync {
+				continue // not a descriptor
+			}
+			fd, gen := int(cqe.userData>>32), uint32(cqe.userData)
+			f := r.fds[fd]
+			if cqe.flags&iouringCQEFBuffer != 0 || (f != nil && gen == f.rgen) {
+				if err := r.received(fd, cqe); err != nil {
+					return err
+				}
+				if f := r.fds[fd]; f != nil {
+					if err := r.update(fd, f); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if f == nil || !f.armed || f.gen != gen {
+				continue // stale request
+			}
+			f.armed, f.nobufs = false, false
+			if fd == p.wfd {
+				woken = true
+			} else if cqe.res < 0 {
+				// the descriptor can't be polled anymore, let the owner
+				// find out about it.
+				delete(r.fds, fd)
+				events = append(events, uringEvent{fd, false})
+				continue
+			} else if cqe.res != 0 {
+				events = append(events, uringEvent{fd, cqe.res&pollErr != 0})
+				continue
+			}
+			if err := r.update(fd, f); err != nil {
+				return err
+			}
+		}
+		if woken {
+			// reset the counter before taking the notes, so that the notes
+			// that are added later write to it again.
+			syscall.Read(p.wfd, buf[:])
+		}
+		p.failed = false
+		if err := p.notes.ForEach(func(note interface{}) error {
+			return iter(0, note)
+		}); err != nil {
+			return err
+		}
+		// the input that's held is passed along with the events
+		for _, ev := range events {
+			p.passed(ev.fd)
+		}
+		for fd, a := range p.ahead {
+			if a.ready() && a.cycle != p.cycle {
+				a.cycle = p.cycle
+				events = append(events, uringEvent{fd, false})
+			}
+		}
+		r.events = events
+		p.prio.order(len(events), func(i int) int {
+			return events[i].fd
+		}, func(i, j int) {
+			events[i], events[j] = events[j], events[i]
+		})
+		for _, ev := range events {
+			p.failed = ev.failed
+			if err := iter(ev.fd, nil); err != nil {
+				return err
+			}
+			if f := r.fds[ev.fd]; f != nil {
+				if err := r.update(ev.fd, f); err != nil {
+					return err
+				}
+			}
+		}
+		// the buffers are for the next receives
+		for _, fd := range r.held {
+			if f := r.fds[fd]; f != nil {
+				if err := r.release(fd, f); err != nil {
+					return err
+				}
+			}
+		}
+		r.held = r.held[:0]
+		p.stats.record(t0, t1)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestURingPushFull(t *testing.T) {
+	r, err := openURing(2)
+	if err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	defer r.close()
+	for i := uint32(0); i < r.sqEntries; i++ {
+		if err := r.push(uringSQE{userData: uringRemove}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the queue is full and can't be flushed, so the submission fails
+	// without overwriting the queued ones
+	fd := r.fd
+	r.fd = -1
+	tail := *r.sqTail
+	if err := r.push(uringSQE{userData: uringRemove}); err != syscall.EBADF {
+		t.Fatalf("expected EBADF, got %v", err)
+	}
+	if *r.sqTail != tail || r.pending != r.sqEntries {
+		t.Fatalf("expected the queue to be unchanged")
+	}
+	r.fd = fd
+	if err := r.enter(false); err != nil {
+		t.Fatal(err)
+	}
+	if r.pending != 0 {
+		t.Fatalf("expected the queue to be flushed, %d pending", r.pending)
+	}
+	if err := r.push(uringSQE{userData: uringRemove}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestURingIO(t *testing.T) {
+	p, err := OpenURingPoll()
+	if err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	defer p.Close()
+	if p.ring.bufs == nil {
+		t.Skip("the kernel can't receive into provided buffers")
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	fd, peer := fds[0], fds[1]
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		t.Fatal(err)
+	}
+	p.AddRead(fd)
+	if n, err := p.Write(fd, []byte("hello")); n != 5 || err != nil {
+		t.Fatalf("expected the write to go through the ring, got %d, %v", n, err)
+	}
+	buf := make([]byte, 16)
+	if n, _ := syscall.Read(peer, buf); string(buf[:n]) != "hello" {
+		t.Fatalf("expected hello, got %q", buf[:n])
+	}
+	// the first read is a system call, the next ones are received
+	syscall.Write(peer, []byte("ping"))
+	if n, err := p.Read(fd, buf); string(buf[:n]) != "ping" || err != nil {
+		t.Fatalf("expected ping, got %q, %v", buf[:n], err)
+	}
+	if _, err := p.Read(fd, buf); err != syscall.EAGAIN {
+		t.Fatalf("expected EAGAIN while the receive is armed, got %v", err)
+	}
+	syscall.Write(peer, []byte("pong"))
+	errDone := errors.New("done")
+	var got string
+	err = p.Wait(func(wfd int, note interface{}) error {
+		if wfd != fd {
+			return nil
+		}
+		if held := p.Buffered(fd); string(held) != "pong" {
+			t.Fatalf("expected the received input to be held, got %q", held)
+		}
+		n, err := p.Read(fd, buf)
+		if err != nil {
+			return err
+		}
+		got = string(buf[:n])
+		return errDone
+	})
+	if err != errDone || got != "pong" {
+		t.Fatalf("expected pong with the wait, got %q, %v", got, err)
+	}
+	// the input that wasn't read comes back when the descriptor is detached
+	syscall.Write(peer, []byte("held"))
+	var detached []byte
+	err = p.Wait(func(wfd int, note interface{}) error {
+		if wfd != fd {
+			return nil
+		}
+		detached = p.ModDetach(fd)
+		return errDone
+	})
+	if err != errDone || string(detached) != "held" {
+		t.Fatalf("expected the held input, got %q, %v", detached, err)
+	}
+	if _, ok := p.ring.fds[fd]; ok {
+		t.Fatal("expected the descriptor to be removed from the ring")
+	}
+}
+
+func TestURingAccept(t *testing.T) {
+	p, err := OpenURingPoll()
+	if err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	defer p.Close()
+	ln, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(ln)
+	if err := syscall.Bind(ln, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(ln, 8); err != nil {
+		t.Fatal(err)
+	}
+	// an accept with nothing queued fails instead of blocking the loop
+	if _, _, err := p.Accept(ln); err != syscall.EAGAIN {
+		t.Fatalf("expected EAGAIN, got %v", err)
+	}
+	sa, err := syscall.Getsockname(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(c)
+	if err := syscall.Connect(c, sa); err != nil {
+		t.Fatal(err)
+	}
+	nfd, rsa, err := p.Accept(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(nfd)
+	local, _ := syscall.Getsockname(c)
+	in4, ok := rsa.(*syscall.SockaddrInet4)
+	if !ok || in4.Addr != [4]byte{127, 0, 0, 1} || in4.Port != local.(*syscall.SockaddrInet4).Port {
+		t.Fatalf("expected the address of the peer, got %#v", rsa)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const afVsock = 40
+
+// rawSockaddrVM is struct sockaddr_vm.
+type rawSockaddrVM struct {
+	family    uint16
+	reserved1 uint16
+	port      uint32
+	cid       uint32
+	flags     uint8
+	zero      [3]uint8
+}
+
+// VsockListen returns a non-blocking AF_VSOCK stream socket that's
+// listening on the cid and port. The syscall package doesn't know the
+// address family, so the socket calls are made directly.
+func VsockListen(cid, port uint32) (fd int, err error) {
+	fd, err = syscall.Socket(afVsock, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	sa := rawSockaddrVM{family: afVsock, port: port, cid: cid}
+	if _, _, e := syscall.Syscall(syscall.SYS_BIND, uintptr(fd),
+		uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa)); e != 0 {
+		syscall.Close(fd)
+		return 0, e
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		syscall.Close(fd)
+		return 0, err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return 0, err
+	}
+	return fd, nil
+}
+
+// VsockAccept accepts a connection on a vsock listener and returns the cid
+// and port of the peer.
+func VsockAccept(fd int) (nfd int, cid, port uint32, err error) {
+	var sa rawSockaddrVM
+	n := uint32(unsafe.Sizeof(sa))
+	r, _, e := syscall.Syscall6(syscall.SYS_ACCEPT4, uintptr(fd),
+		uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&n)),
+		syscall.SOCK_CLOEXEC, 0, 0)
+	if e != 0 {
+		return 0, 0, 0, e
+	}
+	return int(r), sa.cid, sa.port, nil
+}
+
+// VsockConnect returns a blocking vsock socket that's connected to the cid
+// and port.
+func VsockConnect(cid, port uint32) (fd int, err error) {
+	fd, err = syscall.Socket(afVsock, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	sa := rawSockaddrVM{family: afVsock, port: port, cid: cid}
+	if _, _, e := syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd),
+		uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa)); e != 0 {
+		syscall.Close(fd)
+		return 0, e
+	}
+	return fd, nil
+}
+
+// VsockName returns the cid and port that a vsock socket is bound to.
+func VsockName(fd int) (cid, port uint32, err error) {
+	var sa rawSockaddrVM
+	n := uint32(unsafe.Sizeof(sa))
+	if _, _, e := syscall.Syscall(syscall.SYS_GETSOCKNAME, uintptr(fd),
+		uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&n))); e != 0 {
+		return 0, 0, e
+	}
+	return sa.cid, sa.port, nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package internal
+
+import "syscall"
+
+// VsockListen is not supported on this platform.
+func VsockListen(cid, port uint32) (fd int, err error) {
+	return 0, syscall.EAFNOSUPPORT
+}
+
+// VsockAccept is not supported on this platform.
+func VsockAccept(fd int) (nfd int, cid, port uint32, err error) {
+	return 0, 0, 0, syscall.EAFNOSUPPORT
+}
+
+// VsockConnect is not supported on this platform.
+func VsockConnect(cid, port uint32) (fd int, err error) {
+	return 0, syscall.EAFNOSUPPORT
+}
+
+// VsockName is not supported on this platform.
+func VsockName(fd int) (cid, port uint32, err error) {
+	return 0, 0, syscall.EAFNOSUPPORT
+}
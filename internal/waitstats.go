@@ -0,0 +1,91 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// WaitStats records how long a Poll blocks in the kernel wait, how long it
+// takes to dispatch the events of each wait and how many system calls the
+// poll makes. It's updated by the loop
+// that runs the poll and may be read from any goroutine. Methods on a nil
+// WaitStats are no-ops, so a poll without stats only pays for a nil check.
+type WaitStats struct {
+	iterations  int64
+	calls       int64 // system calls of the waits, interest changes and I/O
+	waitAvg     int64 // moving averages and maximums in nanoseconds
+	waitMax     int64
+	dispatchAvg int64
+	dispatchMax int64
+}
+
+// now returns the current time, or the zero time when s is nil.
+func (s *WaitStats) now() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// record adds an iteration that started waiting at t0 and started
+// dispatching at t1.
+func (s *WaitStats) record(t0, t1 time.Time) {
+	if s == nil {
+		return
+	}
+	wait, dispatch := int64(t1.Sub(t0)), int64(time.Since(t1))
+	n := atomic.AddInt64(&s.iterations, 1)
+	update(&s.waitAvg, &s.waitMax, wait, n)
+	update(&s.dispatchAvg, &s.dispatchMax, dispatch, n)
+}
+
+// call counts a system call of the poll.
+func (s *WaitStats) call() {
+	if s != nil {
+		atomic.AddInt64(&s.calls, 1)
+	}
+}
+
+// update moves an exponentially weighted average with a weight of 1/8
+// towards x.
+func update(avg, max *int64, x, n int64) {
+	a := atomic.LoadInt64(avg)
+	if n == 1 {
+		a = x
+	} else {
+		a += (x - a) / 8
+	}
+	atomic.StoreInt64(avg, a)
+	if x > atomic.LoadInt64(max) {
+		atomic.StoreInt64(max, x)
+	}
+}
+
+// Iterations returns the number of waits.
+func (s *WaitStats) Iterations() int64 {
+	return atomic.LoadInt64(&s.iterations)
+}
+
+// Calls returns the number of system calls that the poll made to wait for
+// events and to change the interest set.
+func (s *WaitStats) Calls() int64 {
+	return atomic.LoadInt64(&s.calls)
+}
+
+// Wait returns the moving average and the maximum of the time spent blocked
+// in the wait.
+func (s *WaitStats) Wait() (avg, max time.Duration) {
+	return time.Duration(atomic.LoadInt64(&s.waitAvg)),
+		time.Duration(atomic.LoadInt64(&s.waitMax))
+}
+
+// Dispatch returns the moving average and the maximum of the time spent
+// handling the events of a wait.
+func (s *WaitStats) Dispatch() (avg, max time.Duration) {
+	return time.Duration(atomic.LoadInt64(&s.dispatchAvg)),
+		time.Duration(atomic.LoadInt64(&s.dispatchMax))
+}
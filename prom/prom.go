@@ -0,0 +1,134 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package prom exposes the stats of an evio server as Prometheus text-format
+// metrics, without depending on the Prometheus client.
+//
+//	events.Serving = func(srv evio.Server) (action evio.Action) {
+//		http.Handle("/metrics", prom.Handler(srv))
+//		go http.ListenAndServe(":9100", nil)
+//		return
+//	}
+//
+// The metrics of a loop are labeled with its index, and the ones of a
+// listener with its address.
+package prom
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jursonmo/evio"
+)
+
+// ContentType is the content type of the exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metric is a metric family that's computed from a loop's stats.
+type metric struct {
+	name, typ, help string
+	value           func(ls evio.LoopStats) float64
+}
+
+var loopMetrics = []metric{
+	{"evio_loop_conns", "gauge", "Number of open connections on the loop.",
+		func(ls evio.LoopStats) float64 { return float64(ls.Conns) }},
+	{"evio_loop_iterations_total", "counter", "Number of times the loop waited for events.",
+		func(ls evio.LoopStats) float64 { return float64(ls.Iterations) }},
+	{"evio_loop_wait_avg_seconds", "gauge", "Moving average of the time the loop blocked waiting for events.",
+		func(ls evio.LoopStats) float64 { return seconds(ls.WaitAvg) }},
+	{"evio_loop_wait_max_seconds", "gauge", "Maximum time the loop blocked waiting for events.",
+		func(ls evio.LoopStats) float64 { return seconds(ls.WaitMax) }},
+	{"evio_loop_dispatch_avg_seconds", "gauge", "Moving average of the time the loop spent handling the events of a wait.",
+		func(ls evio.LoopStats) float64 { return seconds(ls.DispatchAvg) }},
+	{"evio_loop_dispatch_max_seconds", "gauge", "Maximum time the loop spent handling the events of a wait.",
+		func(ls evio.LoopStats) float64 { return seconds(ls.DispatchMax) }},
+	{"evio_loop_accepts_total", "counter", "Number of connections that the loop accepted or attached.",
+		func(ls evio.LoopStats) float64 { return float64(ls.Accepts) }},
+	{"evio_loop_closes_total", "counter", "Number of connections that the loop closed.",
+		func(ls evio.LoopStats) float64 { return float64(ls.Closes) }},
+	{"evio_loop_read_bytes_total", "counter", "Number of bytes that the loop read from its connections.",
+		func(ls evio.LoopStats) float64 { return float64(ls.BytesIn) }},
+	{"evio_loop_written_bytes_total", "counter", "Number of bytes that the loop wrote to its connections.",
+		func(ls evio.LoopStats) float64 { return float64(ls.BytesOut) }},
+	{"evio_loop_timeouts_total", "counter", "Number of open timeouts and deadlines that fired on the loop.",
+		func(ls evio.LoopStats) float64 { return float64(ls.Timeouts) }},
+}
+
+func seconds(d time.Duration) float64 { return d.Seconds() }
+
+// Write writes the stats as Prometheus text-format metrics.
+func Write(w io.Writer, stats evio.Stats) error {
+	bw := bufio.NewWriter(w)
+	header(bw, "evio_conns", "gauge", "Number of open connections.")
+	sample(bw, "evio_conns", "", float64(stats.Conns))
+	if len(stats.Loops) > 0 {
+		header(bw, "evio_loops", "gauge", "Number of loops.")
+		sample(bw, "evio_loops", "", float64(len(stats.Loops)))
+		for _, m := range loopMetrics {
+			header(bw, m.name, m.typ, m.help)
+			for i, ls := range stats.Loops {
+				sample(bw, m.name, `loop="`+strconv.Itoa(i)+`"`, m.value(ls))
+			}
+		}
+	}
+	// the accept queues are only reported on Linux
+	if len(stats.Listeners) > 0 {
+		header(bw, "evio_listen_overflows_total", "counter", "Number of connections that the host dropped because an accept queue was full.")
+		sample(bw, "evio_listen_overflows_total", "", float64(stats.ListenOverflows))
+		header(bw, "evio_listen_drops_total", "counter", "Number of connections that the listeners of the host dropped.")
+		sample(bw, "evio_listen_drops_total", "", float64(stats.ListenDrops))
+		header(bw, "evio_listener_queued", "gauge", "Number of connections that wait to be accepted.")
+		for _, ls := range stats.Listeners {
+			sample(bw, "evio_listener_queued", addrLabel(ls.Addr), float64(ls.Queued))
+		}
+		header(bw, "evio_listener_backlog", "gauge", "Maximum number of connections that may wait to be accepted.")
+		for _, ls := range stats.Listeners {
+			sample(bw, "evio_listener_backlog", addrLabel(ls.Addr), float64(ls.Backlog))
+		}
+	}
+	lameDuck := 0.0
+	if stats.LameDuck {
+		lameDuck = 1
+	}
+	header(bw, "evio_lame_duck", "gauge", "Whether the lame duck mode is on.")
+	sample(bw, "evio_lame_duck", "", lameDuck)
+	return bw.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// addrLabel returns the label of a listener's address.
+func addrLabel(addr net.Addr) string {
+	return `addr="` + labelEscaper.Replace(addr.String()) + `"`
+}
+
+func header(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sample(w *bufio.Writer, name, labels string, value float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteByte(' ')
+	w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	w.WriteByte('\n')
+}
+
+// Handler returns an HTTP handler that serves the current stats of the
+// server, such as on /metrics.
+func Handler(srv evio.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		Write(w, srv.Stats())
+	})
+}
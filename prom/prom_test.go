@@ -0,0 +1,112 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package prom
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jursonmo/evio"
+)
+
+var (
+	commentRE = regexp.MustCompile(`^# (HELP|TYPE) ([a-z_]+) (.+)$`)
+	sampleRE  = regexp.MustCompile(`^([a-z_]+)(\{([a-z_]+)="([^"]*)"\})? (\S+)$`)
+)
+
+func TestWrite(t *testing.T) {
+	stats := evio.Stats{Conns: 3, Loops: []evio.LoopStats{
+		{Conns: 1, Iterations: 10, WaitAvg: time.Millisecond, WaitMax: time.Second,
+			Accepts: 5, Closes: 4, BytesIn: 100, BytesOut: 200, Timeouts: 1},
+		{Conns: 2, Iterations: 20, DispatchAvg: time.Microsecond, Accepts: 2},
+	}, Listeners: []evio.ListenerStats{
+		{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}, Queued: 3, Backlog: 128},
+		{Addr: &net.TCPAddr{IP: net.IPv6loopback, Port: 8081}, Backlog: 64},
+	}, ListenOverflows: 7, ListenDrops: 9, LameDuck: true}
+	var buf bytes.Buffer
+	if err := Write(&buf, stats); err != nil {
+		t.Fatal(err)
+	}
+	typed := make(map[string]string)
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if m := commentRE.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				typed[m[2]] = m[3]
+			}
+			continue
+		}
+		m := sampleRE.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("malformed line %q", line)
+		}
+		if _, ok := typed[m[1]]; !ok {
+			t.Fatalf("sample %q before its TYPE", line)
+		}
+		if m[2] != "" && m[3] != "loop" && m[3] != "addr" {
+			t.Fatalf("unexpected label in %q", line)
+		}
+		v, err := strconv.ParseFloat(m[5], 64)
+		if err != nil {
+			t.Fatalf("malformed value in %q", line)
+		}
+		samples[m[1]+m[2]] = v
+	}
+	expected := map[string]float64{
+		`evio_conns`:                                   3,
+		`evio_loops`:                                   2,
+		`evio_loop_conns{loop="0"}`:                    1,
+		`evio_loop_conns{loop="1"}`:                    2,
+		`evio_loop_iterations_total{loop="1"}`:         20,
+		`evio_loop_wait_avg_seconds{loop="0"}`:         0.001,
+		`evio_loop_wait_max_seconds{loop="0"}`:         1,
+		`evio_loop_dispatch_avg_seconds{loop="1"}`:     0.000001,
+		`evio_loop_dispatch_max_seconds{loop="1"}`:     0,
+		`evio_loop_accepts_total{loop="0"}`:            5,
+		`evio_loop_accepts_total{loop="1"}`:            2,
+		`evio_loop_closes_total{loop="0"}`:             4,
+		`evio_loop_read_bytes_total{loop="0"}`:         100,
+		`evio_loop_written_bytes_total{loop="0"}`:      200,
+		`evio_loop_timeouts_total{loop="0"}`:           1,
+		`evio_loop_timeouts_total{loop="1"}`:           0,
+		`evio_listen_overflows_total`:                  7,
+		`evio_listen_drops_total`:                      9,
+		`evio_listener_queued{addr="127.0.0.1:8080"}`:  3,
+		`evio_listener_backlog{addr="127.0.0.1:8080"}`: 128,
+		`evio_listener_queued{addr="[::1]:8081"}`:      0,
+		`evio_listener_backlog{addr="[::1]:8081"}`:     64,
+		`evio_lame_duck`:                               1,
+	}
+	for name, v := range expected {
+		if got, ok := samples[name]; !ok || got != v {
+			t.Fatalf("expected %s %v, got %v (present %v)", name, v, got, ok)
+		}
+	}
+	for name, typ := range typed {
+		if strings.HasSuffix(name, "_total") != (typ == "counter") {
+			t.Fatalf("unexpected type %s for %s", typ, name)
+		}
+	}
+	if typed["evio_conns"] != "gauge" {
+		t.Fatalf("unexpected types %v", typed)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Handler(evio.Server{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "\nevio_conns 0\n") {
+		t.Fatalf("unexpected body %q", rec.Body.String())
+	}
+}
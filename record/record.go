@@ -0,0 +1,324 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package record records the Opened, Data and Closed events of an evio
+// server, with their input, output and timing, and replays the recording
+// through a handler offline to reproduce a protocol bug deterministically.
+//
+//	rec := record.New(record.NewWriter(f))
+//	rec.SetEnabled(*recordFlag)
+//	events = rec.Events(events)
+//
+// The recording is read back and replayed against the events of a handler,
+// which return the events as the handler produced them:
+//
+//	recorded, err := record.Read(f)
+//	replayed := record.Replay(recorded, events)
+//
+// Each recorded connection is replayed on a connection of its own that has
+// the recorded id and addresses. Its context works as usual, and the other
+// methods that need a socket return evio.ErrUnsupported.
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jursonmo/evio"
+)
+
+// Kind is the kind of a recorded event.
+type Kind int
+
+const (
+	// Opened is an Opened event.
+	Opened Kind = iota
+	// Data is a Data event. A nil input is a wake up.
+	Data
+	// Closed is a Closed event.
+	Closed
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Opened:
+		return "Opened"
+	case Data:
+		return "Data"
+	case Closed:
+		return "Closed"
+	}
+	return "Kind(?)"
+}
+
+// Event is a recorded event.
+type Event struct {
+	Conn      uint64        // id of the connection
+	Kind      Kind          // kind of event
+	Time      time.Duration // when it fired, since the recording started
+	AddrIndex int           // listener of the connection
+	Local     string        // local address, for Opened
+	Remote    string        // remote address, for Opened
+	In        []byte        // input of a Data event
+	Out       []byte        // output of the event
+	Action    evio.Action   // action returned by the event
+	Err       string        // error passed to a Closed event
+}
+
+// Sink receives the recorded events. Record is called by one event at a
+// time.
+type Sink interface {
+	Record(e Event)
+}
+
+// SinkFunc is a function that's used as a sink.
+type SinkFunc func(e Event)
+
+// Record calls f(e).
+func (f SinkFunc) Record(e Event) { f(e) }
+
+// Writer is a sink that writes the events as lines of JSON, which are read
+// back by Read.
+type Writer struct {
+	enc *json.Encoder
+	err error
+}
+
+// NewWriter returns a sink that writes to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: json.NewEncoder(w)}
+}
+
+// Record writes the event. Once a write fails the events are dropped.
+func (w *Writer) Record(e Event) {
+	if w.err == nil {
+		w.err = w.enc.Encode(e)
+	}
+}
+
+// Err returns the first error that writing the events returned.
+func (w *Writer) Err() error {
+	return w.err
+}
+
+// Read reads the events that were written by a Writer.
+func Read(r io.Reader) ([]Event, error) {
+	dec := json.NewDecoder(r)
+	var events []Event
+	for {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				return events, nil
+			}
+			return events, err
+		}
+		events = append(events, e)
+	}
+}
+
+// Recorder records the events of a server while it's enabled.
+type Recorder struct {
+	mu    sync.Mutex
+	sink  Sink
+	start time.Time
+	on    int32
+}
+
+// New returns a recorder that records to the sink. Recording is off until
+// it's enabled.
+func New(sink Sink) *Recorder {
+	return &Recorder{sink: sink, start: time.Now()}
+}
+
+// SetEnabled turns recording on or off. It may be called from any
+// goroutine.
+func (r *Recorder) SetEnabled(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&r.on, v)
+}
+
+// Enabled reports whether events are being recorded.
+func (r *Recorder) Enabled() bool {
+	return atomic.LoadInt32(&r.on) == 1
+}
+
+// record sends an event to the sink.
+func (r *Recorder) record(e Event, t time.Time) {
+	e.Time = t.Sub(r.start)
+	r.mu.Lock()
+	r.sink.Record(e)
+	r.mu.Unlock()
+}
+
+// Events returns the events with their Opened, Data and Closed events
+// recorded. The input and output are copied, so ReuseInput and output that
+// the handler reuses don't change the recording.
+func (r *Recorder) Events(events evio.Events) evio.Events {
+	opened, data, closed := events.Opened, events.Data, events.Closed
+	events.Opened = func(c evio.Conn) (out []byte, opts evio.Options, action evio.Action) {
+		t := time.Now()
+		if opened != nil {
+			out, opts, action = opened(c)
+		}
+		if r.Enabled() {
+			e := Event{Conn: c.ID(), Kind: Opened, AddrIndex: c.AddrIndex(),
+				Out: copyBytes(out), Action: action}
+			if a := c.LocalAddr(); a != nil {
+				e.Local = a.String()
+			}
+			if a := c.RemoteAddr(); a != nil {
+				e.Remote = a.String()
+			}
+			r.record(e, t)
+		}
+		return
+	}
+	if data != nil {
+		events.Data = func(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+			if !r.Enabled() {
+				return data(c, in)
+			}
+			t := time.Now()
+			e := Event{Conn: c.ID(), Kind: Data, AddrIndex: c.AddrIndex(),
+				In: copyBytes(in)}
+			out, action = data(c, in)
+			e.Out, e.Action = copyBytes(out), action
+			r.record(e, t)
+			return
+		}
+	}
+	events.Closed = func(c evio.Conn, err error) (action evio.Action) {
+		t := time.Now()
+		if closed != nil {
+			action = closed(c, err)
+		}
+		if r.Enabled() {
+			e := Event{Conn: c.ID(), Kind: Closed, AddrIndex: c.AddrIndex(),
+				Action: action}
+			if err != nil {
+				e.Err = err.Error()
+			}
+			r.record(e, t)
+		}
+		return
+	}
+	return events
+}
+
+// copyBytes copies b, keeping nil apart from empty.
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// Replay calls the Opened, Data and Closed events with the recorded events,
+// in order, and returns the events as they were produced. They have the
+// recorded input and timing, and the output and actions of the handler,
+// so they can be compared with the recording.
+func Replay(recorded []Event, events evio.Events) []Event {
+	conns := make(map[uint64]*conn)
+	replayed := make([]Event, 0, len(recorded))
+	for _, e := range recorded {
+		c := conns[e.Conn]
+		if c == nil {
+			c = &conn{id: e.Conn, addrIndex: e.AddrIndex}
+			conns[e.Conn] = c
+		}
+		r := e
+		r.Out, r.Action = nil, evio.None
+		switch e.Kind {
+		case Opened:
+			c.local, c.remote = replayAddr(e.Local), replayAddr(e.Remote)
+			if events.Opened != nil {
+				r.Out, _, r.Action = events.Opened(c)
+			}
+		case Data:
+			if events.Data != nil {
+				r.Out, r.Action = events.Data(c, copyBytes(e.In))
+			}
+		case Closed:
+			var err error
+			if e.Err != "" {
+				err = errors.New(e.Err)
+			}
+			if events.Closed != nil {
+				r.Action = events.Closed(c, err)
+			}
+			delete(conns, e.Conn)
+		}
+		r.Out = copyBytes(r.Out)
+		replayed = append(replayed, r)
+	}
+	return replayed
+}
+
+// addr is a recorded address.
+type addr string
+
+func (a addr) Network() string { return "record" }
+func (a addr) String() string  { return string(a) }
+
+func replayAddr(s string) net.Addr {
+	if s == "" {
+		return nil
+	}
+	return addr(s)
+}
+
+// conn is the connection that a recorded connection is replayed on.
+type conn struct {
+	id            uint64
+	addrIndex     int
+	local, remote net.Addr
+	ctx           interface{}
+}
+
+func (c *conn) Context() interface{}                   { return c.ctx }
+func (c *conn) SetContext(ctx interface{})             { c.ctx = ctx }
+func (c *conn) ID() uint64                             { return c.id }
+func (c *conn) AddrIndex() int                         { return c.addrIndex }
+func (c *conn) LocalAddr() net.Addr                    { return c.local }
+func (c *conn) RemoteAddr() net.Addr                   { return c.remote }
+func (c *conn) Wake() error                            { return nil }
+func (c *conn) Timestamp() time.Time                   { return time.Time{} }
+func (c *conn) ReadableBytes() (int, error)            { return 0, evio.ErrUnsupported }
+func (c *conn) Peek(n int) ([]byte, error)             { return nil, evio.ErrUnsupported }
+func (c *conn) SetNoDelay(bool) error                  { return evio.ErrUnsupported }
+func (c *conn) SetKeepAlive(time.Duration) error       { return evio.ErrUnsupported }
+func (c *conn) WriteFrom(io.Reader) error              { return evio.ErrUnsupported }
+func (c *conn) SendUrgent([]byte) error                { return evio.ErrUnsupported }
+func (c *conn) WriteString(string) error               { return evio.ErrUnsupported }
+func (c *conn) WriteBuffers(net.Buffers) error         { return evio.ErrUnsupported }
+func (c *conn) TryWrite([]byte) error                  { return evio.ErrUnsupported }
+func (c *conn) SetWriteWatermarks(low, high int) error { return evio.ErrUnsupported }
+func (c *conn) Drain()                                 {}
+func (c *conn) Ready()                                 {}
+func (c *conn) BeginRequest()                          {}
+func (c *conn) EndRequest()                            {}
+func (c *conn) SuspendUntil(<-chan struct{}) error {
+	return evio.ErrUnsupported
+}
+func (c *conn) CloseWithReason(int, string) error {
+	return evio.ErrUnsupported
+}
+func (c *conn) SetDeadline(time.Time, func(c evio.Conn) ([]byte, evio.Action)) error {
+	return evio.ErrUnsupported
+}
+func (c *conn) PeerCred() (pid, uid, gid int, err error) {
+	return 0, 0, 0, evio.ErrUnsupported
+}
+func (c *conn) OriginalDst() (net.Addr, error) {
+	return nil, evio.ErrUnsupported
+}
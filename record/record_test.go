@@ -0,0 +1,115 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package record
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jursonmo/evio"
+)
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// counter numbers the lines of a connection and closes it on "bye".
+func counter() evio.Events {
+	var events evio.Events
+	events.Opened = func(c evio.Conn) (out []byte, opts evio.Options, action evio.Action) {
+		c.SetContext(new(int))
+		return []byte("hello " + c.RemoteAddr().String() + "\n"), opts, action
+	}
+	events.Data = func(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+		n := c.Context().(*int)
+		for _, line := range strings.Split(strings.TrimSpace(string(in)), "\n") {
+			if line == "bye" {
+				return out, evio.Close
+			}
+			*n++
+			out = append(out, fmt.Sprintf("%d %s\n", *n, line)...)
+		}
+		return
+	}
+	return events
+}
+
+// serve runs the events until the client is done.
+func serve(events evio.Events, addr string, client func(c net.Conn)) {
+	closed := events.Closed
+	events.Closed = func(c evio.Conn, err error) (action evio.Action) {
+		if closed != nil {
+			closed(c, err)
+		}
+		return evio.Shutdown
+	}
+	events.Serving = func(_ evio.Server) (action evio.Action) {
+		go func() {
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			client(c)
+		}()
+		return
+	}
+	must(evio.Serve(events, "tcp://"+addr))
+}
+
+func TestReplay(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	rec := New(w)
+	rec.SetEnabled(true)
+	serve(rec.Events(counter()), ":9898", func(c net.Conn) {
+		for _, s := range []string{"a\n", "b\nc\n", "d\n", "bye\n"} {
+			c.Write([]byte(s))
+			time.Sleep(time.Millisecond * 10)
+		}
+		io.Copy(ioutil.Discard, c)
+	})
+	must(w.Err())
+	recorded, err := Read(&buf)
+	must(err)
+	if len(recorded) < 4 || recorded[0].Kind != Opened || recorded[len(recorded)-1].Kind != Closed {
+		t.Fatalf("expected the opened, data and closed events, got %v", recorded)
+	}
+	replayed := Replay(recorded, counter())
+	if len(replayed) != len(recorded) {
+		t.Fatalf("expected %d replayed events, got %d", len(recorded), len(replayed))
+	}
+	for i := range recorded {
+		r, p := recorded[i], replayed[i]
+		if r.Kind != p.Kind || !bytes.Equal(r.In, p.In) || !bytes.Equal(r.Out, p.Out) || r.Action != p.Action {
+			t.Fatalf("event %d: recorded %s %q -> %q %v, replayed %s %q -> %q %v", i,
+				r.Kind, r.In, r.Out, r.Action, p.Kind, p.In, p.Out, p.Action)
+		}
+		if i > 0 && r.Time < recorded[i-1].Time {
+			t.Fatalf("event %d: expected increasing times", i)
+		}
+	}
+	if last := recorded[len(recorded)-2]; last.Action != evio.Close {
+		t.Fatalf("expected the last Data event to close, got %v", last.Action)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	var recorded []Event
+	rec := New(SinkFunc(func(e Event) { recorded = append(recorded, e) }))
+	serve(rec.Events(counter()), ":9897", func(c net.Conn) {
+		c.Write([]byte("bye\n"))
+		io.Copy(ioutil.Discard, c)
+	})
+	if len(recorded) != 0 {
+		t.Fatalf("expected no events while disabled, got %d", len(recorded))
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package resp decodes Redis protocol (RESP) commands from the evio Data
+// event and encodes the replies.
+//
+//	var events evio.Events
+//	events.Data = resp.Data(resp.Config{}, func(c evio.Conn, args [][]byte, out []byte) ([]byte, evio.Action) {
+//		switch strings.ToLower(string(args[0])) {
+//		case "ping":
+//			return resp.AppendString(out, "PONG"), evio.None
+//		}
+//		return resp.AppendError(out, "ERR unknown command"), evio.None
+//	})
+//
+// Commands may be split across reads and pipelined, and both multi-bulk and
+// inline commands are accepted. The state of a connection is stored in its
+// context, so the context must not be used for anything else.
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+
+	"github.com/jursonmo/evio"
+)
+
+// Handler handles a command by appending its reply to out. The arguments
+// are only valid until the handler returns.
+type Handler func(c evio.Conn, args [][]byte, out []byte) ([]byte, evio.Action)
+
+// conn is the state of a connection.
+type conn struct {
+	is   evio.InputStream
+	more bool // commands were left for the next call
+}
+
+// Config is the configuration of a Data event.
+type Config struct {
+	// MaxPipelined is the maximum number of commands that the event handles
+	// per call. The commands that follow are handled once the replies have
+	// been written, so that a client that pipelines many commands doesn't
+	// hold the loop from the other connections. Zero means no limit.
+	MaxPipelined int
+}
+
+var (
+	errInvalidMultiBulk = errors.New("ERR Protocol error: invalid multibulk length")
+	errInvalidBulk      = errors.New("ERR Protocol error: invalid bulk length")
+	errExpectedDollar   = errors.New("ERR Protocol error: expected '$'")
+	errUnbalancedQuotes = errors.New("ERR Protocol error: unbalanced quotes in request")
+)
+
+// Data returns a Data event that decodes the commands of a connection and
+// calls the handler for each of them, at most Config.MaxPipelined per call.
+// A protocol error is replied to and closes the connection.
+func Data(config Config, handler Handler) func(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+	return func(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+		rc, ok := c.Context().(*conn)
+		if in == nil && (!ok || !rc.more) {
+			return
+		}
+		if !ok {
+			rc = &conn{}
+			c.SetContext(rc)
+		}
+		rc.more = false
+		data := rc.is.Begin(in)
+		for n := 0; action == evio.None && len(data) > 0; {
+			args, leftover, complete, err := ReadCommand(data)
+			if err != nil {
+				out = AppendError(out, err.Error())
+				action = evio.Close
+				data = nil
+				break
+			}
+			if !complete {
+				break
+			}
+			if config.MaxPipelined > 0 && n == config.MaxPipelined {
+				// More calls the event again with nil input
+				rc.more = true
+				break
+			}
+			data = leftover
+			if len(args) == 0 {
+				continue // empty inline command
+			}
+			out, action = handler(c, args, out)
+			n++
+		}
+		if rc.more {
+			action = evio.More
+		} else if action != evio.None {
+			data = nil
+		}
+		rc.is.End(data)
+		return
+	}
+}
+
+// ReadCommand reads the next command from the data. The command is complete
+// when all of it has been read, the leftover holds the data that follows it.
+// The arguments point into the data.
+func ReadCommand(data []byte) (args [][]byte, leftover []byte, complete bool, err error) {
+	if len(data) == 0 {
+		return nil, data, false, nil
+	}
+	if data[0] != '*' {
+		return readInline(data)
+	}
+	n, i, ok := readLength(data[1:])
+	if !ok {
+		return nil, data, false, nil
+	}
+	if n < 0 || n > 1024*1024 {
+		return nil, data, false, errInvalidMultiBulk
+	}
+	pos := 1 + i
+	for j := 0; j < n; j++ {
+		if pos == len(data) {
+			return nil, data, false, nil
+		}
+		if data[pos] != '$' {
+			return nil, data, false, errExpectedDollar
+		}
+		size, i, ok := readLength(data[pos+1:])
+		if !ok {
+			return nil, data, false, nil
+		}
+		if size < 0 || size > 512*1024*1024 {
+			return nil, data, false, errInvalidBulk
+		}
+		pos += 1 + i
+		if len(data)-pos < size+2 {
+			return nil, data, false, nil
+		}
+		if data[pos+size] != '\r' || data[pos+size+1] != '\n' {
+			return nil, data, false, errInvalidBulk
+		}
+		args = append(args, data[pos:pos+size])
+		pos += size + 2
+	}
+	return args, data[pos:], true, nil
+}
+
+// readLength reads a number that ends with a CRLF. The returned index is
+// past the CRLF, ok is false when the line isn't complete.
+func readLength(data []byte) (n, i int, ok bool) {
+	end := bytes.IndexByte(data, '\n')
+	if end == -1 {
+		return 0, 0, false
+	}
+	line := data[:end]
+	if len(line) == 0 || line[len(line)-1] != '\r' {
+		return -1, end + 1, true
+	}
+	n, err := strconv.Atoi(string(line[:len(line)-1]))
+	if err != nil {
+		return -1, end + 1, true
+	}
+	return n, end + 1, true
+}
+
+// readInline reads a command that's a line of space separated arguments.
+// Arguments may be quoted.
+func readInline(data []byte) (args [][]byte, leftover []byte, complete bool, err error) {
+	end := bytes.IndexByte(data, '\n')
+	if end == -1 {
+		return nil, data, false, nil
+	}
+	line := bytes.TrimRight(data[:end], "\r")
+	leftover = data[end+1:]
+	for len(line) > 0 {
+		switch line[0] {
+		case ' ', '\t':
+			line = line[1:]
+			continue
+		case '"', '\'':
+			quote := line[0]
+			i := bytes.IndexByte(line[1:], quote)
+			if i == -1 {
+				return nil, data, false, errUnbalancedQuotes
+			}
+			args = append(args, line[1:1+i])
+			line = line[2+i:]
+			continue
+		}
+		i := bytes.IndexAny(line, " \t")
+		if i == -1 {
+			i = len(line)
+		}
+		args = append(args, line[:i])
+		line = line[i:]
+	}
+	return args, leftover, true, nil
+}
+
+// AppendString appends a simple string reply.
+func AppendString(b []byte, s string) []byte {
+	b = append(b, '+')
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// AppendError appends an error reply.
+func AppendError(b []byte, s string) []byte {
+	b = append(b, '-')
+	b = append(b, s...)
+	return append(b, '\r', '\n')
+}
+
+// AppendInt appends an integer reply.
+func AppendInt(b []byte, n int64) []byte {
+	b = append(b, ':')
+	b = strconv.AppendInt(b, n, 10)
+	return append(b, '\r', '\n')
+}
+
+// AppendBulk appends a bulk string reply.
+func AppendBulk(b []byte, bulk []byte) []byte {
+	b = append(b, '$')
+	b = strconv.AppendInt(b, int64(len(bulk)), 10)
+	b = append(b, '\r', '\n')
+	b = append(b, bulk...)
+	return append(b, '\r', '\n')
+}
+
+// AppendBulkString appends a bulk string reply.
+func AppendBulkString(b []byte, bulk string) []byte {
+	return AppendBulk(b, []byte(bulk))
+}
+
+// AppendArray appends the header of an array reply with n elements, which
+// must be appended next.
+func AppendArray(b []byte, n int) []byte {
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(n), 10)
+	return append(b, '\r', '\n')
+}
+
+// AppendNull appends a null bulk reply.
+func AppendNull(b []byte) []byte {
+	return append(b, "$-1\r\n"...)
+}
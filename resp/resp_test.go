@@ -0,0 +1,203 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jursonmo/evio"
+)
+
+func TestReadCommand(t *testing.T) {
+	frames := "*1\r\n$4\r\nPING\r\n" +
+		"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n" +
+		"GET \"key\"\r\n"
+	expected := []string{"[PING]", "[SET key value]", "[GET key]"}
+	// feed the frames one byte at a time
+	var got []string
+	var data []byte
+	for i := 0; i < len(frames); i++ {
+		data = append(data, frames[i])
+		for {
+			args, leftover, complete, err := ReadCommand(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !complete {
+				break
+			}
+			got = append(got, fmt.Sprintf("%s", args))
+			data = append([]byte{}, leftover...)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if len(data) != 0 {
+		t.Fatalf("expected no leftover, got %q", data)
+	}
+	for _, bad := range []string{"*x\r\n", "*1\r\n:1\r\n", "*1\r\n$3\r\nabcd\r\n", "GET \"key\r\n"} {
+		if _, _, _, err := ReadCommand([]byte(bad)); err == nil {
+			t.Fatalf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	var b []byte
+	b = AppendString(b, "OK")
+	b = AppendError(b, "ERR bad")
+	b = AppendInt(b, -12)
+	b = AppendBulkString(b, "value")
+	b = AppendNull(b)
+	b = AppendArray(b, 2)
+	b = AppendBulk(b, []byte("a"))
+	b = AppendBulk(b, nil)
+	expected := "+OK\r\n-ERR bad\r\n:-12\r\n$5\r\nvalue\r\n$-1\r\n*2\r\n$1\r\na\r\n$0\r\n\r\n"
+	if string(b) != expected {
+		t.Fatalf("expected %q, got %q", expected, b)
+	}
+}
+
+func TestData(t *testing.T) {
+	keys := make(map[string]string)
+	handler := func(c evio.Conn, args [][]byte, out []byte) ([]byte, evio.Action) {
+		switch strings.ToUpper(string(args[0])) {
+		case "PING":
+			return AppendString(out, "PONG"), evio.None
+		case "SET":
+			keys[string(args[1])] = string(args[2])
+			return AppendString(out, "OK"), evio.None
+		case "GET":
+			if v, ok := keys[string(args[1])]; ok {
+				return AppendBulkString(out, v), evio.None
+			}
+			return AppendNull(out), evio.None
+		case "SHUTDOWN":
+			return nil, evio.Shutdown
+		}
+		return AppendError(out, "ERR unknown command"), evio.None
+	}
+	var replies []string
+	var events evio.Events
+	events.Data = Data(Config{}, handler)
+	events.Serving = func(_ evio.Server) (action evio.Action) {
+		go func() {
+			c, err := net.Dial("tcp", ":9953")
+			if err != nil {
+				panic(err)
+			}
+			defer c.Close()
+			frames := "*1\r\n$4\r\nPING\r\n*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n" +
+				"*2\r\n$3\r\nGET\r\n$1\r\nk\r\nGET missing\r\n"
+			for i := 0; i < len(frames); i += 5 {
+				end := i + 5
+				if end > len(frames) {
+					end = len(frames)
+				}
+				c.Write([]byte(frames[i:end]))
+				time.Sleep(time.Millisecond)
+			}
+			rd := bufio.NewReader(c)
+			for len(replies) < 5 {
+				line, err := rd.ReadString('\n')
+				if err != nil {
+					panic(err)
+				}
+				replies = append(replies, line)
+			}
+			c.Write([]byte("SHUTDOWN\r\n"))
+		}()
+		return
+	}
+	if err := evio.Serve(events, "tcp://:9953"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "+PONG\r\n+OK\r\n$1\r\nv\r\n$-1\r\n"
+	if strings.Join(replies, "") != expected {
+		t.Fatalf("expected %q, got %q", expected, strings.Join(replies, ""))
+	}
+}
+
+func TestMaxPipelined(t *testing.T) {
+	config := Config{MaxPipelined: 10}
+	// the handler records the order of the commands, and the size of the
+	// batch that each Data call handled
+	var order []string
+	var batch, maxBatch int
+	handler := func(c evio.Conn, args [][]byte, out []byte) ([]byte, evio.Action) {
+		switch string(args[0]) {
+		case "SLEEP":
+			// let the other client's commands arrive
+			time.Sleep(time.Millisecond * 100)
+		case "SHUTDOWN":
+			return nil, evio.Shutdown
+		}
+		order = append(order, string(args[0]))
+		batch++
+		return AppendString(out, "OK"), evio.None
+	}
+	data := Data(config, handler)
+	var events evio.Events
+	events.Data = func(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+		batch = 0
+		out, action = data(c, in)
+		if batch > maxBatch {
+			maxBatch = batch
+		}
+		return
+	}
+	events.Serving = func(_ evio.Server) (action evio.Action) {
+		go func() {
+			client := func(cmds string, n int, done chan bool) net.Conn {
+				c, err := net.Dial("tcp", ":9805")
+				if err != nil {
+					panic(err)
+				}
+				if _, err := c.Write([]byte(cmds)); err != nil {
+					panic(err)
+				}
+				go func() {
+					rd := bufio.NewReader(c)
+					for i := 0; i < n; i++ {
+						if _, err := rd.ReadString('\n'); err != nil {
+							panic(err)
+						}
+					}
+					done <- true
+				}()
+				return c
+			}
+			done := make(chan bool)
+			a := client("SLEEP\r\n"+strings.Repeat("A\r\n", 1000), 1001, done)
+			defer a.Close()
+			b := client(strings.Repeat("B\r\n", 10), 10, done)
+			defer b.Close()
+			<-done
+			<-done
+			b.Write([]byte("SHUTDOWN\r\n"))
+		}()
+		return
+	}
+	if err := evio.Serve(events, "tcp://:9805"); err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 1011 {
+		t.Fatalf("expected 1011 commands, got %d", len(order))
+	}
+	if maxBatch > config.MaxPipelined {
+		t.Fatalf("expected at most %d commands per call, got %d", config.MaxPipelined, maxBatch)
+	}
+	// the commands of the second client are handled while the first one's
+	// batch is still being worked through
+	if order[len(order)-1] != "A" {
+		t.Fatalf("expected the pipelined batch to be interleaved with the other client")
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package websocket serves WebSocket (RFC 6455) connections from the evio
+// Data event. The opening handshake is an HTTP request that an evhttp
+// handler passes to Upgrade, which takes the connection over and calls a
+// handler for each message from then on:
+//
+//	events.Data = evhttp.Data(evhttp.Config{}, func(c evio.Conn, req *evhttp.Request, res *evhttp.Response) {
+//		websocket.Upgrade(req, res, websocket.Config{}, func(ws *websocket.Conn, op websocket.Opcode, msg, out []byte) ([]byte, evio.Action) {
+//			return ws.AppendMessage(out, op, msg), evio.None
+//		})
+//	})
+//
+// Fragmented messages are put together, pings are answered and a close
+// frame from the peer is answered before the connection is closed. The
+// permessage-deflate extension (RFC 7692) is negotiated when Config.Deflate
+// is set, in which case the messages are compressed in both directions.
+//
+// Setting Events.CloseFrame to CloseFrame lets a handler close the
+// connection with a close frame holding a status code and a reason:
+//
+//	events.CloseFrame = websocket.CloseFrame
+//	...
+//	ws.CloseWithReason(websocket.CloseGoingAway, "restarting")
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jursonmo/evio"
+	"github.com/jursonmo/evio/evhttp"
+	"github.com/jursonmo/evio/wsdeflate"
+)
+
+// Opcode is the type of a frame.
+type Opcode byte
+
+// The opcodes of RFC 6455, section 5.2.
+const (
+	Continuation Opcode = 0x0
+	Text         Opcode = 0x1
+	Binary       Opcode = 0x2
+	Close        Opcode = 0x8
+	Ping         Opcode = 0x9
+	Pong         Opcode = 0xa
+)
+
+// The status codes of close frames, from RFC 6455, section 7.4.1.
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseInvalidData   = 1007
+	CloseTooLarge      = 1009
+)
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40
+	rsvBits = 0x70
+	maskBit = 0x80
+)
+
+// accept is appended to the key of the handshake to compute the accept
+// header.
+const accept = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Config is the configuration of the connections that Upgrade takes over.
+type Config struct {
+	// Deflate enables the permessage-deflate extension when the client
+	// offers it. Its MaxSize defaults to MaxMessageSize.
+	Deflate *wsdeflate.Config
+	// MaxMessageSize is the most that a message may be, compressed or
+	// not. Larger messages close the connection. Zero means no limit.
+	MaxMessageSize int
+}
+
+// Handler handles a Text or Binary message by appending the frames of its
+// reply to out. The message is only valid until the handler returns.
+type Handler func(ws *Conn, op Opcode, msg, out []byte) ([]byte, evio.Action)
+
+// Conn is a WebSocket connection. It's passed to the handler, and the
+// connection that it wraps may be used like in any other event.
+type Conn struct {
+	evio.Conn
+	handler Handler
+	maxSize int
+	ext     *wsdeflate.Extension // nil unless permessage-deflate was negotiated
+	is      evio.InputStream
+	msg     []byte // the fragments of the message being read
+	msgOp   Opcode // zero when no message is being read
+	deflate bool   // the message being read is compressed
+}
+
+// Upgrade answers the opening handshake of a WebSocket from an evhttp
+// handler, and hands the connection to handler once the response is
+// written. It returns false, with the response set to an error, when the
+// request isn't a valid handshake.
+func Upgrade(req *evhttp.Request, res *evhttp.Response, config Config, handler Handler) bool {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 ||
+		req.Method != "GET" || !hasToken(req.Header.Get("Connection"), "upgrade") ||
+		!hasToken(req.Header.Get("Upgrade"), "websocket") {
+		res.Status = http.StatusBadRequest
+		res.Body = []byte("bad websocket handshake\n")
+		return false
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		res.Status = http.StatusUpgradeRequired
+		res.Header.Set("Sec-WebSocket-Version", "13")
+		return false
+	}
+	ws := &Conn{handler: handler, maxSize: config.MaxMessageSize}
+	if config.Deflate != nil {
+		dc := *config.Deflate
+		if dc.MaxSize == 0 {
+			dc.MaxSize = config.MaxMessageSize
+		}
+		if ext, ok := wsdeflate.Negotiate(req.Header.Get("Sec-WebSocket-Extensions"), dc); ok {
+			ws.ext = ext
+			res.Header.Set("Sec-WebSocket-Extensions", ext.Header())
+		}
+	}
+	res.Status = http.StatusSwitchingProtocols
+	res.Header.Set("Upgrade", "websocket")
+	res.Header.Set("Connection", "Upgrade")
+	res.Header.Set("Sec-WebSocket-Accept", acceptKey(key))
+	res.Hijack(ws.data)
+	return true
+}
+
+// acceptKey returns the Sec-WebSocket-Accept header of a key.
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + accept))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// hasToken reports whether the comma separated header holds the token.
+func hasToken(header, token string) bool {
+	for _, t := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Deflate reports whether permessage-deflate was negotiated.
+func (ws *Conn) Deflate() bool {
+	return ws.ext != nil
+}
+
+// AppendMessage appends a message to b as a single frame. Text and Binary
+// messages are compressed when permessage-deflate was negotiated.
+func (ws *Conn) AppendMessage(b []byte, op Opcode, msg []byte) []byte {
+	if ws.ext != nil && (op == Text || op == Binary) {
+		return appendFrame(b, finBit|rsv1Bit|byte(op), ws.ext.Compress(msg))
+	}
+	return appendFrame(b, finBit|byte(op), msg)
+}
+
+// appendFrame appends an unmasked frame, as sent by servers.
+func appendFrame(b []byte, b0 byte, payload []byte) []byte {
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, b0, byte(n))
+	case n <= 0xffff:
+		b = append(b, b0, 126, byte(n>>8), byte(n))
+	default:
+		b = append(b, b0, 127)
+		for i := 56; i >= 0; i -= 8 {
+			b = append(b, byte(uint64(n)>>uint(i)))
+		}
+	}
+	return append(b, payload...)
+}
+
+// CloseFrame returns a close frame with the code and the reason, for
+// Events.CloseFrame. The reason is cut to fit in a control frame, and a
+// code of zero sends a close frame without a payload.
+func CloseFrame(c evio.Conn, code int, reason string) []byte {
+	return appendClose(nil, code, reason)
+}
+
+// appendClose appends a close frame with the code and the reason, which is
+// cut to fit in a control frame.
+func appendClose(b []byte, code int, reason string) []byte {
+	if code == 0 {
+		return appendFrame(b, finBit|byte(Close), nil)
+	}
+	for len(reason) > 123 {
+		_, n := utf8.DecodeLastRuneInString(reason[:124])
+		reason = reason[:124-n]
+	}
+	payload := append([]byte{byte(code >> 8), byte(code)}, reason...)
+	return appendFrame(b, finBit|byte(Close), payload)
+}
+
+// frame is a frame read from a client.
+type frame struct {
+	b0      byte
+	payload []byte // unmasked in place
+}
+
+var errIncomplete = errors.New("incomplete frame")
+
+// closeError is a reason to fail the connection.
+type closeError struct {
+	code   int
+	reason string
+}
+
+func (e *closeError) Error() string { return e.reason }
+
+// readFrame reads the next frame from the data, and returns the number of
+// bytes that it took.
+func readFrame(data []byte, maxSize int) (f frame, n int, err error) {
+	if len(data) < 2 {
+		return f, 0, errIncomplete
+	}
+	f.b0 = data[0]
+	if data[1]&maskBit == 0 {
+		return f, 0, &closeError{CloseProtocolError, "unmasked frame"}
+	}
+	size, n := uint64(data[1]&0x7f), 2
+	switch size {
+	case 126:
+		if len(data) < 4 {
+			return f, 0, errIncomplete
+		}
+		size, n = uint64(data[2])<<8|uint64(data[3]), 4
+	case 127:
+		if len(data) < 10 {
+			return f, 0, errIncomplete
+		}
+		size = 0
+		for _, b := range data[2:10] {
+			size = size<<8 | uint64(b)
+		}
+		n = 10
+	}
+	if size > 1<<62 || (maxSize > 0 && size > uint64(maxSize)) {
+		return f, 0, &closeError{CloseTooLarge, "message too large"}
+	}
+	if uint64(len(data)-n) < 4+size {
+		return f, 0, errIncomplete
+	}
+	mask := data[n : n+4]
+	n += 4
+	f.payload = data[n : n+int(size)]
+	for i := range f.payload {
+		f.payload[i] ^= mask[i&3]
+	}
+	return f, n + int(size), nil
+}
+
+// data is the Data event of the connection once it's upgraded.
+func (ws *Conn) data(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+	if in == nil {
+		return
+	}
+	ws.Conn = c
+	data := ws.is.Begin(in)
+	for action == evio.None && len(data) > 0 {
+		f, n, err := readFrame(data, ws.maxSize)
+		if err == errIncomplete {
+			break
+		}
+		if err == nil {
+			data = data[n:]
+			out, action, err = ws.frame(f, out)
+		}
+		if err, ok := err.(*closeError); ok {
+			out = appendClose(out, err.code, err.reason)
+			action = evio.Close
+		}
+	}
+	if action != evio.None {
+		data = nil
+	}
+	ws.is.End(data)
+	return
+}
+
+// frame handles a frame from the client.
+func (ws *Conn) frame(f frame, out []byte) ([]byte, evio.Action, error) {
+	op, fin, rsv1 := Opcode(f.b0&0x0f), f.b0&finBit != 0, f.b0&rsv1Bit != 0
+	if f.b0&rsvBits&^rsv1Bit != 0 || (rsv1 && (ws.ext == nil || op == Continuation || op >= Close)) {
+		return out, evio.None, &closeError{CloseProtocolError, "reserved bits set"}
+	}
+	switch op {
+	case Ping, Pong, Close:
+		if !fin || len(f.payload) > 125 {
+			return out, evio.None, &closeError{CloseProtocolError, "invalid control frame"}
+		}
+		switch op {
+		case Ping:
+			out = appendFrame(out, finBit|byte(Pong), f.payload)
+		case Close:
+			// the close is answered with the peer's code
+			if len(f.payload) == 1 {
+				return out, evio.None, &closeError{CloseProtocolError, "invalid close frame"}
+			}
+			code := 0
+			if len(f.payload) >= 2 {
+				code = int(f.payload[0])<<8 | int(f.payload[1])
+			}
+			return appendClose(out, code, ""), evio.Close, nil
+		}
+		return out, evio.None, nil
+	case Text, Binary:
+		if ws.msgOp != 0 {
+			return out, evio.None, &closeError{CloseProtocolError, "expected a continuation frame"}
+		}
+		if fin {
+			return ws.message(op, rsv1, f.payload, out)
+		}
+		ws.msgOp, ws.deflate = op, rsv1
+		ws.msg = append(ws.msg[:0], f.payload...)
+		return out, evio.None, nil
+	case Continuation:
+		if ws.msgOp == 0 {
+			return out, evio.None, &closeError{CloseProtocolError, "unexpected continuation frame"}
+		}
+		if ws.maxSize > 0 && len(ws.msg)+len(f.payload) > ws.maxSize {
+			return out, evio.None, &closeError{CloseTooLarge, "message too large"}
+		}
+		ws.msg = append(ws.msg, f.payload...)
+		if !fin {
+			return out, evio.None, nil
+		}
+		op := ws.msgOp
+		ws.msgOp = 0
+		return ws.message(op, ws.deflate, ws.msg, out)
+	}
+	return out, evio.None, &closeError{CloseProtocolError, "unknown opcode"}
+}
+
+// message passes a complete message to the handler.
+func (ws *Conn) message(op Opcode, compressed bool, msg, out []byte) ([]byte, evio.Action, error) {
+	if compressed {
+		var err error
+		if msg, err = ws.ext.Decompress(msg); err == wsdeflate.ErrTooLarge {
+			return out, evio.None, &closeError{CloseTooLarge, "message too large"}
+		} else if err != nil {
+			return out, evio.None, &closeError{CloseInvalidData, "invalid compressed data"}
+		}
+	}
+	if op == Text && !utf8.Valid(msg) {
+		return out, evio.None, &closeError{CloseInvalidData, "invalid utf-8"}
+	}
+	out, action := ws.handler(ws, op, msg, out)
+	return out, action, nil
+}
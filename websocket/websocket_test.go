@@ -0,0 +1,401 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/jursonmo/evio"
+	"github.com/jursonmo/evio/evhttp"
+	"github.com/jursonmo/evio/wsdeflate"
+)
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// echo replies to text messages in upper case and to binary ones as is.
+func echo(ws *Conn, op Opcode, msg, out []byte) ([]byte, evio.Action) {
+	if op == Text {
+		msg = bytes.ToUpper(msg)
+	}
+	return ws.AppendMessage(out, op, msg), evio.None
+}
+
+// serve serves WebSockets with the handler until the client returns.
+func serve(addr string, config Config, handler Handler, client func()) {
+	var events evio.Events
+	events.CloseFrame = CloseFrame
+	data := evhttp.Data(evhttp.Config{}, func(c evio.Conn, req *evhttp.Request, res *evhttp.Response) {
+		Upgrade(req, res, config, handler)
+	})
+	events.Data = func(c evio.Conn, in []byte) (out []byte, action evio.Action) {
+		if string(in) == "quit" {
+			return nil, evio.Shutdown
+		}
+		return data(c, in)
+	}
+	events.Serving = func(_ evio.Server) (action evio.Action) {
+		go func() {
+			client()
+			c, err := net.Dial("tcp", addr)
+			must(err)
+			defer c.Close()
+			c.Write([]byte("quit"))
+			c.Read(make([]byte, 1))
+		}()
+		return
+	}
+	must(evio.Serve(events, "tcp://"+addr))
+}
+
+// dial opens a WebSocket with the extensions header.
+func dial(addr, extensions string) (net.Conn, *bufio.Reader, *http.Response) {
+	c, err := net.Dial("tcp", addr)
+	must(err)
+	req := "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"
+	if extensions != "" {
+		req += "Sec-WebSocket-Extensions: " + extensions + "\r\n"
+	}
+	_, err = c.Write([]byte(req + "\r\n"))
+	must(err)
+	rd := bufio.NewReader(c)
+	res, err := http.ReadResponse(rd, nil)
+	must(err)
+	return c, rd, res
+}
+
+// writeFrame writes a masked frame, as sent by clients.
+func writeFrame(c net.Conn, b0 byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	b := []byte{b0}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, maskBit|byte(n))
+	default:
+		b = append(b, maskBit|126, byte(n>>8), byte(n))
+	}
+	b = append(b, mask...)
+	for i, p := range payload {
+		b = append(b, p^mask[i&3])
+	}
+	_, err := c.Write(b)
+	must(err)
+}
+
+// readServerFrame reads an unmasked frame.
+func readServerFrame(rd *bufio.Reader) (b0 byte, payload []byte) {
+	var h [2]byte
+	_, err := io.ReadFull(rd, h[:])
+	must(err)
+	n := int(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(rd, ext[:])
+		n = int(ext[0])<<8 | int(ext[1])
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(rd, ext[:])
+		n = 0
+		for _, b := range ext {
+			n = n<<8 | int(b)
+		}
+	}
+	must(err)
+	payload = make([]byte, n)
+	_, err = io.ReadFull(rd, payload)
+	must(err)
+	return h[0], payload
+}
+
+func TestAcceptKey(t *testing.T) {
+	// RFC 6455, section 1.3
+	if key := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept key %q", key)
+	}
+}
+
+func TestUpgradeErrors(t *testing.T) {
+	header := func(kv ...string) http.Header {
+		h := make(http.Header)
+		for i := 0; i < len(kv); i += 2 {
+			h.Set(kv[i], kv[i+1])
+		}
+		return h
+	}
+	valid := []string{"Upgrade", "websocket", "Connection", "keep-alive, Upgrade",
+		"Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ=="}
+	for _, test := range []struct {
+		method string
+		header http.Header
+		status int
+	}{
+		{"GET", header(append(valid, "Sec-WebSocket-Version", "13")...), http.StatusSwitchingProtocols},
+		{"GET", header(append(valid, "Sec-WebSocket-Version", "8")...), http.StatusUpgradeRequired},
+		{"POST", header(append(valid, "Sec-WebSocket-Version", "13")...), http.StatusBadRequest},
+		{"GET", header("Upgrade", "websocket", "Connection", "Upgrade", "Sec-WebSocket-Version", "13"), http.StatusBadRequest},
+		{"GET", header("Connection", "Upgrade", "Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==", "Sec-WebSocket-Version", "13"), http.StatusBadRequest},
+	} {
+		req := &evhttp.Request{Method: test.method, Header: test.header}
+		res := &evhttp.Response{Header: make(http.Header)}
+		ok := Upgrade(req, res, Config{}, echo)
+		if res.Status != test.status || ok != (test.status == http.StatusSwitchingProtocols) {
+			t.Fatalf("%s %v: expected %d, got %d (%v)", test.method, test.header, test.status, res.Status, ok)
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+	var accept, pong, first, second string
+	var closing []byte
+	serve(":9801", Config{}, echo, func() {
+		c, rd, res := dial(":9801", "permessage-deflate")
+		defer c.Close()
+		accept = res.Header.Get("Sec-WebSocket-Accept")
+		if res.Header.Get("Sec-WebSocket-Extensions") != "" {
+			panic("expected no extension without Config.Deflate")
+		}
+		// a fragmented message with a ping in the middle
+		writeFrame(c, byte(Text), []byte("hel"))
+		writeFrame(c, finBit|byte(Ping), []byte("ping"))
+		writeFrame(c, finBit|byte(Continuation), []byte("lo"))
+		_, p := readServerFrame(rd)
+		pong = string(p)
+		_, p = readServerFrame(rd)
+		first = string(p)
+		writeFrame(c, finBit|byte(Binary), bytes.Repeat([]byte("b"), 300))
+		_, p = readServerFrame(rd)
+		second = string(p)
+		// an unmasked frame fails the connection
+		c.Write([]byte{finBit | byte(Text), 1, 'x'})
+		_, closing = readServerFrame(rd)
+		if _, err := rd.ReadByte(); err != io.EOF {
+			panic("expected the connection to be closed")
+		}
+	})
+	if accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept header %q", accept)
+	}
+	if pong != "ping" || first != "HELLO" || second != strings.Repeat("b", 300) {
+		t.Fatalf("unexpected replies %q, %q and %q", pong, first, second)
+	}
+	if len(closing) < 2 || int(closing[0])<<8|int(closing[1]) != CloseProtocolError {
+		t.Fatalf("expected a protocol error close frame, got %q", closing)
+	}
+}
+
+func TestCloseWithReason(t *testing.T) {
+	var reply, closing []byte
+	var cerr error
+	handler := func(ws *Conn, op Opcode, msg, out []byte) ([]byte, evio.Action) {
+		cerr = ws.CloseWithReason(CloseGoingAway, "going away")
+		return ws.AppendMessage(out, op, []byte("last message")), evio.None
+	}
+	serve(":9797", Config{}, handler, func() {
+		c, rd, _ := dial(":9797", "")
+		defer c.Close()
+		writeFrame(c, finBit|byte(Text), []byte("bye"))
+		_, reply = readServerFrame(rd)
+		_, closing = readServerFrame(rd)
+		// the connection is closed once the close frame was sent
+		if _, err := rd.ReadByte(); err != io.EOF {
+			panic("expected the connection to be closed")
+		}
+	})
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if string(reply) != "last message" || string(closing) != "\x03\xe9going away" {
+		t.Fatalf("expected the message and then the close frame, got %q and %q", reply, closing)
+	}
+}
+
+func TestCloseFrame(t *testing.T) {
+	if frame := CloseFrame(nil, 0, "ignored"); string(frame) != "\x88\x00" {
+		t.Fatalf("expected an empty close frame, got %q", frame)
+	}
+	// the reason is cut on a rune so that the payload fits in 125 bytes
+	reason := strings.Repeat("a", 122) + "é"
+	frame := CloseFrame(nil, CloseNormal, reason)
+	if frame[1] != 124 || string(frame[4:]) != reason[:122] {
+		t.Fatalf("expected the reason to be cut to 122 bytes, got %q", frame)
+	}
+}
+
+// tail ends the payload of a compressed message, which is removed by the
+// sender (RFC 7692, section 7.2.1).
+var tail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// flateClient compresses and decompresses the messages of a client, with a
+// flate stream in each direction, like a client with context takeover does.
+// Without context takeover its messages are compressed on their own.
+type flateClient struct {
+	w        *flate.Writer
+	buf      bytes.Buffer
+	pw       *io.PipeWriter
+	r        io.ReadCloser
+	takeover bool
+}
+
+func newFlateClient(takeover bool) *flateClient {
+	fc := &flateClient{takeover: takeover}
+	fc.w, _ = flate.NewWriter(&fc.buf, flate.BestCompression)
+	pr, pw := io.Pipe()
+	fc.pw, fc.r = pw, flate.NewReader(pr)
+	return fc
+}
+
+func (fc *flateClient) compress(msg []byte) []byte {
+	fc.buf.Reset()
+	if !fc.takeover {
+		fc.w.Reset(&fc.buf)
+	}
+	fc.w.Write(msg)
+	fc.w.Flush()
+	return bytes.TrimSuffix(fc.buf.Bytes(), tail)
+}
+
+func (fc *flateClient) decompress(payload []byte, n int) []byte {
+	go func() {
+		fc.pw.Write(payload)
+		fc.pw.Write(tail)
+	}()
+	msg := make([]byte, n)
+	_, err := io.ReadFull(fc.r, msg)
+	must(err)
+	return msg
+}
+
+func TestDeflate(t *testing.T) {
+	t.Run("takeover", func(t *testing.T) {
+		testDeflate(t, ":9800", "permessage-deflate", true)
+	})
+	t.Run("no-takeover", func(t *testing.T) {
+		testDeflate(t, ":9799", "permessage-deflate; server_no_context_takeover; client_no_context_takeover", false)
+	})
+}
+
+// testDeflate echoes messages that are compressed in both directions.
+func testDeflate(t *testing.T, addr, offer string, takeover bool) {
+	var ext string
+	var rsv1 []bool
+	var sizes []int
+	var replies []string
+	msgs := []string{"hello", "hello again", strings.Repeat("hello ", 1000), "hello"}
+	serve(addr, Config{Deflate: &wsdeflate.Config{}}, echo, func() {
+		c, rd, res := dial(addr, offer)
+		defer c.Close()
+		ext = res.Header.Get("Sec-WebSocket-Extensions")
+		fc := newFlateClient(takeover)
+		for _, msg := range msgs {
+			writeFrame(c, finBit|rsv1Bit|byte(Text), fc.compress([]byte(msg)))
+			b0, payload := readServerFrame(rd)
+			rsv1 = append(rsv1, b0&rsv1Bit != 0)
+			sizes = append(sizes, len(payload))
+			replies = append(replies, string(fc.decompress(payload, len(msg))))
+		}
+	})
+	if ext != offer {
+		t.Fatalf("expected the extension %q, got %q", offer, ext)
+	}
+	for i, msg := range msgs {
+		if !rsv1[i] || replies[i] != strings.ToUpper(msg) {
+			t.Fatalf("message %d: expected %q compressed, got %q (rsv1 %v)", i, strings.ToUpper(msg), replies[i], rsv1[i])
+		}
+	}
+	if sizes[2] > 100 {
+		t.Fatalf("expected a repeated message to compress, got %d bytes", sizes[2])
+	}
+}
+
+// nodeClient is run by node with the URL of the server. It sends the
+// messages, closes once they're all echoed, and prints what it saw.
+const nodeClient = `
+const ws = new WebSocket(process.argv[1]);
+ws.binaryType = "arraybuffer";
+const msgs = JSON.parse(process.argv[2]);
+const got = [];
+ws.onopen = () => {
+	for (const m of msgs) ws.send(m);
+	ws.send(new Uint8Array([1, 2, 3]));
+};
+ws.onmessage = (e) => {
+	got.push(typeof e.data === "string" ? e.data : Array.from(new Uint8Array(e.data)).join(","));
+	if (got.length === msgs.length + 1) ws.close(1000, "done");
+};
+ws.onclose = (e) => {
+	console.log(JSON.stringify({extensions: ws.extensions, got: got, code: e.code}));
+};
+`
+
+func TestNode(t *testing.T) {
+	// the WebSocket client of node is behind a flag before node 22
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	hasWebSocket := func(flags ...string) bool {
+		out, err := exec.Command(node, append(flags, "-p", "typeof WebSocket")...).Output()
+		return err == nil && strings.TrimSpace(string(out)) == "function"
+	}
+	args := []string{"--experimental-websocket", "-e", nodeClient}
+	if !hasWebSocket(args[0]) {
+		// the flag isn't known or is gone
+		args = args[1:]
+		if !hasWebSocket() {
+			t.Skip("node has no WebSocket client")
+		}
+	}
+	msgs := []string{"hello", "hello again", strings.Repeat("hello ", 1000)}
+	encoded, _ := json.Marshal(msgs)
+	var compressed int
+	handler := func(ws *Conn, op Opcode, msg, out []byte) ([]byte, evio.Action) {
+		if ws.Deflate() {
+			compressed++
+		}
+		return echo(ws, op, msg, out)
+	}
+	var result struct {
+		Extensions string
+		Got        []string
+		Code       int
+	}
+	var output []byte
+	var runErr error
+	serve(":9798", Config{Deflate: &wsdeflate.Config{}}, handler, func() {
+		cmd := exec.Command(node, append(args, "ws://127.0.0.1:9798/", string(encoded))...)
+		output, runErr = cmd.Output()
+	})
+	if runErr != nil {
+		t.Fatalf("node failed: %v: %s", runErr, output)
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		t.Fatalf("unexpected output %q", output)
+	}
+	if !strings.HasPrefix(result.Extensions, "permessage-deflate") || compressed != len(msgs)+1 {
+		t.Fatalf("expected permessage-deflate, got %q and %d compressed replies", result.Extensions, compressed)
+	}
+	expected := append([]string{}, msgs...)
+	for i := range expected {
+		expected[i] = strings.ToUpper(expected[i])
+	}
+	expected = append(expected, "1,2,3")
+	if strings.Join(result.Got, "\n") != strings.Join(expected, "\n") || result.Code != CloseNormal {
+		t.Fatalf("expected the echoes and a normal close, got %q and %d", result.Got, result.Code)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package wsdeflate implements the permessage-deflate extension of
+// WebSocket (RFC 7692) for the WebSocket servers that are built on evio.
+// The websocket package uses it when its Config.Deflate is set. It doesn't
+// frame messages, so other servers negotiate the extension from the
+// Sec-WebSocket-Extensions header of the opening handshake, keep the
+// extension in the context of the connection, and pass the payloads of
+// the messages through it.
+//
+//	ext, ok := wsdeflate.Negotiate(req.Header.Get("Sec-WebSocket-Extensions"), config)
+//	if ok {
+//		// add "Sec-WebSocket-Extensions: " + ext.Header() to the response
+//		c.SetContext(ext)
+//	}
+//
+// Frames that have RSV1 set are decompressed once the message is complete,
+// and the payloads of the messages that are sent are compressed, with RSV1
+// set on their first frame:
+//
+//	payload, err := ext.Decompress(payload)
+//	payload = ext.Compress(payload)
+//
+// An extension holds the flate state of one connection and must only be
+// used from its events.
+package wsdeflate
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrTooLarge is returned by Decompress for a message that decompresses to
+// more than Config.MaxSize.
+var ErrTooLarge = errors.New("decompressed message too large")
+
+// tail ends the payload of a compressed message, which is removed by the
+// sender (RFC 7692, section 7.2.1).
+var tail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// final is an empty final block, which ends the flate stream once a message
+// has been read.
+var final = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// window is the size of the LZ77 window, which is all that compress/flate
+// supports.
+const window = 1 << 15
+
+// Config is the server side of the negotiation.
+type Config struct {
+	// ServerNoContextTakeover compresses each message on its own, which
+	// saves keeping the window of a connection between messages at the
+	// cost of compression.
+	ServerNoContextTakeover bool
+	// ClientNoContextTakeover asks the clients to compress each message on
+	// their own, so that their window isn't kept between messages.
+	ClientNoContextTakeover bool
+	// Level is the compression level of compress/flate. Zero is
+	// flate.DefaultCompression.
+	Level int
+	// MaxSize is the most that a message may decompress to. Zero means no
+	// limit.
+	MaxSize int
+}
+
+// Params are the negotiated parameters.
+type Params struct {
+	ServerNoContextTakeover bool
+	ClientNoContextTakeover bool
+	// ClientMaxWindowBits is the window that the client compresses with,
+	// from 8 to 15. The server's window is always 15 bits.
+	ClientMaxWindowBits int
+}
+
+// Extension is the permessage-deflate state of a connection.
+type Extension struct {
+	params  Params
+	maxSize int
+	buf     bytes.Buffer  // compressed output
+	w       *flate.Writer // compressor
+	r       io.ReadCloser // decompressor
+	dict    []byte        // window of the client, with context takeover
+	in      bytes.Reader
+}
+
+// Negotiate accepts the first permessage-deflate offer of the value of a
+// Sec-WebSocket-Extensions header that the server supports. It returns
+// false when there's none, and the connection runs without compression.
+// Offers that limit the window of the server below 15 bits are declined,
+// because compress/flate always uses 15 bits.
+func Negotiate(header string, config Config) (*Extension, bool) {
+	for _, offer := range splitHeader(header, ',') {
+		params, ok := parseOffer(offer)
+		if !ok {
+			continue
+		}
+		params.ServerNoContextTakeover = params.ServerNoContextTakeover || config.ServerNoContextTakeover
+		params.ClientNoContextTakeover = params.ClientNoContextTakeover || config.ClientNoContextTakeover
+		level := config.Level
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		ext := &Extension{params: params, maxSize: config.MaxSize}
+		w, err := flate.NewWriter(&ext.buf, level)
+		if err != nil {
+			return nil, false
+		}
+		ext.w = w
+		return ext, true
+	}
+	return nil, false
+}
+
+// parseOffer parses one extension offer, and returns false when it isn't a
+// valid permessage-deflate offer that the server supports.
+func parseOffer(offer string) (params Params, ok bool) {
+	parts := splitHeader(offer, ';')
+	if len(parts) == 0 || !strings.EqualFold(parts[0], "permessage-deflate") {
+		return params, false
+	}
+	params.ClientMaxWindowBits = 15
+	seen := make(map[string]bool)
+	for _, part := range parts[1:] {
+		name, value := part, ""
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			name = strings.TrimSpace(part[:i])
+			value = strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+		}
+		name = strings.ToLower(name)
+		if seen[name] {
+			return params, false
+		}
+		seen[name] = true
+		switch name {
+		case "server_no_context_takeover":
+			if value != "" {
+				return params, false
+			}
+			params.ServerNoContextTakeover = true
+		case "client_no_context_takeover":
+			if value != "" {
+				return params, false
+			}
+			params.ClientNoContextTakeover = true
+		case "server_max_window_bits":
+			if bits, ok := windowBits(value); !ok || bits != 15 {
+				return params, false
+			}
+		case "client_max_window_bits":
+			if value == "" {
+				break
+			}
+			bits, ok := windowBits(value)
+			if !ok {
+				return params, false
+			}
+			params.ClientMaxWindowBits = bits
+		default:
+			return params, false
+		}
+	}
+	return params, true
+}
+
+// windowBits parses the value of a max_window_bits parameter.
+func windowBits(value string) (int, bool) {
+	bits, err := strconv.Atoi(value)
+	if err != nil || bits < 8 || bits > 15 {
+		return 0, false
+	}
+	return bits, true
+}
+
+// splitHeader splits a header value on sep and trims the parts, dropping
+// the empty ones.
+func splitHeader(s string, sep byte) []string {
+	var parts []string
+	for _, part := range strings.Split(s, string(sep)) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// Params returns the negotiated parameters.
+func (ext *Extension) Params() Params {
+	return ext.params
+}
+
+// Header returns the value of the Sec-WebSocket-Extensions header of the
+// handshake response, which accepts the offer.
+func (ext *Extension) Header() string {
+	h := "permessage-deflate"
+	if ext.params.ServerNoContextTakeover {
+		h += "; server_no_context_takeover"
+	}
+	if ext.params.ClientNoContextTakeover {
+		h += "; client_no_context_takeover"
+	}
+	return h
+}
+
+// Compress returns the compressed payload of a message. The window is kept
+// for the next message unless ServerNoContextTakeover was negotiated.
+func (ext *Extension) Compress(payload []byte) []byte {
+	ext.buf.Reset()
+	if ext.params.ServerNoContextTakeover {
+		ext.w.Reset(&ext.buf)
+	}
+	// writes to a bytes.Buffer don't fail
+	ext.w.Write(payload)
+	ext.w.Flush()
+	out := ext.buf.Bytes()
+	if bytes.HasSuffix(out, tail) {
+		out = out[:len(out)-len(tail)]
+	}
+	return append([]byte(nil), out...)
+}
+
+// Decompress returns the decompressed payload of a message whose first
+// frame had RSV1 set. The window of the client is kept for the next message
+// unless ClientNoContextTakeover was negotiated.
+func (ext *Extension) Decompress(payload []byte) ([]byte, error) {
+	data := make([]byte, 0, len(payload)+len(tail)+len(final))
+	data = append(append(append(data, payload...), tail...), final...)
+	ext.in.Reset(data)
+	if ext.r == nil {
+		ext.r = flate.NewReaderDict(&ext.in, ext.dict)
+	} else if err := ext.r.(flate.Resetter).Reset(&ext.in, ext.dict); err != nil {
+		return nil, err
+	}
+	var rd io.Reader = ext.r
+	if ext.maxSize > 0 {
+		rd = io.LimitReader(ext.r, int64(ext.maxSize)+1)
+	}
+	var out bytes.Buffer
+	if _, err := out.ReadFrom(rd); err != nil {
+		return nil, err
+	}
+	if ext.maxSize > 0 && out.Len() > ext.maxSize {
+		return nil, ErrTooLarge
+	}
+	if !ext.params.ClientNoContextTakeover {
+		ext.dict = append(ext.dict, out.Bytes()...)
+		if len(ext.dict) > window {
+			ext.dict = append(ext.dict[:0], ext.dict[len(ext.dict)-window:]...)
+		}
+	}
+	return out.Bytes(), nil
+}
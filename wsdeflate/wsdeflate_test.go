@@ -0,0 +1,87 @@
+// Copyright 2018 Joshua J Baker. All rights reserved.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package wsdeflate
+
+import "testing"
+
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		config Config
+		ok     bool
+		resp   string
+		bits   int
+	}{
+		{header: "permessage-deflate", ok: true, resp: "permessage-deflate", bits: 15},
+		{header: "x-webkit-deflate-frame, permessage-deflate; client_max_window_bits",
+			ok: true, resp: "permessage-deflate", bits: 15},
+		{header: "permessage-deflate; client_max_window_bits=10; server_no_context_takeover",
+			ok: true, resp: "permessage-deflate; server_no_context_takeover", bits: 10},
+		{header: "permessage-deflate", config: Config{ClientNoContextTakeover: true},
+			ok: true, resp: "permessage-deflate; client_no_context_takeover", bits: 15},
+		// the server's window can't be limited, so the next offer is taken
+		{header: "permessage-deflate; server_max_window_bits=10, permessage-deflate; server_max_window_bits=15",
+			ok: true, resp: "permessage-deflate", bits: 15},
+		{header: "permessage-deflate; server_max_window_bits=10"},
+		{header: "permessage-deflate; client_max_window_bits=16"},
+		{header: "permessage-deflate; server_no_context_takeover; server_no_context_takeover"},
+		{header: "permessage-deflate; unknown"},
+		{header: "x-webkit-deflate-frame"},
+		{header: ""},
+	} {
+		ext, ok := Negotiate(test.header, test.config)
+		if ok != test.ok {
+			t.Fatalf("%q: expected ok %v, got %v", test.header, test.ok, ok)
+		}
+		if !ok {
+			continue
+		}
+		if h := ext.Header(); h != test.resp {
+			t.Fatalf("%q: expected response %q, got %q", test.header, test.resp, h)
+		}
+		if bits := ext.Params().ClientMaxWindowBits; bits != test.bits {
+			t.Fatalf("%q: expected client window of %d bits, got %d", test.header, test.bits, bits)
+		}
+	}
+}
+
+func TestDecompressRFC(t *testing.T) {
+	// the examples of RFC 7692, section 7.2.3
+	hello := []byte{0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00}
+	shared := []byte{0xf2, 0x00, 0x11, 0x00, 0x00}
+	stored := []byte{0x00, 0x05, 0x00, 0xfa, 0xff, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x00}
+	ext, _ := Negotiate("permessage-deflate", Config{})
+	for i, payload := range [][]byte{hello, shared, stored, hello} {
+		out, err := ext.Decompress(payload)
+		must(err)
+		if string(out) != "Hello" {
+			t.Fatalf("message %d: expected Hello, got %q", i, out)
+		}
+	}
+	// the second message refers to the window of the first
+	ext, _ = Negotiate("permessage-deflate; client_no_context_takeover", Config{})
+	_, err := ext.Decompress(hello)
+	must(err)
+	if out, err := ext.Decompress(shared); err == nil && string(out) == "Hello" {
+		t.Fatal("expected the window to be dropped without context takeover")
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	ext, _ := Negotiate("permessage-deflate", Config{MaxSize: 1000})
+	peer, _ := Negotiate("permessage-deflate", Config{})
+	if _, err := ext.Decompress(peer.Compress(make([]byte, 1000))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ext.Decompress(peer.Compress(make([]byte, 1001))); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+}